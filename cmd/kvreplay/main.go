@@ -0,0 +1,170 @@
+// Command kvreplay records the updates to a NATS Key-Value bucket to a JSONL file and
+// replays them into another bucket, to reproduce the exact sequence of flight updates
+// a user saw.
+//
+//	kvreplay record -url nats://connect.ngs.global -creds nats.cred -keys 'users.u1.flights.>' -o u1.jsonl
+//	kvreplay replay -url nats://127.0.0.1:4222 -bucket flights -speed 10 -i u1.jsonl
+//
+// Recording runs until interrupted. Replaying creates the bucket if it does not exist.
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+
+	"github.com/arcade55/nzflights_webui/replay"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	var err error
+	switch os.Args[1] {
+	case "record":
+		err = record(ctx, os.Args[2:])
+	case "replay":
+		err = play(ctx, os.Args[2:])
+	default:
+		usage()
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "kvreplay %s: %v\n", os.Args[1], err)
+		os.Exit(1)
+	}
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: kvreplay record|replay [flags]")
+	os.Exit(2)
+}
+
+// connection holds the flags shared by both subcommands.
+type connection struct {
+	url, creds, domain, bucket string
+}
+
+func (c *connection) flags(fs *flag.FlagSet) {
+	fs.StringVar(&c.url, "url", nats.DefaultURL, "NATS server URL")
+	fs.StringVar(&c.creds, "creds", "", "NATS credentials file")
+	fs.StringVar(&c.domain, "domain", "", "JetStream domain of the bucket")
+	fs.StringVar(&c.bucket, "bucket", "flights", "Key-Value bucket")
+}
+
+// connect returns a JetStream context for the server. The caller closes the connection.
+func (c *connection) connect() (*nats.Conn, jetstream.JetStream, error) {
+	var opts []nats.Option
+	if c.creds != "" {
+		opts = append(opts, nats.UserCredentials(c.creds))
+	}
+	nc, err := nats.Connect(c.url, append(opts, nats.Name("kvreplay"))...)
+	if err != nil {
+		return nil, nil, err
+	}
+	var js jetstream.JetStream
+	if c.domain != "" {
+		js, err = jetstream.NewWithDomain(nc, c.domain)
+	} else {
+		js, err = jetstream.New(nc)
+	}
+	if err != nil {
+		nc.Close()
+		return nil, nil, err
+	}
+	return nc, js, nil
+}
+
+func record(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("record", flag.ExitOnError)
+	var conn connection
+	conn.flags(fs)
+	patterns := fs.String("keys", ">", "comma-separated key patterns to record")
+	out := fs.String("o", "", "recording to write (default stdout)")
+	history := fs.Bool("history", false, "start with every revision still in the bucket")
+	updatesOnly := fs.Bool("updates-only", false, "record only updates made from now on")
+	fs.Parse(args)
+
+	nc, js, err := conn.connect()
+	if err != nil {
+		return err
+	}
+	defer nc.Close()
+	kv, err := js.KeyValue(ctx, conn.bucket)
+	if err != nil {
+		return err
+	}
+
+	w := os.Stdout
+	if *out != "" {
+		if w, err = os.Create(*out); err != nil {
+			return err
+		}
+		defer w.Close()
+	}
+	opts := replay.RecordOptions{History: *history, UpdatesOnly: *updatesOnly}
+	return replay.Record(ctx, kv, strings.Split(*patterns, ","), replay.NewWriter(w), opts)
+}
+
+func play(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("replay", flag.ExitOnError)
+	var conn connection
+	conn.flags(fs)
+	in := fs.String("i", "", "recording to replay (default stdin)")
+	speed := fs.Float64("speed", 1, "how many times faster than recorded the updates are replayed")
+	user := fs.String("as-user", "", "replay every user's keys as this user's")
+	fs.Parse(args)
+
+	opts := replay.Options{Speed: *speed}
+	if *user != "" {
+		rename, err := replay.AsUser(*user)
+		if err != nil {
+			return fmt.Errorf("invalid -as-user: %w", err)
+		}
+		opts.Rename = rename
+	}
+
+	r := os.Stdin
+	if *in != "" {
+		f, err := os.Open(*in)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		r = f
+	}
+	entries, err := replay.ReadAll(r)
+	if err != nil {
+		return err
+	}
+
+	nc, js, err := conn.connect()
+	if err != nil {
+		return err
+	}
+	defer nc.Close()
+	kv, err := js.KeyValue(ctx, conn.bucket)
+	if errors.Is(err, jetstream.ErrBucketNotFound) {
+		kv, err = js.CreateKeyValue(ctx, jetstream.KeyValueConfig{Bucket: conn.bucket, History: 10})
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := replay.Replay(ctx, kv, entries, opts); err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "replayed %d entries into %s\n", len(entries), conn.bucket)
+	return nil
+}
@@ -0,0 +1,306 @@
+// Package config loads the typed configuration for the whole application.
+//
+// Settings are resolved in this order, later sources overriding earlier ones:
+// built-in defaults, an optional JSON config file, then environment variables.
+// Staging, production and local deployments differ only by these inputs.
+package config
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/arcade55/nzflights_webui/natsclient"
+	"github.com/arcade55/nzflights_webui/responder"
+	"github.com/arcade55/nzflights_webui/simulator"
+)
+
+// Environment variables read by Load.
+const (
+	EnvConfigFile  = "NZF_CONFIG_FILE"
+	EnvPort        = "PORT"
+	EnvServiceName = "NZF_SERVICE_NAME"
+	EnvLogLevel    = "NZF_LOG_LEVEL"
+
+	EnvCloudURL       = "NZF_NATS_CLOUD_URL"
+	EnvCloudCredsFile = "NZF_NATS_CLOUD_CREDS_FILE"
+	EnvServerName     = "NZF_NATS_SERVER_NAME"
+	EnvLeafURL        = "NZF_NATS_LEAF_URL"
+	EnvLeafCredsFile  = "NZF_NATS_LEAF_CREDS_FILE"
+	EnvFlightsBucket  = "NZF_NATS_FLIGHTS_BUCKET"
+	EnvMirrorBucket   = "NZF_NATS_MIRROR_BUCKET"
+	EnvMirrorDomain   = "NZF_NATS_MIRROR_DOMAIN"
+	EnvMirrorInterval = "NZF_NATS_MIRROR_CHECK_INTERVAL"
+	EnvMirrorMaxLag   = "NZF_NATS_MIRROR_MAX_LAG"
+	EnvMirrorMaxIdle  = "NZF_NATS_MIRROR_MAX_IDLE"
+	EnvSkipStale      = "NZF_NATS_SKIP_STALE_MIRROR"
+	EnvFetchTimeout   = "NZF_NATS_FETCH_TIMEOUT"
+	EnvFetchWindow    = "NZF_NATS_FETCH_COALESCE_WINDOW"
+	EnvStoreDir       = "NZF_NATS_STORE_DIR"
+	EnvCorruptStore   = "NZF_NATS_CORRUPT_STORE_POLICY"
+	EnvSlowConsumer   = "NZF_NATS_SLOW_CONSUMER_POLICY"
+	EnvWatchBuffer    = "NZF_NATS_WATCH_BUFFER_SIZE"
+	EnvNoAuth         = "NZF_NATS_NO_AUTH"
+	EnvOffline        = "NZF_NATS_OFFLINE"
+	EnvSeedFile       = "NZF_NATS_SEED_FILE"
+
+	EnvResponderCatalogue   = "NZF_DEV_RESPONDER_CATALOGUE"
+	EnvResponderLatency     = "NZF_DEV_RESPONDER_LATENCY"
+	EnvResponderFailureRate = "NZF_DEV_RESPONDER_FAILURE_RATE"
+	EnvSimulatorScenario    = "NZF_DEV_SIMULATOR_SCENARIO"
+	EnvSimulatorSpeed       = "NZF_DEV_SIMULATOR_SPEED"
+	EnvSimulatorUsers       = "NZF_DEV_SIMULATOR_USERS"
+)
+
+// Log levels accepted in Config.LogLevel.
+const (
+	LogLevelDebug = "debug"
+	LogLevelInfo  = "info"
+)
+
+// ErrInvalidConfig is wrapped by every validation failure.
+var ErrInvalidConfig = errors.New("invalid configuration")
+
+// Config is the single source of settings for the application.
+type Config struct {
+	// Port is the TCP port the HTTP server listens on.
+	Port string `json:"port"`
+	// ServiceName is attached to every log line.
+	ServiceName string `json:"serviceName"`
+	// LogLevel is either "debug" or "info".
+	LogLevel string `json:"logLevel"`
+
+	// CloudCredsFile is a path to the cloud NATS credentials. When empty the
+	// credentials embedded in the binary are used.
+	CloudCredsFile string `json:"cloudCredsFile"`
+
+	// NATS is passed straight to natsclient.New.
+	NATS natsclient.Options `json:"nats"`
+
+	// Responder answers API fetches from a fixture catalogue when its Catalogue is set.
+	// It is for development only and needs offline mode.
+	Responder responder.Options `json:"responder"`
+	// Simulator plays a scenario of flight updates when its Scenario is set.
+	// It is for development only and needs offline mode.
+	Simulator simulator.Options `json:"simulator"`
+}
+
+// Default returns the production configuration.
+func Default() Config {
+	return Config{
+		Port:        "8080",
+		ServiceName: "nzflights-webui",
+		LogLevel:    LogLevelInfo,
+		NATS:        natsclient.DefaultOptions(),
+	}
+}
+
+// Load builds the configuration from the defaults, the file named by path
+// (or by NZF_CONFIG_FILE when path is empty) and the environment, then validates it.
+func Load(path string) (Config, error) {
+	cfg := Default()
+
+	if path == "" {
+		path = os.Getenv(EnvConfigFile)
+	}
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return Config{}, fmt.Errorf("failed to read config file: %w", err)
+		}
+		if err := json.Unmarshal(data, &cfg); err != nil {
+			return Config{}, fmt.Errorf("failed to unmarshal config file %s: %w", path, err)
+		}
+	}
+
+	if err := cfg.applyEnv(); err != nil {
+		return Config{}, err
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return Config{}, err
+	}
+	return cfg, nil
+}
+
+// applyEnv overrides cfg with any environment variables that are set.
+func (c *Config) applyEnv() error {
+	fields := map[string]*string{
+		EnvPort:           &c.Port,
+		EnvServiceName:    &c.ServiceName,
+		EnvLogLevel:       &c.LogLevel,
+		EnvCloudURL:       &c.NATS.CloudURL,
+		EnvCloudCredsFile: &c.CloudCredsFile,
+		EnvServerName:     &c.NATS.ServerName,
+		EnvLeafURL:        &c.NATS.LeafURL,
+		EnvLeafCredsFile:  &c.NATS.LeafCredsFile,
+		EnvFlightsBucket:  &c.NATS.FlightsBucket,
+		EnvMirrorBucket:   &c.NATS.MirrorBucket,
+		EnvMirrorDomain:   &c.NATS.MirrorDomain,
+		EnvSeedFile:       &c.NATS.SeedFile,
+		EnvStoreDir:       &c.NATS.StoreDir,
+
+		EnvResponderCatalogue: &c.Responder.Catalogue,
+		EnvSimulatorScenario:  &c.Simulator.Scenario,
+	}
+	for name, field := range fields {
+		if v, ok := os.LookupEnv(name); ok {
+			*field = v
+		}
+	}
+
+	if v, ok := os.LookupEnv(EnvCorruptStore); ok {
+		if err := c.NATS.CorruptStorePolicy.UnmarshalText([]byte(v)); err != nil {
+			return fmt.Errorf("%w: %s: %v", ErrInvalidConfig, EnvCorruptStore, err)
+		}
+	}
+	if v, ok := os.LookupEnv(EnvSlowConsumer); ok {
+		if err := c.NATS.SlowConsumerPolicy.UnmarshalText([]byte(v)); err != nil {
+			return fmt.Errorf("%w: %s: %v", ErrInvalidConfig, EnvSlowConsumer, err)
+		}
+	}
+	if v, ok := os.LookupEnv(EnvWatchBuffer); ok {
+		size, err := strconv.Atoi(v)
+		if err != nil {
+			return fmt.Errorf("%w: %s must be a number: %v", ErrInvalidConfig, EnvWatchBuffer, err)
+		}
+		c.NATS.WatchBufferSize = size
+	}
+
+	durations := map[string]*time.Duration{
+		EnvMirrorInterval: &c.NATS.MirrorCheckInterval,
+		EnvMirrorMaxIdle:  &c.NATS.MirrorMaxIdle,
+		EnvFetchTimeout:   &c.NATS.FetchTimeout,
+		EnvFetchWindow:    &c.NATS.FetchCoalesceWindow,
+
+		EnvResponderLatency: &c.Responder.Latency,
+	}
+	for name, field := range durations {
+		if v, ok := os.LookupEnv(name); ok {
+			d, err := time.ParseDuration(v)
+			if err != nil {
+				return fmt.Errorf("%w: %s must be a duration: %v", ErrInvalidConfig, name, err)
+			}
+			*field = d
+		}
+	}
+	if v, ok := os.LookupEnv(EnvMirrorMaxLag); ok {
+		lag, err := strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			return fmt.Errorf("%w: %s must be a number: %v", ErrInvalidConfig, EnvMirrorMaxLag, err)
+		}
+		c.NATS.MirrorMaxLag = &lag
+	}
+	bools := map[string]*bool{
+		EnvSkipStale: &c.NATS.SkipStaleMirror,
+		EnvNoAuth:    &c.NATS.NoAuth,
+	}
+	for name, field := range bools {
+		if v, ok := os.LookupEnv(name); ok {
+			b, err := strconv.ParseBool(v)
+			if err != nil {
+				return fmt.Errorf("%w: %s must be a boolean: %v", ErrInvalidConfig, name, err)
+			}
+			*field = b
+		}
+	}
+
+	if v, ok := os.LookupEnv(EnvResponderFailureRate); ok {
+		rate, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			return fmt.Errorf("%w: %s must be a number: %v", ErrInvalidConfig, EnvResponderFailureRate, err)
+		}
+		c.Responder.FailureRate = rate
+	}
+	if v, ok := os.LookupEnv(EnvSimulatorSpeed); ok {
+		speed, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			return fmt.Errorf("%w: %s must be a number: %v", ErrInvalidConfig, EnvSimulatorSpeed, err)
+		}
+		c.Simulator.Speed = speed
+	}
+	if v, ok := os.LookupEnv(EnvSimulatorUsers); ok {
+		c.Simulator.Users = strings.Split(v, ",")
+	}
+
+	if v, ok := os.LookupEnv(EnvOffline); ok {
+		offline, err := strconv.ParseBool(v)
+		if err != nil {
+			return fmt.Errorf("%w: %s must be a boolean: %v", ErrInvalidConfig, EnvOffline, err)
+		}
+		c.NATS.Offline = offline
+	}
+	return nil
+}
+
+// bucketName matches the names JetStream accepts for a KV bucket.
+var bucketName = regexp.MustCompile(`^[a-zA-Z0-9_-]+$`)
+
+// Validate reports every problem with the configuration in a single error.
+func (c Config) Validate() error {
+	var errs []error
+
+	if port, err := strconv.Atoi(c.Port); err != nil || port < 1 || port > 65535 {
+		errs = append(errs, fmt.Errorf("port %q must be a number between 1 and 65535", c.Port))
+	}
+	if c.ServiceName == "" {
+		errs = append(errs, errors.New("serviceName is required"))
+	}
+	if c.LogLevel != LogLevelDebug && c.LogLevel != LogLevelInfo {
+		errs = append(errs, fmt.Errorf("logLevel %q must be %q or %q", c.LogLevel, LogLevelDebug, LogLevelInfo))
+	}
+
+	if c.NATS.FetchTimeout <= 0 {
+		errs = append(errs, fmt.Errorf("fetchTimeout %v must be positive", c.NATS.FetchTimeout))
+	}
+	if c.NATS.WatchBufferSize < 1 {
+		errs = append(errs, fmt.Errorf("watchBufferSize %d must be at least 1", c.NATS.WatchBufferSize))
+	}
+
+	if !bucketName.MatchString(c.NATS.FlightsBucket) {
+		errs = append(errs, fmt.Errorf("flightsBucket %q is not a valid bucket name", c.NATS.FlightsBucket))
+	}
+	if !c.NATS.Offline {
+		if !bucketName.MatchString(c.NATS.MirrorBucket) {
+			errs = append(errs, fmt.Errorf("mirrorBucket %q is not a valid bucket name", c.NATS.MirrorBucket))
+		}
+		if c.NATS.MirrorBucket == c.NATS.FlightsBucket {
+			errs = append(errs, errors.New("mirrorBucket must differ from flightsBucket"))
+		}
+		if c.NATS.CloudURL == "" {
+			errs = append(errs, errors.New("cloudURL is required unless offline"))
+		}
+		if c.NATS.LeafURL == "" {
+			errs = append(errs, errors.New("leafURL is required unless offline"))
+		}
+		if c.NATS.MirrorDomain == "" {
+			errs = append(errs, errors.New("mirrorDomain is required unless offline"))
+		}
+		if c.NATS.MirrorCheckInterval <= 0 {
+			errs = append(errs, fmt.Errorf("mirrorCheckInterval %v must be positive", c.NATS.MirrorCheckInterval))
+		}
+	}
+
+	if c.Responder.Catalogue != "" && !c.NATS.Offline {
+		errs = append(errs, errors.New("responder needs offline mode"))
+	}
+	if c.Simulator.Scenario != "" && !c.NATS.Offline {
+		errs = append(errs, errors.New("simulator needs offline mode"))
+	}
+	if c.Simulator.Speed < 0 {
+		errs = append(errs, fmt.Errorf("simulator speed %v must not be negative", c.Simulator.Speed))
+	}
+	if c.Responder.FailureRate < 0 || c.Responder.FailureRate > 1 {
+		errs = append(errs, fmt.Errorf("responder failureRate %v must be between 0 and 1", c.Responder.FailureRate))
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("%w: %w", ErrInvalidConfig, errors.Join(errs...))
+	}
+	return nil
+}
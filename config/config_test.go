@@ -0,0 +1,138 @@
+package config
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// TestLoad_Precedence verifies that the environment overrides the file, which overrides the defaults.
+func TestLoad_Precedence(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.json")
+	file := `{"port": "9000", "serviceName": "staging-webui", "nats": {"flightsBucket": "staging_flights", "mirrorDomain": "staging"}}`
+	if err := os.WriteFile(path, []byte(file), 0o600); err != nil {
+		t.Fatalf("failed to write config file: %v", err)
+	}
+	t.Setenv(EnvPort, "9100")
+	t.Setenv(EnvMirrorBucket, "stagingMirror")
+
+	cfg, err := Load(path)
+	if err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+
+	if cfg.Port != "9100" {
+		t.Errorf("expected port from env 9100, got %s", cfg.Port)
+	}
+	if cfg.ServiceName != "staging-webui" {
+		t.Errorf("expected service name from file, got %s", cfg.ServiceName)
+	}
+	if cfg.NATS.FlightsBucket != "staging_flights" || cfg.NATS.MirrorDomain != "staging" {
+		t.Errorf("expected NATS settings from file, got %+v", cfg.NATS)
+	}
+	if cfg.NATS.MirrorBucket != "stagingMirror" {
+		t.Errorf("expected mirror bucket from env, got %s", cfg.NATS.MirrorBucket)
+	}
+	if cfg.NATS.ServerName != Default().NATS.ServerName {
+		t.Errorf("expected default server name, got %s", cfg.NATS.ServerName)
+	}
+}
+
+// TestLoad_FileSettings verifies that durations can be written as strings in the config
+// file and that a zero mirror lag is kept rather than replaced by the default.
+func TestLoad_FileSettings(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.json")
+	file := `{"nats": {"mirrorCheckInterval": "30s", "mirrorMaxIdle": "2m", "fetchTimeout": "1500ms", "mirrorMaxLag": 0}}`
+	if err := os.WriteFile(path, []byte(file), 0o600); err != nil {
+		t.Fatalf("failed to write config file: %v", err)
+	}
+
+	cfg, err := Load(path)
+	if err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	if cfg.NATS.MirrorCheckInterval != 30*time.Second || cfg.NATS.MirrorMaxIdle != 2*time.Minute ||
+		cfg.NATS.FetchTimeout != 1500*time.Millisecond {
+		t.Errorf("expected durations from the file, got %+v", cfg.NATS)
+	}
+	if cfg.NATS.FetchCoalesceWindow != Default().NATS.FetchCoalesceWindow {
+		t.Errorf("expected the default coalesce window, got %v", cfg.NATS.FetchCoalesceWindow)
+	}
+	if cfg.NATS.MirrorMaxLag == nil || *cfg.NATS.MirrorMaxLag != 0 {
+		t.Errorf("expected a zero mirror lag, got %v", cfg.NATS.MirrorMaxLag)
+	}
+
+	if err := os.WriteFile(path, []byte(`{"nats": {"fetchTimeout": "soon"}}`), 0o600); err != nil {
+		t.Fatalf("failed to write config file: %v", err)
+	}
+	if _, err := Load(path); err == nil {
+		t.Error("expected a bad duration to be rejected")
+	}
+}
+
+// TestLoad_ResponderLatency verifies that the responder latency can be written as a string in the config file.
+func TestLoad_ResponderLatency(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.json")
+	if err := os.WriteFile(path, []byte(`{"responder": {"latency": "250ms"}}`), 0o600); err != nil {
+		t.Fatalf("failed to write config file: %v", err)
+	}
+
+	cfg, err := Load(path)
+	if err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	if cfg.Responder.Latency != 250*time.Millisecond {
+		t.Errorf("expected the responder latency from the file, got %v", cfg.Responder.Latency)
+	}
+}
+
+// TestLoad_Invalid verifies that bad settings are rejected at startup.
+func TestLoad_Invalid(t *testing.T) {
+	tests := map[string]map[string]string{
+		"port out of range":   {EnvPort: "70000"},
+		"bad bucket name":     {EnvFlightsBucket: "flights.master"},
+		"mirror same as main": {EnvMirrorBucket: "flights"},
+		"bad log level":       {EnvLogLevel: "verbose"},
+		"bad offline flag":    {EnvOffline: "sometimes"},
+		"bad policy":          {EnvSlowConsumer: "wait"},
+		"bad store policy":    {EnvCorruptStore: "repair"},
+		"empty buffer":        {EnvWatchBuffer: "0"},
+		"bad mirror interval": {EnvMirrorInterval: "15"},
+		"zero mirror check":   {EnvMirrorInterval: "0s"},
+		"negative max lag":    {EnvMirrorMaxLag: "-1"},
+		"bad skip flag":       {EnvSkipStale: "maybe"},
+		"zero fetch timeout":  {EnvFetchTimeout: "0s"},
+		"responder online":    {EnvResponderCatalogue: "flights.json"},
+		"bad failure rate":    {EnvOffline: "true", EnvResponderFailureRate: "1.5"},
+		"simulator online":    {EnvSimulatorScenario: "demo.json"},
+		"negative speed":      {EnvOffline: "true", EnvSimulatorSpeed: "-2"},
+	}
+
+	for name, env := range tests {
+		t.Run(name, func(t *testing.T) {
+			for k, v := range env {
+				t.Setenv(k, v)
+			}
+			if _, err := Load(""); !errors.Is(err, ErrInvalidConfig) {
+				t.Errorf("expected ErrInvalidConfig, got %v", err)
+			}
+		})
+	}
+}
+
+// TestLoad_Offline verifies that offline mode does not require any cloud settings.
+func TestLoad_Offline(t *testing.T) {
+	t.Setenv(EnvOffline, "true")
+	t.Setenv(EnvCloudURL, "")
+	t.Setenv(EnvLeafURL, "")
+
+	cfg, err := Load("")
+	if err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	if !cfg.NATS.Offline {
+		t.Error("expected offline mode to be enabled")
+	}
+}
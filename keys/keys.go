@@ -0,0 +1,322 @@
+// Package keys builds and parses the Key-Value keys used by the app.
+//
+// Every key is a dot-separated NATS subject:
+//
+//	users.{userID}.flights.owned.{flightID}
+//	users.{userID}.flights.shared.{flightID}
+//	users.{sharerID}.shares.sent.{shareID}
+//	shares.pending.{shareID}
+//	index.flight.{flightID}.users
+//	flights.master.{ident}.{YYYY-MM-DD}.{HHMM}.{origin}.{destination}
+//
+// IDs often come from the outside world, e.g. the visitor cookie, so they are
+// never pasted into a key as-is. Each ID becomes exactly one token: wildcards
+// are rejected, and any character that is not a letter, digit, '-' or '_' is
+// escaped as '=' followed by two hex digits. A crafted ID therefore cannot
+// reach another user's keys.
+package keys
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/arcade55/nzflights-models"
+)
+
+var (
+	ErrInvalidToken = errors.New("invalid key token")
+	ErrInvalidKey   = errors.New("invalid key")
+)
+
+// Kind identifies which part of the schema a key belongs to.
+type Kind int
+
+const (
+	KindOwnedFlight Kind = iota + 1
+	KindSharedFlight
+	KindSentShare
+	KindPendingShare
+	KindFlightIndex
+	KindMasterFlight
+)
+
+func (k Kind) String() string {
+	switch k {
+	case KindOwnedFlight:
+		return "owned flight"
+	case KindSharedFlight:
+		return "shared flight"
+	case KindSentShare:
+		return "sent share"
+	case KindPendingShare:
+		return "pending share"
+	case KindFlightIndex:
+		return "flight index"
+	case KindMasterFlight:
+		return "master flight"
+	default:
+		return "unknown"
+	}
+}
+
+// Key is a parsed key. Only the fields used by its Kind are set, and IDs are unescaped.
+type Key struct {
+	Kind     Kind
+	UserID   string
+	FlightID string
+	ShareID  string
+	Master   MasterFlight
+}
+
+// --- Tokens ---
+
+// Escape turns id into a single key token. It fails for empty IDs and for IDs
+// containing the '*' or '>' wildcards.
+func Escape(id string) (string, error) {
+	if id == "" {
+		return "", fmt.Errorf("%w: empty", ErrInvalidToken)
+	}
+	if strings.ContainsAny(id, "*>") {
+		return "", fmt.Errorf("%w: %q contains a wildcard", ErrInvalidToken, id)
+	}
+
+	var b strings.Builder
+	for i := 0; i < len(id); i++ {
+		c := id[i]
+		if isSafe(c) {
+			b.WriteByte(c)
+			continue
+		}
+		fmt.Fprintf(&b, "=%02X", c)
+	}
+	return b.String(), nil
+}
+
+// Unescape reverses Escape.
+func Unescape(token string) (string, error) {
+	if token == "" {
+		return "", fmt.Errorf("%w: empty", ErrInvalidToken)
+	}
+
+	var b strings.Builder
+	for i := 0; i < len(token); i++ {
+		c := token[i]
+		switch {
+		case isSafe(c):
+			b.WriteByte(c)
+		case c == '=' && i+2 < len(token):
+			n, err := strconv.ParseUint(token[i+1:i+3], 16, 8)
+			if err != nil {
+				return "", fmt.Errorf("%w: bad escape in %q", ErrInvalidToken, token)
+			}
+			b.WriteByte(byte(n))
+			i += 2
+		default:
+			return "", fmt.Errorf("%w: unexpected %q in %q", ErrInvalidToken, c, token)
+		}
+	}
+	return b.String(), nil
+}
+
+func isSafe(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_'
+}
+
+// join escapes each ID and places it between the fixed tokens of a key.
+// Arguments alternate: even positions are literal tokens, odd positions are IDs.
+func join(parts ...string) (string, error) {
+	tokens := make([]string, len(parts))
+	for i, part := range parts {
+		if i%2 == 0 {
+			tokens[i] = part
+			continue
+		}
+		token, err := Escape(part)
+		if err != nil {
+			return "", err
+		}
+		tokens[i] = token
+	}
+	return strings.Join(tokens, "."), nil
+}
+
+// --- Builders ---
+
+// OwnedFlight is the key of a flight the user added themselves.
+func OwnedFlight(userID, flightID string) (string, error) {
+	return join("users", userID, "flights.owned", flightID)
+}
+
+// SharedFlight is the key of the user's copy of a flight someone shared with them.
+func SharedFlight(userID, flightID string) (string, error) {
+	return join("users", userID, "flights.shared", flightID)
+}
+
+// SentShare is the sharer's record of a share they created.
+func SentShare(sharerID, shareID string) (string, error) {
+	return join("users", sharerID, "shares.sent", shareID)
+}
+
+// PendingShare is the key of a share that has not been claimed yet.
+func PendingShare(shareID string) (string, error) {
+	return join("shares.pending", shareID)
+}
+
+// FlightIndex is the key listing every user who tracks a flight.
+func FlightIndex(flightID string) (string, error) {
+	return join("index.flight", flightID, "users")
+}
+
+// --- Filters ---
+
+// UserFlights matches every flight, owned or shared, in the user's list.
+func UserFlights(userID string) (string, error) {
+	return join("users", userID, "flights.>")
+}
+
+// OwnedFlights matches the flights the user added themselves.
+func OwnedFlights(userID string) (string, error) {
+	return join("users", userID, "flights.owned.>")
+}
+
+// SharedFlights matches the flights shared with the user.
+func SharedFlights(userID string) (string, error) {
+	return join("users", userID, "flights.shared.>")
+}
+
+// FlightOwners matches every user's owned copy of a flight.
+func FlightOwners(flightID string) (string, error) {
+	return join("users.*.flights.owned", flightID)
+}
+
+// SentShares matches every share the user has created.
+func SentShares(sharerID string) (string, error) {
+	return join("users", sharerID, "shares.sent.>")
+}
+
+// --- Parsing ---
+
+// Parse identifies key and extracts its IDs.
+func Parse(key string) (Key, error) {
+	t := strings.Split(key, ".")
+	invalid := fmt.Errorf("%w: %q", ErrInvalidKey, key)
+
+	var parsed Key
+	var err error
+	switch {
+	case len(t) == 5 && t[0] == "users" && t[2] == "flights" && t[3] == "owned":
+		parsed.Kind = KindOwnedFlight
+		parsed.UserID, parsed.FlightID, err = unescape2(t[1], t[4])
+	case len(t) == 5 && t[0] == "users" && t[2] == "flights" && t[3] == "shared":
+		parsed.Kind = KindSharedFlight
+		parsed.UserID, parsed.FlightID, err = unescape2(t[1], t[4])
+	case len(t) == 5 && t[0] == "users" && t[2] == "shares" && t[3] == "sent":
+		parsed.Kind = KindSentShare
+		parsed.UserID, parsed.ShareID, err = unescape2(t[1], t[4])
+	case len(t) == 3 && t[0] == "shares" && t[1] == "pending":
+		parsed.Kind = KindPendingShare
+		parsed.ShareID, err = Unescape(t[2])
+	case len(t) == 4 && t[0] == "index" && t[1] == "flight" && t[3] == "users":
+		parsed.Kind = KindFlightIndex
+		parsed.FlightID, err = Unescape(t[2])
+	case len(t) == 7 && t[0] == "flights" && t[1] == "master":
+		parsed.Kind = KindMasterFlight
+		parsed.Master, err = ParseMasterFlight(key)
+	default:
+		return Key{}, invalid
+	}
+	if err != nil {
+		return Key{}, fmt.Errorf("%w: %v", invalid, err)
+	}
+	return parsed, nil
+}
+
+func unescape2(a, b string) (string, string, error) {
+	first, err := Unescape(a)
+	if err != nil {
+		return "", "", err
+	}
+	second, err := Unescape(b)
+	if err != nil {
+		return "", "", err
+	}
+	return first, second, nil
+}
+
+// --- Master flights ---
+
+const (
+	masterDateLayout = "2006-01-02"
+	masterTimeLayout = "1504"
+)
+
+// MasterFlight identifies a flight instance in the flights.master namespace.
+// Scheduled is the original scheduled departure; it must never change once
+// the flight is ingested, because it is part of the key.
+type MasterFlight struct {
+	Ident       string
+	Scheduled   time.Time
+	Origin      string
+	Destination string
+}
+
+// MasterFlightFor identifies the master entry of flight, using its ICAO ident and
+// airports as the ingestor does.
+func MasterFlightFor(flight nzflights.Flight) (MasterFlight, error) {
+	scheduled, err := time.Parse(time.RFC3339, flight.ScheduledOut)
+	if err != nil {
+		return MasterFlight{}, fmt.Errorf("%w: flight %s has a bad scheduled departure: %v", ErrInvalidToken, flight.Ident, err)
+	}
+	ident := flight.IdentICAO
+	if ident == "" {
+		ident = flight.Ident
+	}
+	return MasterFlight{
+		Ident:       ident,
+		Scheduled:   scheduled.UTC(),
+		Origin:      flight.Origin,
+		Destination: flight.Destination,
+	}, nil
+}
+
+// Key builds flights.master.{ident}.{YYYY-MM-DD}.{HHMM}.{origin}.{destination}.
+func (m MasterFlight) Key() (string, error) {
+	if m.Scheduled.IsZero() {
+		return "", fmt.Errorf("%w: master flight %s has no scheduled time", ErrInvalidToken, m.Ident)
+	}
+	tokens := make([]string, 3)
+	for i, id := range []string{m.Ident, m.Origin, m.Destination} {
+		token, err := Escape(id)
+		if err != nil {
+			return "", err
+		}
+		tokens[i] = token
+	}
+	return fmt.Sprintf("flights.master.%s.%s.%s.%s.%s", tokens[0],
+		m.Scheduled.Format(masterDateLayout), m.Scheduled.Format(masterTimeLayout), tokens[1], tokens[2]), nil
+}
+
+// ParseMasterFlight parses a flights.master key. The scheduled time is returned in UTC.
+func ParseMasterFlight(key string) (MasterFlight, error) {
+	t := strings.Split(key, ".")
+	if len(t) != 7 || t[0] != "flights" || t[1] != "master" {
+		return MasterFlight{}, fmt.Errorf("%w: %q is not a master flight key", ErrInvalidKey, key)
+	}
+
+	scheduled, err := time.Parse(masterDateLayout+masterTimeLayout, t[3]+t[4])
+	if err != nil {
+		return MasterFlight{}, fmt.Errorf("%w: %q has a bad schedule: %v", ErrInvalidKey, key, err)
+	}
+	ident, err := Unescape(t[2])
+	if err != nil {
+		return MasterFlight{}, err
+	}
+	origin, destination, err := unescape2(t[5], t[6])
+	if err != nil {
+		return MasterFlight{}, err
+	}
+	return MasterFlight{Ident: ident, Scheduled: scheduled, Origin: origin, Destination: destination}, nil
+}
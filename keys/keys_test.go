@@ -0,0 +1,83 @@
+package keys
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+// TestBuilders_RejectWildcards verifies that crafted IDs can never widen a key or filter.
+func TestBuilders_RejectWildcards(t *testing.T) {
+	for _, id := range []string{"", "*", ">", "a.*", "u1.>"} {
+		if key, err := OwnedFlights(id); !errors.Is(err, ErrInvalidToken) {
+			t.Errorf("OwnedFlights(%q) = %q, %v; want ErrInvalidToken", id, key, err)
+		}
+	}
+
+	key, err := OwnedFlights("a.b")
+	if err != nil {
+		t.Fatalf("OwnedFlights failed: %v", err)
+	}
+	if key != "users.a=2Eb.flights.owned.>" {
+		t.Errorf("expected the dot to be escaped, got %q", key)
+	}
+}
+
+// TestParse_RoundTrip verifies that every key form parses back to the IDs it was built from.
+func TestParse_RoundTrip(t *testing.T) {
+	scheduled := time.Date(2025, 9, 11, 8, 30, 0, 0, time.UTC)
+	master := MasterFlight{Ident: "ANZ5272", Scheduled: scheduled, Origin: "NZAA", Destination: "NZCH"}
+
+	build := func(key string, err error) string {
+		t.Helper()
+		if err != nil {
+			t.Fatalf("building key: %v", err)
+		}
+		return key
+	}
+
+	tests := map[string]struct {
+		key  string
+		want Key
+	}{
+		"owned":   {build(OwnedFlight("user 1", "NZ1")), Key{Kind: KindOwnedFlight, UserID: "user 1", FlightID: "NZ1"}},
+		"shared":  {build(SharedFlight("u=1", "NZ1")), Key{Kind: KindSharedFlight, UserID: "u=1", FlightID: "NZ1"}},
+		"sent":    {build(SentShare("u1", "5f1c-9a")), Key{Kind: KindSentShare, UserID: "u1", ShareID: "5f1c-9a"}},
+		"pending": {build(PendingShare("5f1c-9a")), Key{Kind: KindPendingShare, ShareID: "5f1c-9a"}},
+		"index":   {build(FlightIndex("NZ1")), Key{Kind: KindFlightIndex, FlightID: "NZ1"}},
+		"master":  {build(master.Key()), Key{Kind: KindMasterFlight, Master: master}},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			got, err := Parse(tt.key)
+			if err != nil {
+				t.Fatalf("Parse(%q) failed: %v", tt.key, err)
+			}
+			if got.Kind != tt.want.Kind || got.UserID != tt.want.UserID || got.FlightID != tt.want.FlightID ||
+				got.ShareID != tt.want.ShareID || got.Master != tt.want.Master {
+				t.Errorf("Parse(%q) = %+v, want %+v", tt.key, got, tt.want)
+			}
+		})
+	}
+
+	if key := build(master.Key()); key != "flights.master.ANZ5272.2025-09-11.0830.NZAA.NZCH" {
+		t.Errorf("unexpected master key %q", key)
+	}
+}
+
+// TestParse_Invalid verifies that keys outside the schema are rejected.
+func TestParse_Invalid(t *testing.T) {
+	for _, key := range []string{
+		"",
+		"users.u1.flights.owned",
+		"users.u1.flights.other.NZ1",
+		"users.u1.flights.owned.NZ1.extra",
+		"users.u=Z1.flights.owned.NZ1",
+		"flights.master.NZ1.2025-13-01.0830.NZAA.NZCH",
+		"shares.pending.*",
+	} {
+		if _, err := Parse(key); !errors.Is(err, ErrInvalidKey) {
+			t.Errorf("Parse(%q) = %v, want ErrInvalidKey", key, err)
+		}
+	}
+}
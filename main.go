@@ -4,7 +4,8 @@ import (
 	"context"
 	"embed"
 	"errors"
-	"log"
+	"flag"
+	"fmt"
 	"log/slog"
 	"net/http"
 	"os"
@@ -19,9 +20,13 @@ import (
 	"github.com/arcade55/htma"
 	"github.com/arcade55/logging"
 	correlation "github.com/arcade55/nzflights-correlation"
+	"github.com/arcade55/nzflights_webui/config"
 	"github.com/arcade55/nzflights_webui/natsclient"
+	"github.com/arcade55/nzflights_webui/responder"
 	"github.com/arcade55/nzflights_webui/server/handlers/middleware"
+	"github.com/arcade55/nzflights_webui/server/handlers/sse"
 	"github.com/arcade55/nzflights_webui/server/handlers/standard"
+	"github.com/arcade55/nzflights_webui/simulator"
 	"github.com/arcade55/nzflights_webui/webui/components"
 	"github.com/arcade55/nzflights_webui/webui/pages"
 )
@@ -29,30 +34,77 @@ import (
 //go:embed nats.cred
 var credsFile embed.FS
 
-
-
 func main() {
+	configFile := flag.String("config", "", "optional JSON config file (overrides "+config.EnvConfigFile+")")
+	offline := flag.Bool("offline", false, "run without Synadia Cloud, hosting the flights bucket on the embedded server")
+	seedFile := flag.String("seed", "", "JSON fixture file used to seed the flights bucket in offline mode")
+	responderCatalogue := flag.String("responder", "", "fixture catalogue used to answer API fetches locally in offline mode")
+	scenarioFile := flag.String("simulate", "", "scenario file to play into the flights bucket in offline mode")
+	speed := flag.Float64("simulate-speed", 0, "how many times faster than real time the scenario plays")
+	flag.Parse()
+
+	appConfig, err := config.Load(*configFile)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to load configuration: %v\n", err)
+		os.Exit(1)
+	}
+	// Flags given on the command line win over the file and environment.
+	flag.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "offline":
+			appConfig.NATS.Offline = *offline
+		case "seed":
+			appConfig.NATS.SeedFile = *seedFile
+		case "responder":
+			appConfig.Responder.Catalogue = *responderCatalogue
+		case "simulate":
+			appConfig.Simulator.Scenario = *scenarioFile
+		case "simulate-speed":
+			appConfig.Simulator.Speed = *speed
+		}
+	})
+	if err := appConfig.Validate(); err != nil {
+		fmt.Fprintf(os.Stderr, "failed to load configuration: %v\n", err)
+		os.Exit(1)
+	}
+
 	ctx := correlation.EnsureCorrelationID(context.Background())
 
 	cfg := logging.Config{
-		ServiceName: "my-app-service", // Required for base attributes.
-		Output:      os.Stdout,        // Or a file, etc.
+		ServiceName: appConfig.ServiceName, // Required for base attributes.
+		Output:      os.Stdout,             // Or a file, etc.
 		Level:       logging.LevelInfo,
 		Format:      logging.FormatPretty, // Or JSON/Text.
 		AddSource:   true,                 // Includes file/line in logs.
 	}
+	if appConfig.LogLevel == config.LogLevelDebug {
+		cfg.Level = logging.LevelDebug
+	}
 
 	logger, cleanup, err := logging.Init(ctx, cfg)
-
-	creds, err := credsFile.ReadFile("nats.cred")
 	if err != nil {
-		log.Error(err, slog.String("action", "embedded_file_error"), slog.String("message", "failed to read embedded credentials file"))
+		fmt.Fprintf(os.Stderr, "failed to initialise logging: %v\n", err)
 		os.Exit(1)
 	}
+	defer cleanup()
+	log := logger.WithContext(ctx)
+
+	opts := appConfig.NATS
+	if !opts.Offline && !opts.NoAuth {
+		if appConfig.CloudCredsFile != "" {
+			opts.CloudCreds, err = os.ReadFile(appConfig.CloudCredsFile)
+		} else {
+			opts.CloudCreds, err = credsFile.ReadFile("nats.cred")
+		}
+		if err != nil {
+			log.Error(err, slog.String("action", "credentials_file_error"), slog.String("message", "failed to read cloud credentials file"))
+			os.Exit(1)
+		}
+	}
 
 	// --- 2. Initialize the NATS Client ---
 	// This single call sets up everything: embedded server, cloud connection, mirrors, etc.
-	client, err := natsclient.New(ctx, logger, creds)
+	client, err := natsclient.New(ctx, logger, opts)
 	if err != nil {
 		if errors.Is(err, natsclient.ErrCloudConnectionFailed) {
 			log.Error(err)
@@ -62,6 +114,41 @@ func main() {
 		os.Exit(1)
 	}
 	defer client.Shutdown()
+
+	// --- 3. Answer API fetches locally in place of the ingestor ---
+	if appConfig.Responder.Catalogue != "" {
+		catalogue, err := responder.LoadCatalogue(appConfig.Responder.Catalogue)
+		if err != nil {
+			log.Error(err)
+			os.Exit(1)
+		}
+		resp, err := responder.Start(client.Local, client.InMemoryKV, catalogue, appConfig.Responder)
+		if err != nil {
+			log.Error(err)
+			os.Exit(1)
+		}
+		defer resp.Stop()
+		log.Info(fmt.Sprintf("✅ Answering API fetches from %s.", appConfig.Responder.Catalogue))
+	}
+
+	// --- 4. Play a scenario of flight updates for development ---
+	if appConfig.Simulator.Scenario != "" {
+		scenario, err := simulator.LoadScenario(appConfig.Simulator.Scenario)
+		if err != nil {
+			log.Error(err)
+			os.Exit(1)
+		}
+		simCtx, stopSimulator := context.WithCancel(ctx)
+		defer stopSimulator()
+		go func() {
+			if err := simulator.New(client.InMemoryKV, scenario, appConfig.Simulator).Run(simCtx); err != nil && simCtx.Err() == nil {
+				log.Error(err)
+				return
+			}
+			log.Info("SIMULATOR: Scenario finished.")
+		}()
+		log.Info(fmt.Sprintf("✅ Playing %s.", appConfig.Simulator.Scenario))
+	}
 	log.Info("🚀 Application started successfully. NATS client is ready.")
 
 	// --- Setup Graceful Shutdown ---
@@ -80,15 +167,28 @@ func main() {
 	mux.HandleFunc("GET /home-sse", handleHomeSSE)
 	mux.HandleFunc("GET /add-flight", handleAddFlight)
 	mux.HandleFunc("GET /add-flight-sse", handleAddFlightSSE)
+
+	// --- Live flight list and search, both fed from the NATS client ---
+	flightsHandler := &sse.FlightSSEHandler{KV: client.InMemoryKV, Flights: client.Flights, Hub: client.Hub, State: client.State}
+	mux.Handle("GET /sse/flights", middleware.VisitorID(flightsHandler))
+	mux.Handle("POST /flights/add", middleware.VisitorID(&sse.AddFlightHandler{Fetcher: client.Fetcher, Flights: client.Flights}))
+	mux.Handle("POST /flights/undo", middleware.VisitorID(&sse.UndoUntrackHandler{Flights: client.Flights}))
+	mux.Handle("POST /flights/shared/{action}", middleware.VisitorID(&sse.SharedFlightHandler{Flights: client.Flights}))
+
+	// --- Sharing flights by link, and the shared page ---
+	mux.Handle("POST /flights/share", middleware.VisitorID(&sse.ShareFlightHandler{Flights: client.Flights}))
+	mux.Handle("GET /shared", middleware.VisitorID(http.HandlerFunc(standard.SharedHandler)))
+	mux.Handle("POST /shared/claim", middleware.VisitorID(&sse.ClaimShareHandler{Flights: client.Flights}))
+	mux.Handle("GET /sse/shared", middleware.VisitorID(&sse.SharesSSEHandler{KV: client.InMemoryKV}))
+
+	searchHandler := &sse.SearchSSEHandler{KV: client.InMemoryKV}
+	mux.Handle("POST /search-flights", middleware.VisitorID(http.HandlerFunc(searchHandler.Search)))
+	mux.Handle("GET /healthz", &standard.HealthHandler{State: client.State, Mirror: client.Mirror})
 	mux.HandleFunc("GET /{$}", func(w http.ResponseWriter, r *http.Request) {
 		http.Redirect(w, r, "/home", http.StatusMovedPermanently)
 	})
 
-	port := os.Getenv("PORT")
-	if port == "" {
-		port = "8080"
-	}
-
+	port := appConfig.Port
 	log.Info("Starting server on port " + port)
 	err = http.ListenAndServe(":"+port, mux)
 	if err != nil {
@@ -0,0 +1,80 @@
+package natsclient
+
+import (
+	"fmt"
+	"slices"
+)
+
+// SlowConsumerPolicy decides what a watcher does when its consumer falls behind
+// and the buffer of undelivered updates is full.
+type SlowConsumerPolicy int
+
+const (
+	// PolicyCoalesce keeps only the latest undelivered update per key. If the buffer
+	// is still full of distinct keys, the oldest update is dropped.
+	PolicyCoalesce SlowConsumerPolicy = iota
+	// PolicyDropOldest drops the oldest undelivered update to make room.
+	PolicyDropOldest
+	// PolicyDisconnect stops the watcher and closes its Updates channel.
+	// Err then reports ErrSlowConsumer.
+	PolicyDisconnect
+)
+
+// defaultWatchBufferSize is the number of undelivered updates a watcher holds.
+const defaultWatchBufferSize = 64
+
+func (p SlowConsumerPolicy) String() string {
+	switch p {
+	case PolicyCoalesce:
+		return "coalesce"
+	case PolicyDropOldest:
+		return "drop-oldest"
+	case PolicyDisconnect:
+		return "disconnect"
+	default:
+		return fmt.Sprintf("SlowConsumerPolicy(%d)", int(p))
+	}
+}
+
+// MarshalText lets the policy be written by name in config files.
+func (p SlowConsumerPolicy) MarshalText() ([]byte, error) {
+	return []byte(p.String()), nil
+}
+
+// UnmarshalText parses a policy name as written by MarshalText.
+func (p *SlowConsumerPolicy) UnmarshalText(text []byte) error {
+	for _, policy := range []SlowConsumerPolicy{PolicyCoalesce, PolicyDropOldest, PolicyDisconnect} {
+		if string(text) == policy.String() {
+			*p = policy
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown slow consumer policy %q", text)
+}
+
+// enqueue adds entry to queue, applying policy once the queue holds size entries.
+// It returns the new queue, the number of updates dropped or coalesced away, and
+// false if the policy requires the consumer to be disconnected. Below size every
+// update is queued, so a consumer that keeps up sees each revision. Under
+// PolicyCoalesce a full queue has the update replace any queued one for its key.
+// The update goes to the back of the queue rather than taking the old one's place,
+// so the queue stays in the order updates arrived and a client resuming from the
+// last revision it saw misses nothing queued before it.
+func enqueue[T interface{ Key() string }](queue []T, entry T, policy SlowConsumerPolicy, size int) ([]T, uint64, bool) {
+	if len(queue) < size {
+		return append(queue, entry), 0, true
+	}
+
+	if policy == PolicyCoalesce {
+		for i, queued := range queue {
+			if queued.Key() == entry.Key() {
+				return append(slices.Delete(queue, i, i+1), entry), 1, true
+			}
+		}
+	}
+
+	if policy == PolicyDisconnect {
+		return nil, uint64(len(queue)) + 1, false
+	}
+	return append(queue[1:], entry), 1, true
+}
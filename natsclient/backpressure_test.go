@@ -0,0 +1,196 @@
+package natsclient
+
+import (
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+// fill delivers revisions 1..n of the given keys, round-robin, without anyone reading.
+func fill(w *mergedWatcher, keys []string, n int) {
+	for rev := 1; rev <= n; rev++ {
+		key := keys[rev%len(keys)]
+		w.deliver(Entry{KeyValueEntry: testEntry{key: key, revision: uint64(rev)}})
+	}
+}
+
+// drain reads everything currently available on the watcher.
+func drain(w *mergedWatcher) []Entry {
+	var entries []Entry
+	for {
+		select {
+		case entry, ok := <-w.Updates():
+			if !ok {
+				return entries
+			}
+			entries = append(entries, entry)
+		case <-time.After(100 * time.Millisecond):
+			return entries
+		}
+	}
+}
+
+// TestMergedWatcher_Policies verifies each slow consumer policy when nobody reads.
+func TestMergedWatcher_Policies(t *testing.T) {
+	t.Run("coalesce", func(t *testing.T) {
+		w := newMergedWatcher(PolicyCoalesce, 4)
+		defer w.Stop()
+		fill(w, []string{"a", "b"}, 10)
+
+		entries := drain(w)
+		// The pump may already hold one entry; the full queue then coalesces the rest.
+		if len(entries) > 5 {
+			t.Errorf("expected at most 5 entries after coalescing 2 keys, got %d", len(entries))
+		}
+		last := entries[len(entries)-1]
+		if last.Revision() != 10 {
+			t.Errorf("expected the latest revision 10 to survive, got %d", last.Revision())
+		}
+		if got := uint64(len(entries)) + w.Dropped(); got != 10 {
+			t.Errorf("expected delivered + coalesced to be 10, got %d", got)
+		}
+	})
+
+	t.Run("drop oldest", func(t *testing.T) {
+		w := newMergedWatcher(PolicyDropOldest, 4)
+		defer w.Stop()
+		fill(w, []string{"a", "b", "c", "d", "e"}, 10)
+
+		entries := drain(w)
+		if entries[len(entries)-1].Revision() != 10 {
+			t.Errorf("expected newest revision to be kept, got %d", entries[len(entries)-1].Revision())
+		}
+		if got := uint64(len(entries)) + w.Dropped(); got != 10 {
+			t.Errorf("expected delivered + dropped to be 10, got %d", got)
+		}
+	})
+
+	t.Run("disconnect", func(t *testing.T) {
+		w := newMergedWatcher(PolicyDisconnect, 4)
+		defer w.Stop()
+		fill(w, []string{"a", "b", "c", "d", "e"}, 10)
+
+		drain(w)
+		if _, ok := <-w.Updates(); ok {
+			t.Error("expected Updates to be closed after disconnecting")
+		}
+		if !errors.Is(w.Err(), ErrSlowConsumer) {
+			t.Errorf("expected ErrSlowConsumer, got %v", w.Err())
+		}
+	})
+}
+
+// TestMergedWatcher_StopUnblocks verifies that Stop releases a watcher whose consumer never reads.
+func TestMergedWatcher_StopUnblocks(t *testing.T) {
+	w := newMergedWatcher(PolicyDropOldest, 1)
+	fill(w, []string{"a"}, 5)
+
+	stopped := make(chan struct{})
+	go func() {
+		w.Stop()
+		close(stopped)
+	}()
+
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Fatal("Stop blocked on a stalled consumer")
+	}
+
+	if w.deliver(Entry{KeyValueEntry: testEntry{key: "a", revision: 6}}) {
+		t.Error("expected deliver to report the watcher as stopped")
+	}
+
+	select {
+	case _, ok := <-w.Updates():
+		if ok {
+			// One entry may already have been handed to the pump; the channel must close after it.
+			if _, ok := <-w.Updates(); ok {
+				t.Error("expected Updates to be closed after Stop")
+			}
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Updates was not closed after Stop")
+	}
+}
+
+// TestEnqueue_CoalescesOnlyWhenFull verifies that updates for a queued key are kept
+// until the queue is full, and only then coalesced and counted as a drop.
+func TestEnqueue_CoalescesOnlyWhenFull(t *testing.T) {
+	entry := func(key string, revision uint64) Entry {
+		return Entry{KeyValueEntry: testEntry{key: key, revision: revision}}
+	}
+
+	queue, dropped, _ := enqueue([]Entry{entry("a", 1)}, entry("a", 2), PolicyCoalesce, 2)
+	if dropped != 0 || len(queue) != 2 {
+		t.Errorf("expected both revisions queued below capacity, got %d dropped and %d queued", dropped, len(queue))
+	}
+
+	queue, dropped, _ = enqueue([]Entry{entry("a", 1), entry("b", 2)}, entry("a", 3), PolicyCoalesce, 2)
+	if dropped != 1 || len(queue) != 2 {
+		t.Errorf("expected a counted coalesce at capacity, got %d dropped and %d queued", dropped, len(queue))
+	}
+	// The coalesced update moves behind b, keeping the queue in revision order.
+	if queue[0].Revision() != 2 || queue[1].Revision() != 3 {
+		t.Errorf("expected revisions 2 then 3, got %d then %d", queue[0].Revision(), queue[1].Revision())
+	}
+
+	_, dropped, _ = enqueue([]Entry{entry("a", 1), entry("b", 2)}, entry("c", 3), PolicyCoalesce, 2)
+	if dropped != 1 {
+		t.Errorf("expected the oldest distinct key to be dropped at capacity, got %d dropped", dropped)
+	}
+}
+
+// closedWatcher is a KeyWatcher whose Updates channel has already been closed.
+type closedWatcher struct {
+	updates chan jetstream.KeyValueEntry
+}
+
+func (w closedWatcher) Updates() <-chan jetstream.KeyValueEntry { return w.updates }
+func (w closedWatcher) Stop() error                             { return nil }
+
+// TestMergedWatcher_ForwardStopsOnClosedWatcher verifies that a forwarder returns once
+// its underlying watcher closes, rather than spinning on nil entries.
+func TestMergedWatcher_ForwardStopsOnClosedWatcher(t *testing.T) {
+	w := newMergedWatcher(PolicyCoalesce, 4)
+	defer w.Stop()
+	kw := closedWatcher{updates: make(chan jetstream.KeyValueEntry)}
+	close(kw.updates)
+
+	returned := make(chan struct{})
+	go func() {
+		w.forward(kw, SourceCloud)
+		close(returned)
+	}()
+	select {
+	case <-returned:
+	case <-time.After(time.Second):
+		t.Fatal("forward kept running after its watcher closed")
+	}
+}
+
+// stopCountingWatcher is a KeyWatcher that records whether it was stopped.
+type stopCountingWatcher struct {
+	updates chan jetstream.KeyValueEntry
+	stopped *atomic.Bool
+}
+
+func (w stopCountingWatcher) Updates() <-chan jetstream.KeyValueEntry { return w.updates }
+func (w stopCountingWatcher) Stop() error                             { w.stopped.Store(true); return nil }
+
+// TestMergedWatcher_AddAfterStop verifies that a watcher added once the merged watcher
+// has stopped is stopped straight away rather than leaked.
+func TestMergedWatcher_AddAfterStop(t *testing.T) {
+	w := newMergedWatcher(PolicyDisconnect, 1)
+	fill(w, []string{"a", "b", "c"}, 3)
+	drain(w)
+
+	kw := stopCountingWatcher{updates: make(chan jetstream.KeyValueEntry), stopped: new(atomic.Bool)}
+	w.add(kw, SourceCloud)
+	if !kw.stopped.Load() {
+		t.Error("expected a watcher added after a disconnect to be stopped")
+	}
+}
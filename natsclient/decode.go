@@ -0,0 +1,199 @@
+package natsclient
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/arcade55/nzflights-models"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+// FlightEntry is a decoded flight value along with its Key-Value metadata.
+type FlightEntry struct {
+	Key      string
+	Revision uint64
+	Created  time.Time
+	Source   Source
+	Value    nzflights.FlightValue
+	// Removed is set when the key was deleted or purged. Value then holds the last
+	// value seen for the key, if any.
+	Removed bool
+	// Share is set for flights shared with the user. It is empty for a removal.
+	Share *Share
+}
+
+// DecodeError reports a Key-Value entry whose value is not a valid flight.
+// It matches ErrFlightDecodeFailed with errors.Is.
+type DecodeError struct {
+	Key      string
+	Revision uint64
+	Err      error
+}
+
+func (e *DecodeError) Error() string {
+	return fmt.Sprintf("%v: key %s revision %d: %v", ErrFlightDecodeFailed, e.Key, e.Revision, e.Err)
+}
+
+func (e *DecodeError) Unwrap() []error {
+	return []error{ErrFlightDecodeFailed, e.Err}
+}
+
+// DecodeEntry decodes the flight value held in entry, and its share if the flight was
+// shared with the user. Deletes and purges hold no value; they decode as a removal
+// with an empty Value.
+func DecodeEntry(entry Entry) (FlightEntry, error) {
+	flight := FlightEntry{
+		Key:      entry.Key(),
+		Revision: entry.Revision(),
+		Created:  entry.Created(),
+		Source:   entry.Source,
+		Removed:  entry.Operation() != jetstream.KeyValuePut,
+	}
+	if !flight.Removed {
+		if err := json.Unmarshal(entry.Value(), &flight.Value); err != nil {
+			return FlightEntry{}, &DecodeError{Key: entry.Key(), Revision: entry.Revision(), Err: err}
+		}
+	}
+	if err := decodeShare(entry, &flight); err != nil {
+		return FlightEntry{}, &DecodeError{Key: entry.Key(), Revision: entry.Revision(), Err: err}
+	}
+	return flight, nil
+}
+
+// FlightWatcher is a Watcher that delivers decoded flights.
+// Entries that fail to decode are reported on Errors rather than dropped,
+// so callers must drain both channels. Updates is closed once the watcher stops.
+// Deletes and purges are delivered with Removed set and the key's last value.
+type FlightWatcher interface {
+	Updates() <-chan FlightEntry
+	Errors() <-chan *DecodeError
+	Stop()
+}
+
+// FlightsResult is the outcome of a multi-key read with every entry decoded.
+type FlightsResult struct {
+	// Found holds the decoded flights, by key.
+	Found map[string]FlightEntry
+	// Missing lists the keys that do not exist, in request order.
+	Missing []string
+	// Failed holds the keys that could not be read or decoded and why.
+	Failed map[string]error
+}
+
+// decodeFlights decodes every found entry. Entries that fail to decode move to
+// Failed, and their errors are joined with err.
+func decodeFlights(result GetResult, err error) (FlightsResult, error) {
+	flights := FlightsResult{
+		Found:   make(map[string]FlightEntry, len(result.Found)),
+		Missing: result.Missing,
+		Failed:  make(map[string]error, len(result.Failed)),
+	}
+	// Copied, so decode failures are not added to the caller's result.
+	for key, err := range result.Failed {
+		flights.Failed[key] = err
+	}
+	errs := []error{err}
+	for key, entry := range result.Found {
+		flight, decodeErr := DecodeEntry(entry)
+		if decodeErr != nil {
+			flights.Failed[key] = decodeErr
+			errs = append(errs, decodeErr)
+			continue
+		}
+		flights.Found[key] = flight
+	}
+	return flights, errors.Join(errs...)
+}
+
+// GetFlights fetches and decodes multiple keys using GetMultiple.
+func (s *flightStore) GetFlights(ctx context.Context, keys []string) (FlightsResult, error) {
+	return decodeFlights(s.GetMultiple(ctx, keys))
+}
+
+// WatchFlights wraps WatchMultiple in a watcher that decodes every update.
+func (s *flightStore) WatchFlights(ctx context.Context, keys []string) (FlightWatcher, error) {
+	w, err := s.WatchMultiple(ctx, keys)
+	if err != nil {
+		return nil, err
+	}
+	return newDecodingWatcher(w), nil
+}
+
+// decodingWatcher implements FlightWatcher on top of a Watcher.
+type decodingWatcher struct {
+	inner   Watcher
+	updates chan FlightEntry
+	errors  chan *DecodeError
+	done    chan struct{}
+	once    sync.Once
+	// last holds the latest value of each key, to fill in removals.
+	last map[string]nzflights.FlightValue
+}
+
+func newDecodingWatcher(inner Watcher) *decodingWatcher {
+	w := &decodingWatcher{
+		inner:   inner,
+		updates: make(chan FlightEntry, 64),
+		errors:  make(chan *DecodeError, 16),
+		done:    make(chan struct{}),
+		last:    make(map[string]nzflights.FlightValue),
+	}
+	go w.run()
+	return w
+}
+
+// run decodes entries from the inner watcher until it stops.
+func (w *decodingWatcher) run() {
+	defer close(w.updates)
+	for {
+		select {
+		case entry, ok := <-w.inner.Updates():
+			if !ok {
+				return
+			}
+			flight, err := DecodeEntry(entry)
+			if err != nil {
+				var decodeErr *DecodeError
+				errors.As(err, &decodeErr)
+				select {
+				case w.errors <- decodeErr:
+				case <-w.done:
+					return
+				}
+				continue
+			}
+			if flight.Removed {
+				flight.Value = w.last[flight.Key]
+				delete(w.last, flight.Key)
+			} else {
+				w.last[flight.Key] = flight.Value
+			}
+			select {
+			case w.updates <- flight:
+			case <-w.done:
+				return
+			}
+		case <-w.done:
+			return
+		}
+	}
+}
+
+func (w *decodingWatcher) Updates() <-chan FlightEntry {
+	return w.updates
+}
+
+func (w *decodingWatcher) Errors() <-chan *DecodeError {
+	return w.errors
+}
+
+func (w *decodingWatcher) Stop() {
+	w.once.Do(func() {
+		w.inner.Stop()
+		close(w.done)
+	})
+}
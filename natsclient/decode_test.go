@@ -0,0 +1,131 @@
+package natsclient
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/arcade55/nzflights-models"
+)
+
+// TestWatchFlights_DecodesAndReportsErrors verifies that good values are decoded and bad ones surface as DecodeErrors.
+func TestWatchFlights_DecodesAndReportsErrors(t *testing.T) {
+	kv, cleanup := setupTestKV(t)
+	defer cleanup()
+	ctx := context.Background()
+
+	const goodKey = "users.u1.flights.owned.NZ1"
+	const badKey = "users.u1.flights.owned.BAD"
+
+	store := newFlightStore(kv, kv, Options{})
+	watcher, err := store.WatchFlights(ctx, []string{goodKey, badKey})
+	if err != nil {
+		t.Fatalf("WatchFlights failed: %v", err)
+	}
+	defer watcher.Stop()
+
+	data, _ := json.Marshal(nzflights.FlightValue{ElementId: "NZ1", Flight: nzflights.Flight{Ident: "NZ1"}})
+	if _, err := kv.Put(ctx, goodKey, data); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	if _, err := kv.Put(ctx, badKey, []byte("not json")); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+
+	gotUpdate, gotError := false, false
+	for !gotUpdate || !gotError {
+		select {
+		case flight := <-watcher.Updates():
+			if flight.Key != goodKey || flight.Value.Flight.Ident != "NZ1" || flight.Revision == 0 {
+				t.Errorf("unexpected flight entry: %+v", flight)
+			}
+			gotUpdate = true
+		case decodeErr := <-watcher.Errors():
+			if decodeErr.Key != badKey || !errors.Is(decodeErr, ErrFlightDecodeFailed) {
+				t.Errorf("unexpected decode error: %v", decodeErr)
+			}
+			gotError = true
+		case <-time.After(2 * time.Second):
+			t.Fatalf("timed out: update received %v, error received %v", gotUpdate, gotError)
+		}
+	}
+
+	result, err := store.GetFlights(ctx, []string{goodKey, badKey})
+	var decodeErr *DecodeError
+	if !errors.As(err, &decodeErr) || decodeErr.Key != badKey {
+		t.Errorf("expected a DecodeError for %s, got %v", badKey, err)
+	}
+	if _, ok := result.Found[goodKey]; !ok || len(result.Found) != 1 {
+		t.Errorf("expected only %s to decode, got %d flights", goodKey, len(result.Found))
+	}
+	if _, ok := result.Failed[badKey]; !ok {
+		t.Errorf("expected %s to be reported as failed", badKey)
+	}
+}
+
+// TestWatchFlights_DeliversRemovals verifies that deletes and purges arrive as removals carrying the last value.
+func TestWatchFlights_DeliversRemovals(t *testing.T) {
+	kv, cleanup := setupTestKV(t)
+	defer cleanup()
+	ctx := context.Background()
+
+	const key = "users.u1.flights.owned.NZ1"
+	store := newFlightStore(kv, kv, Options{})
+	watcher, err := store.WatchFlights(ctx, []string{key})
+	if err != nil {
+		t.Fatalf("WatchFlights failed: %v", err)
+	}
+	defer watcher.Stop()
+
+	next := func() FlightEntry {
+		t.Helper()
+		select {
+		case flight := <-watcher.Updates():
+			return flight
+		case decodeErr := <-watcher.Errors():
+			t.Fatalf("unexpected decode error: %v", decodeErr)
+		case <-time.After(2 * time.Second):
+			t.Fatal("timed out waiting for an update")
+		}
+		return FlightEntry{}
+	}
+
+	data, _ := json.Marshal(nzflights.FlightValue{ElementId: "NZ1", Flight: nzflights.Flight{Ident: "NZ1"}})
+	kv.Put(ctx, key, data)
+	if flight := next(); flight.Removed {
+		t.Fatalf("expected the put, got a removal: %+v", flight)
+	}
+
+	kv.Delete(ctx, key)
+	if flight := next(); !flight.Removed || flight.Revision != 2 || flight.Value.ElementId != "NZ1" {
+		t.Errorf("expected a delete carrying the last value, got %+v", flight)
+	}
+
+	kv.Put(ctx, key, data)
+	next()
+	kv.Purge(ctx, key)
+	if flight := next(); !flight.Removed || flight.Revision != 4 {
+		t.Errorf("expected a purge, got %+v", flight)
+	}
+}
+
+// TestDecodeFlights_LeavesResultUntouched verifies that decode failures are reported
+// alongside read failures without being added to the caller's result.
+func TestDecodeFlights_LeavesResultUntouched(t *testing.T) {
+	result := GetResult{
+		Found: map[string]Entry{
+			"users.u1.flights.owned.NZ1": {KeyValueEntry: testEntry{key: "users.u1.flights.owned.NZ1", value: []byte("not json"), revision: 1}},
+		},
+		Failed: map[string]error{"users.u1.flights.owned.NZ2": ErrCloudUnavailable},
+	}
+
+	flights, err := decodeFlights(result, nil)
+	if err == nil || len(flights.Failed) != 2 {
+		t.Errorf("expected both keys to fail, got %v and %v", flights.Failed, err)
+	}
+	if len(result.Failed) != 1 {
+		t.Errorf("expected the caller's failures to be left alone, got %v", result.Failed)
+	}
+}
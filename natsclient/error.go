@@ -11,7 +11,30 @@ var (
 	// --- Key-Value Store Errors ---
 	ErrKVStoreMirrorFailed = errors.New("failed to create mirrored Key-Value store")
 	ErrKVStoreBindFailed   = errors.New("failed to bind to cloud Key-Value store")
+	ErrSeedFailed          = errors.New("failed to seed local Key-Value store")
+	ErrStoreCorrupt        = errors.New("embedded server store directory is unusable")
+	ErrCloudUnavailable    = errors.New("cloud Key-Value store is unavailable")
 
 	// --- Watcher Errors ---
 	ErrWatcherCreationFailed = errors.New("failed to create Key-Value watcher")
+	ErrSlowConsumer          = errors.New("watcher consumer fell too far behind")
+
+	// --- Write Errors ---
+	ErrFlightAlreadyTracked = errors.New("flight is already tracked")
+	ErrFlightNotTracked     = errors.New("flight is not tracked")
+	ErrRevisionConflict     = errors.New("flight was modified by another writer")
+	ErrRevisionUnavailable  = errors.New("flight revision is no longer available")
+
+	// --- Share Errors ---
+	ErrShareNotFound = errors.New("share does not exist or was already claimed")
+	ErrShareExpired  = errors.New("share has expired")
+	ErrOwnShare      = errors.New("share was created by the same user")
+	ErrAlreadyShared = errors.New("flight is already shared with the user")
+
+	// --- API Fetch Errors ---
+	ErrFetchTimeout = errors.New("no reply to API fetch request")
+	ErrFetchFailed  = errors.New("API fetch failed")
+
+	// --- Decoding Errors ---
+	ErrFlightDecodeFailed = errors.New("failed to decode flight value")
 )
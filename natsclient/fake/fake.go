@@ -0,0 +1,609 @@
+// Package fake provides an in-memory natsclient.FlightStore for tests.
+//
+// A Store behaves like a single Key-Value bucket: every write gets the next
+// revision, watchers see the current values followed by every later write in
+// order, and errors can be injected per key or per operation. No NATS server
+// is needed.
+package fake
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/arcade55/nzflights-models"
+	"github.com/arcade55/nzflights_webui/keys"
+	"github.com/arcade55/nzflights_webui/natsclient"
+	"github.com/google/uuid"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+var _ natsclient.FlightStore = (*Store)(nil)
+
+// Store is an in-memory natsclient.FlightStore. The zero value is not usable; use NewStore.
+type Store struct {
+	// Now stamps the creation time of new entries. It defaults to time.Now.
+	Now func() time.Time
+	// Source is reported on every entry read or watched. It defaults to natsclient.SourceInMemory.
+	Source natsclient.Source
+
+	mu         sync.Mutex
+	revision   uint64
+	entries    map[string]*entry
+	history    map[uint64]*entry
+	getErrs    map[string]error
+	watchErr   error
+	writeErr   error
+	watchers   []*Watcher
+	watchCount int
+}
+
+// NewStore returns an empty Store.
+func NewStore() *Store {
+	return &Store{
+		Now:     time.Now,
+		entries: make(map[string]*entry),
+		history: make(map[uint64]*entry),
+		getErrs: make(map[string]error),
+	}
+}
+
+// --- Scripting ---
+
+// Put stores value under key and delivers it to matching watchers. It returns the new revision.
+func (s *Store) Put(key string, value []byte) uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.write(key, value, jetstream.KeyValuePut)
+}
+
+// PutFlight stores fv as JSON under key. It returns the new revision.
+func (s *Store) PutFlight(key string, fv nzflights.FlightValue) uint64 {
+	data, err := json.Marshal(fv)
+	if err != nil {
+		panic(fmt.Sprintf("fake: encoding flight for %s: %v", key, err))
+	}
+	return s.Put(key, data)
+}
+
+// Delete removes key and tells matching watchers. Earlier revisions stay in the
+// history. It returns the revision of the delete marker.
+func (s *Store) Delete(key string) uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.write(key, nil, jetstream.KeyValueDelete)
+}
+
+// Purge removes key and its history and tells matching watchers. It returns the
+// revision of the purge marker.
+func (s *Store) Purge(key string) uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for rev, e := range s.history {
+		if e.key == key {
+			delete(s.history, rev)
+		}
+	}
+	return s.write(key, nil, jetstream.KeyValuePurge)
+}
+
+// Revision returns the latest revision of key, or zero if it does not exist.
+func (s *Store) Revision(key string) uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if e, ok := s.live(key); ok {
+		return e.revision
+	}
+	return 0
+}
+
+// FailGet makes reads of key fail with err. A nil err clears the failure.
+func (s *Store) FailGet(key string, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err == nil {
+		delete(s.getErrs, key)
+		return
+	}
+	s.getErrs[key] = err
+}
+
+// FailWatch makes new watchers fail to start with err. A nil err clears the failure.
+func (s *Store) FailWatch(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.watchErr = err
+}
+
+// FailWrites makes every FlightStore write, from Track to ClaimShare, fail with err. A nil err clears the failure.
+func (s *Store) FailWrites(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.writeErr = err
+}
+
+// Watchers reports how many watchers are currently running.
+func (s *Store) Watchers() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.watchers)
+}
+
+// --- FlightStore ---
+
+// GetMultiple reads every key. Keys with an injected failure are reported in Failed.
+func (s *Store) GetMultiple(_ context.Context, keys []string) (natsclient.GetResult, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	result := natsclient.GetResult{
+		Found:  make(map[string]natsclient.Entry),
+		Failed: make(map[string]error),
+	}
+	var errs []error
+	for _, key := range keys {
+		if err, ok := s.getErrs[key]; ok {
+			keyErr := &natsclient.KeyError{Key: key, Source: s.Source, Err: err}
+			result.Failed[key] = keyErr
+			errs = append(errs, keyErr)
+			continue
+		}
+		e, ok := s.live(key)
+		if !ok {
+			result.Missing = append(result.Missing, key)
+			continue
+		}
+		result.Found[key] = natsclient.Entry{KeyValueEntry: *e, Source: s.Source}
+	}
+	return result, errors.Join(errs...)
+}
+
+// GetMultipleInMemory is GetMultiple; the fake has a single tier.
+func (s *Store) GetMultipleInMemory(ctx context.Context, keys []string) (natsclient.GetResult, error) {
+	return s.GetMultiple(ctx, keys)
+}
+
+// GetFlights is GetMultiple with every entry decoded.
+func (s *Store) GetFlights(ctx context.Context, keys []string) (natsclient.FlightsResult, error) {
+	result, err := s.GetMultiple(ctx, keys)
+	flights := natsclient.FlightsResult{
+		Found:   make(map[string]natsclient.FlightEntry, len(result.Found)),
+		Missing: result.Missing,
+		Failed:  result.Failed,
+	}
+	errs := []error{err}
+	for key, entry := range result.Found {
+		flight, decodeErr := natsclient.DecodeEntry(entry)
+		if decodeErr != nil {
+			flights.Failed[key] = decodeErr
+			errs = append(errs, decodeErr)
+			continue
+		}
+		flights.Found[key] = flight
+	}
+	return flights, errors.Join(errs...)
+}
+
+// WatchMultiple watches keys, which may use the '*' and '>' wildcards.
+// The watcher first delivers the current value of every matching key in revision
+// order, then every later put. It stops when ctx is done.
+func (s *Store) WatchMultiple(ctx context.Context, keys []string) (natsclient.Watcher, error) {
+	return s.watch(ctx, keys)
+}
+
+// WatchMultipleInMemory is WatchMultiple; the fake has a single tier.
+func (s *Store) WatchMultipleInMemory(ctx context.Context, keys []string) (natsclient.Watcher, error) {
+	return s.watch(ctx, keys)
+}
+
+// WatchFlights is WatchMultiple with every update decoded.
+func (s *Store) WatchFlights(ctx context.Context, keys []string) (natsclient.FlightWatcher, error) {
+	w, err := s.watch(ctx, keys)
+	if err != nil {
+		return nil, err
+	}
+	return newFlightWatcher(w), nil
+}
+
+// Track stores a new flight for the user, failing with natsclient.ErrFlightAlreadyTracked if it exists.
+func (s *Store) Track(_ context.Context, userID, flightID string, fv nzflights.FlightValue) (uint64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.writeErr != nil {
+		return 0, s.writeErr
+	}
+
+	key, err := keys.OwnedFlight(userID, flightID)
+	if err != nil {
+		return 0, err
+	}
+	if _, ok := s.live(key); ok {
+		return 0, fmt.Errorf("%w: %s", natsclient.ErrFlightAlreadyTracked, key)
+	}
+	fv.NatsKey = key
+	data, err := json.Marshal(fv)
+	if err != nil {
+		return 0, err
+	}
+	return s.write(key, data, jetstream.KeyValuePut), nil
+}
+
+// UpdateUserFlight replaces a tracked flight if it is still at lastRevision.
+func (s *Store) UpdateUserFlight(_ context.Context, userID, flightID string, fv nzflights.FlightValue, lastRevision uint64) (uint64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.writeErr != nil {
+		return 0, s.writeErr
+	}
+
+	key, err := keys.OwnedFlight(userID, flightID)
+	if err != nil {
+		return 0, err
+	}
+	if err := s.checkRevision(key, lastRevision); err != nil {
+		return 0, err
+	}
+	fv.NatsKey = key
+	data, err := json.Marshal(fv)
+	if err != nil {
+		return 0, err
+	}
+	return s.write(key, data, jetstream.KeyValuePut), nil
+}
+
+// Untrack removes a tracked flight. A non-zero lastRevision makes the removal conditional.
+func (s *Store) Untrack(_ context.Context, userID, flightID string, lastRevision uint64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.writeErr != nil {
+		return s.writeErr
+	}
+
+	key, err := keys.OwnedFlight(userID, flightID)
+	if err != nil {
+		return err
+	}
+	e, ok := s.live(key)
+	if !ok {
+		return fmt.Errorf("%w: %s", natsclient.ErrFlightNotTracked, key)
+	}
+	if lastRevision == 0 {
+		lastRevision = e.revision
+	}
+	if err := s.checkRevision(key, lastRevision); err != nil {
+		return err
+	}
+	s.write(key, nil, jetstream.KeyValueDelete)
+	return nil
+}
+
+// RestoreUserFlight tracks a removed flight again with the value it held at revision.
+func (s *Store) RestoreUserFlight(_ context.Context, userID, flightID string, revision uint64) (uint64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.writeErr != nil {
+		return 0, s.writeErr
+	}
+
+	key, err := keys.OwnedFlight(userID, flightID)
+	if err != nil {
+		return 0, err
+	}
+	old, ok := s.history[revision]
+	if !ok || old.key != key || old.op != jetstream.KeyValuePut {
+		return 0, fmt.Errorf("%w: %s revision %d", natsclient.ErrRevisionUnavailable, key, revision)
+	}
+	if _, ok := s.live(key); ok {
+		return 0, fmt.Errorf("%w: %s", natsclient.ErrFlightAlreadyTracked, key)
+	}
+	return s.write(key, old.value, jetstream.KeyValuePut), nil
+}
+
+// AcceptSharedFlight accepts a flight shared with the user.
+func (s *Store) AcceptSharedFlight(_ context.Context, userID, flightID string, lastRevision uint64) (uint64, error) {
+	return s.updateShare(userID, flightID, lastRevision, func(share *natsclient.Share) {
+		share.Accepted = true
+	})
+}
+
+// HideSharedFlight hides a flight shared with the user.
+func (s *Store) HideSharedFlight(_ context.Context, userID, flightID string, lastRevision uint64) (uint64, error) {
+	return s.updateShare(userID, flightID, lastRevision, func(share *natsclient.Share) {
+		share.Hidden = true
+	})
+}
+
+// ConvertSharedFlight moves a flight shared with the user to their owned list.
+func (s *Store) ConvertSharedFlight(_ context.Context, userID, flightID string, lastRevision uint64) (uint64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.writeErr != nil {
+		return 0, s.writeErr
+	}
+
+	key, shared, err := s.sharedFlight(userID, flightID, lastRevision)
+	if err != nil {
+		return 0, err
+	}
+	ownedKey, err := keys.OwnedFlight(userID, flightID)
+	if err != nil {
+		return 0, err
+	}
+	if _, ok := s.live(ownedKey); ok {
+		return 0, fmt.Errorf("%w: %s", natsclient.ErrFlightAlreadyTracked, ownedKey)
+	}
+	fv := shared.FlightValue
+	fv.NatsKey = ownedKey
+	data, err := json.Marshal(fv)
+	if err != nil {
+		return 0, err
+	}
+	rev := s.write(ownedKey, data, jetstream.KeyValuePut)
+	s.write(key, nil, jetstream.KeyValueDelete)
+	return rev, nil
+}
+
+// ShareFlight creates a pending share of a flight the user owns and their record of it.
+func (s *Store) ShareFlight(_ context.Context, sharerID, flightID string, ttl time.Duration) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.writeErr != nil {
+		return "", s.writeErr
+	}
+
+	ownedKey, err := keys.OwnedFlight(sharerID, flightID)
+	if err != nil {
+		return "", err
+	}
+	e, ok := s.live(ownedKey)
+	if !ok {
+		return "", fmt.Errorf("%w: %s", natsclient.ErrFlightNotTracked, ownedKey)
+	}
+	var fv nzflights.FlightValue
+	if err := json.Unmarshal(e.value, &fv); err != nil {
+		return "", &natsclient.DecodeError{Key: ownedKey, Revision: e.revision, Err: err}
+	}
+
+	shareID := uuid.NewString()
+	pendingKey, _ := keys.PendingShare(shareID)
+	sentKey, err := keys.SentShare(sharerID, shareID)
+	if err != nil {
+		return "", err
+	}
+	expiresAt := s.Now().Add(ttl).UTC()
+	pending, _ := json.Marshal(natsclient.PendingShare{FlightID: flightID, SharerID: sharerID, Flight: fv, ExpiresAt: expiresAt})
+	sent, _ := json.Marshal(natsclient.SentShare{FlightID: flightID, Status: natsclient.SharePending, Snapshot: fv, ExpiresAt: expiresAt})
+	s.write(pendingKey, pending, jetstream.KeyValuePut)
+	s.write(sentKey, sent, jetstream.KeyValuePut)
+	return shareID, nil
+}
+
+// ClaimShare consumes a pending share, copying its flight to the recipient's shared
+// flights and marking the sharer's record claimed. A flight already shared with the
+// recipient is left as it is.
+func (s *Store) ClaimShare(_ context.Context, recipientID, shareID string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.writeErr != nil {
+		return "", s.writeErr
+	}
+
+	pendingKey, err := keys.PendingShare(shareID)
+	if err != nil {
+		return "", err
+	}
+	e, ok := s.live(pendingKey)
+	if !ok {
+		return "", fmt.Errorf("%w: %s", natsclient.ErrShareNotFound, pendingKey)
+	}
+	var pending natsclient.PendingShare
+	if err := json.Unmarshal(e.value, &pending); err != nil {
+		return "", &natsclient.DecodeError{Key: pendingKey, Revision: e.revision, Err: err}
+	}
+	if pending.SharerID == recipientID {
+		return "", fmt.Errorf("%w: %s", natsclient.ErrOwnShare, pendingKey)
+	}
+	sharedKey, err := keys.SharedFlight(recipientID, pending.FlightID)
+	if err != nil {
+		return "", err
+	}
+	if !s.Now().Before(pending.ExpiresAt) {
+		s.write(pendingKey, nil, jetstream.KeyValueDelete)
+		return "", fmt.Errorf("%w: %s", natsclient.ErrShareExpired, pendingKey)
+	}
+	// The share stays pending when the flight is already shared with the recipient.
+	if _, ok := s.live(sharedKey); ok {
+		return "", fmt.Errorf("%w: %s", natsclient.ErrAlreadyShared, sharedKey)
+	}
+	s.write(pendingKey, nil, jetstream.KeyValueDelete)
+
+	fv := pending.Flight
+	fv.NatsKey = sharedKey
+	shared, _ := json.Marshal(natsclient.SharedFlightValue{FlightValue: fv, Share: natsclient.Share{SharedBy: pending.SharerID}})
+	s.write(sharedKey, shared, jetstream.KeyValuePut)
+
+	sentKey, _ := keys.SentShare(pending.SharerID, shareID)
+	if e, ok := s.live(sentKey); ok {
+		var sent natsclient.SentShare
+		if err := json.Unmarshal(e.value, &sent); err == nil {
+			sent.Status = natsclient.ShareClaimed
+			sent.ClaimedAt = s.Now().UTC()
+			data, _ := json.Marshal(sent)
+			s.write(sentKey, data, jetstream.KeyValuePut)
+		}
+	}
+	return pending.FlightID, nil
+}
+
+// --- Internals ---
+
+// updateShare applies update to the share of a flight shared with the user.
+func (s *Store) updateShare(userID, flightID string, lastRevision uint64, update func(*natsclient.Share)) (uint64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.writeErr != nil {
+		return 0, s.writeErr
+	}
+
+	key, shared, err := s.sharedFlight(userID, flightID, lastRevision)
+	if err != nil {
+		return 0, err
+	}
+	update(&shared.Share)
+	data, err := json.Marshal(shared)
+	if err != nil {
+		return 0, err
+	}
+	return s.write(key, data, jetstream.KeyValuePut), nil
+}
+
+// sharedFlight decodes the flight shared with the user, checking lastRevision unless it
+// is zero. s.mu must be held.
+func (s *Store) sharedFlight(userID, flightID string, lastRevision uint64) (string, natsclient.SharedFlightValue, error) {
+	var shared natsclient.SharedFlightValue
+	key, err := keys.SharedFlight(userID, flightID)
+	if err != nil {
+		return "", shared, err
+	}
+	e, ok := s.live(key)
+	if !ok {
+		return "", shared, fmt.Errorf("%w: %s", natsclient.ErrFlightNotTracked, key)
+	}
+	if lastRevision != 0 {
+		if err := s.checkRevision(key, lastRevision); err != nil {
+			return "", shared, err
+		}
+	}
+	if err := json.Unmarshal(e.value, &shared); err != nil {
+		return "", shared, &natsclient.DecodeError{Key: key, Revision: e.revision, Err: err}
+	}
+	return key, shared, nil
+}
+
+// live returns the entry for key unless it does not exist or was deleted. s.mu must be held.
+func (s *Store) live(key string) (*entry, bool) {
+	e, ok := s.entries[key]
+	if !ok || e.op != jetstream.KeyValuePut {
+		return nil, false
+	}
+	return e, true
+}
+
+// checkRevision fails unless key exists at lastRevision. s.mu must be held.
+func (s *Store) checkRevision(key string, lastRevision uint64) error {
+	e, ok := s.live(key)
+	if !ok {
+		return fmt.Errorf("%w: %s", natsclient.ErrFlightNotTracked, key)
+	}
+	if e.revision != lastRevision {
+		return fmt.Errorf("%w: %s expected revision %d, found %d", natsclient.ErrRevisionConflict, key, lastRevision, e.revision)
+	}
+	return nil
+}
+
+// write records a new revision of key and hands it to matching watchers. s.mu must be held.
+func (s *Store) write(key string, value []byte, op jetstream.KeyValueOp) uint64 {
+	s.revision++
+	e := &entry{
+		key:      key,
+		value:    append([]byte(nil), value...),
+		revision: s.revision,
+		created:  s.Now(),
+		op:       op,
+	}
+	s.entries[key] = e
+	s.history[e.revision] = e
+
+	for _, w := range s.watchers {
+		if w.matches(key) {
+			w.enqueue(natsclient.Entry{KeyValueEntry: *e, Source: s.Source})
+		}
+	}
+	return e.revision
+}
+
+// watch registers a watcher and queues the current values of matching keys.
+func (s *Store) watch(ctx context.Context, keys []string) (*Watcher, error) {
+	if len(keys) == 0 {
+		return nil, errors.New("fake: watch requires at least one key")
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.watchErr != nil {
+		return nil, s.watchErr
+	}
+
+	s.watchCount++
+	w := newWatcher(s, s.watchCount, keys)
+
+	var initial []*entry
+	for key := range s.entries {
+		if e, ok := s.live(key); ok && w.matches(key) {
+			initial = append(initial, e)
+		}
+	}
+	sort.Slice(initial, func(i, j int) bool { return initial[i].revision < initial[j].revision })
+	for _, e := range initial {
+		w.enqueue(natsclient.Entry{KeyValueEntry: *e, Source: s.Source})
+	}
+	s.watchers = append(s.watchers, w)
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			w.Stop()
+		case <-w.done:
+		}
+	}()
+	return w, nil
+}
+
+// forget unregisters a stopped watcher.
+func (s *Store) forget(w *Watcher) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, other := range s.watchers {
+		if other.id == w.id {
+			s.watchers = append(s.watchers[:i], s.watchers[i+1:]...)
+			return
+		}
+	}
+}
+
+// matchKey reports whether key matches a NATS subject pattern with '*' and '>' wildcards.
+func matchKey(pattern, key string) bool {
+	patternTokens := strings.Split(pattern, ".")
+	keyTokens := strings.Split(key, ".")
+	for i, token := range patternTokens {
+		if token == ">" {
+			return len(keyTokens) > i
+		}
+		if i >= len(keyTokens) || (token != "*" && token != keyTokens[i]) {
+			return false
+		}
+	}
+	return len(keyTokens) == len(patternTokens)
+}
+
+// entry is an immutable jetstream.KeyValueEntry.
+type entry struct {
+	key      string
+	value    []byte
+	revision uint64
+	created  time.Time
+	op       jetstream.KeyValueOp
+}
+
+func (e entry) Bucket() string                  { return "fake" }
+func (e entry) Key() string                     { return e.key }
+func (e entry) Value() []byte                   { return e.value }
+func (e entry) Revision() uint64                { return e.revision }
+func (e entry) Created() time.Time              { return e.created }
+func (e entry) Delta() uint64                   { return 0 }
+func (e entry) Operation() jetstream.KeyValueOp { return e.op }
@@ -0,0 +1,129 @@
+package fake
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/arcade55/nzflights-models"
+	"github.com/arcade55/nzflights_webui/natsclient"
+)
+
+// next reads one update or fails the test.
+func next(t *testing.T, w natsclient.Watcher) natsclient.Entry {
+	t.Helper()
+	select {
+	case entry, ok := <-w.Updates():
+		if !ok {
+			t.Fatal("watcher stopped unexpectedly")
+		}
+		return entry
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for an update")
+	}
+	return natsclient.Entry{}
+}
+
+// TestStore_WatchOrdering verifies that watchers see current values, then later puts, in revision order.
+func TestStore_WatchOrdering(t *testing.T) {
+	store := NewStore()
+	ctx := context.Background()
+
+	store.Put("users.u1.flights.owned.NZ2", []byte("2"))
+	store.Put("users.u1.flights.owned.NZ1", []byte("1"))
+	store.Put("users.u2.flights.owned.NZ9", []byte("other user"))
+
+	w, err := store.WatchMultiple(ctx, []string{"users.u1.flights.>"})
+	if err != nil {
+		t.Fatalf("WatchMultiple failed: %v", err)
+	}
+	defer w.Stop()
+
+	store.Put("users.u1.flights.owned.NZ2", []byte("2b"))
+	store.Delete("users.u1.flights.owned.NZ1")
+	store.Put("users.u1.flights.owned.NZ3", []byte("3"))
+
+	want := []struct {
+		key      string
+		revision uint64
+	}{
+		{"users.u1.flights.owned.NZ2", 1},
+		{"users.u1.flights.owned.NZ1", 2},
+		{"users.u1.flights.owned.NZ2", 4},
+		{"users.u1.flights.owned.NZ1", 5},
+		{"users.u1.flights.owned.NZ3", 6},
+	}
+	for _, expected := range want {
+		entry := next(t, w)
+		if entry.Key() != expected.key || entry.Revision() != expected.revision {
+			t.Errorf("expected %s@%d, got %s@%d", expected.key, expected.revision, entry.Key(), entry.Revision())
+		}
+	}
+
+	w.Stop()
+	if _, ok := <-w.Updates(); ok {
+		t.Error("expected Updates to be closed after Stop")
+	}
+	if store.Watchers() != 0 {
+		t.Errorf("expected no running watchers, got %d", store.Watchers())
+	}
+}
+
+// TestStore_InjectedErrors verifies that injected failures surface the way the real store reports them.
+func TestStore_InjectedErrors(t *testing.T) {
+	store := NewStore()
+	ctx := context.Background()
+	store.PutFlight("flights.master.NZ1", nzflights.FlightValue{Flight: nzflights.Flight{Ident: "NZ1"}})
+
+	store.FailGet("flights.master.NZ1", natsclient.ErrCloudUnavailable)
+	result, err := store.GetFlights(ctx, []string{"flights.master.NZ1", "flights.master.NZ2"})
+	if !errors.Is(err, natsclient.ErrCloudUnavailable) {
+		t.Errorf("expected ErrCloudUnavailable, got %v", err)
+	}
+	if _, ok := result.Failed["flights.master.NZ1"]; !ok {
+		t.Error("expected the failing key to be reported")
+	}
+	if len(result.Missing) != 1 || result.Missing[0] != "flights.master.NZ2" {
+		t.Errorf("expected the unknown key to be missing, got %v", result.Missing)
+	}
+
+	store.FailWatch(errors.New("boom"))
+	if _, err := store.WatchMultiple(ctx, []string{"flights.>"}); err == nil {
+		t.Error("expected WatchMultiple to fail")
+	}
+	store.FailWatch(nil)
+
+	w, err := store.WatchMultiple(ctx, []string{"flights.>"})
+	if err != nil {
+		t.Fatalf("WatchMultiple failed: %v", err)
+	}
+	w.(*Watcher).Fail(natsclient.ErrSlowConsumer)
+	if !errors.Is(w.Err(), natsclient.ErrSlowConsumer) {
+		t.Errorf("expected ErrSlowConsumer, got %v", w.Err())
+	}
+}
+
+// TestStore_Revisions verifies the revision guards on tracked flights.
+func TestStore_Revisions(t *testing.T) {
+	store := NewStore()
+	ctx := context.Background()
+	fv := nzflights.FlightValue{Flight: nzflights.Flight{Ident: "NZ1"}}
+
+	rev, err := store.Track(ctx, "u1", "NZ1", fv)
+	if err != nil {
+		t.Fatalf("Track failed: %v", err)
+	}
+	if _, err := store.Track(ctx, "u1", "NZ1", fv); !errors.Is(err, natsclient.ErrFlightAlreadyTracked) {
+		t.Errorf("expected ErrFlightAlreadyTracked, got %v", err)
+	}
+	if _, err := store.UpdateUserFlight(ctx, "u1", "NZ1", fv, rev+1); !errors.Is(err, natsclient.ErrRevisionConflict) {
+		t.Errorf("expected ErrRevisionConflict, got %v", err)
+	}
+	if err := store.Untrack(ctx, "u1", "NZ1", rev); err != nil {
+		t.Errorf("Untrack failed: %v", err)
+	}
+	if err := store.Untrack(ctx, "u1", "NZ1", 0); !errors.Is(err, natsclient.ErrFlightNotTracked) {
+		t.Errorf("expected ErrFlightNotTracked, got %v", err)
+	}
+}
@@ -0,0 +1,180 @@
+package fake
+
+import (
+	"errors"
+	"sync"
+
+	"github.com/arcade55/nzflights-models"
+
+	"github.com/arcade55/nzflights_webui/natsclient"
+)
+
+// Watcher is an in-memory natsclient.Watcher. It never drops updates:
+// everything written to a matching key is queued until the consumer reads it.
+type Watcher struct {
+	store   *Store
+	id      int
+	keys    []string
+	updates chan natsclient.Entry
+	wake    chan struct{}
+	done    chan struct{}
+	once    sync.Once
+
+	mu    sync.Mutex
+	queue []natsclient.Entry
+	err   error
+}
+
+func newWatcher(store *Store, id int, keys []string) *Watcher {
+	w := &Watcher{
+		store:   store,
+		id:      id,
+		keys:    keys,
+		updates: make(chan natsclient.Entry),
+		wake:    make(chan struct{}, 1),
+		done:    make(chan struct{}),
+	}
+	go w.pump()
+	return w
+}
+
+// Updates delivers entries in revision order and is closed once the watcher stops.
+func (w *Watcher) Updates() <-chan natsclient.Entry {
+	return w.updates
+}
+
+// Dropped is always zero; the fake never drops updates.
+func (w *Watcher) Dropped() uint64 {
+	return 0
+}
+
+// Err reports the error passed to Fail, if any.
+func (w *Watcher) Err() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.err
+}
+
+// Fail stops the watcher as if it had stopped on its own with err, e.g. natsclient.ErrSlowConsumer.
+func (w *Watcher) Fail(err error) {
+	w.mu.Lock()
+	if w.err == nil {
+		w.err = err
+	}
+	w.mu.Unlock()
+	w.Stop()
+}
+
+func (w *Watcher) Stop() {
+	w.once.Do(func() {
+		close(w.done)
+		w.store.forget(w)
+	})
+}
+
+func (w *Watcher) matches(key string) bool {
+	for _, pattern := range w.keys {
+		if matchKey(pattern, key) {
+			return true
+		}
+	}
+	return false
+}
+
+// enqueue queues an entry for delivery. It never blocks.
+func (w *Watcher) enqueue(entry natsclient.Entry) {
+	w.mu.Lock()
+	w.queue = append(w.queue, entry)
+	w.mu.Unlock()
+
+	select {
+	case w.wake <- struct{}{}:
+	default:
+	}
+}
+
+// pump moves queued entries to the Updates channel in order until the watcher stops.
+func (w *Watcher) pump() {
+	defer close(w.updates)
+	for {
+		w.mu.Lock()
+		if len(w.queue) == 0 {
+			w.mu.Unlock()
+			select {
+			case <-w.wake:
+				continue
+			case <-w.done:
+				return
+			}
+		}
+		next := w.queue[0]
+		w.queue = w.queue[1:]
+		w.mu.Unlock()
+
+		select {
+		case w.updates <- next:
+		case <-w.done:
+			return
+		}
+	}
+}
+
+// flightWatcher decodes the updates of a Watcher.
+type flightWatcher struct {
+	inner   *Watcher
+	updates chan natsclient.FlightEntry
+	errors  chan *natsclient.DecodeError
+	// last holds the latest value of each key, to fill in removals.
+	last map[string]nzflights.FlightValue
+}
+
+func newFlightWatcher(inner *Watcher) *flightWatcher {
+	w := &flightWatcher{
+		inner:   inner,
+		updates: make(chan natsclient.FlightEntry),
+		errors:  make(chan *natsclient.DecodeError),
+		last:    make(map[string]nzflights.FlightValue),
+	}
+	go w.run()
+	return w
+}
+
+func (w *flightWatcher) run() {
+	defer close(w.updates)
+	for entry := range w.inner.Updates() {
+		flight, err := natsclient.DecodeEntry(entry)
+		if err != nil {
+			var decodeErr *natsclient.DecodeError
+			errors.As(err, &decodeErr)
+			select {
+			case w.errors <- decodeErr:
+			case <-w.inner.done:
+				return
+			}
+			continue
+		}
+		if flight.Removed {
+			flight.Value = w.last[flight.Key]
+			delete(w.last, flight.Key)
+		} else {
+			w.last[flight.Key] = flight.Value
+		}
+		select {
+		case w.updates <- flight:
+		case <-w.inner.done:
+			return
+		}
+	}
+}
+
+func (w *flightWatcher) Updates() <-chan natsclient.FlightEntry {
+	return w.updates
+}
+
+func (w *flightWatcher) Errors() <-chan *natsclient.DecodeError {
+	return w.errors
+}
+
+func (w *flightWatcher) Stop() {
+	w.inner.Stop()
+}
@@ -0,0 +1,176 @@
+package natsclient
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	correlation "github.com/arcade55/nzflights-correlation"
+	"github.com/arcade55/nzflights_webui/keys"
+	"github.com/nats-io/nats.go"
+)
+
+// FetchSubjectPrefix is followed by the escaped flight ID to form the subject API fetches are requested on.
+const FetchSubjectPrefix = "api.flightaware.fetch."
+
+// FetchRequest asks the fetcher service to refresh a flight from the upstream API.
+type FetchRequest struct {
+	FlightID string `json:"flightId"`
+	// Requester identifies who asked for the fetch, e.g. a user ID.
+	Requester string `json:"requester,omitempty"`
+	// CorrelationID ties the fetch to the request that caused it in the logs of both services.
+	CorrelationID string `json:"correlationId,omitempty"`
+}
+
+// FetchStatus is the outcome reported by the fetcher service.
+type FetchStatus string
+
+const (
+	// FetchAccepted means the fetch was queued. The flight is updated in the KV store when it completes.
+	FetchAccepted FetchStatus = "accepted"
+	// FetchComplete means the flight has already been updated in the KV store.
+	FetchComplete FetchStatus = "complete"
+	// FetchFailed means the fetch could not be done. FetchReply.Error says why.
+	FetchFailed FetchStatus = "failed"
+)
+
+// FetchReply is the fetcher service's answer to a FetchRequest.
+type FetchReply struct {
+	FlightID string      `json:"flightId"`
+	Status   FetchStatus `json:"status"`
+	Error    string      `json:"error,omitempty"`
+	// Key is the flights.master key the flight is stored under, when the service knows it.
+	Key           string `json:"key,omitempty"`
+	CorrelationID string `json:"correlationId,omitempty"`
+}
+
+// FetchSubject returns the subject a fetch for flightID is requested on.
+func FetchSubject(flightID string) (string, error) {
+	token, err := keys.Escape(flightID)
+	if err != nil {
+		return "", err
+	}
+	return FetchSubjectPrefix + token, nil
+}
+
+// FlightFetcher requests an API fetch for a flight on behalf of requester and waits for the reply.
+// Fetcher implements it.
+type FlightFetcher interface {
+	Fetch(ctx context.Context, flightID, requester string) (FetchReply, error)
+}
+
+// Fetcher requests API fetches and waits for the fetcher service to reply.
+// Fetches for the same flight are coalesced: callers that ask while a fetch is in
+// flight, or within the coalescing window after it succeeded, share its reply.
+type Fetcher struct {
+	nc      *nats.Conn
+	timeout time.Duration
+	window  time.Duration
+
+	mu    sync.Mutex
+	calls map[string]*fetchCall
+}
+
+// fetchCall is a single upstream request shared by every caller fetching the same flight.
+type fetchCall struct {
+	done  chan struct{}
+	reply FetchReply
+	err   error
+}
+
+// newFetcher returns a Fetcher that sends requests on nc.
+func newFetcher(nc *nats.Conn, opts Options) *Fetcher {
+	return &Fetcher{
+		nc:      nc,
+		timeout: opts.FetchTimeout,
+		window:  opts.FetchCoalesceWindow,
+		calls:   make(map[string]*fetchCall),
+	}
+}
+
+// Fetch asks for flightID to be refreshed and waits up to the fetch timeout for the reply.
+// The correlation ID is taken from ctx. A reply with FetchFailed is returned along with
+// ErrFetchFailed, and no reply in time gives ErrFetchTimeout.
+//
+// Only the first caller's requester and correlation ID are sent when fetches are coalesced.
+// Giving up on ctx does not cancel the shared request for the other callers.
+func (f *Fetcher) Fetch(ctx context.Context, flightID, requester string) (FetchReply, error) {
+	subject, err := FetchSubject(flightID)
+	if err != nil {
+		return FetchReply{}, err
+	}
+
+	f.mu.Lock()
+	call, ok := f.calls[flightID]
+	if !ok {
+		call = &fetchCall{done: make(chan struct{})}
+		f.calls[flightID] = call
+		req := FetchRequest{
+			FlightID:      flightID,
+			Requester:     requester,
+			CorrelationID: correlationID(ctx),
+		}
+		go f.request(call, subject, req)
+	}
+	f.mu.Unlock()
+
+	select {
+	case <-call.done:
+		return call.reply, call.err
+	case <-ctx.Done():
+		return FetchReply{}, ctx.Err()
+	}
+}
+
+// request sends req and records the reply in call. A successful call is kept for the
+// coalescing window so that callers arriving just after it do not fetch again.
+func (f *Fetcher) request(call *fetchCall, subject string, req FetchRequest) {
+	call.reply, call.err = f.send(subject, req)
+	close(call.done)
+
+	forget := func() {
+		f.mu.Lock()
+		if f.calls[req.FlightID] == call {
+			delete(f.calls, req.FlightID)
+		}
+		f.mu.Unlock()
+	}
+	if call.err != nil || f.window <= 0 {
+		forget()
+		return
+	}
+	time.AfterFunc(f.window, forget)
+}
+
+// send makes the request and decodes the reply.
+func (f *Fetcher) send(subject string, req FetchRequest) (FetchReply, error) {
+	data, err := json.Marshal(req)
+	if err != nil {
+		return FetchReply{}, err
+	}
+
+	msg, err := f.nc.Request(subject, data, f.timeout)
+	if err != nil {
+		if errors.Is(err, nats.ErrTimeout) || errors.Is(err, nats.ErrNoResponders) {
+			return FetchReply{}, fmt.Errorf("%w: %s: %v", ErrFetchTimeout, req.FlightID, err)
+		}
+		return FetchReply{}, fmt.Errorf("%w: %s: %v", ErrFetchFailed, req.FlightID, err)
+	}
+
+	var reply FetchReply
+	if err := json.Unmarshal(msg.Data, &reply); err != nil {
+		return FetchReply{}, fmt.Errorf("%w: %s: bad reply: %v", ErrFetchFailed, req.FlightID, err)
+	}
+	if reply.Status == FetchFailed {
+		return reply, fmt.Errorf("%w: %s: %s", ErrFetchFailed, req.FlightID, reply.Error)
+	}
+	return reply, nil
+}
+
+// correlationID returns the correlation ID carried by ctx, if any.
+func correlationID(ctx context.Context) string {
+	return correlation.FromContext(ctx)
+}
@@ -0,0 +1,130 @@
+package natsclient
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	correlation "github.com/arcade55/nzflights-correlation"
+	"github.com/nats-io/nats-server/v2/server"
+	"github.com/nats-io/nats-server/v2/test"
+	"github.com/nats-io/nats.go"
+)
+
+// setupFetcher starts a throwaway NATS server with a fetcher service that answers with reply
+// after delay, and returns a Fetcher connected to it and a count of the requests served.
+func setupFetcher(t *testing.T, opts Options, delay time.Duration, reply func(FetchRequest) FetchReply) (*Fetcher, *atomic.Int32) {
+	t.Helper()
+	s := test.RunServer(&server.Options{Port: -1})
+	t.Cleanup(s.Shutdown)
+	nc, err := nats.Connect(s.ClientURL())
+	if err != nil {
+		t.Fatalf("NATS connect failed: %v", err)
+	}
+	t.Cleanup(nc.Close)
+
+	var served atomic.Int32
+	if reply != nil {
+		_, err = nc.Subscribe(FetchSubjectPrefix+"*", func(msg *nats.Msg) {
+			served.Add(1)
+			var req FetchRequest
+			if err := json.Unmarshal(msg.Data, &req); err != nil {
+				t.Errorf("bad request: %v", err)
+				return
+			}
+			time.Sleep(delay)
+			data, _ := json.Marshal(reply(req))
+			msg.Respond(data)
+		})
+		if err != nil {
+			t.Fatalf("Subscribe failed: %v", err)
+		}
+	}
+	return newFetcher(nc, opts.withDefaults()), &served
+}
+
+// TestFetcher_Coalesces verifies that concurrent and closely following fetches of a flight share one request.
+func TestFetcher_Coalesces(t *testing.T) {
+	fetcher, served := setupFetcher(t, Options{}, 50*time.Millisecond, func(req FetchRequest) FetchReply {
+		return FetchReply{FlightID: req.FlightID, Status: FetchComplete, CorrelationID: req.CorrelationID}
+	})
+	ctx := correlation.EnsureCorrelationID(context.Background())
+
+	var wg sync.WaitGroup
+	for range 10 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			reply, err := fetcher.Fetch(ctx, "NZ123", "u1")
+			if err != nil {
+				t.Errorf("Fetch failed: %v", err)
+				return
+			}
+			if reply.Status != FetchComplete || reply.CorrelationID != correlation.FromContext(ctx) {
+				t.Errorf("unexpected reply %+v", reply)
+			}
+		}()
+	}
+	wg.Wait()
+
+	// Within the window the earlier reply is reused.
+	if _, err := fetcher.Fetch(context.Background(), "NZ123", "u2"); err != nil {
+		t.Fatalf("Fetch failed: %v", err)
+	}
+	if n := served.Load(); n != 1 {
+		t.Errorf("expected one upstream request, got %d", n)
+	}
+
+	// Other flights are fetched separately.
+	if _, err := fetcher.Fetch(context.Background(), "NZ456", "u1"); err != nil {
+		t.Fatalf("Fetch failed: %v", err)
+	}
+	if n := served.Load(); n != 2 {
+		t.Errorf("expected two upstream requests, got %d", n)
+	}
+}
+
+// TestFetcher_Failures verifies that failed fetches are reported and not reused.
+func TestFetcher_Failures(t *testing.T) {
+	fetcher, served := setupFetcher(t, Options{}, 0, func(req FetchRequest) FetchReply {
+		return FetchReply{FlightID: req.FlightID, Status: FetchFailed, Error: "quota exceeded"}
+	})
+	ctx := context.Background()
+
+	for range 2 {
+		reply, err := fetcher.Fetch(ctx, "NZ123", "u1")
+		if !errors.Is(err, ErrFetchFailed) || reply.Error != "quota exceeded" {
+			t.Errorf("expected ErrFetchFailed with the service's reason, got %+v, %v", reply, err)
+		}
+	}
+	if n := served.Load(); n != 2 {
+		t.Errorf("expected a failed fetch to be retried, got %d requests", n)
+	}
+
+	if _, err := fetcher.Fetch(ctx, "NZ*", "u1"); err == nil {
+		t.Error("expected a wildcard flight ID to be rejected")
+	}
+}
+
+// TestFetcher_Timeout verifies that a fetch with nobody to answer it gives up with ErrFetchTimeout.
+func TestFetcher_Timeout(t *testing.T) {
+	fetcher, _ := setupFetcher(t, Options{FetchTimeout: 100 * time.Millisecond}, 0, nil)
+	if _, err := fetcher.Fetch(context.Background(), "NZ123", "u1"); !errors.Is(err, ErrFetchTimeout) {
+		t.Errorf("expected ErrFetchTimeout, got %v", err)
+	}
+}
+
+// TestFetchSubject verifies that a flight ID always fills exactly one subject token.
+func TestFetchSubject(t *testing.T) {
+	subject, err := FetchSubject("NZ.123")
+	if err != nil {
+		t.Fatalf("FetchSubject failed: %v", err)
+	}
+	if subject != FetchSubjectPrefix+"NZ=2E123" {
+		t.Errorf("expected the dot to be escaped, got %s", subject)
+	}
+}
@@ -3,8 +3,11 @@ package natsclient
 import (
 	"context"
 	"errors"
+	"fmt"
 	"sync"
+	"time"
 
+	"github.com/arcade55/nzflights-models"
 	"github.com/nats-io/nats.go/jetstream"
 )
 
@@ -13,77 +16,256 @@ import (
 type FlightStore interface {
 	// GetMultiple retrieves the latest values for a slice of flight keys.
 	// It automatically checks the fast in-memory cache first, then the cloud cache for each key.
-	// Returns a map of keys to their found entries. Keys not found are omitted.
-	GetMultiple(ctx context.Context, keys []string) (map[string]jetstream.KeyValueEntry, error)
+	// Every key ends up in exactly one of the result's Found, Missing or Failed sets.
+	// The error joins a *KeyError for each failed key and is nil when none failed.
+	GetMultiple(ctx context.Context, keys []string) (GetResult, error)
 
 	// WatchMultiple creates a unified watcher for a given slice of keys.
 	// It intelligently merges updates from both the in-memory and cloud caches for all keys,
-	// providing a single channel of updates to the caller.
+	// providing a single channel of updates to the caller. Each key is delivered in
+	// strictly increasing revision order, so an update seen on both caches arrives once.
+	// Deletes and purges are delivered too, as entries whose Operation is not KeyValuePut.
 	// The returned Watcher must be stopped by the caller when no longer needed.
 	WatchMultiple(ctx context.Context, keys []string) (Watcher, error)
 
+	// GetFlights is GetMultiple with every entry decoded into a flight value.
+	// Entries that fail to decode are counted as failed and reported in the
+	// returned error as *DecodeError values.
+	GetFlights(ctx context.Context, keys []string) (FlightsResult, error)
+
+	// WatchFlights is WatchMultiple with every update decoded into a flight value.
+	WatchFlights(ctx context.Context, keys []string) (FlightWatcher, error)
+
+	// --- Write Methods ---
+	// Writes go to the cloud store, which is the source for the in-memory mirror.
+	// Each one is guarded by the Key-Value revision of the user's flight.
+
+	// Track adds a flight to the user's owned list. It fails with ErrFlightAlreadyTracked
+	// if the user already tracks the flight. It returns the new revision.
+	Track(ctx context.Context, userID, flightID string, fv nzflights.FlightValue) (uint64, error)
+	// Untrack removes a flight from the user's owned list. A non-zero lastRevision makes
+	// the removal conditional, failing with ErrRevisionConflict if the flight has changed.
+	Untrack(ctx context.Context, userID, flightID string, lastRevision uint64) error
+	// UpdateUserFlight replaces the user's copy of a flight if it is still at lastRevision,
+	// failing with ErrRevisionConflict otherwise. It returns the new revision.
+	UpdateUserFlight(ctx context.Context, userID, flightID string, fv nzflights.FlightValue, lastRevision uint64) (uint64, error)
+	// RestoreUserFlight undoes an Untrack by tracking the flight again with the value it
+	// had at revision. It fails with ErrFlightAlreadyTracked if the flight has been tracked
+	// again since, and ErrRevisionUnavailable if that revision is no longer in the store.
+	// It returns the new revision.
+	RestoreUserFlight(ctx context.Context, userID, flightID string, revision uint64) (uint64, error)
+
+	// --- Shared Flights ---
+	// Flights shared with the user are guarded the same way. A non-zero lastRevision makes
+	// each write conditional, failing with ErrRevisionConflict if the flight has changed,
+	// and a flight no longer shared with the user fails with ErrFlightNotTracked.
+
+	// AcceptSharedFlight accepts a flight shared with the user. It returns the new revision.
+	AcceptSharedFlight(ctx context.Context, userID, flightID string, lastRevision uint64) (uint64, error)
+	// HideSharedFlight hides a flight shared with the user. It returns the new revision.
+	HideSharedFlight(ctx context.Context, userID, flightID string, lastRevision uint64) (uint64, error)
+	// ConvertSharedFlight moves a flight shared with the user to their owned list, failing
+	// with ErrFlightAlreadyTracked if they already own it. It returns the owned revision.
+	ConvertSharedFlight(ctx context.Context, userID, flightID string, lastRevision uint64) (uint64, error)
+
+	// --- Sharing ---
+
+	// ShareFlight creates a single-use share of a flight the user owns, valid for ttl, and
+	// the user's record of it. It fails with ErrFlightNotTracked if the user does not own
+	// the flight. It returns the share ID.
+	ShareFlight(ctx context.Context, sharerID, flightID string, ttl time.Duration) (string, error)
+	// ClaimShare copies the flight in a share to the recipient's shared flights, consuming
+	// the share and marking the sharer's record claimed. It fails with ErrShareNotFound once
+	// the share has been claimed, ErrShareExpired after it expires and ErrOwnShare for the
+	// sharer. It returns the flight ID, even if only the sharer's record failed to update.
+	ClaimShare(ctx context.Context, recipientID, shareID string) (string, error)
+
 	// --- In-Memory Only Methods for Development ---
 
 	// GetMultipleInMemory retrieves values only from the fast in-memory cache.
-	GetMultipleInMemory(ctx context.Context, keys []string) (map[string]jetstream.KeyValueEntry, error)
+	GetMultipleInMemory(ctx context.Context, keys []string) (GetResult, error)
 	// WatchMultipleInMemory creates a watcher that only listens to the in-memory cache.
 	WatchMultipleInMemory(ctx context.Context, keys []string) (Watcher, error)
 }
 
 // Watcher is a simplified interface for a Key-Value watcher.
 type Watcher interface {
-	Updates() <-chan jetstream.KeyValueEntry
+	// Updates delivers entries and is closed once the watcher stops.
+	Updates() <-chan Entry
+	// Dropped reports how many updates were dropped, or coalesced away while the buffer was
+	// full, because the consumer fell behind.
+	Dropped() uint64
+	// Err reports why the watcher stopped on its own, e.g. ErrSlowConsumer.
+	Err() error
 	Stop()
 }
 
+// Source identifies which cache an entry was read from.
+type Source int
+
+const (
+	// SourceInMemory is the in-memory mirror on the embedded server.
+	SourceInMemory Source = iota
+	// SourceCloud is the cloud Key-Value store.
+	SourceCloud
+)
+
+func (s Source) String() string {
+	switch s {
+	case SourceInMemory:
+		return "in-memory"
+	case SourceCloud:
+		return "cloud"
+	default:
+		return "unknown"
+	}
+}
+
+// Entry is a Key-Value entry along with the cache it came from.
+// A mirror keeps the sequence numbers of its source, so revisions
+// are comparable across both caches.
+type Entry struct {
+	jetstream.KeyValueEntry
+	Source Source
+}
+
+// GetResult is the outcome of a multi-key read.
+type GetResult struct {
+	// Found holds the entries that were read, by key.
+	Found map[string]Entry
+	// Missing lists the keys that do not exist, in request order.
+	Missing []string
+	// Failed holds the keys that could not be read and why.
+	Failed map[string]error
+}
+
+// KeyError reports a key that could not be read. Failures caused by the
+// cloud store being unreachable match ErrCloudUnavailable with errors.Is.
+type KeyError struct {
+	Key    string
+	Source Source
+	Err    error
+}
+
+func (e *KeyError) Error() string {
+	return fmt.Sprintf("key %s from %v cache: %v", e.Key, e.Source, e.Err)
+}
+
+func (e *KeyError) Unwrap() error {
+	return e.Err
+}
+
 // flightStore is the concrete implementation of our FlightStore interface.
 type flightStore struct {
 	inMemoryKV jetstream.KeyValue
 	cloudKV    jetstream.KeyValue
+	opts       Options
+	// state is optional. When set, the store stops using the cloud while it is unreachable.
+	state *StateTracker
+	// mirror is optional. When set with Options.SkipStaleMirror, reads bypass a stale mirror.
+	mirror *MirrorMonitor
 }
 
 // newFlightStore is a private constructor for our flight store.
-func newFlightStore(inMemoryKV, cloudKV jetstream.KeyValue) FlightStore {
+func newFlightStore(inMemoryKV, cloudKV jetstream.KeyValue, opts Options) *flightStore {
 	return &flightStore{
 		inMemoryKV: inMemoryKV,
 		cloudKV:    cloudKV,
+		opts:       opts.withDefaults(),
 	}
 }
 
-// GetMultiple fetches multiple keys in parallel using a WaitGroup and a Mutex.
-func (s *flightStore) GetMultiple(ctx context.Context, keys []string) (map[string]jetstream.KeyValueEntry, error) {
-	results := make(map[string]jetstream.KeyValueEntry)
-	var mu sync.Mutex
-	var wg sync.WaitGroup
-
-	for _, key := range keys {
-		wg.Add(1)
-		go func(k string) {
-			defer wg.Done()
-			var entry jetstream.KeyValueEntry
-			var err error
-
-			// Try the fast in-memory mirror first.
-			entry, err = s.inMemoryKV.Get(ctx, k)
+// cloudDown reports whether the cloud connection is known to be down.
+func (s *flightStore) cloudDown() bool {
+	return s.state != nil && !s.state.cloudConnected()
+}
 
-			// If not there, check the cloud KV store.
+// errCloudDown is returned for cloud operations while the connection is down,
+// rather than waiting for them to time out.
+var errCloudDown = fmt.Errorf("%w: connection is down", ErrCloudUnavailable)
+
+// GetMultiple fetches multiple keys in parallel, falling back to the cloud for keys not in memory.
+// A stale mirror is skipped when Options.SkipStaleMirror is set.
+// While the cloud is down it falls back to the mirror alone. If the mirror is still
+// in sync through the leaf link, a key it lacks is missing; otherwise it is failed.
+func (s *flightStore) GetMultiple(ctx context.Context, keys []string) (GetResult, error) {
+	skipMirror := s.opts.SkipStaleMirror && s.mirror != nil && s.mirror.stale() && !s.cloudDown()
+	return getEach(ctx, keys, func(ctx context.Context, k string) (Entry, error) {
+		if skipMirror {
+			entry, err := s.cloudKV.Get(ctx, k)
 			if err != nil {
-				entry, err = s.cloudKV.Get(ctx, k)
+				return Entry{Source: SourceCloud}, cloudError(ctx, err)
 			}
+			return Entry{KeyValueEntry: entry, Source: SourceCloud}, nil
+		}
 
-			// If we found an entry in either store, add it to the results map.
-			if err == nil {
-				mu.Lock()
-				results[k] = entry
-				mu.Unlock()
+		// Try the fast in-memory mirror first.
+		entry, memErr := s.inMemoryKV.Get(ctx, k)
+		if memErr == nil {
+			return Entry{KeyValueEntry: entry, Source: SourceInMemory}, nil
+		}
+
+		if s.cloudDown() {
+			if s.state.State() == StateDegraded {
+				return Entry{Source: SourceInMemory}, memErr
 			}
-		}(key)
+			return Entry{Source: SourceCloud}, errCloudDown
+		}
+
+		// If not there, the cloud KV store has the final say.
+		entry, err := s.cloudKV.Get(ctx, k)
+		if err != nil {
+			return Entry{Source: SourceCloud}, cloudError(ctx, err)
+		}
+		return Entry{KeyValueEntry: entry, Source: SourceCloud}, nil
+	})
+}
+
+// cloudError marks a cloud read failure as ErrCloudUnavailable unless the key
+// simply does not exist or the caller gave up.
+func cloudError(ctx context.Context, err error) error {
+	if errors.Is(err, jetstream.ErrKeyNotFound) || ctx.Err() != nil {
+		return err
+	}
+	return fmt.Errorf("%w: %v", ErrCloudUnavailable, err)
+}
+
+// getEach reads every key in parallel using a WaitGroup and sorts the outcomes into a GetResult.
+// A get that fails with jetstream.ErrKeyNotFound marks the key as missing.
+func getEach(ctx context.Context, keys []string, get func(context.Context, string) (Entry, error)) (GetResult, error) {
+	entries := make([]Entry, len(keys))
+	errs := make([]error, len(keys))
+	var wg sync.WaitGroup
+
+	for i, key := range keys {
+		wg.Add(1)
+		go func(i int, k string) {
+			defer wg.Done()
+			entries[i], errs[i] = get(ctx, k)
+		}(i, key)
 	}
 
 	// Wait for all the concurrent fetches to complete.
 	wg.Wait()
 
-	return results, nil
+	result := GetResult{
+		Found:  make(map[string]Entry),
+		Failed: make(map[string]error),
+	}
+	var failures []error
+	for i, key := range keys {
+		switch err := errs[i]; {
+		case err == nil:
+			result.Found[key] = entries[i]
+		case errors.Is(err, jetstream.ErrKeyNotFound):
+			result.Missing = append(result.Missing, key)
+		default:
+			keyErr := &KeyError{Key: key, Source: entries[i].Source, Err: err}
+			result.Failed[key] = keyErr
+			failures = append(failures, keyErr)
+		}
+	}
+	return result, errors.Join(failures...)
 }
 
 // WatchMultiple creates and manages watchers for multiple keys, merging their updates.
@@ -92,79 +274,45 @@ func (s *flightStore) WatchMultiple(ctx context.Context, keys []string) (Watcher
 		return nil, errors.New("WatchMultiple requires at least one key")
 	}
 
-	mergedUpdates := make(chan jetstream.KeyValueEntry, 64)
-	done := make(chan struct{})
-	var allWatchers []jetstream.KeyWatcher
-
-	// Goroutine to forward updates from any watcher to the merged channel.
-	forwarder := func(w jetstream.KeyWatcher) {
-		for {
-			select {
-			case entry := <-w.Updates():
-				if entry != nil {
-					mergedUpdates <- entry
-				}
-			case <-done:
-				return
-			}
-		}
-	}
+	merged := newMergedWatcher(s.opts.SlowConsumerPolicy, s.opts.WatchBufferSize)
 
 	for _, key := range keys {
 		// Watch in-memory store for this key
-		memWatcher, err := s.inMemoryKV.Watch(ctx, key, jetstream.IgnoreDeletes())
+		memWatcher, err := s.inMemoryKV.Watch(ctx, key)
 		if err != nil {
 			// Stop any watchers we've already created
-			for _, w := range allWatchers {
-				w.Stop()
-			}
+			merged.Stop()
 			return nil, err
 		}
-		allWatchers = append(allWatchers, memWatcher)
-		go forwarder(memWatcher)
+		merged.add(memWatcher, SourceInMemory)
 
-		// Watch cloud store for this key
-		cloudWatcher, err := s.cloudKV.Watch(ctx, key, jetstream.IgnoreDeletes())
+		// Watch cloud store for this key, unless it is unreachable and the mirror is all there is.
+		if s.cloudDown() {
+			continue
+		}
+		cloudWatcher, err := s.cloudKV.Watch(ctx, key)
 		if err != nil {
-			for _, w := range allWatchers {
-				w.Stop()
-			}
+			merged.Stop()
 			return nil, err
 		}
-		allWatchers = append(allWatchers, cloudWatcher)
-		go forwarder(cloudWatcher)
+		merged.add(cloudWatcher, SourceCloud)
 	}
 
-	return &mergedWatcher{
-		updates:     mergedUpdates,
-		allWatchers: allWatchers,
-		done:        done,
-	}, nil
+	return merged, nil
 }
 
 // --- In-Memory Only Implementations ---
 
 // GetMultipleInMemory fetches multiple keys in parallel, only from the in-memory store.
-func (s *flightStore) GetMultipleInMemory(ctx context.Context, keys []string) (map[string]jetstream.KeyValueEntry, error) {
-	results := make(map[string]jetstream.KeyValueEntry)
-	var mu sync.Mutex
-	var wg sync.WaitGroup
-
-	for _, key := range keys {
-		wg.Add(1)
-		go func(k string) {
-			defer wg.Done()
-			// Only try the in-memory mirror.
-			if entry, err := s.inMemoryKV.Get(ctx, k); err == nil {
-				mu.Lock()
-				results[k] = entry
-				mu.Unlock()
-			}
-		}(key)
-	}
-
-	wg.Wait()
-	return results, nil
+func (s *flightStore) GetMultipleInMemory(ctx context.Context, keys []string) (GetResult, error) {
+	return getEach(ctx, keys, func(ctx context.Context, k string) (Entry, error) {
+		// Only try the in-memory mirror.
+		entry, err := s.inMemoryKV.Get(ctx, k)
+		if err != nil {
+			return Entry{Source: SourceInMemory}, err
+		}
+		return Entry{KeyValueEntry: entry, Source: SourceInMemory}, nil
+	})
 }
 
 // WatchMultipleInMemory creates watchers that only listen to the in-memory store.
@@ -173,57 +321,191 @@ func (s *flightStore) WatchMultipleInMemory(ctx context.Context, keys []string)
 		return nil, errors.New("WatchMultipleInMemory requires at least one key")
 	}
 
-	mergedUpdates := make(chan jetstream.KeyValueEntry, 64)
-	done := make(chan struct{})
-	var allWatchers []jetstream.KeyWatcher
-
-	forwarder := func(w jetstream.KeyWatcher) {
-		for {
-			select {
-			case entry := <-w.Updates():
-				if entry != nil {
-					mergedUpdates <- entry
-				}
-			case <-done:
-				return
-			}
-		}
-	}
+	merged := newMergedWatcher(s.opts.SlowConsumerPolicy, s.opts.WatchBufferSize)
 
 	for _, key := range keys {
 		// Only watch the in-memory store for this key.
-		memWatcher, err := s.inMemoryKV.Watch(ctx, key, jetstream.IgnoreDeletes())
+		memWatcher, err := s.inMemoryKV.Watch(ctx, key)
 		if err != nil {
-			for _, w := range allWatchers {
-				w.Stop()
-			}
+			merged.Stop()
 			return nil, err
 		}
-		allWatchers = append(allWatchers, memWatcher)
-		go forwarder(memWatcher)
+		merged.add(memWatcher, SourceInMemory)
 	}
 
-	return &mergedWatcher{
-		updates:     mergedUpdates,
-		allWatchers: allWatchers,
-		done:        done,
-	}, nil
+	return merged, nil
 }
 
 // mergedWatcher implements the Watcher interface for multiple keys.
+// It forwards updates from every underlying watcher into one channel, dropping
+// any entry whose revision is not newer than the last one accepted for its key.
+//
+// Forwarders never block on the consumer: accepted entries go into a bounded queue
+// that a single pump drains into the Updates channel, and the SlowConsumerPolicy
+// decides what happens when the queue is full. Stop therefore always unblocks
+// every forwarder, and the pump closes Updates on its way out.
 type mergedWatcher struct {
-	updates     <-chan jetstream.KeyValueEntry
+	updates     chan Entry
 	allWatchers []jetstream.KeyWatcher
 	done        chan struct{}
+	stopOnce    sync.Once
+	wake        chan struct{}
+
+	policy     SlowConsumerPolicy
+	bufferSize int
+
+	// mu guards everything below.
+	mu           sync.Mutex
+	lastRevision map[string]uint64
+	queue        []Entry
+	dropped      uint64
+	err          error
 }
 
-func (w *mergedWatcher) Updates() <-chan jetstream.KeyValueEntry {
+func newMergedWatcher(policy SlowConsumerPolicy, bufferSize int) *mergedWatcher {
+	if bufferSize <= 0 {
+		bufferSize = defaultWatchBufferSize
+	}
+	w := &mergedWatcher{
+		updates:      make(chan Entry),
+		done:         make(chan struct{}),
+		wake:         make(chan struct{}, 1),
+		policy:       policy,
+		bufferSize:   bufferSize,
+		lastRevision: make(map[string]uint64),
+	}
+	go w.pump()
+	return w
+}
+
+// add starts forwarding updates from kw, tagged with source. A watcher added after
+// Stop is stopped straight away.
+func (w *mergedWatcher) add(kw jetstream.KeyWatcher, source Source) {
+	w.mu.Lock()
+	select {
+	case <-w.done:
+		w.mu.Unlock()
+		kw.Stop()
+		return
+	default:
+	}
+	w.allWatchers = append(w.allWatchers, kw)
+	w.mu.Unlock()
+	go w.forward(kw, source)
+}
+
+// forward passes updates from a single watcher to deliver until the merged watcher is stopped.
+func (w *mergedWatcher) forward(kw jetstream.KeyWatcher, source Source) {
+	for {
+		select {
+		case entry, ok := <-kw.Updates():
+			if !ok {
+				// The underlying watcher was stopped or lost its subscription.
+				return
+			}
+			if entry != nil && !w.deliver(Entry{KeyValueEntry: entry, Source: source}) {
+				return
+			}
+		case <-w.done:
+			return
+		}
+	}
+}
+
+// deliver queues entry unless an equal or newer revision of its key has already
+// been accepted. It never blocks, and returns false once the watcher has stopped.
+func (w *mergedWatcher) deliver(entry Entry) bool {
+	select {
+	case <-w.done:
+		return false
+	default:
+	}
+
+	w.mu.Lock()
+	if w.err != nil {
+		w.mu.Unlock()
+		return false
+	}
+	if entry.Revision() <= w.lastRevision[entry.Key()] {
+		w.mu.Unlock()
+		return true
+	}
+	w.lastRevision[entry.Key()] = entry.Revision()
+
+	queue, dropped, ok := enqueue(w.queue, entry, w.policy, w.bufferSize)
+	w.queue = queue
+	w.dropped += dropped
+	if !ok {
+		w.err = ErrSlowConsumer
+	}
+	w.mu.Unlock()
+
+	if !ok {
+		w.Stop()
+		return false
+	}
+
+	select {
+	case w.wake <- struct{}{}:
+	default:
+	}
+	return true
+}
+
+// pump moves queued entries to the Updates channel in order until the watcher stops.
+func (w *mergedWatcher) pump() {
+	defer close(w.updates)
+	for {
+		w.mu.Lock()
+		if len(w.queue) == 0 {
+			w.mu.Unlock()
+			select {
+			case <-w.wake:
+				continue
+			case <-w.done:
+				return
+			}
+		}
+		entry := w.queue[0]
+		w.queue = w.queue[1:]
+		w.mu.Unlock()
+
+		select {
+		case w.updates <- entry:
+		case <-w.done:
+			return
+		}
+	}
+}
+
+// Updates delivers merged entries. It is closed once the watcher stops.
+func (w *mergedWatcher) Updates() <-chan Entry {
 	return w.updates
 }
 
+// Dropped reports how many updates were dropped, or coalesced away while the queue was full,
+// because the consumer fell behind.
+func (w *mergedWatcher) Dropped() uint64 {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.dropped
+}
+
+// Err reports ErrSlowConsumer if the watcher was disconnected by PolicyDisconnect.
+func (w *mergedWatcher) Err() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.err
+}
+
 func (w *mergedWatcher) Stop() {
-	for _, watcher := range w.allWatchers {
-		watcher.Stop()
-	}
-	close(w.done)
+	w.stopOnce.Do(func() {
+		w.mu.Lock()
+		watchers := w.allWatchers
+		close(w.done)
+		w.mu.Unlock()
+		for _, watcher := range watchers {
+			watcher.Stop()
+		}
+	})
 }
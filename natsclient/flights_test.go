@@ -0,0 +1,155 @@
+package natsclient
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats-server/v2/server"
+	"github.com/nats-io/nats-server/v2/test"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+// setupTestKV creates a clean, isolated KV bucket on a throwaway NATS server.
+func setupTestKV(t *testing.T) (jetstream.KeyValue, func()) {
+	t.Helper()
+	opts := &server.Options{Port: -1, JetStream: true, StoreDir: t.TempDir()}
+	s := test.RunServer(opts)
+	nc, err := nats.Connect(s.ClientURL())
+	if err != nil {
+		t.Fatalf("NATS connect failed: %v", err)
+	}
+	js, err := jetstream.New(nc)
+	if err != nil {
+		t.Fatalf("JetStream context failed: %v", err)
+	}
+
+	bucketName := fmt.Sprintf("flights_%d", time.Now().UnixNano())
+	// LimitMarkerTTL lets shares be written with a TTL, as on the cloud bucket.
+	kv, err := js.CreateKeyValue(context.Background(), jetstream.KeyValueConfig{Bucket: bucketName, LimitMarkerTTL: time.Minute})
+	if err != nil {
+		t.Fatalf("KV creation failed: %v", err)
+	}
+
+	cleanup := func() {
+		nc.Close()
+		s.Shutdown()
+	}
+	return kv, cleanup
+}
+
+// testEntry is a minimal jetstream.KeyValueEntry for driving watchers directly.
+type testEntry struct {
+	key      string
+	value    []byte
+	revision uint64
+	op       jetstream.KeyValueOp
+}
+
+func (e testEntry) Bucket() string                  { return "test" }
+func (e testEntry) Key() string                     { return e.key }
+func (e testEntry) Value() []byte                   { return e.value }
+func (e testEntry) Revision() uint64                { return e.revision }
+func (e testEntry) Created() time.Time              { return time.Time{} }
+func (e testEntry) Delta() uint64                   { return 0 }
+func (e testEntry) Operation() jetstream.KeyValueOp { return e.op }
+
+// TestWatchMultiple_Deduplicates verifies that an update seen on both caches is delivered once.
+func TestWatchMultiple_Deduplicates(t *testing.T) {
+	kv, cleanup := setupTestKV(t)
+	defer cleanup()
+	ctx := context.Background()
+
+	// Using the same bucket for both tiers means every update arrives twice with the same revision.
+	store := newFlightStore(kv, kv, Options{})
+	watcher, err := store.WatchMultiple(ctx, []string{"users.u1.flights.owned.NZ1"})
+	if err != nil {
+		t.Fatalf("WatchMultiple failed: %v", err)
+	}
+	defer watcher.Stop()
+
+	for i := 0; i < 3; i++ {
+		if _, err := kv.Put(ctx, "users.u1.flights.owned.NZ1", []byte(fmt.Sprintf("v%d", i))); err != nil {
+			t.Fatalf("Put failed: %v", err)
+		}
+	}
+
+	var last uint64
+	for i := 0; i < 3; i++ {
+		select {
+		case entry := <-watcher.Updates():
+			if entry.Revision() <= last {
+				t.Fatalf("revision %d delivered after %d", entry.Revision(), last)
+			}
+			last = entry.Revision()
+		case <-time.After(2 * time.Second):
+			t.Fatalf("timed out waiting for update %d", i+1)
+		}
+	}
+
+	select {
+	case entry := <-watcher.Updates():
+		t.Fatalf("unexpected duplicate update for revision %d from %s", entry.Revision(), entry.Source)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+// TestMergedWatcher_DropsStale verifies that an older revision is never delivered after a newer one.
+func TestMergedWatcher_DropsStale(t *testing.T) {
+	w := newMergedWatcher(PolicyCoalesce, 0)
+	defer w.Stop()
+
+	w.deliver(Entry{KeyValueEntry: testEntry{key: "k", revision: 5}, Source: SourceCloud})
+	w.deliver(Entry{KeyValueEntry: testEntry{key: "k", revision: 3}, Source: SourceInMemory})
+	w.deliver(Entry{KeyValueEntry: testEntry{key: "other", revision: 4}, Source: SourceInMemory})
+	w.deliver(Entry{KeyValueEntry: testEntry{key: "k", revision: 5}, Source: SourceInMemory})
+
+	first := <-w.Updates()
+	if first.Revision() != 5 || first.Source != SourceCloud {
+		t.Errorf("expected revision 5 from cloud, got %d from %s", first.Revision(), first.Source)
+	}
+	second := <-w.Updates()
+	if second.Key() != "other" {
+		t.Errorf("expected update for 'other', got %s revision %d", second.Key(), second.Revision())
+	}
+	select {
+	case entry := <-w.Updates():
+		t.Errorf("expected stale and duplicate entries to be dropped, got %s revision %d", entry.Key(), entry.Revision())
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+// TestGetMultiple_CloudUnavailable verifies that keys the cloud cannot answer for are reported, not dropped.
+func TestGetMultiple_CloudUnavailable(t *testing.T) {
+	memKV, cleanupMem := setupTestKV(t)
+	defer cleanupMem()
+	cloudKV, cleanupCloud := setupTestKV(t)
+	cleanupCloud()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	const cached, uncached = "users.u1.flights.owned.NZ1", "users.u1.flights.owned.NZ2"
+	if _, err := memKV.Put(ctx, cached, []byte("{}")); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+
+	store := newFlightStore(memKV, cloudKV, Options{})
+	result, err := store.GetMultiple(ctx, []string{cached, uncached})
+	if !errors.Is(err, ErrCloudUnavailable) {
+		t.Errorf("expected ErrCloudUnavailable, got %v", err)
+	}
+	if entry, ok := result.Found[cached]; !ok || entry.Source != SourceInMemory {
+		t.Errorf("expected %s to be found in memory, got %+v", cached, result.Found)
+	}
+	var keyErr *KeyError
+	if !errors.As(result.Failed[uncached], &keyErr) || keyErr.Key != uncached || keyErr.Source != SourceCloud {
+		t.Errorf("expected a cloud KeyError for %s, got %v", uncached, result.Failed[uncached])
+	}
+	if len(result.Missing) != 0 {
+		t.Errorf("expected no missing keys, got %v", result.Missing)
+	}
+}
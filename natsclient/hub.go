@@ -0,0 +1,431 @@
+package natsclient
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+// Hub shares one upstream Key-Value watch per key pattern between any number of
+// subscribers, such as the SSE streams of every open tab. The upstream watch is
+// started by the first subscriber to a pattern and stopped when the last one leaves.
+type Hub struct {
+	kv jetstream.KeyValue
+	// policy and bufferSize bound each subscriber's queue, as for FlightStore watchers.
+	policy     SlowConsumerPolicy
+	bufferSize int
+
+	mu     sync.Mutex
+	topics map[string]*hubTopic
+}
+
+// NewHub creates a hub that watches kv. Each subscriber holds up to bufferSize
+// undelivered live updates, beyond which policy decides what happens. A bufferSize of
+// zero or less uses the same default as FlightStore watchers.
+func NewHub(kv jetstream.KeyValue, policy SlowConsumerPolicy, bufferSize int) *Hub {
+	if bufferSize <= 0 {
+		bufferSize = defaultWatchBufferSize
+	}
+	return &Hub{
+		kv:         kv,
+		policy:     policy,
+		bufferSize: bufferSize,
+		topics:     make(map[string]*hubTopic),
+	}
+}
+
+// Subscribe registers a new subscriber for every key matching pattern.
+// The subscriber first receives the latest value of each matching key, then live updates.
+// Keys deleted or purged while subscribed are delivered with FlightEntry.Removed set.
+// The returned Subscription must be stopped by the caller when no longer needed.
+func (h *Hub) Subscribe(pattern string) (*Subscription, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	topic, ok := h.topics[pattern]
+	if !ok {
+		var err error
+		if topic, err = h.newTopic(pattern, true); err != nil {
+			return nil, err
+		}
+		h.topics[pattern] = topic
+	}
+
+	return topic.add(), nil
+}
+
+// SubscribeFrom registers a subscriber for every change to keys matching pattern from
+// revision onwards, including deletes and purges, then live updates. It is for clients
+// resuming after a reconnect. The upstream watch starts as the subscriber's own, as it
+// starts from a point in history no shared watch is at. Once it has caught up with the
+// shared watch for pattern, the subscriber joins that and its own watch stops.
+func (h *Hub) SubscribeFrom(pattern string, revision uint64) (*Subscription, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	topic, err := h.newTopic(pattern, false, jetstream.ResumeFromRevision(revision))
+	if err != nil {
+		return nil, err
+	}
+	return topic.add(), nil
+}
+
+// newTopic starts an upstream watch on pattern. h.mu must be held.
+func (h *Hub) newTopic(pattern string, shared bool, opts ...jetstream.WatchOpt) (*hubTopic, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	watcher, err := h.kv.Watch(ctx, pattern, opts...)
+	if err != nil {
+		cancel()
+		return nil, fmt.Errorf("%w: %v", ErrWatcherCreationFailed, err)
+	}
+	topic := &hubTopic{
+		hub:      h,
+		pattern:  pattern,
+		shared:   shared,
+		watcher:  watcher,
+		ctx:      ctx,
+		cancel:   cancel,
+		latest:   make(map[string]FlightEntry),
+		subs:     make(map[*Subscription]struct{}),
+		finished: make(chan struct{}),
+	}
+	go topic.run()
+	return topic, nil
+}
+
+// Subscribers reports how many subscribers are registered for pattern.
+func (h *Hub) Subscribers(pattern string) int {
+	h.mu.Lock()
+	topic, ok := h.topics[pattern]
+	h.mu.Unlock()
+	if !ok {
+		return 0
+	}
+
+	topic.mu.Lock()
+	defer topic.mu.Unlock()
+	return len(topic.subs)
+}
+
+// hubTopic is the single upstream watch for one key pattern.
+type hubTopic struct {
+	hub     *Hub
+	pattern string
+	// shared topics are listed in hub.topics for other subscribers to join.
+	shared   bool
+	watcher  jetstream.KeyWatcher
+	ctx      context.Context
+	cancel   context.CancelFunc
+	finished chan struct{}
+
+	mu     sync.Mutex
+	latest map[string]FlightEntry
+	subs   map[*Subscription]struct{}
+	// caughtUp is set once the watch has delivered its initial values, and
+	// lastRevision is the last revision it dispatched.
+	caughtUp     bool
+	lastRevision uint64
+}
+
+// add registers a subscriber and queues the latest value of every known key for it.
+// The latest values are on top of the subscriber's buffer, so a large list does not
+// count against it.
+func (t *hubTopic) add() *Subscription {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	sub := newSubscription(t, t.hub.policy, t.hub.bufferSize+len(t.latest))
+	for _, flight := range t.latest {
+		sub.push(hubEvent{flight: flight})
+	}
+	t.subs[sub] = struct{}{}
+	return sub
+}
+
+// remove unregisters a subscriber from the topic it is on, tearing down the upstream
+// watch once nobody is left.
+func (h *Hub) remove(sub *Subscription) {
+	h.mu.Lock()
+	t := sub.topic
+	t.mu.Lock()
+	delete(t.subs, sub)
+	empty := len(t.subs) == 0
+	t.mu.Unlock()
+
+	if !empty || t.shared && h.topics[t.pattern] != t {
+		h.mu.Unlock()
+		return
+	}
+	if t.shared {
+		delete(h.topics, t.pattern)
+	}
+	h.mu.Unlock()
+
+	// A resumed topic may be waiting for the hub's lock to hand over, so it is
+	// released before waiting for the watch to finish.
+	t.watcher.Stop()
+	t.cancel()
+	<-t.finished
+}
+
+// run decodes upstream entries and fans them out to every subscriber. A resumed
+// topic stops once its subscriber has been handed over to the shared topic.
+func (t *hubTopic) run() {
+	defer close(t.finished)
+	for {
+		select {
+		case entry, ok := <-t.watcher.Updates():
+			if !ok {
+				return
+			}
+			if entry == nil {
+				// All initial values have been delivered.
+				t.mu.Lock()
+				t.caughtUp = true
+				t.mu.Unlock()
+			} else {
+				t.dispatch(entry)
+			}
+			if !t.shared && t.handOver() {
+				t.watcher.Stop()
+				t.cancel()
+				return
+			}
+		case <-t.ctx.Done():
+			return
+		}
+	}
+}
+
+// handOver moves the subscriber of a resumed topic to the shared topic for its pattern,
+// once both have caught up and the shared one has dispatched nothing the resumed one
+// has not. From then on the shared topic delivers only what comes after, so nothing is
+// missed or repeated. It reports whether the subscriber was handed over.
+func (t *hubTopic) handOver() bool {
+	h := t.hub
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	shared, ok := h.topics[t.pattern]
+	if !ok {
+		return false
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if !t.caughtUp || len(t.subs) == 0 {
+		return false
+	}
+	shared.mu.Lock()
+	defer shared.mu.Unlock()
+	if !shared.caughtUp || shared.lastRevision > t.lastRevision {
+		return false
+	}
+	for sub := range t.subs {
+		sub.skipThrough(t.lastRevision)
+		sub.topic = shared
+		shared.subs[sub] = struct{}{}
+		delete(t.subs, sub)
+	}
+	return true
+}
+
+// dispatch records an entry and queues it for every subscriber.
+func (t *hubTopic) dispatch(entry jetstream.KeyValueEntry) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.lastRevision = entry.Revision()
+
+	if entry.Operation() != jetstream.KeyValuePut {
+		// Removals always decode.
+		removed, _ := DecodeEntry(Entry{KeyValueEntry: entry})
+		removed.Value = t.latest[entry.Key()].Value
+		delete(t.latest, entry.Key())
+		for sub := range t.subs {
+			sub.push(hubEvent{flight: removed})
+		}
+		return
+	}
+
+	flight, err := DecodeEntry(Entry{KeyValueEntry: entry})
+	var event hubEvent
+	if err != nil {
+		var decodeErr *DecodeError
+		errors.As(err, &decodeErr)
+		event.err = decodeErr
+	} else {
+		t.latest[entry.Key()] = flight
+		event.flight = flight
+	}
+
+	for sub := range t.subs {
+		sub.push(event)
+	}
+}
+
+// hubEvent is a single item queued for a subscriber: either a flight or a decode error.
+type hubEvent struct {
+	flight FlightEntry
+	err    *DecodeError
+}
+
+// revision is the revision of the entry the event is about.
+func (e hubEvent) revision() uint64 {
+	if e.err != nil {
+		return e.err.Revision
+	}
+	return e.flight.Revision
+}
+
+// Key is the key the event is about, for coalescing.
+func (e hubEvent) Key() string {
+	if e.err != nil {
+		return e.err.Key
+	}
+	return e.flight.Key
+}
+
+var _ FlightWatcher = (*Subscription)(nil)
+
+// Subscription is one subscriber's view of a hub topic. It implements FlightWatcher.
+// Events are queued per subscriber, so a slow subscriber never holds up the others.
+// The queue is bounded, and the hub's SlowConsumerPolicy decides what happens once a
+// subscriber falls that far behind.
+type Subscription struct {
+	hub *Hub
+	// topic is guarded by the hub's lock, as a resumed subscriber moves to the shared topic.
+	topic   *hubTopic
+	updates chan FlightEntry
+	errors  chan *DecodeError
+	done    chan struct{}
+	once    sync.Once
+
+	policy SlowConsumerPolicy
+	limit  int
+
+	// mu guards everything below.
+	mu      sync.Mutex
+	pending []hubEvent
+	wake    chan struct{}
+	dropped uint64
+	err     error
+	// skip is the revision up to which the subscriber already has every event.
+	skip uint64
+}
+
+func newSubscription(topic *hubTopic, policy SlowConsumerPolicy, limit int) *Subscription {
+	sub := &Subscription{
+		hub:     topic.hub,
+		topic:   topic,
+		updates: make(chan FlightEntry),
+		errors:  make(chan *DecodeError),
+		done:    make(chan struct{}),
+		wake:    make(chan struct{}, 1),
+		policy:  policy,
+		limit:   limit,
+	}
+	go sub.pump()
+	return sub
+}
+
+// push queues an event without blocking. Under PolicyDisconnect a subscriber that has
+// fallen too far behind is stopped, closing its Updates channel.
+func (s *Subscription) push(event hubEvent) {
+	s.mu.Lock()
+	if s.err != nil || event.revision() <= s.skip {
+		s.mu.Unlock()
+		return
+	}
+	pending, dropped, ok := enqueue(s.pending, event, s.policy, s.limit)
+	s.pending = pending
+	s.dropped += dropped
+	if !ok {
+		s.err = ErrSlowConsumer
+	}
+	s.mu.Unlock()
+
+	if !ok {
+		// The topic's lock is held while pushing, and Stop takes it.
+		go s.Stop()
+		return
+	}
+
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// skipThrough drops any later event at or below revision, which the subscriber
+// has already been sent.
+func (s *Subscription) skipThrough(revision uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.skip = revision
+}
+
+// pump delivers queued events in order until the subscription is stopped.
+func (s *Subscription) pump() {
+	defer close(s.updates)
+	for {
+		s.mu.Lock()
+		if len(s.pending) == 0 {
+			s.mu.Unlock()
+			select {
+			case <-s.wake:
+				continue
+			case <-s.done:
+				return
+			}
+		}
+		event := s.pending[0]
+		s.pending = s.pending[1:]
+		s.mu.Unlock()
+
+		if event.err != nil {
+			select {
+			case s.errors <- event.err:
+			case <-s.done:
+				return
+			}
+			continue
+		}
+		select {
+		case s.updates <- event.flight:
+		case <-s.done:
+			return
+		}
+	}
+}
+
+func (s *Subscription) Updates() <-chan FlightEntry {
+	return s.updates
+}
+
+func (s *Subscription) Errors() <-chan *DecodeError {
+	return s.errors
+}
+
+// Dropped reports how many updates were dropped, or coalesced away while the queue was full,
+// because the subscriber fell behind.
+func (s *Subscription) Dropped() uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.dropped
+}
+
+// Err reports ErrSlowConsumer if the subscriber was disconnected by PolicyDisconnect.
+func (s *Subscription) Err() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.err
+}
+
+// Stop unregisters the subscriber. The upstream watch is stopped when the last subscriber leaves.
+func (s *Subscription) Stop() {
+	s.once.Do(func() {
+		close(s.done)
+		s.hub.remove(s)
+	})
+}
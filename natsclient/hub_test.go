@@ -0,0 +1,371 @@
+package natsclient
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/arcade55/nzflights-models"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+// consumerCount reports how many consumers exist on the stream behind kv.
+func consumerCount(t *testing.T, kv jetstream.KeyValue) int {
+	t.Helper()
+	status, err := kv.Status(context.Background())
+	if err != nil {
+		t.Fatalf("Status failed: %v", err)
+	}
+	return status.(*jetstream.KeyValueBucketStatus).StreamInfo().State.Consumers
+}
+
+// receive waits for the next flight from a subscription.
+func receive(t *testing.T, sub *Subscription) FlightEntry {
+	t.Helper()
+	select {
+	case flight := <-sub.Updates():
+		return flight
+	case <-time.After(2 * time.Second):
+		t.Fatal("timed out waiting for a flight")
+		return FlightEntry{}
+	}
+}
+
+// TestHub_SharesOneUpstreamWatch verifies fan-out, snapshot replay and teardown after the last subscriber.
+func TestHub_SharesOneUpstreamWatch(t *testing.T) {
+	kv, cleanup := setupTestKV(t)
+	defer cleanup()
+	ctx := context.Background()
+
+	const pattern = "users.u1.flights.owned.>"
+	put := func(ident string) {
+		data, _ := json.Marshal(nzflights.FlightValue{ElementId: ident, Flight: nzflights.Flight{Ident: ident}})
+		if _, err := kv.Put(ctx, "users.u1.flights.owned."+ident, data); err != nil {
+			t.Fatalf("Put failed: %v", err)
+		}
+	}
+
+	put("NZ1")
+	hub := NewHub(kv, PolicyCoalesce, 0)
+
+	first, err := hub.Subscribe(pattern)
+	if err != nil {
+		t.Fatalf("Subscribe failed: %v", err)
+	}
+	if got := receive(t, first).Value.Flight.Ident; got != "NZ1" {
+		t.Fatalf("expected initial NZ1, got %s", got)
+	}
+
+	// A late subscriber is replayed the latest values without a new upstream watch.
+	second, err := hub.Subscribe(pattern)
+	if err != nil {
+		t.Fatalf("Subscribe failed: %v", err)
+	}
+	if got := receive(t, second).Value.Flight.Ident; got != "NZ1" {
+		t.Fatalf("expected replayed NZ1, got %s", got)
+	}
+	if n := consumerCount(t, kv); n != 1 {
+		t.Errorf("expected 1 upstream consumer, got %d", n)
+	}
+	if n := hub.Subscribers(pattern); n != 2 {
+		t.Errorf("expected 2 subscribers, got %d", n)
+	}
+
+	put("NZ2")
+	if got := receive(t, first).Value.Flight.Ident; got != "NZ2" {
+		t.Errorf("first subscriber expected NZ2, got %s", got)
+	}
+	if got := receive(t, second).Value.Flight.Ident; got != "NZ2" {
+		t.Errorf("second subscriber expected NZ2, got %s", got)
+	}
+
+	first.Stop()
+	if n := hub.Subscribers(pattern); n != 1 {
+		t.Errorf("expected 1 subscriber after first left, got %d", n)
+	}
+	second.Stop()
+	if n := hub.Subscribers(pattern); n != 0 {
+		t.Errorf("expected no subscribers, got %d", n)
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for consumerCount(t, kv) != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("upstream watch was not torn down after the last subscriber left")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+// TestHub_DeliversRemovals verifies that a deleted key reaches subscribers with its last value
+// and is not replayed to later subscribers.
+func TestHub_DeliversRemovals(t *testing.T) {
+	kv, cleanup := setupTestKV(t)
+	defer cleanup()
+	ctx := context.Background()
+
+	const key = "users.u1.flights.owned.NZ1"
+	data, _ := json.Marshal(nzflights.FlightValue{ElementId: "NZ1", Flight: nzflights.Flight{Ident: "NZ1"}})
+	if _, err := kv.Put(ctx, key, data); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+
+	hub := NewHub(kv, PolicyCoalesce, 0)
+	sub, err := hub.Subscribe("users.u1.flights.owned.>")
+	if err != nil {
+		t.Fatalf("Subscribe failed: %v", err)
+	}
+	defer sub.Stop()
+	if flight := receive(t, sub); flight.Removed {
+		t.Fatalf("expected the initial value, got a removal")
+	}
+
+	if err := kv.Delete(ctx, key); err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+	removed := receive(t, sub)
+	if !removed.Removed || removed.Key != key || removed.Revision != 2 || removed.Value.ElementId != "NZ1" {
+		t.Errorf("expected a removal of %s carrying its last value, got %+v", key, removed)
+	}
+
+	late, err := hub.Subscribe("users.u1.flights.owned.>")
+	if err != nil {
+		t.Fatalf("Subscribe failed: %v", err)
+	}
+	defer late.Stop()
+	select {
+	case flight := <-late.Updates():
+		t.Errorf("expected nothing for a late subscriber, got %+v", flight)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+// TestHub_SubscribeFrom verifies that a resumed subscriber gets every change from the
+// revision asked for, on a watch of its own that ends with it.
+func TestHub_SubscribeFrom(t *testing.T) {
+	kv, cleanup := setupTestKV(t)
+	defer cleanup()
+	ctx := context.Background()
+
+	const pattern = "users.u1.flights.owned.>"
+	for _, ident := range []string{"NZ1", "NZ1", "NZ2"} {
+		data, _ := json.Marshal(nzflights.FlightValue{ElementId: ident, Flight: nzflights.Flight{Ident: ident}})
+		if _, err := kv.Put(ctx, "users.u1.flights.owned."+ident, data); err != nil {
+			t.Fatalf("Put failed: %v", err)
+		}
+	}
+	if err := kv.Delete(ctx, "users.u1.flights.owned.NZ1"); err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+
+	hub := NewHub(kv, PolicyCoalesce, 0)
+	sub, err := hub.SubscribeFrom(pattern, 3)
+	if err != nil {
+		t.Fatalf("SubscribeFrom failed: %v", err)
+	}
+	if flight := receive(t, sub); flight.Revision != 3 || flight.Removed || flight.Value.ElementId != "NZ2" {
+		t.Errorf("expected NZ2 at revision 3, got %+v", flight)
+	}
+	if flight := receive(t, sub); flight.Revision != 4 || !flight.Removed || flight.Key != "users.u1.flights.owned.NZ1" {
+		t.Errorf("expected the removal of NZ1 at revision 4, got %+v", flight)
+	}
+	if n := hub.Subscribers(pattern); n != 0 {
+		t.Errorf("expected the resumed subscriber not to join the shared watch, got %d subscribers", n)
+	}
+
+	sub.Stop()
+	if n := consumerCount(t, kv); n != 0 {
+		t.Errorf("expected the watch to stop with its subscriber, got %d consumers", n)
+	}
+}
+
+// TestHub_ResumesAfterCoalescedBurst verifies that a subscriber that coalesced a burst
+// still gets updates in revision order, so resuming from the last one it saw misses nothing.
+func TestHub_ResumesAfterCoalescedBurst(t *testing.T) {
+	kv, cleanup := setupTestKV(t)
+	defer cleanup()
+	ctx := context.Background()
+
+	const pattern = "users.u1.flights.owned.>"
+	put := func(ident string) uint64 {
+		t.Helper()
+		data, _ := json.Marshal(nzflights.FlightValue{ElementId: ident, Flight: nzflights.Flight{Ident: ident}})
+		rev, err := kv.Put(ctx, "users.u1.flights.owned."+ident, data)
+		if err != nil {
+			t.Fatalf("Put failed: %v", err)
+		}
+		return rev
+	}
+
+	hub := NewHub(kv, PolicyCoalesce, 2)
+	sub, err := hub.Subscribe(pattern)
+	if err != nil {
+		t.Fatalf("Subscribe failed: %v", err)
+	}
+	// The first update is held by the subscriber's pump; the burst behind it fills the
+	// queue while nobody reads, so NZ1's second update coalesces with its first.
+	put("NZ0")
+	time.Sleep(100 * time.Millisecond)
+	put("NZ1")
+	nz2 := put("NZ2")
+	nz1 := put("NZ1")
+	time.Sleep(200 * time.Millisecond)
+
+	if flight := receive(t, sub); flight.Value.ElementId != "NZ0" {
+		t.Fatalf("expected NZ0 first, got %+v", flight)
+	}
+	next := receive(t, sub)
+	if next.Revision != nz2 {
+		t.Errorf("expected NZ2 at revision %d before the coalesced NZ1, got %s at %d", nz2, next.Value.ElementId, next.Revision)
+	}
+
+	// The stream drops here, and the client resumes after the last revision it saw.
+	sub.Stop()
+	resumed, err := hub.SubscribeFrom(pattern, next.Revision+1)
+	if err != nil {
+		t.Fatalf("SubscribeFrom failed: %v", err)
+	}
+	defer resumed.Stop()
+	if flight := receive(t, resumed); flight.Revision != nz1 || flight.Value.ElementId != "NZ1" {
+		t.Errorf("expected NZ1 at revision %d after resuming, got %+v", nz1, flight)
+	}
+}
+
+// TestHub_ResumedSubscriberJoinsSharedWatch verifies that a resumed subscriber moves to
+// the shared watch once it has caught up, without missing or repeating an update.
+func TestHub_ResumedSubscriberJoinsSharedWatch(t *testing.T) {
+	kv, cleanup := setupTestKV(t)
+	defer cleanup()
+	ctx := context.Background()
+
+	const pattern = "users.u1.flights.owned.>"
+	put := func(ident string) uint64 {
+		t.Helper()
+		data, _ := json.Marshal(nzflights.FlightValue{ElementId: ident, Flight: nzflights.Flight{Ident: ident}})
+		rev, err := kv.Put(ctx, "users.u1.flights.owned."+ident, data)
+		if err != nil {
+			t.Fatalf("Put failed: %v", err)
+		}
+		return rev
+	}
+	put("NZ1")
+	nz2 := put("NZ2")
+
+	hub := NewHub(kv, PolicyCoalesce, 0)
+	shared, err := hub.Subscribe(pattern)
+	if err != nil {
+		t.Fatalf("Subscribe failed: %v", err)
+	}
+	defer shared.Stop()
+	receive(t, shared)
+	receive(t, shared)
+
+	resumed, err := hub.SubscribeFrom(pattern, nz2)
+	if err != nil {
+		t.Fatalf("SubscribeFrom failed: %v", err)
+	}
+	if flight := receive(t, resumed); flight.Revision != nz2 {
+		t.Fatalf("expected NZ2 at revision %d after resuming, got %+v", nz2, flight)
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for hub.Subscribers(pattern) != 2 || consumerCount(t, kv) != 1 {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the resumed subscriber on the shared watch, got %d subscribers and %d consumers",
+				hub.Subscribers(pattern), consumerCount(t, kv))
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	nz3 := put("NZ3")
+	for _, sub := range []*Subscription{shared, resumed} {
+		if flight := receive(t, sub); flight.Revision != nz3 {
+			t.Errorf("expected NZ3 at revision %d, got %+v", nz3, flight)
+		}
+	}
+	select {
+	case flight := <-resumed.Updates():
+		t.Errorf("expected nothing more for the resumed subscriber, got %+v", flight)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	resumed.Stop()
+	if n := hub.Subscribers(pattern); n != 1 {
+		t.Errorf("expected 1 subscriber after the resumed one left, got %d", n)
+	}
+}
+
+// TestHub_BoundsSlowSubscribers verifies that a subscriber that stops reading is held to
+// the hub's buffer, and is disconnected under PolicyDisconnect.
+func TestHub_BoundsSlowSubscribers(t *testing.T) {
+	kv, cleanup := setupTestKV(t)
+	defer cleanup()
+	ctx := context.Background()
+
+	const pattern = "users.u1.flights.owned.>"
+	// putAll writes ten distinct flights and waits for the hub to queue them.
+	putAll := func(hub *Hub) {
+		t.Helper()
+		for i := range 10 {
+			ident := fmt.Sprintf("NZ%d", i)
+			data, _ := json.Marshal(nzflights.FlightValue{ElementId: ident, Flight: nzflights.Flight{Ident: ident}})
+			if _, err := kv.Put(ctx, "users.u1.flights.owned."+ident, data); err != nil {
+				t.Fatalf("Put failed: %v", err)
+			}
+		}
+		time.Sleep(200 * time.Millisecond)
+	}
+
+	t.Run("drop oldest", func(t *testing.T) {
+		hub := NewHub(kv, PolicyDropOldest, 2)
+		sub, err := hub.Subscribe(pattern)
+		if err != nil {
+			t.Fatalf("Subscribe failed: %v", err)
+		}
+		defer sub.Stop()
+		putAll(hub)
+
+		var received int
+		for {
+			select {
+			case <-sub.Updates():
+				received++
+				continue
+			case <-time.After(100 * time.Millisecond):
+			}
+			break
+		}
+		// The pump may already hold one update when the rest are queued.
+		if received > 3 || sub.Dropped() == 0 {
+			t.Errorf("expected at most 3 updates and some dropped, got %d received and %d dropped", received, sub.Dropped())
+		}
+	})
+
+	t.Run("disconnect", func(t *testing.T) {
+		hub := NewHub(kv, PolicyDisconnect, 2)
+		sub, err := hub.Subscribe(pattern)
+		if err != nil {
+			t.Fatalf("Subscribe failed: %v", err)
+		}
+		defer sub.Stop()
+		putAll(hub)
+
+		closed := false
+		for !closed {
+			select {
+			case _, ok := <-sub.Updates():
+				closed = !ok
+			case <-time.After(2 * time.Second):
+				t.Fatal("expected Updates to be closed after disconnecting")
+			}
+		}
+		if !errors.Is(sub.Err(), ErrSlowConsumer) {
+			t.Errorf("expected ErrSlowConsumer, got %v", sub.Err())
+		}
+		if n := hub.Subscribers(pattern); n != 0 {
+			t.Errorf("expected the disconnected subscriber to leave the topic, got %d subscribers", n)
+		}
+	})
+}
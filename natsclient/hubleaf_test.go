@@ -0,0 +1,167 @@
+package natsclient_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/arcade55/nzflights-models"
+	"github.com/arcade55/nzflights_webui/keys"
+	"github.com/arcade55/nzflights_webui/natsclient"
+	"github.com/arcade55/nzflights_webui/natsclient/natstest"
+)
+
+// putFlight writes a flight value under key in the hub's flights bucket.
+func putFlight(t *testing.T, hub *natstest.Hub, key, status string) uint64 {
+	t.Helper()
+	data, err := json.Marshal(nzflights.FlightValue{NatsKey: key, Flight: nzflights.Flight{Ident: "NZ1", Status: status}})
+	if err != nil {
+		t.Fatalf("marshal failed: %v", err)
+	}
+	rev, err := hub.Flights.Put(context.Background(), key, data)
+	if err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	return rev
+}
+
+// inMirror reports whether the client's mirror has key at revision rev or later.
+func inMirror(client *natsclient.Client, key string, rev uint64) func() bool {
+	return func() bool {
+		entry, err := client.InMemoryKV.Get(context.Background(), key)
+		return err == nil && entry.Revision() >= rev
+	}
+}
+
+// TestHubLeaf_MirrorAndWatch verifies that hub writes reach the mirror across the
+// JetStream domain and are delivered to watchers from there.
+func TestHubLeaf_MirrorAndWatch(t *testing.T) {
+	hub := natstest.StartHub(t)
+	client := hub.Client(hub.Options())
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	key, _ := keys.OwnedFlight("u1", "NZ1")
+	rev := putFlight(t, hub, key, "Scheduled")
+	natstest.Eventually(t, 5*time.Second, inMirror(client, key, rev), "flight not mirrored")
+
+	result, err := client.Flights.GetFlights(ctx, []string{key})
+	if err != nil {
+		t.Fatalf("GetFlights failed: %v", err)
+	}
+	if flight := result.Found[key]; flight.Source != natsclient.SourceInMemory || flight.Value.Flight.Status != "Scheduled" {
+		t.Errorf("expected the mirrored flight, got %+v", result.Found)
+	}
+
+	pattern, _ := keys.OwnedFlights("u1")
+	sub, err := client.Hub.Subscribe(pattern)
+	if err != nil {
+		t.Fatalf("Subscribe failed: %v", err)
+	}
+	defer sub.Stop()
+
+	statuses := []string{"Scheduled", "Boarding"}
+	putFlight(t, hub, key, "Boarding")
+	for _, want := range statuses {
+		select {
+		case flight := <-sub.Updates():
+			if flight.Value.Flight.Status != want {
+				t.Errorf("expected %s, got %s", want, flight.Value.Flight.Status)
+			}
+		case <-ctx.Done():
+			t.Fatalf("timed out waiting for %s", want)
+		}
+	}
+
+	natstest.Eventually(t, 5*time.Second, func() bool {
+		health := client.Mirror.Health()
+		return !health.CheckedAt.IsZero() && health.MirrorLastSeq == health.SourceLastSeq
+	}, "mirror health never caught up")
+	if health := client.Mirror.Health(); health.Stale {
+		t.Errorf("expected a healthy mirror, got %+v", health)
+	}
+}
+
+// TestHubLeaf_CloudDown verifies the fallback while only the cloud connection is down:
+// the mirror keeps syncing over the leaf link, reads use it, and writes fail fast.
+func TestHubLeaf_CloudDown(t *testing.T) {
+	hub := natstest.StartHub(t)
+	client := hub.Client(hub.Options())
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	key, _ := keys.OwnedFlight("u1", "NZ1")
+	putFlight(t, hub, key, "Scheduled")
+
+	hub.CutCloud()
+	natstest.Eventually(t, 5*time.Second, func() bool {
+		return client.State.State() == natsclient.StateDegraded
+	}, "client never noticed the cloud connection drop")
+
+	rev := putFlight(t, hub, key, "Boarding")
+	natstest.Eventually(t, 5*time.Second, inMirror(client, key, rev), "mirror stopped syncing")
+
+	missing, _ := keys.OwnedFlight("u1", "NZ2")
+	result, err := client.Flights.GetFlights(ctx, []string{key, missing})
+	if err != nil {
+		t.Fatalf("GetFlights failed while degraded: %v", err)
+	}
+	if flight := result.Found[key]; flight.Value.Flight.Status != "Boarding" {
+		t.Errorf("expected the latest mirrored flight, got %+v", result.Found)
+	}
+	if len(result.Missing) != 1 || result.Missing[0] != missing {
+		t.Errorf("expected %s to be missing, got %v", missing, result.Missing)
+	}
+
+	fv := nzflights.FlightValue{ElementId: "NZ3", Flight: nzflights.Flight{Ident: "NZ3"}}
+	if _, err := client.Flights.Track(ctx, "u1", "NZ3", fv); !errors.Is(err, natsclient.ErrCloudUnavailable) {
+		t.Errorf("expected Track to fail with ErrCloudUnavailable, got %v", err)
+	}
+
+	hub.RestoreCloud()
+	natstest.Eventually(t, 10*time.Second, func() bool {
+		return client.State.State() == natsclient.StateConnected
+	}, "client never reconnected")
+	if _, err := client.Flights.Track(ctx, "u1", "NZ3", fv); err != nil {
+		t.Errorf("Track failed after reconnecting: %v", err)
+	}
+}
+
+// TestHubLeaf_HubDown verifies that the mirror keeps serving the last known flights
+// while the hub is unreachable, and that the client recovers when it returns.
+func TestHubLeaf_HubDown(t *testing.T) {
+	hub := natstest.StartHub(t)
+	client := hub.Client(hub.Options())
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+
+	key, _ := keys.OwnedFlight("u1", "NZ1")
+	rev := putFlight(t, hub, key, "Scheduled")
+	natstest.Eventually(t, 5*time.Second, inMirror(client, key, rev), "flight not mirrored")
+
+	hub.Shutdown()
+	natstest.Eventually(t, 5*time.Second, func() bool {
+		return client.State.State() == natsclient.StateOffline
+	}, "client never noticed the hub going away")
+
+	missing, _ := keys.OwnedFlight("u1", "NZ2")
+	result, err := client.Flights.GetFlights(ctx, []string{key, missing})
+	if !errors.Is(err, natsclient.ErrCloudUnavailable) {
+		t.Errorf("expected ErrCloudUnavailable for the uncached key, got %v", err)
+	}
+	if _, ok := result.Found[key]; !ok {
+		t.Errorf("expected %s to be served from the mirror", key)
+	}
+	if _, ok := result.Failed[missing]; !ok {
+		t.Errorf("expected %s to fail while offline, got %+v", missing, result)
+	}
+
+	hub.Restart()
+	natstest.Eventually(t, 15*time.Second, func() bool {
+		return client.State.State() == natsclient.StateConnected
+	}, "client never recovered")
+	rev = putFlight(t, hub, key, "Departed")
+	natstest.Eventually(t, 5*time.Second, inMirror(client, key, rev), "mirror did not resume")
+}
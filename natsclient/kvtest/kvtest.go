@@ -0,0 +1,51 @@
+// Package kvtest creates throwaway Key-Value buckets for tests, each on a NATS server
+// of its own that is shut down when the test ends.
+package kvtest
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats-server/v2/server"
+	"github.com/nats-io/nats-server/v2/test"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+// History is the number of revisions per key that NewHistoryKV keeps, as the
+// flights bucket must for undo and resumed streams.
+const History = 10
+
+// NewKV creates a bucket with cfg on a new server. A bucket name is made up when
+// cfg has none.
+func NewKV(t testing.TB, cfg jetstream.KeyValueConfig) jetstream.KeyValue {
+	t.Helper()
+	s := test.RunServer(&server.Options{Port: -1, JetStream: true, StoreDir: t.TempDir()})
+	t.Cleanup(s.Shutdown)
+	nc, err := nats.Connect(s.ClientURL())
+	if err != nil {
+		t.Fatalf("NATS connect failed: %v", err)
+	}
+	t.Cleanup(nc.Close)
+	js, err := jetstream.New(nc)
+	if err != nil {
+		t.Fatalf("JetStream context failed: %v", err)
+	}
+
+	if cfg.Bucket == "" {
+		cfg.Bucket = fmt.Sprintf("flights_%d", time.Now().UnixNano())
+	}
+	kv, err := js.CreateKeyValue(context.Background(), cfg)
+	if err != nil {
+		t.Fatalf("KV creation failed: %v", err)
+	}
+	return kv
+}
+
+// NewHistoryKV creates a bucket that keeps History revisions per key.
+func NewHistoryKV(t testing.TB) jetstream.KeyValue {
+	t.Helper()
+	return NewKV(t, jetstream.KeyValueConfig{History: History})
+}
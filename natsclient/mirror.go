@@ -0,0 +1,164 @@
+package natsclient
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/arcade55/logging"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+// MirrorHealth describes how closely the mirror follows the cloud flights stream.
+type MirrorHealth struct {
+	// SourceLastSeq is the last sequence in the cloud flights stream.
+	SourceLastSeq uint64 `json:"sourceLastSeq"`
+	// MirrorLastSeq is the last sequence the mirror has stored. A mirror keeps the
+	// source's sequence numbers, so the two are equal once it has caught up.
+	MirrorLastSeq uint64 `json:"mirrorLastSeq"`
+	// Lag is how many messages the mirror is behind the source.
+	Lag uint64 `json:"lag"`
+	// Active is how long ago the mirror last heard from the source, or -1 if it never has.
+	Active time.Duration `json:"active"`
+	// Stale is set when Lag or Active is over its threshold, or the last check failed.
+	Stale bool `json:"stale"`
+	// CheckedAt is when the health was last checked. It is zero before the first check.
+	CheckedAt time.Time `json:"checkedAt"`
+	// Err is the reason the last check failed, if it did.
+	Err error `json:"-"`
+}
+
+// MirrorMonitor periodically compares the mirror with the cloud stream it mirrors.
+type MirrorMonitor struct {
+	mirror  kvStream
+	source  kvStream
+	maxLag  uint64
+	maxIdle time.Duration
+
+	mu     sync.Mutex
+	health MirrorHealth
+	done   chan struct{}
+	stop   sync.Once
+}
+
+// kvStream is the stream behind a KV bucket. The monitor looks the stream up afresh on
+// every check rather than asking the bucket's KeyValue handle for its status, because
+// that updates state the handle shares with concurrent reads.
+type kvStream struct {
+	js     jetstream.JetStream
+	bucket string
+}
+
+// info returns the current info of the stream.
+func (s kvStream) info(ctx context.Context) (*jetstream.StreamInfo, error) {
+	stream, err := s.js.Stream(ctx, "KV_"+s.bucket)
+	if err != nil {
+		return nil, err
+	}
+	return stream.CachedInfo(), nil
+}
+
+// newMirrorMonitor returns a monitor for mirror, which mirrors source. Nothing is
+// checked until Check or run is called.
+func newMirrorMonitor(mirror, source kvStream, opts Options) *MirrorMonitor {
+	opts = opts.withDefaults()
+	return &MirrorMonitor{
+		mirror:  mirror,
+		source:  source,
+		maxLag:  *opts.MirrorMaxLag,
+		maxIdle: opts.MirrorMaxIdle,
+		done:    make(chan struct{}),
+	}
+}
+
+// Health returns the result of the last check.
+func (m *MirrorMonitor) Health() MirrorHealth {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.health
+}
+
+// stale reports whether the last check found the mirror too far behind.
+// A mirror that has not been checked yet is not stale.
+func (m *MirrorMonitor) stale() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.health.Stale
+}
+
+// Check compares the mirror with its source now and records the result.
+func (m *MirrorMonitor) Check(ctx context.Context) MirrorHealth {
+	health := MirrorHealth{CheckedAt: time.Now()}
+
+	mirror, err := m.mirror.info(ctx)
+	if err != nil {
+		health.Err = fmt.Errorf("mirror: %w", err)
+	}
+	source, err := m.source.info(ctx)
+	if err != nil {
+		health.Err = errors.Join(health.Err, fmt.Errorf("source: %w", err))
+	}
+
+	if health.Err != nil {
+		health.Stale = true
+	} else {
+		health.SourceLastSeq = source.State.LastSeq
+		health.MirrorLastSeq = mirror.State.LastSeq
+		if health.SourceLastSeq > health.MirrorLastSeq {
+			health.Lag = health.SourceLastSeq - health.MirrorLastSeq
+		}
+		health.Active = -1
+		if mirror.Mirror != nil {
+			// The mirror's own count only updates while it is in contact with the source,
+			// so trust whichever lag is larger.
+			health.Lag = max(health.Lag, mirror.Mirror.Lag)
+			health.Active = mirror.Mirror.Active
+		}
+		health.Stale = health.Lag > m.maxLag ||
+			(m.maxIdle > 0 && (health.Active < 0 || health.Active > m.maxIdle))
+	}
+
+	m.mu.Lock()
+	m.health = health
+	m.mu.Unlock()
+	return health
+}
+
+// run checks the mirror every interval until the monitor is closed, logging when it
+// becomes stale and when it recovers.
+func (m *MirrorMonitor) run(ctx context.Context, logger *logging.Logger, interval time.Duration) {
+	log := logger.WithContext(ctx)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	wasStale := false
+	for {
+		checkCtx, cancel := context.WithTimeout(context.Background(), interval)
+		health := m.Check(checkCtx)
+		cancel()
+
+		switch {
+		case health.Stale && !wasStale && health.Err != nil:
+			log.Error(health.Err)
+			log.Warn("⚠️ Could not check the mirror, treating it as stale.")
+		case health.Stale && !wasStale:
+			log.Warn(fmt.Sprintf("⚠️ Mirror is stale: %d messages behind, last active %v ago.", health.Lag, health.Active))
+		case !health.Stale && wasStale:
+			log.Info("✅ Mirror has caught up with the cloud.")
+		}
+		wasStale = health.Stale
+
+		select {
+		case <-ticker.C:
+		case <-m.done:
+			return
+		}
+	}
+}
+
+// close stops the periodic checks.
+func (m *MirrorMonitor) close() {
+	m.stop.Do(func() { close(m.done) })
+}
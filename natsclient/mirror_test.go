@@ -0,0 +1,136 @@
+package natsclient
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats-server/v2/server"
+	"github.com/nats-io/nats-server/v2/test"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+// setupMirroredKV creates a bucket and a mirror of it on a throwaway NATS server.
+func setupMirroredKV(t *testing.T) (js jetstream.JetStream, source, mirror jetstream.KeyValue) {
+	t.Helper()
+	s := test.RunServer(&server.Options{Port: -1, JetStream: true, StoreDir: t.TempDir()})
+	t.Cleanup(s.Shutdown)
+	nc, err := nats.Connect(s.ClientURL())
+	if err != nil {
+		t.Fatalf("NATS connect failed: %v", err)
+	}
+	t.Cleanup(nc.Close)
+	js, err = jetstream.New(nc)
+	if err != nil {
+		t.Fatalf("JetStream context failed: %v", err)
+	}
+
+	ctx := context.Background()
+	bucket := fmt.Sprintf("flights_%d", time.Now().UnixNano())
+	source, err = js.CreateKeyValue(ctx, jetstream.KeyValueConfig{Bucket: bucket})
+	if err != nil {
+		t.Fatalf("KV creation failed: %v", err)
+	}
+	mirror, err = js.CreateKeyValue(ctx, jetstream.KeyValueConfig{
+		Bucket: bucket + "_mirror",
+		Mirror: &jetstream.StreamSource{Name: bucket},
+	})
+	if err != nil {
+		t.Fatalf("mirror creation failed: %v", err)
+	}
+	return js, source, mirror
+}
+
+// TestMirrorMonitor_Check verifies that a mirror in sync is healthy and one that is behind is stale.
+func TestMirrorMonitor_Check(t *testing.T) {
+	js, source, mirror := setupMirroredKV(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	for i := range 3 {
+		if _, err := source.Put(ctx, fmt.Sprintf("flights.master.NZ%d", i), []byte("{}")); err != nil {
+			t.Fatalf("Put failed: %v", err)
+		}
+	}
+
+	monitor := newMirrorMonitor(kvStream{js, mirror.Bucket()}, kvStream{js, source.Bucket()}, Options{MirrorMaxLag: MaxLag(1), MirrorMaxIdle: time.Minute})
+	var health MirrorHealth
+	for {
+		health = monitor.Check(ctx)
+		if health.Err != nil {
+			t.Fatalf("Check failed: %v", health.Err)
+		}
+		if health.MirrorLastSeq == 3 || ctx.Err() != nil {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if health.Stale || health.SourceLastSeq != 3 || health.Lag != 0 {
+		t.Errorf("expected an in-sync mirror, got %+v", health)
+	}
+	if monitor.stale() {
+		t.Error("expected the recorded health to be fresh")
+	}
+
+	// A bucket that is not a mirror never hears from the source, so it falls behind.
+	otherJS, unrelated, _ := setupMirroredKV(t)
+	monitor = newMirrorMonitor(kvStream{otherJS, unrelated.Bucket()}, kvStream{js, source.Bucket()}, Options{MirrorMaxLag: MaxLag(1), MirrorMaxIdle: time.Minute})
+	health = monitor.Check(ctx)
+	if !health.Stale || health.Lag != 3 || health.Active != -1 {
+		t.Errorf("expected a stale mirror 3 messages behind, got %+v", health)
+	}
+}
+
+// TestNewMirrorMonitor_MaxLag verifies that a zero lag allowance is kept and an unset one takes the default.
+func TestNewMirrorMonitor_MaxLag(t *testing.T) {
+	if monitor := newMirrorMonitor(kvStream{}, kvStream{}, Options{MirrorMaxLag: MaxLag(0)}); monitor.maxLag != 0 {
+		t.Errorf("expected a max lag of 0, got %d", monitor.maxLag)
+	}
+	if monitor := newMirrorMonitor(kvStream{}, kvStream{}, Options{}); monitor.maxLag != defaultMirrorMaxLag {
+		t.Errorf("expected the default max lag, got %d", monitor.maxLag)
+	}
+}
+
+// TestGetMultiple_SkipsStaleMirror verifies that reads go to the cloud while the mirror is stale.
+func TestGetMultiple_SkipsStaleMirror(t *testing.T) {
+	memJS, memKV, _ := setupMirroredKV(t)
+	cloudJS, cloudKV, _ := setupMirroredKV(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	const key = "users.u1.flights.owned.NZ1"
+	if _, err := memKV.Put(ctx, key, []byte(`{"status":"old"}`)); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	for range 3 {
+		if _, err := cloudKV.Put(ctx, key, []byte(`{"status":"new"}`)); err != nil {
+			t.Fatalf("Put failed: %v", err)
+		}
+	}
+
+	opts := Options{MirrorMaxLag: MaxLag(1), SkipStaleMirror: true}
+	store := newFlightStore(memKV, cloudKV, opts)
+	store.mirror = newMirrorMonitor(kvStream{memJS, memKV.Bucket()}, kvStream{cloudJS, cloudKV.Bucket()}, opts)
+	if health := store.mirror.Check(ctx); !health.Stale {
+		t.Fatalf("expected the mirror to be stale, got %+v", health)
+	}
+
+	result, err := store.GetMultiple(ctx, []string{key})
+	if err != nil {
+		t.Fatalf("GetMultiple failed: %v", err)
+	}
+	if entry := result.Found[key]; entry.Source != SourceCloud || string(entry.Value()) != `{"status":"new"}` {
+		t.Errorf("expected the cloud value, got %+v", result.Found)
+	}
+
+	store.opts.SkipStaleMirror = false
+	result, err = store.GetMultiple(ctx, []string{key})
+	if err != nil {
+		t.Fatalf("GetMultiple failed: %v", err)
+	}
+	if entry := result.Found[key]; entry.Source != SourceInMemory {
+		t.Errorf("expected the mirror to be used when skipping is off, got %+v", result.Found)
+	}
+}
@@ -2,8 +2,10 @@ package natsclient
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"net/url"
+	"os"
 	"time"
 
 	"github.com/arcade55/logging"
@@ -18,8 +20,21 @@ type Client struct {
 	Flights FlightStore
 	// InMemoryKV provides direct access to the in-memory mirror for monitoring.
 	InMemoryKV jetstream.KeyValue
-	// Publish a message to trigger an API fetch for a flight.
+	// Hub shares watches on the in-memory mirror between all live subscribers.
+	Hub *Hub
+	// State reports whether the cloud connection and leaf link are up.
+	// In offline mode the local bucket is the source of truth, so it always reports StateConnected.
+	State *StateTracker
+	// Mirror reports how far the in-memory mirror is behind the cloud. It is nil in offline mode,
+	// where there is no mirror.
+	Mirror *MirrorMonitor
+	// Publish a message to trigger an API fetch for a flight, without waiting for a reply.
+	// Adding a flight uses Fetcher instead, to tell the user how the fetch went.
 	TriggerAPIFetch func(flightID string) error
+	// Fetcher requests an API fetch for a flight and waits for the result.
+	Fetcher *Fetcher
+	// Local is the connection to the embedded server, which carries API fetches in offline mode.
+	Local *nats.Conn
 
 	// A function to gracefully clean up connections and the server.
 	Shutdown func()
@@ -28,41 +43,57 @@ type Client struct {
 const SynadiaCloudURL = "tls://connect.ngs.global:4222"
 
 // New creates and configures the entire NATS stack for the application.
-func New(ctx context.Context, logger *logging.Logger, cloudCreds []byte) (*Client, error) {
+func New(ctx context.Context, logger *logging.Logger, opts Options) (*Client, error) {
 	log := logger.WithContext(ctx)
+	opts = opts.withDefaults()
 
-	// --- 1. Set up and run the Embedded Leaf Server ---
-	embeddedNC, embeddedServer, err := runEmbeddedServer(true, true)
-	if err != nil {
-		return nil, fmt.Errorf("%w: %v", ErrEmbeddedServerFailed, err)
-	}
-	log.Info("✅ Embedded NATS leaf server started.")
-
-	embeddedJS, err := jetstream.New(embeddedNC)
-	if err != nil {
-		embeddedServer.Shutdown()
-		return nil, fmt.Errorf("%w on embedded server: %v", ErrJetStreamContextFailed, err)
+	if opts.Offline {
+		return newOffline(ctx, logger, opts)
 	}
 
-	// --- 2. Create the In-Memory Mirrored Key-Value Store ---
+	// --- 1. Run the Embedded Leaf Server with the Mirrored Key-Value Store ---
+	// The mirror lives in memory unless a StoreDir is set, in which case it survives
+	// restarts and serves the last known state while it catches up with the cloud.
 	mirrorConfig := jetstream.KeyValueConfig{
-		Bucket:  "inMemoryFlights",
+		Bucket:  opts.MirrorBucket,
 		Storage: jetstream.MemoryStorage,
 		Mirror: &jetstream.StreamSource{
-			Name:   "flights",
-			Domain: "ngs", // Updated domain
+			Name:   opts.FlightsBucket,
+			Domain: opts.MirrorDomain,
 		},
 	}
-	inMemoryKV, err := embeddedJS.CreateOrUpdateKeyValue(ctx, mirrorConfig)
+	embeddedNC, embeddedServer, inMemoryKV, err := startEmbedded(ctx, logger, opts, true, mirrorConfig, ErrKVStoreMirrorFailed)
 	if err != nil {
-		embeddedServer.Shutdown()
-		return nil, fmt.Errorf("%w: %v", ErrKVStoreMirrorFailed, err)
+		return nil, err
 	}
-	log.Info("✅ In-memory KV store configured to mirror 'flights'.")
+	log.Info("✅ Embedded NATS leaf server started.")
+	log.Info(fmt.Sprintf("✅ In-memory KV store configured to mirror '%s'.", opts.FlightsBucket))
 
-	// --- 3. Connect to the Cloud NATS Server ---
-	cloudNC, err := nats.Connect(SynadiaCloudURL, nats.Name("nzflights_webui"), nats.UserCredentialBytes(cloudCreds))
+	// --- 2. Connect to the Cloud NATS Server ---
+	// The connection retries forever, and the tracker follows it so reads can fall
+	// back to the mirror while it is down.
+	tracker := newStateTracker()
+	cloudOpts := []nats.Option{
+		nats.Name(opts.ClientName),
+		nats.MaxReconnects(-1),
+		nats.DisconnectErrHandler(func(_ *nats.Conn, err error) {
+			log.Warn(fmt.Sprintf("⚠️ Disconnected from cloud NATS server: %v", err))
+			tracker.setCloud(false)
+		}),
+		nats.ReconnectHandler(func(*nats.Conn) {
+			log.Info("✅ Reconnected to cloud NATS server.")
+			tracker.setCloud(true)
+		}),
+		nats.ClosedHandler(func(*nats.Conn) {
+			tracker.setCloud(false)
+		}),
+	}
+	if !opts.NoAuth {
+		cloudOpts = append(cloudOpts, nats.UserCredentialBytes(opts.CloudCreds))
+	}
+	cloudNC, err := nats.Connect(opts.CloudURL, cloudOpts...)
 	if err != nil {
+		embeddedNC.Close()
 		embeddedServer.Shutdown()
 		return nil, fmt.Errorf("%w: %v", ErrCloudConnectionFailed, err)
 	}
@@ -71,32 +102,65 @@ func New(ctx context.Context, logger *logging.Logger, cloudCreds []byte) (*Clien
 	cloudJS, err := jetstream.New(cloudNC)
 	if err != nil {
 		cloudNC.Close()
+		embeddedNC.Close()
 		embeddedServer.Shutdown()
 		return nil, fmt.Errorf("%w on cloud server: %v", ErrJetStreamContextFailed, err)
 	}
 
-	// --- 4. Get a handle to the actual Cloud Key-Value Store ---
-	cloudKV, err := cloudJS.KeyValue(ctx, "flights")
+	// --- 3. Get a handle to the actual Cloud Key-Value Store ---
+	cloudKV, err := cloudJS.KeyValue(ctx, opts.FlightsBucket)
 	if err != nil {
 		cloudNC.Close()
+		embeddedNC.Close()
 		embeddedServer.Shutdown()
 		return nil, fmt.Errorf("%w: %v", ErrKVStoreBindFailed, err)
 	}
-	log.Info("✅ Bound to cloud 'flights' KV store.")
+	log.Info(fmt.Sprintf("✅ Bound to cloud '%s' KV store.", opts.FlightsBucket))
+	checkFlightsBucket(ctx, logger, cloudKV)
+
+	// --- 4. Follow the leaf link and the mirror it keeps in sync ---
+	go tracker.watchLeaf(embeddedServer)
+	embeddedJS, err := jetstream.New(embeddedNC)
+	if err != nil {
+		cloudNC.Close()
+		embeddedNC.Close()
+		embeddedServer.Shutdown()
+		return nil, fmt.Errorf("%w on embedded server: %v", ErrJetStreamContextFailed, err)
+	}
+	mirror := newMirrorMonitor(
+		kvStream{js: embeddedJS, bucket: opts.MirrorBucket},
+		kvStream{js: cloudJS, bucket: opts.FlightsBucket},
+		opts,
+	)
+	go mirror.run(ctx, logger, opts.MirrorCheckInterval)
 
 	// --- 5. Construct the final Client object ---
+	store := newFlightStore(inMemoryKV, cloudKV, opts)
+	store.state = tracker
+	store.mirror = mirror
 	client := &Client{
 		// HERE is where the 'unused' code is now being used.
-		Flights:    newFlightStore(inMemoryKV, cloudKV),
+		Flights:    store,
 		InMemoryKV: inMemoryKV,
+		Hub:        NewHub(inMemoryKV, opts.SlowConsumerPolicy, opts.WatchBufferSize),
+		State:      tracker,
+		Mirror:     mirror,
 
 		TriggerAPIFetch: func(flightID string) error {
-			subject := fmt.Sprintf("api.flightaware.fetch.%s", flightID)
+			subject, err := FetchSubject(flightID)
+			if err != nil {
+				return err
+			}
 			return cloudNC.Publish(subject, nil)
 		},
+		Fetcher: newFetcher(cloudNC, opts),
+		Local:   embeddedNC,
 		Shutdown: func() {
 			log.Info("Shutting down NATS client and server...")
+			tracker.close()
+			mirror.close()
 			cloudNC.Close()
+			embeddedNC.Close()
 			embeddedServer.Shutdown()
 			log.Info("Shutdown complete.")
 		},
@@ -105,23 +169,128 @@ func New(ctx context.Context, logger *logging.Logger, cloudCreds []byte) (*Clien
 	return client, nil
 }
 
-// runEmbeddedServer starts an embedded NATS server configured as a leaf node.
-func runEmbeddedServer(inProcess bool, enableLogging bool) (*nats.Conn, *server.Server, error) {
-	leafURL, err := url.Parse("nats-leaf://connect.ngs.global")
+// newOffline builds the NATS stack entirely on the embedded server.
+func newOffline(ctx context.Context, logger *logging.Logger, opts Options) (*Client, error) {
+	log := logger.WithContext(ctx)
+
+	// --- 1. Run the Embedded Server without a leaf remote, hosting the 'flights'
+	// bucket locally in place of the cloud store ---
+	embeddedNC, embeddedServer, localKV, err := startEmbedded(ctx, logger, opts, false, jetstream.KeyValueConfig{
+		Bucket:         opts.FlightsBucket,
+		Storage:        jetstream.MemoryStorage,
+		History:        offlineHistory,
+		LimitMarkerTTL: limitMarkerTTL,
+	}, ErrKVStoreBindFailed)
 	if err != nil {
-		return nil, nil, err
+		return nil, err
 	}
+	log.Info("✅ Embedded NATS server started in offline mode.")
+	log.Info(fmt.Sprintf("✅ Local '%s' KV store created.", opts.FlightsBucket))
+
+	if opts.SeedFile != "" {
+		count, err := seedFromFile(ctx, localKV, opts.SeedFile)
+		if err != nil {
+			embeddedNC.Close()
+			embeddedServer.Shutdown()
+			return nil, fmt.Errorf("%w: %v", ErrSeedFailed, err)
+		}
+		log.Info(fmt.Sprintf("✅ Seeded %d flights from %s.", count, opts.SeedFile))
+	}
+
+	// --- 2. The local bucket already lives on the embedded server, so it
+	// serves as both the in-memory tier and the stand-in for the cloud tier.
+	client := &Client{
+		Flights:    newFlightStore(localKV, localKV, opts),
+		InMemoryKV: localKV,
+		Hub:        NewHub(localKV, opts.SlowConsumerPolicy, opts.WatchBufferSize),
+		State:      newStateTracker(),
+
+		TriggerAPIFetch: func(flightID string) error {
+			subject, err := FetchSubject(flightID)
+			if err != nil {
+				return err
+			}
+			return embeddedNC.Publish(subject, nil)
+		},
+		Fetcher: newFetcher(embeddedNC, opts),
+		Local:   embeddedNC,
+		Shutdown: func() {
+			log.Info("Shutting down NATS client and server...")
+			embeddedNC.Close()
+			embeddedServer.Shutdown()
+			log.Info("Shutdown complete.")
+		},
+	}
+
+	return client, nil
+}
+
+// offlineHistory is how many revisions per key the local 'flights' bucket keeps
+// in offline mode, enough for Undo to find the value a flight had before.
+const offlineHistory = 10
+
+// limitMarkerTTL is how long the local 'flights' bucket keeps the marker left when a
+// key's TTL runs out, so watchers see expired shares go.
+const limitMarkerTTL = time.Minute
+
+// checkFlightsBucket warns when kv lacks a setting the store relies on. Undo restores
+// the revision before a delete, so it needs more than one revision per key, and shares
+// are written with a TTL, which needs LimitMarkerTTL.
+func checkFlightsBucket(ctx context.Context, logger *logging.Logger, kv jetstream.KeyValue) {
+	log := logger.WithContext(ctx)
+	status, err := kv.Status(ctx)
+	if err != nil {
+		log.Warn(fmt.Sprintf("⚠️ Could not read the settings of the '%s' KV store: %v", kv.Bucket(), err))
+		return
+	}
+	if status.History() < 2 {
+		log.Warn(fmt.Sprintf("⚠️ The '%s' KV store keeps %d revision per key; Undo needs at least 2 and will fail.", kv.Bucket(), status.History()))
+	}
+	if status.LimitMarkerTTL() == 0 {
+		log.Warn(fmt.Sprintf("⚠️ The '%s' KV store has no LimitMarkerTTL; sharing needs per-key TTLs and will fail.", kv.Bucket()))
+	}
+}
+
+// seedFromFile puts every key -> value pair from a JSON fixture file into kv.
+// It returns the number of entries written.
+func seedFromFile(ctx context.Context, kv jetstream.KeyValue, path string) (int, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+
+	var entries map[string]json.RawMessage
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return 0, fmt.Errorf("failed to unmarshal %s: %w", path, err)
+	}
+
+	for key, value := range entries {
+		if _, err := kv.Put(ctx, key, value); err != nil {
+			return 0, fmt.Errorf("failed to put %s: %w", key, err)
+		}
+	}
+	return len(entries), nil
+}
+
+// runEmbeddedServer starts an embedded NATS server, configured as a leaf node
+// of the cloud server when withLeafRemote is set.
+func runEmbeddedServer(clientOpts Options, inProcess bool, enableLogging bool, withLeafRemote bool) (*nats.Conn, *server.Server, error) {
 	opts := &server.Options{
-		ServerName: "FlightApp_LeafNode",
-		StoreDir:   "",
+		ServerName: clientOpts.ServerName,
+		StoreDir:   clientOpts.StoreDir,
 		DontListen: inProcess,
 		JetStream:  true,
-		LeafNode: server.LeafNodeOpts{
-			Remotes: []*server.RemoteLeafOpts{{
-				URLs:        []*url.URL{leafURL},
-				Credentials: "./natsclient/leafnode.cred",
-			}},
-		},
+	}
+	if withLeafRemote {
+		leafURL, err := url.Parse(clientOpts.LeafURL)
+		if err != nil {
+			return nil, nil, err
+		}
+		remote := &server.RemoteLeafOpts{URLs: []*url.URL{leafURL}}
+		if !clientOpts.NoAuth {
+			remote.Credentials = clientOpts.LeafCredsFile
+		}
+		opts.LeafNode = server.LeafNodeOpts{Remotes: []*server.RemoteLeafOpts{remote}}
 	}
 	ns, err := server.NewServer(opts)
 	if err != nil {
@@ -134,11 +303,11 @@ func runEmbeddedServer(inProcess bool, enableLogging bool) (*nats.Conn, *server.
 	if !ns.ReadyForConnections(5 * time.Second) {
 		return nil, nil, fmt.Errorf("embedded server not ready for connections")
 	}
-	clientOpts := []nats.Option{}
+	connectOpts := []nats.Option{}
 	if inProcess {
-		clientOpts = append(clientOpts, nats.InProcessServer(ns))
+		connectOpts = append(connectOpts, nats.InProcessServer(ns))
 	}
-	nc, err := nats.Connect(nats.DefaultURL, clientOpts...)
+	nc, err := nats.Connect(nats.DefaultURL, connectOpts...)
 	if err != nil {
 		return nil, nil, err
 	}
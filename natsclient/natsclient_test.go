@@ -0,0 +1,77 @@
+package natsclient
+
+import (
+	"context"
+	"testing"
+
+	"github.com/arcade55/logging"
+	"github.com/arcade55/nzflights-models"
+)
+
+// newTestLogger returns a quiet logger for constructing clients in tests.
+func newTestLogger(t *testing.T) *logging.Logger {
+	t.Helper()
+	logger, _, err := logging.Init(context.Background(), logging.Config{
+		Format: logging.FormatPretty,
+		Level:  logging.LevelInfo,
+	})
+	if err != nil {
+		t.Fatalf("logger init failed: %v", err)
+	}
+	return logger
+}
+
+// TestNew_Offline verifies that offline mode serves seeded flights without any cloud connection.
+func TestNew_Offline(t *testing.T) {
+	ctx := context.Background()
+
+	client, err := New(ctx, newTestLogger(t), Options{Offline: true, SeedFile: "testdata/seed_flights.json"})
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	defer client.Shutdown()
+
+	const key = "flights.master.ANZ123.2025-09-15.0900.NZAA.NZWN"
+
+	if _, err := client.InMemoryKV.Get(ctx, key); err != nil {
+		t.Fatalf("seeded key %s not found: %v", key, err)
+	}
+
+	result, err := client.Flights.GetMultiple(ctx, []string{key, "flights.master.missing"})
+	if err != nil {
+		t.Fatalf("GetMultiple failed: %v", err)
+	}
+	if _, ok := result.Found[key]; !ok || len(result.Found) != 1 {
+		t.Errorf("expected only %s to be found, got %d entries", key, len(result.Found))
+	}
+	if len(result.Missing) != 1 || result.Missing[0] != "flights.master.missing" {
+		t.Errorf("expected the unknown key to be missing, got %v", result.Missing)
+	}
+
+	if err := client.TriggerAPIFetch("NZ123"); err != nil {
+		t.Errorf("TriggerAPIFetch failed in offline mode: %v", err)
+	}
+}
+
+// TestNew_OfflineUndo verifies that the offline bucket keeps the history Undo restores from.
+func TestNew_OfflineUndo(t *testing.T) {
+	ctx := context.Background()
+
+	client, err := New(ctx, newTestLogger(t), Options{Offline: true})
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	defer client.Shutdown()
+
+	fv := nzflights.FlightValue{ElementId: "NZ1", Flight: nzflights.Flight{Ident: "NZ1", Status: "Boarding"}}
+	rev, err := client.Flights.Track(ctx, "u1", "NZ1", fv)
+	if err != nil {
+		t.Fatalf("Track failed: %v", err)
+	}
+	if err := client.Flights.Untrack(ctx, "u1", "NZ1", rev); err != nil {
+		t.Fatalf("Untrack failed: %v", err)
+	}
+	if _, err := client.Flights.RestoreUserFlight(ctx, "u1", "NZ1", rev); err != nil {
+		t.Errorf("RestoreUserFlight failed in offline mode: %v", err)
+	}
+}
@@ -0,0 +1,186 @@
+// Package natstest runs a local stand-in for the cloud NATS deployment so natsclient
+// can be tested end to end without network access or credentials.
+//
+// A Hub is a NATS server with JetStream in its own domain that accepts leaf node
+// connections and hosts the flights bucket. Clients built by Hub.Client run the real
+// natsclient.New against it: the embedded server joins the hub as a leaf node and
+// mirrors the bucket across the domain, exactly as it does with Synadia Cloud.
+package natstest
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/arcade55/logging"
+	"github.com/arcade55/nzflights_webui/natsclient"
+	"github.com/nats-io/nats-server/v2/server"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+// Domain is the JetStream domain of every Hub.
+const Domain = "hub"
+
+// clients numbers the embedded servers started against hubs, so each has a unique name.
+var clients atomic.Int64
+
+// Hub is a local stand-in for the cloud NATS server.
+type Hub struct {
+	t      testing.TB
+	opts   *server.Options
+	cloud  *proxy
+	Server *server.Server
+	// Conn is a connection to the hub for driving tests.
+	Conn *nats.Conn
+	// Flights is the hub's flights bucket, which clients mirror.
+	Flights jetstream.KeyValue
+}
+
+// StartHub starts a hub with an empty flights bucket. It is shut down when the test ends.
+func StartHub(t testing.TB) *Hub {
+	t.Helper()
+	h := &Hub{
+		t: t,
+		opts: &server.Options{
+			ServerName:      fmt.Sprintf("hub-%d", time.Now().UnixNano()),
+			Host:            "127.0.0.1",
+			Port:            -1,
+			JetStream:       true,
+			JetStreamDomain: Domain,
+			StoreDir:        t.TempDir(),
+			NoLog:           true,
+			NoSigs:          true,
+			LeafNode:        server.LeafNodeOpts{Host: "127.0.0.1", Port: -1},
+		},
+	}
+	h.start()
+	t.Cleanup(h.Shutdown)
+
+	// Cloud connections go through a proxy so tests can cut them without the leaf link.
+	var err error
+	h.cloud, err = newProxy(fmt.Sprintf("127.0.0.1:%d", h.opts.Port))
+	if err != nil {
+		t.Fatalf("cloud proxy failed: %v", err)
+	}
+	t.Cleanup(h.cloud.close)
+
+	js, err := jetstream.New(h.Conn)
+	if err != nil {
+		t.Fatalf("hub JetStream context failed: %v", err)
+	}
+	h.Flights, err = js.CreateKeyValue(context.Background(), jetstream.KeyValueConfig{Bucket: "flights", History: 10, LimitMarkerTTL: time.Minute})
+	if err != nil {
+		t.Fatalf("hub flights bucket failed: %v", err)
+	}
+	return h
+}
+
+// start runs the server on h.opts and connects to it.
+func (h *Hub) start() {
+	h.t.Helper()
+	ns, err := server.NewServer(h.opts)
+	if err != nil {
+		h.t.Fatalf("hub server failed: %v", err)
+	}
+	go ns.Start()
+	if !ns.ReadyForConnections(5 * time.Second) {
+		h.t.Fatal("hub server not ready for connections")
+	}
+	h.Server = ns
+
+	h.Conn, err = nats.Connect(ns.ClientURL(), nats.MaxReconnects(-1))
+	if err != nil {
+		h.t.Fatalf("hub connect failed: %v", err)
+	}
+	// The server writes the ports it picked back into h.opts, so a restart reuses
+	// them and clients can reconnect.
+}
+
+// Shutdown stops the hub. Clients lose both their cloud connection and their leaf link.
+func (h *Hub) Shutdown() {
+	if h.Conn != nil {
+		h.Conn.Close()
+	}
+	h.Server.Shutdown()
+	h.Server.WaitForShutdown()
+}
+
+// Restart starts the hub again on the same ports and store after Shutdown.
+func (h *Hub) Restart() {
+	h.t.Helper()
+	h.start()
+	js, err := jetstream.New(h.Conn)
+	if err != nil {
+		h.t.Fatalf("hub JetStream context failed: %v", err)
+	}
+	h.Flights, err = js.KeyValue(context.Background(), "flights")
+	if err != nil {
+		h.t.Fatalf("hub flights bucket failed: %v", err)
+	}
+}
+
+// Options returns natsclient options for a client of this hub. Checks run often so
+// that tests do not wait long for them.
+func (h *Hub) Options() natsclient.Options {
+	return natsclient.Options{
+		CloudURL:            "nats://" + h.cloud.addr(),
+		ClientName:          "natstest",
+		ServerName:          fmt.Sprintf("leaf-%d", clients.Add(1)),
+		LeafURL:             fmt.Sprintf("nats-leaf://127.0.0.1:%d", h.opts.LeafNode.Port),
+		NoAuth:              true,
+		FlightsBucket:       "flights",
+		MirrorBucket:        "inMemoryFlights",
+		MirrorDomain:        Domain,
+		MirrorCheckInterval: 100 * time.Millisecond,
+	}
+}
+
+// Client runs natsclient.New against the hub with opts, which usually start from
+// Options. It waits for the leaf link and shuts the client down when the test ends.
+func (h *Hub) Client(opts natsclient.Options) *natsclient.Client {
+	h.t.Helper()
+	logger, _, err := logging.Init(context.Background(), logging.Config{
+		Format: logging.FormatPretty,
+		Level:  logging.LevelInfo,
+	})
+	if err != nil {
+		h.t.Fatalf("logger init failed: %v", err)
+	}
+
+	client, err := natsclient.New(context.Background(), logger, opts)
+	if err != nil {
+		h.t.Fatalf("natsclient.New failed: %v", err)
+	}
+	h.t.Cleanup(client.Shutdown)
+
+	Eventually(h.t, 5*time.Second, func() bool {
+		return client.State.State() == natsclient.StateConnected && h.Server.NumLeafNodes() > 0
+	}, "leaf link did not come up")
+	return client
+}
+
+// CutCloud drops every cloud connection made through Options().CloudURL and refuses
+// new ones until RestoreCloud. Leaf links are untouched, so the mirror keeps syncing.
+func (h *Hub) CutCloud() {
+	h.cloud.setCut(true)
+}
+
+// RestoreCloud lets cloud connections through again after CutCloud.
+func (h *Hub) RestoreCloud() {
+	h.cloud.setCut(false)
+}
+
+// Eventually fails the test if cond is not true within timeout.
+func Eventually(t testing.TB, timeout time.Duration, cond func() bool, msg string) {
+	t.Helper()
+	deadline := time.Now().Add(timeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out after %v: %s", timeout, msg)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,204 @@
+package natsclient
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// Options controls how New builds the NATS stack.
+// Zero values fall back to the production defaults.
+type Options struct {
+	// CloudURL is the URL of the cloud NATS server.
+	CloudURL string `json:"cloudURL"`
+	// CloudCreds are the user credentials for the cloud NATS server. Not used in offline mode.
+	CloudCreds []byte `json:"-"`
+	// ClientName is the connection name reported to the cloud NATS server.
+	ClientName string `json:"clientName"`
+
+	// ServerName is the name of the embedded leaf server.
+	ServerName string `json:"serverName"`
+	// LeafURL is the remote the embedded server connects to as a leaf node.
+	LeafURL string `json:"leafURL"`
+	// LeafCredsFile is the path to the credentials file for the leaf node connection.
+	LeafCredsFile string `json:"leafCredsFile"`
+
+	// NoAuth connects to CloudURL and LeafURL without credentials, e.g. to a local hub in tests.
+	NoAuth bool `json:"noAuth"`
+
+	// FlightsBucket is the name of the cloud flights KV bucket.
+	FlightsBucket string `json:"flightsBucket"`
+	// MirrorBucket is the name of the in-memory KV bucket that mirrors FlightsBucket.
+	MirrorBucket string `json:"mirrorBucket"`
+	// MirrorDomain is the JetStream domain FlightsBucket is mirrored from.
+	MirrorDomain string `json:"mirrorDomain"`
+
+	// MirrorCheckInterval is how often the mirror is compared with the cloud stream.
+	MirrorCheckInterval time.Duration `json:"mirrorCheckInterval"`
+	// MirrorMaxLag is how many messages the mirror may fall behind before it is stale.
+	// Nil takes the default; zero makes the mirror stale as soon as it falls behind at all.
+	MirrorMaxLag *uint64 `json:"mirrorMaxLag"`
+	// MirrorMaxIdle is how long the mirror may go without hearing from the cloud before it is stale.
+	MirrorMaxIdle time.Duration `json:"mirrorMaxIdle"`
+	// SkipStaleMirror makes reads go straight to the cloud while the mirror is stale.
+	// It has no effect while the cloud is unreachable, since the mirror is all there is.
+	SkipStaleMirror bool `json:"skipStaleMirror"`
+
+	// FetchTimeout is how long a Fetcher waits for the fetcher service to reply.
+	FetchTimeout time.Duration `json:"fetchTimeout"`
+	// FetchCoalesceWindow is how long a successful fetch is shared with later callers
+	// asking for the same flight, so bursts of requests cause one upstream call.
+	FetchCoalesceWindow time.Duration `json:"fetchCoalesceWindow"`
+
+	// StoreDir is where the embedded server keeps its JetStream data. When set, the
+	// mirror is file-backed and keeps the last known flights across restarts.
+	// When empty, the mirror lives in memory and is rebuilt from the cloud on every start.
+	StoreDir string `json:"storeDir"`
+	// CorruptStorePolicy decides whether an unusable or damaged StoreDir is wiped or stops New.
+	CorruptStorePolicy CorruptStorePolicy `json:"corruptStorePolicy"`
+
+	// SlowConsumerPolicy decides what a FlightStore watcher or Hub subscriber does when its consumer falls behind.
+	SlowConsumerPolicy SlowConsumerPolicy `json:"slowConsumerPolicy"`
+	// WatchBufferSize is the number of undelivered updates a FlightStore watcher or Hub subscriber holds.
+	WatchBufferSize int `json:"watchBufferSize"`
+
+	// Offline runs the whole stack on the embedded server with no cloud dependency.
+	// A local 'flights' bucket stands in for both the cloud store and the in-memory
+	// mirror, and API fetches are published on the embedded server.
+	Offline bool `json:"offline"`
+	// SeedFile optionally points to a JSON object of key -> flight value used to
+	// populate the local 'flights' bucket in offline mode.
+	SeedFile string `json:"seedFile"`
+}
+
+// Defaults for the mirror health checks.
+const (
+	defaultMirrorCheckInterval = 15 * time.Second
+	defaultMirrorMaxLag        = 100
+	defaultMirrorMaxIdle       = time.Minute
+)
+
+// Defaults for API fetch requests.
+const (
+	defaultFetchTimeout        = 10 * time.Second
+	defaultFetchCoalesceWindow = 30 * time.Second
+)
+
+// DefaultOptions returns the options for the production cloud deployment.
+func DefaultOptions() Options {
+	return Options{
+		CloudURL:      SynadiaCloudURL,
+		ClientName:    "nzflights_webui",
+		ServerName:    "FlightApp_LeafNode",
+		LeafURL:       "nats-leaf://connect.ngs.global",
+		LeafCredsFile: "./natsclient/leafnode.cred",
+		FlightsBucket: "flights",
+		MirrorBucket:  "inMemoryFlights",
+		MirrorDomain:  "ngs",
+
+		MirrorCheckInterval: defaultMirrorCheckInterval,
+		MirrorMaxLag:        MaxLag(defaultMirrorMaxLag),
+		MirrorMaxIdle:       defaultMirrorMaxIdle,
+
+		FetchTimeout:        defaultFetchTimeout,
+		FetchCoalesceWindow: defaultFetchCoalesceWindow,
+
+		SlowConsumerPolicy: PolicyCoalesce,
+		WatchBufferSize:    defaultWatchBufferSize,
+	}
+}
+
+// withDefaults returns a copy of o with every unset field taken from DefaultOptions.
+func (o Options) withDefaults() Options {
+	d := DefaultOptions()
+	if o.CloudURL == "" {
+		o.CloudURL = d.CloudURL
+	}
+	if o.ClientName == "" {
+		o.ClientName = d.ClientName
+	}
+	if o.ServerName == "" {
+		o.ServerName = d.ServerName
+	}
+	if o.LeafURL == "" {
+		o.LeafURL = d.LeafURL
+	}
+	if o.LeafCredsFile == "" {
+		o.LeafCredsFile = d.LeafCredsFile
+	}
+	if o.FlightsBucket == "" {
+		o.FlightsBucket = d.FlightsBucket
+	}
+	if o.MirrorBucket == "" {
+		o.MirrorBucket = d.MirrorBucket
+	}
+	if o.MirrorDomain == "" {
+		o.MirrorDomain = d.MirrorDomain
+	}
+	if o.MirrorCheckInterval <= 0 {
+		o.MirrorCheckInterval = d.MirrorCheckInterval
+	}
+	if o.MirrorMaxLag == nil {
+		o.MirrorMaxLag = d.MirrorMaxLag
+	}
+	if o.MirrorMaxIdle <= 0 {
+		o.MirrorMaxIdle = d.MirrorMaxIdle
+	}
+	if o.FetchTimeout <= 0 {
+		o.FetchTimeout = d.FetchTimeout
+	}
+	if o.FetchCoalesceWindow <= 0 {
+		o.FetchCoalesceWindow = d.FetchCoalesceWindow
+	}
+	if o.WatchBufferSize <= 0 {
+		o.WatchBufferSize = d.WatchBufferSize
+	}
+	return o
+}
+
+// MaxLag returns lag for Options.MirrorMaxLag.
+func MaxLag(lag uint64) *uint64 {
+	return &lag
+}
+
+// Duration is a time.Duration read from config files as a string such as "30s" or
+// "1m30s". A plain number is still read as nanoseconds.
+type Duration time.Duration
+
+// UnmarshalJSON parses a duration string or a number of nanoseconds.
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var text string
+	if err := json.Unmarshal(data, &text); err != nil {
+		var nanos int64
+		if err := json.Unmarshal(data, &nanos); err != nil {
+			return fmt.Errorf("duration must be a string such as \"30s\": %s", data)
+		}
+		*d = Duration(nanos)
+		return nil
+	}
+	parsed, err := time.ParseDuration(text)
+	if err != nil {
+		return err
+	}
+	*d = Duration(parsed)
+	return nil
+}
+
+// UnmarshalJSON reads Options from a config file, taking durations as Duration does.
+func (o *Options) UnmarshalJSON(data []byte) error {
+	type plain Options
+	durations := struct {
+		*plain
+		MirrorCheckInterval *Duration `json:"mirrorCheckInterval"`
+		MirrorMaxIdle       *Duration `json:"mirrorMaxIdle"`
+		FetchTimeout        *Duration `json:"fetchTimeout"`
+		FetchCoalesceWindow *Duration `json:"fetchCoalesceWindow"`
+	}{
+		plain:               (*plain)(o),
+		MirrorCheckInterval: (*Duration)(&o.MirrorCheckInterval),
+		MirrorMaxIdle:       (*Duration)(&o.MirrorMaxIdle),
+		FetchTimeout:        (*Duration)(&o.FetchTimeout),
+		FetchCoalesceWindow: (*Duration)(&o.FetchCoalesceWindow),
+	}
+	return json.Unmarshal(data, &durations)
+}
@@ -0,0 +1,131 @@
+package natsclient
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/arcade55/nzflights-models"
+	"github.com/arcade55/nzflights_webui/keys"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+// Share describes a flight someone shared with the user and what the user has done with it.
+type Share struct {
+	// SharedBy names the user who shared the flight.
+	SharedBy string `json:"sharedBy"`
+	// Accepted is set once the user accepts the flight into their shared list.
+	Accepted bool `json:"accepted,omitempty"`
+	// Hidden is set once the user hides the flight. Its copy is kept, but not shown.
+	Hidden bool `json:"hidden,omitempty"`
+}
+
+// SharedFlightValue is the value held under a shared flight key. The flight's fields
+// are inline alongside the share's, so it also decodes as a plain flight value.
+type SharedFlightValue struct {
+	nzflights.FlightValue
+	Share
+}
+
+// decodeShare sets flight.Share if entry is a flight shared with the user.
+func decodeShare(entry Entry, flight *FlightEntry) error {
+	parsed, err := keys.Parse(entry.Key())
+	if err != nil || parsed.Kind != keys.KindSharedFlight {
+		return nil
+	}
+	flight.Share = &Share{}
+	if entry.Operation() != jetstream.KeyValuePut {
+		return nil
+	}
+	return json.Unmarshal(entry.Value(), flight.Share)
+}
+
+// AcceptSharedFlight accepts a flight shared with the user. It returns the new revision.
+func (s *flightStore) AcceptSharedFlight(ctx context.Context, userID, flightID string, lastRevision uint64) (uint64, error) {
+	return s.updateShare(ctx, userID, flightID, lastRevision, func(share *Share) {
+		share.Accepted = true
+	})
+}
+
+// HideSharedFlight hides a flight shared with the user. It returns the new revision.
+func (s *flightStore) HideSharedFlight(ctx context.Context, userID, flightID string, lastRevision uint64) (uint64, error) {
+	return s.updateShare(ctx, userID, flightID, lastRevision, func(share *Share) {
+		share.Hidden = true
+	})
+}
+
+// ConvertSharedFlight moves a flight shared with the user to their owned list. The owned
+// copy is created first, so a failure part way leaves the flight in both lists rather
+// than neither. It returns the revision of the owned copy.
+func (s *flightStore) ConvertSharedFlight(ctx context.Context, userID, flightID string, lastRevision uint64) (uint64, error) {
+	if s.cloudDown() {
+		return 0, errCloudDown
+	}
+	key, err := keys.SharedFlight(userID, flightID)
+	if err != nil {
+		return 0, err
+	}
+	shared, revision, err := s.sharedFlight(ctx, key, lastRevision)
+	if err != nil {
+		return 0, err
+	}
+
+	ownedRev, err := s.Track(ctx, userID, flightID, shared.FlightValue)
+	if err != nil {
+		return 0, err
+	}
+	err = s.cloudKV.Delete(ctx, key, jetstream.LastRevision(revision))
+	if errors.Is(err, jetstream.ErrKeyExists) {
+		return ownedRev, s.conflictError(ctx, key, revision)
+	}
+	return ownedRev, err
+}
+
+// updateShare applies update to the share of a flight shared with the user, if it is
+// still at lastRevision. A zero lastRevision updates the latest revision.
+func (s *flightStore) updateShare(ctx context.Context, userID, flightID string, lastRevision uint64, update func(*Share)) (uint64, error) {
+	if s.cloudDown() {
+		return 0, errCloudDown
+	}
+	key, err := keys.SharedFlight(userID, flightID)
+	if err != nil {
+		return 0, err
+	}
+	shared, revision, err := s.sharedFlight(ctx, key, lastRevision)
+	if err != nil {
+		return 0, err
+	}
+
+	update(&shared.Share)
+	data, err := json.Marshal(shared)
+	if err != nil {
+		return 0, err
+	}
+	rev, err := s.cloudKV.Update(ctx, key, data, revision)
+	if errors.Is(err, jetstream.ErrKeyExists) {
+		return 0, s.conflictError(ctx, key, revision)
+	}
+	return rev, err
+}
+
+// sharedFlight reads the shared flight at key along with its revision, failing with
+// ErrRevisionConflict unless lastRevision is zero or the latest revision.
+func (s *flightStore) sharedFlight(ctx context.Context, key string, lastRevision uint64) (SharedFlightValue, uint64, error) {
+	entry, err := s.cloudKV.Get(ctx, key)
+	if errors.Is(err, jetstream.ErrKeyNotFound) || errors.Is(err, jetstream.ErrKeyDeleted) {
+		return SharedFlightValue{}, 0, fmt.Errorf("%w: %s", ErrFlightNotTracked, key)
+	}
+	if err != nil {
+		return SharedFlightValue{}, 0, err
+	}
+	if lastRevision != 0 && entry.Revision() != lastRevision {
+		return SharedFlightValue{}, 0, fmt.Errorf("%w: %s expected revision %d, found %d", ErrRevisionConflict, key, lastRevision, entry.Revision())
+	}
+
+	var shared SharedFlightValue
+	if err := json.Unmarshal(entry.Value(), &shared); err != nil {
+		return SharedFlightValue{}, 0, &DecodeError{Key: key, Revision: entry.Revision(), Err: err}
+	}
+	return shared, entry.Revision(), nil
+}
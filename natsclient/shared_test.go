@@ -0,0 +1,68 @@
+package natsclient
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/arcade55/nzflights-models"
+)
+
+// TestSharedFlights verifies that shared flights decode with their share, and that
+// accepting, hiding and converting them are guarded by revision.
+func TestSharedFlights(t *testing.T) {
+	kv, cleanup := setupTestKV(t)
+	defer cleanup()
+	ctx := context.Background()
+	store := newFlightStore(kv, kv, Options{})
+
+	const key = "users.u1.flights.shared.NZ1"
+	data, _ := json.Marshal(SharedFlightValue{
+		FlightValue: nzflights.FlightValue{ElementId: "NZ1", Flight: nzflights.Flight{Ident: "NZ1", Status: "Scheduled"}},
+		Share:       Share{SharedBy: "alice"},
+	})
+	rev, err := kv.Put(ctx, key, data)
+	if err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+
+	result, err := store.GetFlights(ctx, []string{key})
+	if err != nil {
+		t.Fatalf("GetFlights failed: %v", err)
+	}
+	if flight := result.Found[key]; flight.Share == nil || flight.Share.SharedBy != "alice" || flight.Value.Flight.Status != "Scheduled" {
+		t.Fatalf("expected the flight shared by alice, got %+v", flight)
+	}
+
+	accepted, err := store.AcceptSharedFlight(ctx, "u1", "NZ1", rev)
+	if err != nil {
+		t.Fatalf("AcceptSharedFlight failed: %v", err)
+	}
+	if _, err := store.HideSharedFlight(ctx, "u1", "NZ1", rev); !errors.Is(err, ErrRevisionConflict) {
+		t.Errorf("expected ErrRevisionConflict hiding a stale revision, got %v", err)
+	}
+	if _, err := store.HideSharedFlight(ctx, "u1", "NZ1", accepted); err != nil {
+		t.Fatalf("HideSharedFlight failed: %v", err)
+	}
+	result, _ = store.GetFlights(ctx, []string{key})
+	if share := result.Found[key].Share; share == nil || !share.Accepted || !share.Hidden || share.SharedBy != "alice" {
+		t.Errorf("expected the share to be accepted and hidden, got %+v", share)
+	}
+
+	if _, err := store.ConvertSharedFlight(ctx, "u1", "NZ1", 0); err != nil {
+		t.Fatalf("ConvertSharedFlight failed: %v", err)
+	}
+	owned, err := kv.Get(ctx, "users.u1.flights.owned.NZ1")
+	if err != nil {
+		t.Fatalf("expected an owned copy: %v", err)
+	}
+	var fv nzflights.FlightValue
+	json.Unmarshal(owned.Value(), &fv)
+	if fv.Flight.Status != "Scheduled" || fv.NatsKey != "users.u1.flights.owned.NZ1" {
+		t.Errorf("expected the owned copy to hold the flight under its own key, got %+v", fv)
+	}
+	if _, err := store.ConvertSharedFlight(ctx, "u1", "NZ1", 0); !errors.Is(err, ErrFlightNotTracked) {
+		t.Errorf("expected ErrFlightNotTracked converting twice, got %v", err)
+	}
+}
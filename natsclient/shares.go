@@ -0,0 +1,238 @@
+package natsclient
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/arcade55/nzflights-models"
+	"github.com/arcade55/nzflights_webui/keys"
+	"github.com/google/uuid"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+// ShareStatus is how far a share has got.
+type ShareStatus int
+
+const (
+	// SharePending is a share waiting to be claimed.
+	SharePending ShareStatus = iota
+	// ShareClaimed is a share someone has claimed.
+	ShareClaimed
+	// ShareExpired is a share nobody claimed in time.
+	ShareExpired
+)
+
+func (s ShareStatus) String() string {
+	switch s {
+	case SharePending:
+		return "pending"
+	case ShareClaimed:
+		return "claimed"
+	case ShareExpired:
+		return "expired"
+	default:
+		return fmt.Sprintf("ShareStatus(%d)", int(s))
+	}
+}
+
+// MarshalText writes the status by name in share records.
+func (s ShareStatus) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+// UnmarshalText parses a status name as written by MarshalText.
+func (s *ShareStatus) UnmarshalText(text []byte) error {
+	for _, status := range []ShareStatus{SharePending, ShareClaimed, ShareExpired} {
+		if string(text) == status.String() {
+			*s = status
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown share status %q", text)
+}
+
+// PendingShare is the value of a share that has not been claimed yet: a single-use
+// token holding a copy of the flight until it expires.
+type PendingShare struct {
+	FlightID  string                `json:"flightID"`
+	SharerID  string                `json:"sharerID"`
+	Flight    nzflights.FlightValue `json:"flightData"`
+	ExpiresAt time.Time             `json:"expiresAt"`
+}
+
+// SentShare is the sharer's record of a share they created.
+type SentShare struct {
+	FlightID  string                `json:"flightID"`
+	Status    ShareStatus           `json:"status"`
+	Snapshot  nzflights.FlightValue `json:"sharedDataSnapshot"`
+	ExpiresAt time.Time             `json:"expiresAt"`
+	ClaimedAt time.Time             `json:"claimedAt,omitzero"`
+}
+
+// StatusAt is the status of the share at now. The pending share is written with a
+// TTL that ends at ExpiresAt, so the bucket removes it then without touching this
+// record, and a pending share past its expiry is reported as expired.
+func (s SentShare) StatusAt(now time.Time) ShareStatus {
+	if s.Status == SharePending && !now.Before(s.ExpiresAt) {
+		return ShareExpired
+	}
+	return s.Status
+}
+
+// ShareFlight creates a single-use share of a flight the user owns, valid for ttl, along
+// with the user's record of it. It returns the share ID, which is all a recipient needs
+// to claim the flight. The pending share is removed by the bucket once ttl passes, which
+// needs a bucket with LimitMarkerTTL set. The bucket takes TTLs of a second or more, so a
+// shorter ttl is raised to one second.
+func (s *flightStore) ShareFlight(ctx context.Context, sharerID, flightID string, ttl time.Duration) (string, error) {
+	if s.cloudDown() {
+		return "", errCloudDown
+	}
+	ownedKey, err := keys.OwnedFlight(sharerID, flightID)
+	if err != nil {
+		return "", err
+	}
+	entry, err := s.cloudKV.Get(ctx, ownedKey)
+	if errors.Is(err, jetstream.ErrKeyNotFound) || errors.Is(err, jetstream.ErrKeyDeleted) {
+		return "", fmt.Errorf("%w: %s", ErrFlightNotTracked, ownedKey)
+	}
+	if err != nil {
+		return "", err
+	}
+	var fv nzflights.FlightValue
+	if err := json.Unmarshal(entry.Value(), &fv); err != nil {
+		return "", &DecodeError{Key: ownedKey, Revision: entry.Revision(), Err: err}
+	}
+
+	ttl = max(ttl, time.Second)
+	shareID := uuid.NewString()
+	pendingKey, err := keys.PendingShare(shareID)
+	if err != nil {
+		return "", err
+	}
+	sentKey, err := keys.SentShare(sharerID, shareID)
+	if err != nil {
+		return "", err
+	}
+	expiresAt := time.Now().Add(ttl).UTC()
+	pending, err := json.Marshal(PendingShare{FlightID: flightID, SharerID: sharerID, Flight: fv, ExpiresAt: expiresAt})
+	if err != nil {
+		return "", err
+	}
+	sent, err := json.Marshal(SentShare{FlightID: flightID, Status: SharePending, Snapshot: fv, ExpiresAt: expiresAt})
+	if err != nil {
+		return "", err
+	}
+
+	if _, err := s.cloudKV.Create(ctx, pendingKey, pending, jetstream.KeyTTL(ttl)); err != nil {
+		return "", err
+	}
+	if _, err := s.cloudKV.Put(ctx, sentKey, sent); err != nil {
+		// The sharer could not see or follow a share without its record, so withdraw it.
+		if derr := s.cloudKV.Delete(ctx, pendingKey); derr != nil {
+			err = errors.Join(err, fmt.Errorf("failed to withdraw share %s: %w", pendingKey, derr))
+		}
+		return "", err
+	}
+	return shareID, nil
+}
+
+// ClaimShare copies the flight in a pending share to the recipient's shared flights and
+// marks the sharer's record claimed. Removing the pending share is the claim itself: it
+// is deleted at the revision read, so of two recipients claiming at once only one gets
+// the flight. The copy and the record follow. The copy is only created, so a flight
+// already shared with the recipient is left as it is and ErrAlreadyShared returned. If
+// the copy is not written the share is put back to be claimed again; if only the record
+// cannot be updated the claim stands, and the flight ID is returned along with the error.
+func (s *flightStore) ClaimShare(ctx context.Context, recipientID, shareID string) (string, error) {
+	if s.cloudDown() {
+		return "", errCloudDown
+	}
+	pendingKey, err := keys.PendingShare(shareID)
+	if err != nil {
+		return "", err
+	}
+	entry, err := s.cloudKV.Get(ctx, pendingKey)
+	if errors.Is(err, jetstream.ErrKeyNotFound) || errors.Is(err, jetstream.ErrKeyDeleted) {
+		return "", fmt.Errorf("%w: %s", ErrShareNotFound, pendingKey)
+	}
+	if err != nil {
+		return "", err
+	}
+	var pending PendingShare
+	if err := json.Unmarshal(entry.Value(), &pending); err != nil {
+		return "", &DecodeError{Key: pendingKey, Revision: entry.Revision(), Err: err}
+	}
+	if pending.SharerID == recipientID {
+		return "", fmt.Errorf("%w: %s", ErrOwnShare, pendingKey)
+	}
+	sharedKey, err := keys.SharedFlight(recipientID, pending.FlightID)
+	if err != nil {
+		return "", err
+	}
+
+	if !time.Now().Before(pending.ExpiresAt) {
+		// Tidy up the expired share. Losing the race to someone else doing so is fine.
+		s.cloudKV.Delete(ctx, pendingKey, jetstream.LastRevision(entry.Revision()))
+		return "", fmt.Errorf("%w: %s", ErrShareExpired, pendingKey)
+	}
+	err = s.cloudKV.Delete(ctx, pendingKey, jetstream.LastRevision(entry.Revision()))
+	if errors.Is(err, jetstream.ErrKeyExists) {
+		return "", fmt.Errorf("%w: %s", ErrShareNotFound, pendingKey)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	fv := pending.Flight
+	fv.NatsKey = sharedKey
+	data, err := json.Marshal(SharedFlightValue{FlightValue: fv, Share: Share{SharedBy: pending.SharerID}})
+	if err == nil {
+		_, err = s.cloudKV.Create(ctx, sharedKey, data)
+	}
+	if errors.Is(err, jetstream.ErrKeyExists) {
+		err = fmt.Errorf("%w: %s", ErrAlreadyShared, sharedKey)
+	}
+	if err != nil {
+		// Put the share back with the time it had left, so the link still works.
+		ttl := max(time.Until(pending.ExpiresAt), time.Second)
+		if _, cerr := s.cloudKV.Create(ctx, pendingKey, entry.Value(), jetstream.KeyTTL(ttl)); cerr != nil {
+			err = errors.Join(err, fmt.Errorf("failed to put back share %s: %w", pendingKey, cerr))
+		}
+		return "", err
+	}
+
+	if err := s.markClaimed(ctx, pending.SharerID, shareID); err != nil {
+		return pending.FlightID, err
+	}
+	return pending.FlightID, nil
+}
+
+// markClaimed updates the sharer's record of a share once it has been claimed.
+func (s *flightStore) markClaimed(ctx context.Context, sharerID, shareID string) error {
+	sentKey, err := keys.SentShare(sharerID, shareID)
+	if err != nil {
+		return err
+	}
+	entry, err := s.cloudKV.Get(ctx, sentKey)
+	if err != nil {
+		return fmt.Errorf("failed to read share record %s: %w", sentKey, err)
+	}
+	var sent SentShare
+	if err := json.Unmarshal(entry.Value(), &sent); err != nil {
+		return &DecodeError{Key: sentKey, Revision: entry.Revision(), Err: err}
+	}
+	sent.Status = ShareClaimed
+	sent.ClaimedAt = time.Now().UTC()
+	data, err := json.Marshal(sent)
+	if err != nil {
+		return err
+	}
+	if _, err := s.cloudKV.Update(ctx, sentKey, data, entry.Revision()); err != nil {
+		return fmt.Errorf("failed to mark share record %s claimed: %w", sentKey, err)
+	}
+	return nil
+}
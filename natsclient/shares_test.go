@@ -0,0 +1,119 @@
+package natsclient
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/arcade55/nzflights-models"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+// TestShareAndClaim verifies that a share copies the flight to one recipient only,
+// marks the sharer's record claimed, and cannot be claimed by its sharer or once expired.
+func TestShareAndClaim(t *testing.T) {
+	kv, cleanup := setupTestKV(t)
+	defer cleanup()
+	ctx := context.Background()
+	store := newFlightStore(kv, kv, Options{})
+
+	fv := nzflights.FlightValue{ElementId: "NZ1", Flight: nzflights.Flight{Ident: "NZ1", Status: "Scheduled"}}
+	if _, err := store.Track(ctx, "alice", "NZ1", fv); err != nil {
+		t.Fatalf("Track failed: %v", err)
+	}
+	if _, err := store.ShareFlight(ctx, "alice", "NZ2", time.Hour); !errors.Is(err, ErrFlightNotTracked) {
+		t.Errorf("expected ErrFlightNotTracked sharing an untracked flight, got %v", err)
+	}
+
+	shareID, err := store.ShareFlight(ctx, "alice", "NZ1", time.Hour)
+	if err != nil {
+		t.Fatalf("ShareFlight failed: %v", err)
+	}
+	if _, err := store.ClaimShare(ctx, "alice", shareID); !errors.Is(err, ErrOwnShare) {
+		t.Errorf("expected ErrOwnShare claiming one's own share, got %v", err)
+	}
+	flightID, err := store.ClaimShare(ctx, "bob", shareID)
+	if err != nil || flightID != "NZ1" {
+		t.Fatalf("expected bob to claim NZ1, got %q, %v", flightID, err)
+	}
+	if _, err := store.ClaimShare(ctx, "carol", shareID); !errors.Is(err, ErrShareNotFound) {
+		t.Errorf("expected ErrShareNotFound claiming twice, got %v", err)
+	}
+	if _, err := kv.Get(ctx, "shares.pending."+shareID); !errors.Is(err, jetstream.ErrKeyNotFound) {
+		t.Errorf("expected the pending share to be gone, got %v", err)
+	}
+
+	result, _ := store.GetFlights(ctx, []string{"users.bob.flights.shared.NZ1"})
+	if flight := result.Found["users.bob.flights.shared.NZ1"]; flight.Share == nil || flight.Share.SharedBy != "alice" ||
+		flight.Value.Flight.Status != "Scheduled" {
+		t.Errorf("expected bob's copy shared by alice, got %+v", flight)
+	}
+	entry, err := kv.Get(ctx, "users.alice.shares.sent."+shareID)
+	if err != nil {
+		t.Fatalf("expected alice's record: %v", err)
+	}
+	var sent SentShare
+	json.Unmarshal(entry.Value(), &sent)
+	if sent.Status != ShareClaimed || sent.ClaimedAt.IsZero() || sent.Snapshot.Flight.Ident != "NZ1" {
+		t.Errorf("expected alice's record to be claimed, got %+v", sent)
+	}
+
+	// Bob already has NZ1, so another link to it is refused and left to claim.
+	again, err := store.ShareFlight(ctx, "alice", "NZ1", time.Hour)
+	if err != nil {
+		t.Fatalf("ShareFlight failed: %v", err)
+	}
+	if _, err := store.ClaimShare(ctx, "bob", again); !errors.Is(err, ErrAlreadyShared) {
+		t.Errorf("expected ErrAlreadyShared, got %v", err)
+	}
+	if flightID, err := store.ClaimShare(ctx, "carol", again); err != nil || flightID != "NZ1" {
+		t.Errorf("expected the share to be put back for carol, got %q, %v", flightID, err)
+	}
+
+	expiring, err := store.ShareFlight(ctx, "alice", "NZ1", time.Second)
+	if err != nil {
+		t.Fatalf("ShareFlight failed: %v", err)
+	}
+	// The bucket removes the pending share once its TTL runs out.
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		_, err := kv.Get(ctx, "shares.pending."+expiring)
+		if errors.Is(err, jetstream.ErrKeyNotFound) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the expired share to be removed, got %v", err)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	if _, err := store.ClaimShare(ctx, "bob", expiring); !errors.Is(err, ErrShareNotFound) {
+		t.Errorf("expected ErrShareNotFound for a removed share, got %v", err)
+	}
+}
+
+// TestSentShare_StatusAt verifies that a pending share reports itself expired once its time
+// is up, and that statuses round-trip through their names.
+func TestSentShare_StatusAt(t *testing.T) {
+	now := time.Now()
+	sent := SentShare{Status: SharePending, ExpiresAt: now.Add(time.Minute)}
+	if got := sent.StatusAt(now); got != SharePending {
+		t.Errorf("expected pending before expiry, got %v", got)
+	}
+	if got := sent.StatusAt(now.Add(time.Hour)); got != ShareExpired {
+		t.Errorf("expected expired after expiry, got %v", got)
+	}
+	sent.Status = ShareClaimed
+	if got := sent.StatusAt(now.Add(time.Hour)); got != ShareClaimed {
+		t.Errorf("expected a claimed share to stay claimed, got %v", got)
+	}
+
+	for _, status := range []ShareStatus{SharePending, ShareClaimed, ShareExpired} {
+		text, _ := status.MarshalText()
+		var parsed ShareStatus
+		if err := parsed.UnmarshalText(text); err != nil || parsed != status {
+			t.Errorf("expected %v to round-trip, got %v, %v", status, parsed, err)
+		}
+	}
+}
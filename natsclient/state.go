@@ -0,0 +1,170 @@
+package natsclient
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats-server/v2/server"
+)
+
+// ConnState describes how fresh the flights served by the Client are.
+type ConnState int
+
+const (
+	// StateConnected means the cloud connection and the leaf link are both up:
+	// the mirror is in sync and reads and writes reach the cloud store.
+	StateConnected ConnState = iota
+	// StateDegraded means the direct cloud connection is down but the leaf link is up.
+	// The mirror still receives updates, but reads that miss it and all writes fail.
+	StateDegraded
+	// StateOffline means the cloud connection and the leaf link are both down, so the
+	// mirror is no longer updated and only the last known flights can be served.
+	StateOffline
+	// StateCloudOnly means the leaf link is down but the direct cloud connection is up.
+	// Reads that miss the mirror and all writes still reach the cloud store, but the
+	// mirror is no longer updated, so the flights it serves may be out of date.
+	StateCloudOnly
+)
+
+func (s ConnState) String() string {
+	switch s {
+	case StateConnected:
+		return "connected"
+	case StateDegraded:
+		return "degraded-leaf-only"
+	case StateOffline:
+		return "offline"
+	case StateCloudOnly:
+		return "degraded-cloud-only"
+	default:
+		return fmt.Sprintf("ConnState(%d)", int(s))
+	}
+}
+
+// StateEvent reports a change of ConnState.
+type StateEvent struct {
+	From ConnState
+	To   ConnState
+	At   time.Time
+}
+
+// leafPollInterval is how often the embedded server is checked for a leaf connection.
+const leafPollInterval = time.Second
+
+// StateTracker follows the cloud connection and the leaf link and derives the ConnState.
+// The zero value is not usable; use newStateTracker.
+type StateTracker struct {
+	mu      sync.Mutex
+	cloudUp bool
+	leafUp  bool
+	state   ConnState
+	subs    map[chan StateEvent]struct{}
+	done    chan struct{}
+	stop    sync.Once
+}
+
+// newStateTracker returns a tracker that starts in StateConnected.
+func newStateTracker() *StateTracker {
+	return &StateTracker{
+		cloudUp: true,
+		leafUp:  true,
+		state:   StateConnected,
+		subs:    make(map[chan StateEvent]struct{}),
+		done:    make(chan struct{}),
+	}
+}
+
+// State returns the current connection state.
+func (t *StateTracker) State() ConnState {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.state
+}
+
+// Subscribe returns a channel of state changes and a function that cancels the subscription.
+// A subscriber that falls behind only receives the most recent change.
+func (t *StateTracker) Subscribe() (<-chan StateEvent, func()) {
+	ch := make(chan StateEvent, 1)
+	t.mu.Lock()
+	t.subs[ch] = struct{}{}
+	t.mu.Unlock()
+
+	var once sync.Once
+	return ch, func() {
+		once.Do(func() {
+			t.mu.Lock()
+			delete(t.subs, ch)
+			t.mu.Unlock()
+		})
+	}
+}
+
+// cloudConnected reports whether the direct cloud connection is up.
+func (t *StateTracker) cloudConnected() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.cloudUp
+}
+
+// setCloud records whether the direct cloud connection is up.
+func (t *StateTracker) setCloud(up bool) {
+	t.mu.Lock()
+	t.cloudUp = up
+	t.update()
+	t.mu.Unlock()
+}
+
+// setLeaf records whether the leaf link to the cloud is up.
+func (t *StateTracker) setLeaf(up bool) {
+	t.mu.Lock()
+	t.leafUp = up
+	t.update()
+	t.mu.Unlock()
+}
+
+// update derives the state and tells subscribers if it changed. t.mu must be held.
+func (t *StateTracker) update() {
+	next := StateConnected
+	switch {
+	case !t.leafUp && !t.cloudUp:
+		next = StateOffline
+	case !t.leafUp:
+		next = StateCloudOnly
+	case !t.cloudUp:
+		next = StateDegraded
+	}
+	if next == t.state {
+		return
+	}
+
+	event := StateEvent{From: t.state, To: next, At: time.Now()}
+	t.state = next
+	for ch := range t.subs {
+		// Replace any change the subscriber has not read yet with this one.
+		select {
+		case <-ch:
+		default:
+		}
+		ch <- event
+	}
+}
+
+// watchLeaf polls ns for a leaf connection until the tracker is closed.
+func (t *StateTracker) watchLeaf(ns *server.Server) {
+	ticker := time.NewTicker(leafPollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			t.setLeaf(ns.NumLeafNodes() > 0)
+		case <-t.done:
+			return
+		}
+	}
+}
+
+// close stops watching the leaf link.
+func (t *StateTracker) close() {
+	t.stop.Do(func() { close(t.done) })
+}
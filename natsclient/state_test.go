@@ -0,0 +1,142 @@
+package natsclient
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/arcade55/nzflights-models"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+// TestStateTracker_Transitions verifies the state derived from the cloud connection and leaf link.
+func TestStateTracker_Transitions(t *testing.T) {
+	tracker := newStateTracker()
+	defer tracker.close()
+	events, unsubscribe := tracker.Subscribe()
+	defer unsubscribe()
+
+	steps := []struct {
+		name  string
+		apply func()
+		want  ConnState
+	}{
+		{"cloud drops", func() { tracker.setCloud(false) }, StateDegraded},
+		{"leaf drops", func() { tracker.setLeaf(false) }, StateOffline},
+		{"leaf returns", func() { tracker.setLeaf(true) }, StateDegraded},
+		{"leaf drops again", func() { tracker.setLeaf(false) }, StateOffline},
+		{"cloud returns", func() { tracker.setCloud(true) }, StateCloudOnly},
+		{"leaf returns to the cloud", func() { tracker.setLeaf(true) }, StateConnected},
+	}
+	from := StateConnected
+	for _, step := range steps {
+		step.apply()
+		if got := tracker.State(); got != step.want {
+			t.Fatalf("%s: expected %s, got %s", step.name, step.want, got)
+		}
+		select {
+		case event := <-events:
+			if event.From != from || event.To != step.want {
+				t.Errorf("%s: expected %s -> %s, got %s -> %s", step.name, from, step.want, event.From, event.To)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("%s: no state event", step.name)
+		}
+		from = step.want
+	}
+
+	// Repeating the current state is not a change.
+	tracker.setCloud(true)
+	select {
+	case event := <-events:
+		t.Errorf("expected no event, got %s -> %s", event.From, event.To)
+	default:
+	}
+}
+
+// TestStateTracker_SlowSubscriberGetsLatest verifies that a subscriber that falls behind only sees the latest change.
+func TestStateTracker_SlowSubscriberGetsLatest(t *testing.T) {
+	tracker := newStateTracker()
+	defer tracker.close()
+	events, unsubscribe := tracker.Subscribe()
+
+	tracker.setCloud(false)
+	tracker.setLeaf(false)
+	if event := <-events; event.To != StateOffline {
+		t.Errorf("expected the latest event to be %s, got %s", StateOffline, event.To)
+	}
+
+	unsubscribe()
+	tracker.setLeaf(true)
+	select {
+	case event := <-events:
+		t.Errorf("expected no event after unsubscribe, got %s", event.To)
+	default:
+	}
+}
+
+// TestFlightStore_CloudDown verifies that reads fall back to the mirror and writes fail fast while the cloud is down.
+func TestFlightStore_CloudDown(t *testing.T) {
+	memKV, cleanupMem := setupTestKV(t)
+	defer cleanupMem()
+	cloudKV, cleanupCloud := setupTestKV(t)
+	defer cleanupCloud()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	const cached, uncached = "users.u1.flights.owned.NZ1", "users.u1.flights.owned.NZ2"
+	if _, err := memKV.Put(ctx, cached, []byte("{}")); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	// Only in the cloud, so it must not be read while the cloud is down.
+	if _, err := cloudKV.Put(ctx, uncached, []byte("{}")); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+
+	tracker := newStateTracker()
+	defer tracker.close()
+	store := newFlightStore(memKV, cloudKV, Options{})
+	store.state = tracker
+	tracker.setCloud(false)
+
+	// The leaf link still keeps the mirror in sync, so a miss means the key does not exist.
+	result, err := store.GetMultiple(ctx, []string{cached, uncached})
+	if err != nil {
+		t.Fatalf("GetMultiple failed while degraded: %v", err)
+	}
+	if entry, ok := result.Found[cached]; !ok || entry.Source != SourceInMemory {
+		t.Errorf("expected %s to be found in memory, got %+v", cached, result.Found)
+	}
+	if len(result.Missing) != 1 || result.Missing[0] != uncached {
+		t.Errorf("expected %s to be missing, got %v", uncached, result.Missing)
+	}
+
+	// Without the leaf link the mirror may be behind, so a miss cannot be trusted.
+	tracker.setLeaf(false)
+	result, err = store.GetMultiple(ctx, []string{cached, uncached})
+	if !errors.Is(err, ErrCloudUnavailable) {
+		t.Errorf("expected ErrCloudUnavailable while offline, got %v", err)
+	}
+	if _, ok := result.Found[cached]; !ok {
+		t.Errorf("expected %s to be served from memory while offline", cached)
+	}
+	if _, ok := result.Failed[uncached]; !ok {
+		t.Errorf("expected %s to fail while offline, got %+v", uncached, result)
+	}
+
+	fv := nzflights.FlightValue{ElementId: "NZ3", Flight: nzflights.Flight{Ident: "NZ3"}}
+	if _, err := store.Track(ctx, "u1", "NZ3", fv); !errors.Is(err, ErrCloudUnavailable) {
+		t.Errorf("expected Track to fail with ErrCloudUnavailable, got %v", err)
+	}
+	if _, err := store.UpdateUserFlight(ctx, "u1", "NZ3", fv, 1); !errors.Is(err, ErrCloudUnavailable) {
+		t.Errorf("expected UpdateUserFlight to fail with ErrCloudUnavailable, got %v", err)
+	}
+	if err := store.Untrack(ctx, "u1", "NZ3", 1); !errors.Is(err, ErrCloudUnavailable) {
+		t.Errorf("expected Untrack to fail with ErrCloudUnavailable, got %v", err)
+	}
+	if _, err := cloudKV.Get(ctx, "users.u1.flights.owned.NZ3"); !errors.Is(err, jetstream.ErrKeyNotFound) {
+		t.Errorf("expected no write to reach the cloud, got %v", err)
+	}
+}
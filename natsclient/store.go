@@ -0,0 +1,186 @@
+package natsclient
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+
+	"github.com/arcade55/logging"
+	"github.com/nats-io/nats-server/v2/server"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+// CorruptStorePolicy decides what New does when the embedded server cannot use StoreDir.
+type CorruptStorePolicy int
+
+const (
+	// StoreRefuse fails New with ErrStoreCorrupt and leaves the directory untouched for inspection.
+	StoreRefuse CorruptStorePolicy = iota
+	// StoreWipe deletes the embedded server's JetStream data and starts again with an empty store.
+	// Only the 'jetstream' directory inside StoreDir is removed.
+	StoreWipe
+)
+
+func (p CorruptStorePolicy) String() string {
+	switch p {
+	case StoreRefuse:
+		return "refuse"
+	case StoreWipe:
+		return "wipe"
+	default:
+		return fmt.Sprintf("CorruptStorePolicy(%d)", int(p))
+	}
+}
+
+// MarshalText lets the policy be written by name in config files.
+func (p CorruptStorePolicy) MarshalText() ([]byte, error) {
+	return []byte(p.String()), nil
+}
+
+// UnmarshalText parses a policy name as written by MarshalText.
+func (p *CorruptStorePolicy) UnmarshalText(text []byte) error {
+	for _, policy := range []CorruptStorePolicy{StoreRefuse, StoreWipe} {
+		if string(text) == policy.String() {
+			*p = policy
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown corrupt store policy %q", text)
+}
+
+// startEmbedded runs the embedded server and opens the bucket described by kvConfig on it.
+// When StoreDir is set the bucket is file-backed, so it keeps its data across restarts.
+// If the store cannot be used, the CorruptStorePolicy decides whether to wipe it and try
+// once more or to give up with ErrStoreCorrupt. Failures to open the bucket are wrapped in kvErr.
+func startEmbedded(ctx context.Context, logger *logging.Logger, opts Options, withLeafRemote bool, kvConfig jetstream.KeyValueConfig, kvErr error) (*nats.Conn, *server.Server, jetstream.KeyValue, error) {
+	if opts.StoreDir == "" {
+		return openEmbedded(ctx, opts, withLeafRemote, kvConfig, kvErr)
+	}
+	kvConfig.Storage = jetstream.FileStorage
+
+	// JetStream treats an unusable store directory as fatal and exits the process,
+	// so it has to be checked before the server starts.
+	if err := checkStoreDir(opts.StoreDir); err != nil {
+		if err := recoverStore(ctx, logger, opts, err); err != nil {
+			return nil, nil, nil, err
+		}
+	}
+
+	nc, ns, kv, err := openEmbedded(ctx, opts, withLeafRemote, kvConfig, kvErr)
+	if err == nil {
+		if err = verifyStore(ctx, nc, kvConfig.Bucket); err == nil {
+			return nc, ns, kv, nil
+		}
+		nc.Close()
+		ns.Shutdown()
+	} else if !errors.Is(err, kvErr) {
+		return nil, nil, nil, err
+	}
+
+	// The server started but could not open the bucket from its store, or lost some of it.
+	if err := recoverStore(ctx, logger, opts, err); err != nil {
+		return nil, nil, nil, err
+	}
+	return openEmbedded(ctx, opts, withLeafRemote, kvConfig, kvErr)
+}
+
+// openEmbedded runs the embedded server and opens a single bucket on it.
+func openEmbedded(ctx context.Context, opts Options, withLeafRemote bool, kvConfig jetstream.KeyValueConfig, kvErr error) (*nats.Conn, *server.Server, jetstream.KeyValue, error) {
+	nc, ns, err := runEmbeddedServer(opts, true, true, withLeafRemote)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("%w: %v", ErrEmbeddedServerFailed, err)
+	}
+
+	js, err := jetstream.New(nc)
+	if err != nil {
+		nc.Close()
+		ns.Shutdown()
+		return nil, nil, nil, fmt.Errorf("%w on embedded server: %v", ErrJetStreamContextFailed, err)
+	}
+
+	kv, err := js.CreateOrUpdateKeyValue(ctx, kvConfig)
+	if err != nil {
+		nc.Close()
+		ns.Shutdown()
+		return nil, nil, nil, fmt.Errorf("%w: %v", kvErr, err)
+	}
+	return nc, ns, kv, nil
+}
+
+// verifyStore reads the latest entry for every key the bucket's index holds. The server
+// skips records it cannot read from a damaged block rather than failing to start, so an
+// entry that cannot be found means stored data was lost.
+func verifyStore(ctx context.Context, nc *nats.Conn, bucket string) error {
+	js, err := jetstream.New(nc)
+	if err != nil {
+		return err
+	}
+	stream, err := js.Stream(ctx, "KV_"+bucket)
+	if err != nil {
+		return err
+	}
+	info, err := stream.Info(ctx, jetstream.WithSubjectFilter(">"))
+	if err != nil {
+		return err
+	}
+	for subject := range info.State.Subjects {
+		if _, err := stream.GetLastMsgForSubject(ctx, subject); err != nil {
+			return fmt.Errorf("bucket %s lost %s: %v", bucket, subject, err)
+		}
+	}
+	return nil
+}
+
+// jetStreamDir is where the embedded server keeps its JetStream data inside storeDir.
+func jetStreamDir(storeDir string) string {
+	return filepath.Join(storeDir, server.JetStreamStoreDir)
+}
+
+// checkStoreDir makes sure the embedded server will be able to use storeDir, creating it if needed.
+func checkStoreDir(storeDir string) error {
+	dir := jetStreamDir(storeDir)
+	for _, path := range []string{storeDir, dir} {
+		info, err := os.Stat(path)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			return fmt.Errorf("%s is not a directory", path)
+		}
+	}
+
+	if err := os.MkdirAll(dir, 0o750); err != nil {
+		return err
+	}
+	probe, err := os.CreateTemp(dir, ".probe-*")
+	if err != nil {
+		return err
+	}
+	probe.Close()
+	return os.Remove(probe.Name())
+}
+
+// recoverStore applies the CorruptStorePolicy after the store failed with cause.
+// It returns nil once the store is ready to be used again.
+func recoverStore(ctx context.Context, logger *logging.Logger, opts Options, cause error) error {
+	if opts.CorruptStorePolicy != StoreWipe {
+		return fmt.Errorf("%w: %s: %v", ErrStoreCorrupt, opts.StoreDir, cause)
+	}
+
+	log := logger.WithContext(ctx)
+	log.Warn(fmt.Sprintf("⚠️ Store %s is unusable, wiping it: %v", opts.StoreDir, cause))
+	if err := os.RemoveAll(jetStreamDir(opts.StoreDir)); err != nil {
+		return fmt.Errorf("%w: %s: wipe failed: %v", ErrStoreCorrupt, opts.StoreDir, err)
+	}
+	if err := checkStoreDir(opts.StoreDir); err != nil {
+		return fmt.Errorf("%w: %s: %v", ErrStoreCorrupt, opts.StoreDir, err)
+	}
+	return nil
+}
@@ -0,0 +1,146 @@
+package natsclient
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+// TestNew_StoreDirSurvivesRestart verifies that a file-backed store keeps flights across restarts.
+func TestNew_StoreDirSurvivesRestart(t *testing.T) {
+	ctx := context.Background()
+	opts := Options{Offline: true, StoreDir: t.TempDir()}
+	const key = "flights.master.ANZ1.2025-09-15.0900.NZAA.NZWN"
+
+	client, err := New(ctx, newTestLogger(t), opts)
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	rev, err := client.InMemoryKV.Put(ctx, key, []byte(`{}`))
+	if err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	client.Shutdown()
+
+	client, err = New(ctx, newTestLogger(t), opts)
+	if err != nil {
+		t.Fatalf("New after restart failed: %v", err)
+	}
+	defer client.Shutdown()
+
+	entry, err := client.InMemoryKV.Get(ctx, key)
+	if err != nil {
+		t.Fatalf("flight did not survive the restart: %v", err)
+	}
+	if entry.Revision() != rev {
+		t.Errorf("expected revision %d after restart, got %d", rev, entry.Revision())
+	}
+}
+
+// TestNew_CorruptStoreDir verifies both policies for a store directory the server cannot use.
+func TestNew_CorruptStoreDir(t *testing.T) {
+	corrupt := func(t *testing.T) string {
+		dir := t.TempDir()
+		// A file where the server expects its 'jetstream' directory.
+		if err := os.WriteFile(jetStreamDir(dir), []byte("not a directory"), 0o600); err != nil {
+			t.Fatalf("WriteFile failed: %v", err)
+		}
+		return dir
+	}
+
+	t.Run("refuse", func(t *testing.T) {
+		dir := corrupt(t)
+		_, err := New(context.Background(), newTestLogger(t), Options{Offline: true, StoreDir: dir})
+		if !errors.Is(err, ErrStoreCorrupt) {
+			t.Fatalf("expected ErrStoreCorrupt, got %v", err)
+		}
+		if info, err := os.Stat(jetStreamDir(dir)); err != nil || info.IsDir() {
+			t.Error("expected the store to be left untouched")
+		}
+	})
+
+	t.Run("wipe", func(t *testing.T) {
+		dir := corrupt(t)
+		// Anything outside the 'jetstream' directory must survive the wipe.
+		keep := filepath.Join(dir, "keep.txt")
+		if err := os.WriteFile(keep, nil, 0o600); err != nil {
+			t.Fatalf("WriteFile failed: %v", err)
+		}
+
+		client, err := New(context.Background(), newTestLogger(t), Options{Offline: true, StoreDir: dir, CorruptStorePolicy: StoreWipe})
+		if err != nil {
+			t.Fatalf("New failed: %v", err)
+		}
+		defer client.Shutdown()
+
+		if info, err := os.Stat(jetStreamDir(dir)); err != nil || !info.IsDir() {
+			t.Errorf("expected the store to be rebuilt, got %v", err)
+		}
+		if _, err := os.Stat(keep); err != nil {
+			t.Errorf("expected files outside the store to be kept: %v", err)
+		}
+	})
+}
+
+// TestNew_CorruptStreamData verifies both policies for a store whose stream data was
+// damaged while the server was down. The server starts on it regardless, without the
+// records it could not read.
+func TestNew_CorruptStreamData(t *testing.T) {
+	ctx := context.Background()
+	const key = "flights.master.ANZ1.2025-09-15.0900.NZAA.NZWN"
+	corrupt := func(t *testing.T) (string, string) {
+		dir := t.TempDir()
+		client, err := New(ctx, newTestLogger(t), Options{Offline: true, StoreDir: dir})
+		if err != nil {
+			t.Fatalf("New failed: %v", err)
+		}
+		if _, err := client.InMemoryKV.Put(ctx, key, []byte(`{}`)); err != nil {
+			t.Fatalf("Put failed: %v", err)
+		}
+		client.Shutdown()
+
+		block := filepath.Join(jetStreamDir(dir), "$G", "streams", "KV_flights", "msgs", "1.blk")
+		data, err := os.ReadFile(block)
+		if err != nil {
+			t.Fatalf("ReadFile failed: %v", err)
+		}
+		for i := 10; i < 40 && i < len(data); i++ {
+			data[i] ^= 0xff
+		}
+		if err := os.WriteFile(block, data, 0o600); err != nil {
+			t.Fatalf("WriteFile failed: %v", err)
+		}
+		return dir, block
+	}
+
+	t.Run("refuse", func(t *testing.T) {
+		dir, block := corrupt(t)
+		_, err := New(ctx, newTestLogger(t), Options{Offline: true, StoreDir: dir})
+		if !errors.Is(err, ErrStoreCorrupt) {
+			t.Fatalf("expected ErrStoreCorrupt, got %v", err)
+		}
+		if _, err := os.Stat(block); err != nil {
+			t.Errorf("expected the store to be left untouched, got %v", err)
+		}
+	})
+
+	t.Run("wipe", func(t *testing.T) {
+		dir, _ := corrupt(t)
+		client, err := New(ctx, newTestLogger(t), Options{Offline: true, StoreDir: dir, CorruptStorePolicy: StoreWipe})
+		if err != nil {
+			t.Fatalf("New failed: %v", err)
+		}
+		defer client.Shutdown()
+
+		if _, err := client.InMemoryKV.Get(ctx, key); !errors.Is(err, jetstream.ErrKeyNotFound) {
+			t.Errorf("expected an empty store, got %v", err)
+		}
+		if _, err := client.InMemoryKV.Put(ctx, key, []byte(`{}`)); err != nil {
+			t.Errorf("expected the wiped store to be usable, got %v", err)
+		}
+	})
+}
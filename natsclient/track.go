@@ -0,0 +1,127 @@
+package natsclient
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/arcade55/nzflights-models"
+	"github.com/arcade55/nzflights_webui/keys"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+// Track stores a new flight in the user's list. It only succeeds if the user is not
+// already tracking the flight, so two tabs adding the same flight cannot clobber each other.
+// It returns the revision of the new entry.
+func (s *flightStore) Track(ctx context.Context, userID, flightID string, fv nzflights.FlightValue) (uint64, error) {
+	if s.cloudDown() {
+		return 0, errCloudDown
+	}
+	key, err := keys.OwnedFlight(userID, flightID)
+	if err != nil {
+		return 0, err
+	}
+	fv.NatsKey = key
+	data, err := json.Marshal(fv)
+	if err != nil {
+		return 0, err
+	}
+
+	rev, err := s.cloudKV.Create(ctx, key, data)
+	if errors.Is(err, jetstream.ErrKeyExists) {
+		return 0, fmt.Errorf("%w: %s", ErrFlightAlreadyTracked, key)
+	}
+	return rev, err
+}
+
+// UpdateUserFlight replaces a tracked flight, but only if it is still at lastRevision.
+// It returns the revision of the updated entry.
+func (s *flightStore) UpdateUserFlight(ctx context.Context, userID, flightID string, fv nzflights.FlightValue, lastRevision uint64) (uint64, error) {
+	if s.cloudDown() {
+		return 0, errCloudDown
+	}
+	key, err := keys.OwnedFlight(userID, flightID)
+	if err != nil {
+		return 0, err
+	}
+	fv.NatsKey = key
+	data, err := json.Marshal(fv)
+	if err != nil {
+		return 0, err
+	}
+
+	rev, err := s.cloudKV.Update(ctx, key, data, lastRevision)
+	if errors.Is(err, jetstream.ErrKeyExists) {
+		return 0, s.conflictError(ctx, key, lastRevision)
+	}
+	return rev, err
+}
+
+// Untrack removes a flight from the user's list. If lastRevision is zero the latest
+// revision is removed, otherwise the flight is only removed if it is still at lastRevision.
+func (s *flightStore) Untrack(ctx context.Context, userID, flightID string, lastRevision uint64) error {
+	if s.cloudDown() {
+		return errCloudDown
+	}
+	key, err := keys.OwnedFlight(userID, flightID)
+	if err != nil {
+		return err
+	}
+
+	if lastRevision == 0 {
+		entry, err := s.cloudKV.Get(ctx, key)
+		if errors.Is(err, jetstream.ErrKeyNotFound) {
+			return fmt.Errorf("%w: %s", ErrFlightNotTracked, key)
+		}
+		if err != nil {
+			return err
+		}
+		lastRevision = entry.Revision()
+	}
+
+	err = s.cloudKV.Delete(ctx, key, jetstream.LastRevision(lastRevision))
+	if errors.Is(err, jetstream.ErrKeyExists) {
+		return s.conflictError(ctx, key, lastRevision)
+	}
+	return err
+}
+
+// RestoreUserFlight tracks a removed flight again with the value it held at revision.
+// Like Track, it only succeeds if the flight is not tracked, so an undo cannot clobber
+// a flight added again in the meantime.
+func (s *flightStore) RestoreUserFlight(ctx context.Context, userID, flightID string, revision uint64) (uint64, error) {
+	if s.cloudDown() {
+		return 0, errCloudDown
+	}
+	key, err := keys.OwnedFlight(userID, flightID)
+	if err != nil {
+		return 0, err
+	}
+
+	entry, err := s.cloudKV.GetRevision(ctx, key, revision)
+	if errors.Is(err, jetstream.ErrKeyNotFound) || errors.Is(err, jetstream.ErrKeyDeleted) {
+		return 0, fmt.Errorf("%w: %s revision %d", ErrRevisionUnavailable, key, revision)
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	rev, err := s.cloudKV.Create(ctx, key, entry.Value())
+	if errors.Is(err, jetstream.ErrKeyExists) {
+		return 0, fmt.Errorf("%w: %s", ErrFlightAlreadyTracked, key)
+	}
+	return rev, err
+}
+
+// conflictError explains why a write expecting lastRevision was rejected.
+func (s *flightStore) conflictError(ctx context.Context, key string, lastRevision uint64) error {
+	entry, err := s.cloudKV.Get(ctx, key)
+	if errors.Is(err, jetstream.ErrKeyNotFound) || errors.Is(err, jetstream.ErrKeyDeleted) {
+		return fmt.Errorf("%w: %s", ErrFlightNotTracked, key)
+	}
+	if err != nil {
+		return fmt.Errorf("%w: %s expected revision %d", ErrRevisionConflict, key, lastRevision)
+	}
+	return fmt.Errorf("%w: %s expected revision %d, found %d", ErrRevisionConflict, key, lastRevision, entry.Revision())
+}
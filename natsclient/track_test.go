@@ -0,0 +1,100 @@
+package natsclient
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/arcade55/nzflights-models"
+	"github.com/arcade55/nzflights_webui/natsclient/kvtest"
+)
+
+// TestTrack_ConcurrencyGuards verifies that create-only and revision-guarded writes surface distinct errors.
+func TestTrack_ConcurrencyGuards(t *testing.T) {
+	kv, cleanup := setupTestKV(t)
+	defer cleanup()
+	ctx := context.Background()
+	store := newFlightStore(kv, kv, Options{})
+
+	fv := nzflights.FlightValue{ElementId: "NZ1", Flight: nzflights.Flight{Ident: "NZ1", Status: "Scheduled"}}
+
+	rev, err := store.Track(ctx, "u1", "NZ1", fv)
+	if err != nil {
+		t.Fatalf("Track failed: %v", err)
+	}
+
+	// A second tab adding the same flight must not overwrite the first.
+	if _, err := store.Track(ctx, "u1", "NZ1", fv); !errors.Is(err, ErrFlightAlreadyTracked) {
+		t.Errorf("expected ErrFlightAlreadyTracked, got %v", err)
+	}
+
+	fv.Flight.Status = "Boarding"
+	newRev, err := store.UpdateUserFlight(ctx, "u1", "NZ1", fv, rev)
+	if err != nil {
+		t.Fatalf("UpdateUserFlight failed: %v", err)
+	}
+
+	// A writer still holding the old revision loses.
+	if _, err := store.UpdateUserFlight(ctx, "u1", "NZ1", fv, rev); !errors.Is(err, ErrRevisionConflict) {
+		t.Errorf("expected ErrRevisionConflict on stale update, got %v", err)
+	}
+	if err := store.Untrack(ctx, "u1", "NZ1", rev); !errors.Is(err, ErrRevisionConflict) {
+		t.Errorf("expected ErrRevisionConflict on stale untrack, got %v", err)
+	}
+
+	if err := store.Untrack(ctx, "u1", "NZ1", newRev); err != nil {
+		t.Fatalf("Untrack failed: %v", err)
+	}
+	if err := store.Untrack(ctx, "u1", "NZ1", 0); !errors.Is(err, ErrFlightNotTracked) {
+		t.Errorf("expected ErrFlightNotTracked after untrack, got %v", err)
+	}
+	if _, err := store.UpdateUserFlight(ctx, "u1", "NZ1", fv, newRev); !errors.Is(err, ErrFlightNotTracked) {
+		t.Errorf("expected ErrFlightNotTracked updating an untracked flight, got %v", err)
+	}
+
+	// Tracking again after an untrack is allowed.
+	if _, err := store.Track(ctx, "u1", "NZ1", fv); err != nil {
+		t.Errorf("expected re-tracking to succeed, got %v", err)
+	}
+}
+
+// TestRestoreUserFlight verifies that an untracked flight can be restored from its previous
+// revision once, and not over a flight tracked again or from a purged history.
+func TestRestoreUserFlight(t *testing.T) {
+	kv := kvtest.NewHistoryKV(t)
+	ctx := context.Background()
+	store := newFlightStore(kv, kv, Options{})
+
+	fv := nzflights.FlightValue{ElementId: "NZ1", Flight: nzflights.Flight{Ident: "NZ1", Status: "Boarding"}}
+	rev, err := store.Track(ctx, "u1", "NZ1", fv)
+	if err != nil {
+		t.Fatalf("Track failed: %v", err)
+	}
+	if err := store.Untrack(ctx, "u1", "NZ1", rev); err != nil {
+		t.Fatalf("Untrack failed: %v", err)
+	}
+
+	restored, err := store.RestoreUserFlight(ctx, "u1", "NZ1", rev)
+	if err != nil {
+		t.Fatalf("RestoreUserFlight failed: %v", err)
+	}
+	result, err := store.GetFlights(ctx, []string{"users.u1.flights.owned.NZ1"})
+	if err != nil {
+		t.Fatalf("GetFlights failed: %v", err)
+	}
+	if flight := result.Found["users.u1.flights.owned.NZ1"]; flight.Revision != restored || flight.Value.Flight.Status != "Boarding" {
+		t.Errorf("expected the restored flight at revision %d, got %+v", restored, flight)
+	}
+
+	// A second undo must not clobber the restored flight.
+	if _, err := store.RestoreUserFlight(ctx, "u1", "NZ1", rev); !errors.Is(err, ErrFlightAlreadyTracked) {
+		t.Errorf("expected ErrFlightAlreadyTracked, got %v", err)
+	}
+
+	if err := kv.Purge(ctx, "users.u1.flights.owned.NZ1"); err != nil {
+		t.Fatalf("Purge failed: %v", err)
+	}
+	if _, err := store.RestoreUserFlight(ctx, "u1", "NZ1", restored); !errors.Is(err, ErrRevisionUnavailable) {
+		t.Errorf("expected ErrRevisionUnavailable after a purge, got %v", err)
+	}
+}
@@ -0,0 +1,197 @@
+// Package replay records the updates a Key-Value bucket goes through and plays them back.
+//
+// A recording is a JSONL file with one Entry per line: the key, revision, operation,
+// value and time of every update seen. Recording the flights bucket, or the watcher
+// behind a user's flight list, captures the exact sequence of updates they saw, and
+// replaying it into a local bucket reproduces it at the original or an accelerated speed.
+package replay
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/arcade55/nzflights_webui/natsclient"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+// Op is the operation an entry records.
+type Op int
+
+const (
+	// OpPut stores a value.
+	OpPut Op = iota
+	// OpDelete deletes a key, leaving its history.
+	OpDelete
+	// OpPurge deletes a key and its history.
+	OpPurge
+)
+
+func (o Op) String() string {
+	switch o {
+	case OpPut:
+		return "put"
+	case OpDelete:
+		return "delete"
+	case OpPurge:
+		return "purge"
+	default:
+		return fmt.Sprintf("Op(%d)", int(o))
+	}
+}
+
+// MarshalText writes the operation by name in recordings.
+func (o Op) MarshalText() ([]byte, error) {
+	return []byte(o.String()), nil
+}
+
+// UnmarshalText parses an operation name as written by MarshalText.
+func (o *Op) UnmarshalText(text []byte) error {
+	for _, op := range []Op{OpPut, OpDelete, OpPurge} {
+		if string(text) == op.String() {
+			*o = op
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown operation %q", text)
+}
+
+// Entry is one recorded update.
+type Entry struct {
+	Key      string    `json:"key"`
+	Revision uint64    `json:"revision"`
+	Op       Op        `json:"op"`
+	Value    []byte    `json:"value,omitempty"`
+	Time     time.Time `json:"time"`
+	// Source is the cache a FlightStore watcher read the entry from. It is empty for
+	// entries recorded straight from a bucket.
+	Source string `json:"source,omitempty"`
+}
+
+// EntryOf converts a Key-Value entry for recording.
+func EntryOf(kve jetstream.KeyValueEntry) Entry {
+	entry := Entry{
+		Key:      kve.Key(),
+		Revision: kve.Revision(),
+		Value:    kve.Value(),
+		Time:     kve.Created(),
+	}
+	switch kve.Operation() {
+	case jetstream.KeyValueDelete:
+		entry.Op = OpDelete
+	case jetstream.KeyValuePurge:
+		entry.Op = OpPurge
+	}
+	return entry
+}
+
+// Writer writes entries to a recording, one per line.
+type Writer struct {
+	enc *json.Encoder
+}
+
+// NewWriter returns a Writer that writes to w.
+func NewWriter(w io.Writer) *Writer {
+	return &Writer{enc: json.NewEncoder(w)}
+}
+
+// Write appends entry to the recording.
+func (w *Writer) Write(entry Entry) error {
+	return w.enc.Encode(entry)
+}
+
+// ReadAll reads every entry in a recording. Blank lines are skipped.
+func ReadAll(r io.Reader) ([]Entry, error) {
+	var entries []Entry
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), 16*1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var entry Entry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		entries = append(entries, entry)
+	}
+	return entries, scanner.Err()
+}
+
+// RecordOptions controls what Record captures.
+type RecordOptions struct {
+	// History starts the recording with every revision still in the bucket rather
+	// than only the current value of each key.
+	History bool
+	// UpdatesOnly skips the current values and records only updates made from now on.
+	UpdatesOnly bool
+}
+
+// Record writes every update to the keys matching patterns in kv until ctx is done.
+// The current value of each key is recorded first, unless opts say otherwise. Those
+// entries are stamped with the time the recording started rather than when they were
+// written, so a replay applies them at once instead of waiting out how old they are.
+// It returns nil once ctx is done or the watch ends.
+func Record(ctx context.Context, kv jetstream.KeyValue, patterns []string, w *Writer, opts RecordOptions) error {
+	var watchOpts []jetstream.WatchOpt
+	if opts.History {
+		watchOpts = append(watchOpts, jetstream.IncludeHistory())
+	}
+	if opts.UpdatesOnly {
+		watchOpts = append(watchOpts, jetstream.UpdatesOnly())
+	}
+	watcher, err := kv.WatchFiltered(ctx, patterns, watchOpts...)
+	if err != nil {
+		return err
+	}
+	defer watcher.Stop()
+
+	began := time.Now().UTC()
+	initial := !opts.UpdatesOnly
+	for {
+		select {
+		case kve, ok := <-watcher.Updates():
+			if !ok {
+				return nil
+			}
+			// A nil entry marks the end of the initial values.
+			if kve == nil {
+				initial = false
+				continue
+			}
+			entry := EntryOf(kve)
+			if initial {
+				entry.Time = began
+			}
+			if err := w.Write(entry); err != nil {
+				return err
+			}
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// RecordWatcher writes every update delivered by a FlightStore watcher until it stops
+// or ctx is done, capturing exactly what a consumer of the watcher saw. It does not
+// stop the watcher, and returns the watcher's error, if any.
+func RecordWatcher(ctx context.Context, watcher natsclient.Watcher, w *Writer) error {
+	for {
+		select {
+		case update, ok := <-watcher.Updates():
+			if !ok {
+				return watcher.Err()
+			}
+			entry := EntryOf(update)
+			entry.Source = update.Source.String()
+			if err := w.Write(entry); err != nil {
+				return err
+			}
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
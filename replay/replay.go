@@ -0,0 +1,103 @@
+package replay
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/arcade55/nzflights_webui/keys"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+// Options controls how a recording is played back.
+type Options struct {
+	// Speed is how many times faster than the original the entries are replayed.
+	// Defaults to 1.
+	Speed float64
+	// Rename maps each recorded key to the key it is replayed under. Entries it maps
+	// to "" are skipped. Defaults to replaying every key unchanged.
+	Rename func(key string) string
+}
+
+// Replay applies entries to kv in order, keeping the gaps between them as recorded
+// divided by opts.Speed. Revisions are not preserved: kv assigns its own.
+// It returns once every entry has been applied or ctx is done.
+func Replay(ctx context.Context, kv jetstream.KeyValue, entries []Entry, opts Options) error {
+	if opts.Speed <= 0 {
+		opts.Speed = 1
+	}
+	if len(entries) == 0 {
+		return nil
+	}
+
+	first := entries[0].Time
+	began := time.Now()
+	for _, entry := range entries {
+		wait := time.Duration(float64(entry.Time.Sub(first))/opts.Speed) - time.Since(began)
+		if wait > 0 {
+			select {
+			case <-time.After(wait):
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+
+		key := entry.Key
+		if opts.Rename != nil {
+			if key = opts.Rename(key); key == "" {
+				continue
+			}
+		}
+		if err := apply(ctx, kv, key, entry); err != nil {
+			return fmt.Errorf("failed to replay %s revision %d: %w", entry.Key, entry.Revision, err)
+		}
+	}
+	return nil
+}
+
+// apply makes the change recorded in entry to key.
+func apply(ctx context.Context, kv jetstream.KeyValue, key string, entry Entry) error {
+	var err error
+	switch entry.Op {
+	case OpPut:
+		_, err = kv.Put(ctx, key, entry.Value)
+	case OpDelete:
+		err = kv.Delete(ctx, key)
+	case OpPurge:
+		err = kv.Purge(ctx, key)
+	default:
+		err = fmt.Errorf("unknown operation %v", entry.Op)
+	}
+	return err
+}
+
+// AsUser returns a Rename function that replays every user's flights and sent shares
+// as userID's, so a recording of someone else's flight list shows up in a test user's.
+// Other keys, such as master flights, are replayed unchanged. It fails if userID cannot
+// be used in a key.
+func AsUser(userID string) (func(key string) string, error) {
+	if _, err := keys.Escape(userID); err != nil {
+		return nil, err
+	}
+	return func(key string) string {
+		parsed, err := keys.Parse(key)
+		if err != nil {
+			return key
+		}
+		var renamed string
+		switch parsed.Kind {
+		case keys.KindOwnedFlight:
+			renamed, err = keys.OwnedFlight(userID, parsed.FlightID)
+		case keys.KindSharedFlight:
+			renamed, err = keys.SharedFlight(userID, parsed.FlightID)
+		case keys.KindSentShare:
+			renamed, err = keys.SentShare(userID, parsed.ShareID)
+		default:
+			return key
+		}
+		if err != nil {
+			return key
+		}
+		return renamed
+	}, nil
+}
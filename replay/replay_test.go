@@ -0,0 +1,187 @@
+package replay
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/arcade55/nzflights_webui/keys"
+	"github.com/arcade55/nzflights_webui/natsclient"
+	"github.com/arcade55/nzflights_webui/natsclient/fake"
+	"github.com/arcade55/nzflights_webui/natsclient/kvtest"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+// TestRecordAndReplay verifies that a recording made from one bucket reproduces its
+// updates, including deletes, in another.
+func TestRecordAndReplay(t *testing.T) {
+	source := kvtest.NewHistoryKV(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if _, err := source.Put(ctx, "users.u1.flights.owned.NZ1", []byte(`{"status":"Scheduled"}`)); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+
+	// The current value is older than the recording, which must not replay its age.
+	time.Sleep(50 * time.Millisecond)
+	started := time.Now()
+
+	var buf bytes.Buffer
+	recordCtx, stopRecording := context.WithCancel(ctx)
+	recorded := make(chan error, 1)
+	go func() {
+		recorded <- Record(recordCtx, source, []string{"users.u1.>"}, NewWriter(&buf), RecordOptions{})
+	}()
+
+	// Only the first write is needed before the recording starts; these come after.
+	time.Sleep(100 * time.Millisecond)
+	source.Put(ctx, "users.u1.flights.owned.NZ1", []byte(`{"status":"Boarding"}`))
+	source.Put(ctx, "users.u1.flights.owned.NZ2", []byte(`{"status":"Scheduled"}`))
+	source.Put(ctx, "users.u2.flights.owned.NZ3", []byte(`{"status":"Scheduled"}`))
+	source.Delete(ctx, "users.u1.flights.owned.NZ2")
+	time.Sleep(100 * time.Millisecond)
+	stopRecording()
+	if err := <-recorded; err != nil {
+		t.Fatalf("Record failed: %v", err)
+	}
+
+	entries, err := ReadAll(&buf)
+	if err != nil {
+		t.Fatalf("ReadAll failed: %v", err)
+	}
+	var ops []string
+	for _, e := range entries {
+		ops = append(ops, e.Op.String()+" "+e.Key)
+	}
+	want := []string{
+		"put users.u1.flights.owned.NZ1",
+		"put users.u1.flights.owned.NZ1",
+		"put users.u1.flights.owned.NZ2",
+		"delete users.u1.flights.owned.NZ2",
+	}
+	if strings.Join(ops, "\n") != strings.Join(want, "\n") {
+		t.Fatalf("expected entries\n%s\ngot\n%s", strings.Join(want, "\n"), strings.Join(ops, "\n"))
+	}
+	if entries[0].Time.Before(started) {
+		t.Errorf("expected the current value to be stamped with the recording start, got %v before %v", entries[0].Time, started)
+	}
+
+	target := kvtest.NewHistoryKV(t)
+	rename, err := AsUser("test")
+	if err != nil {
+		t.Fatalf("AsUser failed: %v", err)
+	}
+	if err := Replay(ctx, target, entries, Options{Speed: 100, Rename: rename}); err != nil {
+		t.Fatalf("Replay failed: %v", err)
+	}
+	entry, err := target.Get(ctx, "users.test.flights.owned.NZ1")
+	if err != nil {
+		t.Fatalf("Get failed: %v", err)
+	}
+	if string(entry.Value()) != `{"status":"Boarding"}` || entry.Revision() != 2 {
+		t.Errorf("expected the latest value at revision 2, got %s at %d", entry.Value(), entry.Revision())
+	}
+	if _, err := target.Get(ctx, "users.test.flights.owned.NZ2"); !errors.Is(err, jetstream.ErrKeyNotFound) {
+		t.Errorf("expected the deleted flight to be gone, got %v", err)
+	}
+}
+
+// TestReplay_Speed verifies that the gaps between entries are kept, divided by the speed.
+func TestReplay_Speed(t *testing.T) {
+	kv := kvtest.NewHistoryKV(t)
+	start := time.Date(2025, 9, 15, 9, 0, 0, 0, time.UTC)
+	entries := []Entry{
+		{Key: "flights.master.a", Value: []byte("1"), Time: start},
+		{Key: "flights.master.a", Value: []byte("2"), Time: start.Add(400 * time.Millisecond)},
+	}
+
+	began := time.Now()
+	if err := Replay(context.Background(), kv, entries, Options{Speed: 2}); err != nil {
+		t.Fatalf("Replay failed: %v", err)
+	}
+	if elapsed := time.Since(began); elapsed < 200*time.Millisecond || elapsed > time.Second {
+		t.Errorf("expected the replay to take about 200ms, took %v", elapsed)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := Replay(ctx, kv, entries, Options{}); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected a canceled replay to stop, got %v", err)
+	}
+}
+
+// TestRecordWatcher verifies that a FlightStore watcher's updates are recorded with their source.
+func TestRecordWatcher(t *testing.T) {
+	store := fake.NewStore()
+	store.Source = natsclient.SourceCloud
+	store.Put("users.u1.flights.owned.NZ1", []byte(`{}`))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	watcher, err := store.WatchMultiple(ctx, []string{"users.u1.flights.owned.NZ1"})
+	if err != nil {
+		t.Fatalf("WatchMultiple failed: %v", err)
+	}
+	store.Put("users.u1.flights.owned.NZ1", []byte(`{"status":"Landed"}`))
+	time.AfterFunc(100*time.Millisecond, watcher.Stop)
+
+	var buf bytes.Buffer
+	if err := RecordWatcher(ctx, watcher, NewWriter(&buf)); err != nil {
+		t.Fatalf("RecordWatcher failed: %v", err)
+	}
+	entries, err := ReadAll(&buf)
+	if err != nil {
+		t.Fatalf("ReadAll failed: %v", err)
+	}
+	if len(entries) != 2 || entries[1].Revision != 2 || entries[1].Source != "cloud" ||
+		string(entries[1].Value) != `{"status":"Landed"}` {
+		t.Errorf("expected both revisions from the cloud, got %+v", entries)
+	}
+}
+
+// TestOp_Text verifies that operations round-trip through their names and unknown names are rejected.
+func TestOp_Text(t *testing.T) {
+	for _, op := range []Op{OpPut, OpDelete, OpPurge} {
+		text, _ := op.MarshalText()
+		var parsed Op
+		if err := parsed.UnmarshalText(text); err != nil || parsed != op {
+			t.Errorf("expected %v to round-trip, got %v, %v", op, parsed, err)
+		}
+	}
+	var op Op
+	if err := op.UnmarshalText([]byte("upsert")); err == nil {
+		t.Error("expected an unknown operation to be rejected")
+	}
+}
+
+// TestAsUser verifies that user keys are rebuilt for the new user, other keys are kept,
+// and a user ID that cannot be a key token is rejected.
+func TestAsUser(t *testing.T) {
+	rename, err := AsUser("test user")
+	if err != nil {
+		t.Fatalf("AsUser failed: %v", err)
+	}
+	owned, _ := keys.OwnedFlight("test user", "NZ1")
+	sent, _ := keys.SentShare("test user", "s1")
+	tests := map[string]string{
+		"users.u1.flights.owned.NZ1":                    owned,
+		"users.u1.shares.sent.s1":                       sent,
+		"flights.master.ANZ1.2025-09-15.0900.NZAA.NZWN": "flights.master.ANZ1.2025-09-15.0900.NZAA.NZWN",
+		"shares.pending.s1":                             "shares.pending.s1",
+	}
+	for key, want := range tests {
+		if got := rename(key); got != want {
+			t.Errorf("rename(%q): got %q, want %q", key, got, want)
+		}
+	}
+
+	for _, userID := range []string{"", "u*"} {
+		if _, err := AsUser(userID); !errors.Is(err, keys.ErrInvalidToken) {
+			t.Errorf("expected user ID %q to be rejected, got %v", userID, err)
+		}
+	}
+}
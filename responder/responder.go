@@ -0,0 +1,261 @@
+// Package responder stands in for the FlightAware ingestor during development and tests.
+//
+// It answers API fetch requests on api.flightaware.fetch.* by writing the requested
+// flight from a fixture catalogue into the flights KV as a flights.master entry, so the
+// "add flight → data appears" loop works without the real ingestor or network access.
+package responder
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/arcade55/nzflights-models"
+	"github.com/arcade55/nzflights_webui/keys"
+	"github.com/arcade55/nzflights_webui/natsclient"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+var (
+	// ErrUnknownFlight is reported for flights that are not in the catalogue.
+	ErrUnknownFlight = errors.New("flight is not in the catalogue")
+	// ErrInjectedFailure is reported for fetches failed on purpose by Options.
+	ErrInjectedFailure = errors.New("injected fetch failure")
+)
+
+// Options controls how the responder answers.
+type Options struct {
+	// Catalogue is the path of a JSON file of flights in the form read by LoadCatalogue.
+	Catalogue string `json:"catalogue"`
+	// Latency delays every answer, as a real upstream call would.
+	Latency time.Duration `json:"latency"`
+	// FailureRate is the chance, from 0 to 1, that a fetch fails.
+	FailureRate float64 `json:"failureRate"`
+	// FailFlights always fail, for deterministic tests.
+	FailFlights []string `json:"failFlights"`
+	// Now is the clock used for LastUpdated. Defaults to time.Now.
+	Now func() time.Time `json:"-"`
+}
+
+// UnmarshalJSON reads Options from a config file, where Latency is a string such as "250ms".
+func (o *Options) UnmarshalJSON(data []byte) error {
+	type plain Options
+	durations := struct {
+		*plain
+		Latency *natsclient.Duration `json:"latency"`
+	}{
+		plain:   (*plain)(o),
+		Latency: (*natsclient.Duration)(&o.Latency),
+	}
+	return json.Unmarshal(data, &durations)
+}
+
+// Catalogue holds the flights the responder knows about, by ident.
+type Catalogue map[string]nzflights.Flight
+
+// LoadCatalogue reads a catalogue from a file of the form {"scheduled_departures": [flight, ...]}.
+// Flights can then be fetched by their IATA or ICAO ident.
+func LoadCatalogue(path string) (Catalogue, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var file struct {
+		ScheduledDepartures []nzflights.Flight `json:"scheduled_departures"`
+	}
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal %s: %w", path, err)
+	}
+
+	catalogue := make(Catalogue)
+	for _, flight := range file.ScheduledDepartures {
+		for _, ident := range []string{flight.Ident, flight.IdentIATA, flight.IdentICAO} {
+			if ident != "" {
+				catalogue[strings.ToUpper(ident)] = flight
+			}
+		}
+	}
+	return catalogue, nil
+}
+
+// lookup finds a flight by any of its idents, ignoring case.
+func (c Catalogue) lookup(ident string) (nzflights.Flight, bool) {
+	flight, ok := c[strings.ToUpper(ident)]
+	return flight, ok
+}
+
+// Responder answers API fetch requests from a Catalogue.
+type Responder struct {
+	kv        jetstream.KeyValue
+	catalogue Catalogue
+	opts      Options
+	sub       *nats.Subscription
+	wg        sync.WaitGroup
+	ctx       context.Context
+	cancel    context.CancelFunc
+}
+
+// Start subscribes to API fetch requests on nc and answers them by writing flights into kv.
+// Requests are answered concurrently, so a slow answer does not hold up the others.
+func Start(nc *nats.Conn, kv jetstream.KeyValue, catalogue Catalogue, opts Options) (*Responder, error) {
+	if opts.Now == nil {
+		opts.Now = time.Now
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	r := &Responder{kv: kv, catalogue: catalogue, opts: opts, ctx: ctx, cancel: cancel}
+
+	sub, err := nc.Subscribe(natsclient.FetchSubjectPrefix+"*", func(msg *nats.Msg) {
+		r.wg.Add(1)
+		go func() {
+			defer r.wg.Done()
+			r.handle(msg)
+		}()
+	})
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	r.sub = sub
+	return r, nil
+}
+
+// Stop unsubscribes and waits for the answers in progress to finish.
+func (r *Responder) Stop() error {
+	err := r.sub.Unsubscribe()
+	r.cancel()
+	r.wg.Wait()
+	return err
+}
+
+// handle answers a single fetch request. Requests published without a body, as
+// Client.TriggerAPIFetch does, take the flight ID from the subject and get no reply.
+func (r *Responder) handle(msg *nats.Msg) {
+	var req natsclient.FetchRequest
+	if len(msg.Data) > 0 {
+		if err := json.Unmarshal(msg.Data, &req); err != nil {
+			r.reply(msg, natsclient.FetchReply{Status: natsclient.FetchFailed, Error: fmt.Sprintf("bad request: %v", err)})
+			return
+		}
+	}
+	if req.FlightID == "" {
+		id, err := keys.Unescape(strings.TrimPrefix(msg.Subject, natsclient.FetchSubjectPrefix))
+		if err != nil {
+			r.reply(msg, natsclient.FetchReply{Status: natsclient.FetchFailed, Error: err.Error()})
+			return
+		}
+		req.FlightID = id
+	}
+
+	reply := natsclient.FetchReply{FlightID: req.FlightID, Status: natsclient.FetchComplete, CorrelationID: req.CorrelationID}
+	key, err := r.fetch(req)
+	if err != nil {
+		reply.Status = natsclient.FetchFailed
+		reply.Error = err.Error()
+	}
+	reply.Key = key
+	r.reply(msg, reply)
+}
+
+// fetch writes the flight requested by req into the KV after the configured latency,
+// and adds it to the requester's flights when the request names one. It returns the
+// flight's master key once that is written.
+func (r *Responder) fetch(req natsclient.FetchRequest) (string, error) {
+	select {
+	case <-time.After(r.opts.Latency):
+	case <-r.ctx.Done():
+		return "", r.ctx.Err()
+	}
+
+	if r.fail(req.FlightID) {
+		return "", fmt.Errorf("%w: %s", ErrInjectedFailure, req.FlightID)
+	}
+	flight, ok := r.catalogue.lookup(req.FlightID)
+	if !ok {
+		return "", fmt.Errorf("%w: %s", ErrUnknownFlight, req.FlightID)
+	}
+
+	fv, err := FlightValue(flight, r.opts.Now())
+	if err != nil {
+		return "", err
+	}
+	fv.CorrelationID = req.CorrelationID
+	data, err := json.Marshal(fv)
+	if err != nil {
+		return "", err
+	}
+	if _, err := r.kv.Put(r.ctx, fv.NatsKey, data); err != nil {
+		return "", err
+	}
+	if req.Requester == "" {
+		return fv.NatsKey, nil
+	}
+	return fv.NatsKey, r.track(req.Requester, fv)
+}
+
+// track adds fv to the user's flights, as natsclient.FlightStore.Track does. A flight
+// the user already tracks is left as it is.
+func (r *Responder) track(userID string, fv nzflights.FlightValue) error {
+	key, err := keys.OwnedFlight(userID, fv.ElementId)
+	if err != nil {
+		return err
+	}
+	fv.NatsKey = key
+	data, err := json.Marshal(fv)
+	if err != nil {
+		return err
+	}
+	if _, err := r.kv.Create(r.ctx, key, data); err != nil && !errors.Is(err, jetstream.ErrKeyExists) {
+		return err
+	}
+	return nil
+}
+
+// fail decides whether to inject a failure for flightID.
+func (r *Responder) fail(flightID string) bool {
+	if slices.ContainsFunc(r.opts.FailFlights, func(f string) bool { return strings.EqualFold(f, flightID) }) {
+		return true
+	}
+	return r.opts.FailureRate > 0 && rand.Float64() < r.opts.FailureRate
+}
+
+// reply answers msg if its sender is waiting for one.
+func (r *Responder) reply(msg *nats.Msg, reply natsclient.FetchReply) {
+	if msg.Reply == "" {
+		return
+	}
+	data, err := json.Marshal(reply)
+	if err != nil {
+		return
+	}
+	msg.Respond(data)
+}
+
+// FlightValue builds the flights.master value the ingestor would store for flight.
+func FlightValue(flight nzflights.Flight, now time.Time) (nzflights.FlightValue, error) {
+	if flight.Status == "" {
+		flight.Status = "Scheduled"
+	}
+	master, err := keys.MasterFlightFor(flight)
+	if err != nil {
+		return nzflights.FlightValue{}, err
+	}
+	key, err := master.Key()
+	if err != nil {
+		return nzflights.FlightValue{}, err
+	}
+	return nzflights.FlightValue{
+		ElementId:   flight.Ident,
+		NatsKey:     key,
+		LastUpdated: now,
+		Flight:      flight,
+	}, nil
+}
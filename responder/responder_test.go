@@ -0,0 +1,210 @@
+package responder
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/arcade55/logging"
+	"github.com/arcade55/nzflights-models"
+	"github.com/arcade55/nzflights_webui/natsclient"
+	"github.com/arcade55/nzflights_webui/server/handlers/middleware"
+	"github.com/arcade55/nzflights_webui/server/handlers/sse"
+)
+
+// startOffline runs an offline client with a responder answering its API fetches.
+func startOffline(t *testing.T, opts Options) *natsclient.Client {
+	t.Helper()
+	logger, _, err := logging.Init(context.Background(), logging.Config{
+		Format: logging.FormatPretty,
+		Level:  logging.LevelInfo,
+	})
+	if err != nil {
+		t.Fatalf("logger init failed: %v", err)
+	}
+	client, err := natsclient.New(context.Background(), logger, natsclient.Options{Offline: true, FetchTimeout: 2 * time.Second})
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	t.Cleanup(client.Shutdown)
+
+	catalogue, err := LoadCatalogue("testdata/scheduled_departures.json")
+	if err != nil {
+		t.Fatalf("LoadCatalogue failed: %v", err)
+	}
+	resp, err := Start(client.Local, client.InMemoryKV, catalogue, opts)
+	if err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	t.Cleanup(func() { resp.Stop() })
+	return client
+}
+
+// TestResponder_FetchWritesFlight verifies the add flight → data appears loop offline.
+func TestResponder_FetchWritesFlight(t *testing.T) {
+	now := time.Date(2025, 9, 15, 8, 0, 0, 0, time.UTC)
+	client := startOffline(t, Options{Latency: 10 * time.Millisecond, Now: func() time.Time { return now }})
+	ctx := context.Background()
+
+	reply, err := client.Fetcher.Fetch(ctx, "nz123", "u1")
+	if err != nil {
+		t.Fatalf("Fetch failed: %v", err)
+	}
+	if reply.Status != natsclient.FetchComplete {
+		t.Errorf("expected a complete fetch, got %+v", reply)
+	}
+
+	const key = "flights.master.ANZ123.2025-09-15.0900.NZAA.NZWN"
+	result, err := client.Flights.GetFlights(ctx, []string{key, "users.u1.flights.owned.NZ123"})
+	if err != nil {
+		t.Fatalf("GetFlights failed: %v", err)
+	}
+	flight, ok := result.Found[key]
+	if !ok {
+		t.Fatalf("expected %s to be written, got %+v", key, result)
+	}
+	if flight.Value.ElementId != "NZ123" || flight.Value.NatsKey != key || !flight.Value.LastUpdated.Equal(now) {
+		t.Errorf("unexpected flight value %+v", flight.Value)
+	}
+	if reply.Key != key {
+		t.Errorf("expected the reply to carry %s, got %+v", key, reply)
+	}
+	owned, ok := result.Found["users.u1.flights.owned.NZ123"]
+	if !ok || owned.Value.NatsKey != "users.u1.flights.owned.NZ123" || owned.Value.Flight.Ident != "NZ123" {
+		t.Errorf("expected the flight to be added to the requester's flights, got %+v", result)
+	}
+
+	// A bare trigger has no reply but still writes the flight.
+	if err := client.TriggerAPIFetch("QF140"); err != nil {
+		t.Fatalf("TriggerAPIFetch failed: %v", err)
+	}
+	const qantas = "flights.master.QFA140.2025-09-15.0810.NZAA.YSSY"
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		if _, err := client.InMemoryKV.Get(ctx, qantas); err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected %s to be written after a trigger", qantas)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// TestResponder_AddedFlightShowsInFlightLists verifies that a flight added by two users,
+// who share one fetch, appears in both of their open flight lists and nobody else's. A
+// copy the requester already has is kept.
+func TestResponder_AddedFlightShowsInFlightLists(t *testing.T) {
+	client := startOffline(t, Options{})
+	ctx := t.Context()
+
+	// u1 already tracks NZ123 under a note of their own.
+	tracked := nzflights.FlightValue{ElementId: "NZ123", Flight: nzflights.Flight{Ident: "NZ123", Status: "Tracked before"}}
+	rev, err := client.Flights.Track(ctx, "u1", "NZ123", tracked)
+	if err != nil {
+		t.Fatalf("Track failed: %v", err)
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("GET /sse/flights", &sse.FlightSSEHandler{KV: client.InMemoryKV, Flights: client.Flights, Hub: client.Hub, State: client.State})
+	mux.Handle("POST /flights/add", &sse.AddFlightHandler{Fetcher: client.Fetcher, Flights: client.Flights})
+	server := httptest.NewServer(mux)
+	// Registered first so it runs last, once the streams below have been closed.
+	t.Cleanup(server.Close)
+
+	request := func(method, path, visitor string) *http.Response {
+		t.Helper()
+		req, _ := http.NewRequestWithContext(ctx, method, server.URL+path, nil)
+		req.AddCookie(&http.Cookie{Name: middleware.VisitorCookieName, Value: visitor})
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Request failed: %v", err)
+		}
+		t.Cleanup(func() { res.Body.Close() })
+		return res
+	}
+	open := func(visitor string) <-chan string {
+		res := request("GET", "/sse/flights", visitor)
+		lines := make(chan string)
+		go func() {
+			defer close(lines)
+			scanner := bufio.NewScanner(res.Body)
+			for scanner.Scan() {
+				select {
+				case lines <- scanner.Text():
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+		return lines
+	}
+	// waitFor reads lines until one contains want, reporting whether it came in time.
+	waitFor := func(lines <-chan string, want string, timeout time.Duration) bool {
+		deadline := time.After(timeout)
+		for {
+			select {
+			case line, ok := <-lines:
+				if !ok {
+					return false
+				}
+				if strings.Contains(line, want) {
+					return true
+				}
+			case <-deadline:
+				return false
+			}
+		}
+	}
+
+	first, second, other := open("u1"), open("u2"), open("u3")
+	if !waitFor(first, "flight-NZ123", 2*time.Second) {
+		t.Fatal("expected u1's list to start with NZ123")
+	}
+	for _, lines := range []<-chan string{second, other} {
+		if !waitFor(lines, "mode replace", 2*time.Second) {
+			t.Fatal("expected the initial flight list")
+		}
+	}
+
+	for _, visitor := range []string{"u1", "u2"} {
+		res := request("POST", "/flights/add?flight=NZ123", visitor)
+		body, _ := io.ReadAll(res.Body)
+		if strings.Contains(string(body), "NZ123") {
+			t.Errorf("%s: expected the flight to be added without a notice, got %q", visitor, body)
+		}
+	}
+	if !waitFor(second, "flight-NZ123", 2*time.Second) {
+		t.Error("expected NZ123 to appear in u2's flight list")
+	}
+	if waitFor(other, "flight-NZ123", 300*time.Millisecond) {
+		t.Error("expected NZ123 to stay out of other users' flight lists")
+	}
+
+	result, err := client.Flights.GetFlights(ctx, []string{"users.u1.flights.owned.NZ123"})
+	if err != nil {
+		t.Fatalf("GetFlights failed: %v", err)
+	}
+	if flight := result.Found["users.u1.flights.owned.NZ123"]; flight.Revision != rev || flight.Value.Flight.Status != "Tracked before" {
+		t.Errorf("expected u1's copy to be kept, got %+v", flight)
+	}
+}
+
+// TestResponder_Failures verifies that unknown flights and injected failures are reported to the requester.
+func TestResponder_Failures(t *testing.T) {
+	client := startOffline(t, Options{FailFlights: []string{"NZ421"}})
+	ctx := context.Background()
+
+	for _, flightID := range []string{"NZ421", "XX999"} {
+		reply, err := client.Fetcher.Fetch(ctx, flightID, "u1")
+		if !errors.Is(err, natsclient.ErrFetchFailed) || reply.Status != natsclient.FetchFailed {
+			t.Errorf("%s: expected a failed fetch, got %+v, %v", flightID, reply, err)
+		}
+	}
+}
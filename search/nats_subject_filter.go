@@ -1,143 +1,321 @@
 package search
 
-/*
 import (
 	"context"
 	"fmt"
-	"log"
+	"iter"
 	"strings"
+	"sync"
 	"time"
+	"unicode"
 
+	"github.com/arcade55/nzflights-models"
+	"github.com/arcade55/nzflights_webui/keys"
 	"github.com/nats-io/nats.go/jetstream"
 )
 
-// --- NEW: KeyFilterBuilder for creating readable and error-free filters ---
+// --- KeyFilterBuilder for creating readable and error-free filters ---
 
 const (
-	// These constants map to the token positions in your key structure.
-	// flights.{fa_flight_id}.{year}.{month}.{day}.{hour}.{min}.{sec}.{ident}.{origin}.{dest}
-	tokenCount         = 11
-	tokenIdxFAFlightID = 1
-	tokenIdxYear       = 2
-	tokenIdxMonth      = 3
-	tokenIdxDay        = 4
-	tokenIdxHour       = 5
-	tokenIdxMinute     = 6
-	tokenIdxSecond     = 7
-	tokenIdxIdent      = 8
-	tokenIdxOrigin     = 9
-	tokenIdxDest       = 10
+	// These constants map to the token positions in the master flight key.
+	// flights.master.{ident}.{YYYY-MM-DD}.{HHMM}.{origin}.{dest}
+	tokenCount     = 7
+	tokenIdxIdent  = 2
+	tokenIdxDate   = 3
+	tokenIdxTime   = 4
+	tokenIdxOrigin = 5
+	tokenIdxDest   = 6
+
+	dateLayout = "2006-01-02"
 )
 
-// KeyFilterBuilder provides a fluent interface to build NATS KV filter strings.
+// KeyFilterBuilder provides a fluent interface to query the flights.master keys.
+//
+// Whole tokens (ident, date, route) narrow the NATS subject filter so the server
+// does the work. An hour cannot be expressed as a subject, so it is checked on each
+// key as it streams past. Part of an ident is checked on the decoded flight with
+// MatchFlight, as the key only holds the ICAO ident (ANZ123) and users mostly type
+// the IATA one (NZ123).
 type KeyFilterBuilder struct {
 	tokens []string
+	hour   int
+	ident  string
+	err    error
 }
 
-// NewFilterBuilder initializes a builder for the 'flights' bucket.
+// NewFilterBuilder initializes a builder that matches every master flight.
 func NewFilterBuilder() *KeyFilterBuilder {
 	tokens := make([]string, tokenCount)
 	tokens[0] = "flights"
-	for i := 1; i < tokenCount; i++ {
+	tokens[1] = "master"
+	for i := 2; i < tokenCount; i++ {
 		tokens[i] = "*" // Default to wildcard
 	}
-	return &KeyFilterBuilder{tokens: tokens}
+	return &KeyFilterBuilder{tokens: tokens, hour: -1}
 }
 
-// WithDate sets the year, month, and day for the filter.
+// WithDate sets the scheduled departure date.
 func (b *KeyFilterBuilder) WithDate(year int, month time.Month, day int) *KeyFilterBuilder {
-	b.tokens[tokenIdxYear] = fmt.Sprintf("%04d", year)
-	b.tokens[tokenIdxMonth] = fmt.Sprintf("%02d", month)
-	b.tokens[tokenIdxDay] = fmt.Sprintf("%02d", day)
+	b.tokens[tokenIdxDate] = time.Date(year, month, day, 0, 0, 0, 0, time.UTC).Format(dateLayout)
 	return b
 }
 
-// WithHour sets the hour for the filter. It requires WithDate to be set first.
+// WithHour keeps flights scheduled to depart within the given hour.
 func (b *KeyFilterBuilder) WithHour(hour int) *KeyFilterBuilder {
-	b.tokens[tokenIdxHour] = fmt.Sprintf("%02d", hour)
+	if hour < 0 || hour > 23 {
+		b.fail(fmt.Errorf("hour %d out of range", hour))
+		return b
+	}
+	b.hour = hour
 	return b
 }
 
-// WithIdent sets the airline identifier (e.g., "ANZ5023").
+// WithIdent sets the exact flight identifier used in the key (e.g., "ANZ5023").
 func (b *KeyFilterBuilder) WithIdent(ident string) *KeyFilterBuilder {
-	b.tokens[tokenIdxIdent] = ident
+	return b.set(tokenIdxIdent, ident)
+}
+
+// WithIdentContaining keeps flights whose ICAO or IATA identifier contains part, ignoring
+// case. It is checked by MatchFlight, not Build or Match.
+func (b *KeyFilterBuilder) WithIdentContaining(part string) *KeyFilterBuilder {
+	b.ident = strings.ToUpper(part)
 	return b
 }
 
 // WithRoute sets both the origin and destination.
 func (b *KeyFilterBuilder) WithRoute(origin, destination string) *KeyFilterBuilder {
-	b.tokens[tokenIdxOrigin] = origin
-	b.tokens[tokenIdxDest] = destination
-	return b
+	return b.WithOrigin(origin).WithDestination(destination)
+}
+
+// WithOrigin sets the origin airport.
+func (b *KeyFilterBuilder) WithOrigin(origin string) *KeyFilterBuilder {
+	return b.set(tokenIdxOrigin, origin)
 }
 
 // WithDestination sets the destination airport.
 func (b *KeyFilterBuilder) WithDestination(destination string) *KeyFilterBuilder {
-	b.tokens[tokenIdxDest] = destination
+	return b.set(tokenIdxDest, destination)
+}
+
+// set escapes value into a single token, remembering the first failure for Build.
+func (b *KeyFilterBuilder) set(idx int, value string) *KeyFilterBuilder {
+	token, err := keys.Escape(value)
+	if err != nil {
+		b.fail(err)
+		return b
+	}
+	b.tokens[idx] = token
 	return b
 }
 
-// Build constructs the final filter string.
-// Use 'useTrailingWildcard' as 'true' for date/time ranges (e.g., all flights in a day).
-func (b *KeyFilterBuilder) Build(useTrailingWildcard bool) string {
-	if useTrailingWildcard {
-		return strings.Join(b.tokens, ".") + ".>"
+func (b *KeyFilterBuilder) fail(err error) {
+	if b.err == nil {
+		b.err = err
+	}
+}
+
+// Build constructs the NATS subject filter. Trailing wildcards collapse into '>'.
+func (b *KeyFilterBuilder) Build() (string, error) {
+	if b.err != nil {
+		return "", b.err
 	}
-	// Trim trailing wildcards for more specific queries like destination only
+
 	lastTokenIndex := tokenCount - 1
-	for lastTokenIndex > 0 && b.tokens[lastTokenIndex] == "*" {
+	for lastTokenIndex > tokenIdxIdent-1 && b.tokens[lastTokenIndex] == "*" {
 		lastTokenIndex--
 	}
+	if lastTokenIndex == tokenCount-1 {
+		return strings.Join(b.tokens, "."), nil
+	}
+	return strings.Join(b.tokens[:lastTokenIndex+1], ".") + ".>", nil
+}
+
+// Match reports whether key satisfies the partial matches that Build cannot express.
+func (b *KeyFilterBuilder) Match(key string) bool {
+	flight, err := keys.ParseMasterFlight(key)
+	if err != nil {
+		return false
+	}
+	if b.hour >= 0 && flight.Scheduled.Hour() != b.hour {
+		return false
+	}
+	return true
+}
+
+// MatchFlight reports whether a decoded flight satisfies WithIdentContaining. Any of
+// its identifiers may match.
+func (b *KeyFilterBuilder) MatchFlight(fv nzflights.FlightValue) bool {
+	if b.ident == "" {
+		return true
+	}
+	for _, ident := range []string{fv.Flight.Ident, fv.Flight.IdentIATA, fv.Flight.IdentICAO} {
+		if ident != "" && strings.Contains(strings.ToUpper(ident), b.ident) {
+			return true
+		}
+	}
+	return false
+}
+
+// MatchKeyIdent reports whether the flight under key may satisfy WithIdentContaining,
+// judging from the ident in the key alone: the ICAO ident, and the IATA one once
+// airlines knows the airline. A flight of an airline not known yet may match, so it
+// has to be fetched and checked with MatchFlight.
+func (b *KeyFilterBuilder) MatchKeyIdent(key string, airlines *Airlines) bool {
+	if b.ident == "" {
+		return true
+	}
+	flight, err := keys.ParseMasterFlight(key)
+	if err != nil {
+		return false
+	}
+	ident := strings.ToUpper(flight.Ident)
+	if strings.Contains(ident, b.ident) {
+		return true
+	}
+	iata, ok := airlines.iataIdent(ident)
+	return !ok || strings.Contains(iata, b.ident)
+}
 
-	// If everything is a wildcard, we need to add a > to get all flights
-	if lastTokenIndex == 0 {
-		return "flights.>"
+// Airlines remembers the IATA designator of each airline in the flights.master keys,
+// learned from the flights stored under them, so a search for an IATA ident can be
+// checked against the key's ICAO ident without fetching the flight.
+// The zero value is ready to use, and it is safe for concurrent use.
+type Airlines struct {
+	mu   sync.RWMutex
+	iata map[string]string
+}
+
+// Learn records the IATA airline of fv, the flight stored under key.
+func (a *Airlines) Learn(key string, fv nzflights.FlightValue) {
+	flight, err := keys.ParseMasterFlight(key)
+	if err != nil {
+		return
+	}
+	airline, number := splitIdent(strings.ToUpper(flight.Ident))
+	if airline == "" || number == "" {
+		return
+	}
+	// A flight whose other idents are missing or the same as the key's says nothing
+	// about the airline, which stays unknown.
+	var iata string
+	for _, ident := range []string{fv.Flight.IdentIATA, fv.Flight.Ident} {
+		if prefix, ok := strings.CutSuffix(strings.ToUpper(ident), number); ok && prefix != "" && prefix != airline {
+			iata = prefix
+			break
+		}
+	}
+	if iata == "" {
+		return
 	}
 
-	return strings.Join(b.tokens[:lastTokenIndex+1], ".")
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.iata == nil {
+		a.iata = make(map[string]string)
+	}
+	a.iata[airline] = iata
 }
 
-// --- UPDATED: Filter functions using the new KeyFilterBuilder ---
+// iataIdent returns the IATA form of the ICAO ident from a key, if its airline is known.
+func (a *Airlines) iataIdent(ident string) (string, bool) {
+	airline, number := splitIdent(ident)
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	iata, ok := a.iata[airline]
+	return iata + number, ok
+}
 
-// FilterByDate retrieves all flight keys for a specific year, month, and day.
-func FilterByDate(ctx context.Context, kv jetstream.KeyValue, year int, month time.Month, day int) ([]string, error) {
-	filter := NewFilterBuilder().WithDate(year, month, day).Build(true)
-	log.Printf("Using filter: %s", filter)
-	return kv.Keys(ctx, jetstream.KeysFilter(filter))
+// splitIdent splits an ident such as ANZ123 into its airline and flight number.
+func splitIdent(ident string) (airline, number string) {
+	i := strings.IndexFunc(ident, unicode.IsDigit)
+	if i < 0 {
+		return ident, ""
+	}
+	return ident[:i], ident[i:]
 }
 
-// FilterByHour retrieves all flight keys for a specific hour on a specific date.
-func FilterByHour(ctx context.Context, kv jetstream.KeyValue, year int, month time.Month, day int, hour int) ([]string, error) {
-	filter := NewFilterBuilder().WithDate(year, month, day).WithHour(hour).Build(true)
-	log.Printf("Using filter: %s", filter)
-	return kv.Keys(ctx, jetstream.KeysFilter(filter))
+// Keys streams the keys from kv that match Build and Match. Iteration stops at the first error,
+// which is yielded with an empty key. Breaking out of the loop early stops the listing.
+func (b *KeyFilterBuilder) Keys(ctx context.Context, kv jetstream.KeyValue) iter.Seq2[string, error] {
+	return func(yield func(string, error) bool) {
+		filter, err := b.Build()
+		if err != nil {
+			yield("", err)
+			return
+		}
+
+		// Cancelling releases the lister if the caller stops early.
+		ctx, cancel := context.WithCancel(ctx)
+		defer cancel()
+
+		lister, err := kv.ListKeysFiltered(ctx, filter)
+		if err != nil {
+			yield("", err)
+			return
+		}
+		defer lister.Stop()
+
+		for key := range lister.Keys() {
+			if !b.Match(key) {
+				continue
+			}
+			if !yield(key, nil) {
+				return
+			}
+		}
+		if err := ctx.Err(); err != nil {
+			yield("", err)
+		}
+	}
+}
+
+// --- Filter functions using the KeyFilterBuilder ---
+
+// FilterByDate streams all flight keys for a specific year, month, and day.
+func FilterByDate(ctx context.Context, kv jetstream.KeyValue, year int, month time.Month, day int) iter.Seq2[string, error] {
+	return NewFilterBuilder().WithDate(year, month, day).Keys(ctx, kv)
 }
 
-// FilterByAirline retrieves all flight keys for a specific airline identifier.
-func FilterByAirline(ctx context.Context, kv jetstream.KeyValue, ident string) ([]string, error) {
-	filter := NewFilterBuilder().WithIdent(ident).Build(false)
-	log.Printf("Using filter: %s", filter)
-	return kv.Keys(ctx, jetstream.KeysFilter(filter))
+// FilterByHour streams all flight keys for a specific hour on a specific date.
+func FilterByHour(ctx context.Context, kv jetstream.KeyValue, year int, month time.Month, day int, hour int) iter.Seq2[string, error] {
+	return NewFilterBuilder().WithDate(year, month, day).WithHour(hour).Keys(ctx, kv)
 }
 
-// FilterByRoute retrieves all flight keys for a specific route.
-func FilterByRoute(ctx context.Context, kv jetstream.KeyValue, origin, destination string) ([]string, error) {
-	filter := NewFilterBuilder().WithRoute(origin, destination).Build(false)
-	log.Printf("Using filter: %s", filter)
-	return kv.Keys(ctx, jetstream.KeysFilter(filter))
+// FilterByAirline streams all flight keys for a specific flight identifier.
+func FilterByAirline(ctx context.Context, kv jetstream.KeyValue, ident string) iter.Seq2[string, error] {
+	return NewFilterBuilder().WithIdent(ident).Keys(ctx, kv)
 }
 
-// FilterByDestination retrieves all flight keys to a specific destination.
-func FilterByDestination(ctx context.Context, kv jetstream.KeyValue, destination string) ([]string, error) {
-	filter := NewFilterBuilder().WithDestination(destination).Build(false)
-	log.Printf("Using filter: %s", filter)
-	return kv.Keys(ctx, jetstream.KeysFilter(filter))
+// FilterByRoute streams all flight keys for a specific route.
+func FilterByRoute(ctx context.Context, kv jetstream.KeyValue, origin, destination string) iter.Seq2[string, error] {
+	return NewFilterBuilder().WithRoute(origin, destination).Keys(ctx, kv)
 }
 
-// FilterByAirlineAndDate retrieves flights for a specific airline on a given date.
-func FilterByAirlineAndDate(ctx context.Context, kv jetstream.KeyValue, ident string, year int, month time.Month, day int) ([]string, error) {
-	filter := NewFilterBuilder().WithDate(year, month, day).WithIdent(ident).Build(true)
-	log.Printf("Using filter: %s", filter)
-	return kv.Keys(ctx, jetstream.KeysFilter(filter))
+// FilterByDestination streams all flight keys to a specific destination.
+func FilterByDestination(ctx context.Context, kv jetstream.KeyValue, destination string) iter.Seq2[string, error] {
+	return NewFilterBuilder().WithDestination(destination).Keys(ctx, kv)
+}
+
+// FilterByAirlineAndDate streams flights for a specific flight identifier on a given date.
+func FilterByAirlineAndDate(ctx context.Context, kv jetstream.KeyValue, ident string, year int, month time.Month, day int) iter.Seq2[string, error] {
+	return NewFilterBuilder().WithDate(year, month, day).WithIdent(ident).Keys(ctx, kv)
+}
+
+// ParseTerm turns free text from the search box into a builder. Each word is
+// read as a date (2025-09-15), a route between ICAO airports (NZAA-NZWN), or
+// otherwise as part of a flight identifier.
+func ParseTerm(term string) *KeyFilterBuilder {
+	b := NewFilterBuilder()
+	for _, word := range strings.Fields(term) {
+		if date, err := time.Parse(dateLayout, word); err == nil {
+			b.WithDate(date.Year(), date.Month(), date.Day())
+			continue
+		}
+		if origin, destination, ok := strings.Cut(word, "-"); ok && origin != "" && destination != "" {
+			b.WithRoute(strings.ToUpper(origin), strings.ToUpper(destination))
+			continue
+		}
+		b.WithIdentContaining(word)
+	}
+	return b
 }
-*/
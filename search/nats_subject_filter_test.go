@@ -0,0 +1,142 @@
+package search
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/arcade55/nzflights-models"
+	"github.com/arcade55/nzflights_webui/keys"
+	"github.com/arcade55/nzflights_webui/natsclient/kvtest"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+// TestKeyFilterBuilder_Build verifies the subject filters for the master flight key layout.
+func TestKeyFilterBuilder_Build(t *testing.T) {
+	tests := map[string]struct {
+		builder *KeyFilterBuilder
+		want    string
+	}{
+		"everything":       {NewFilterBuilder(), "flights.master.>"},
+		"date":             {NewFilterBuilder().WithDate(2025, time.September, 1), "flights.master.*.2025-09-01.>"},
+		"ident":            {NewFilterBuilder().WithIdent("ANZ5023"), "flights.master.ANZ5023.>"},
+		"route":            {NewFilterBuilder().WithRoute("NZAA", "NZCH"), "flights.master.*.*.*.NZAA.NZCH"},
+		"destination":      {NewFilterBuilder().WithDestination("NZCH"), "flights.master.*.*.*.*.NZCH"},
+		"partial in Match": {NewFilterBuilder().WithHour(8).WithIdentContaining("nz5"), "flights.master.>"},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			got, err := tt.builder.Build()
+			if err != nil {
+				t.Fatalf("Build failed: %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+
+	if _, err := NewFilterBuilder().WithIdent(">").Build(); !errors.Is(err, keys.ErrInvalidToken) {
+		t.Errorf("expected a wildcard ident to be rejected, got %v", err)
+	}
+}
+
+// TestKeyFilterBuilder_MatchFlight verifies that part of an ident matches either the
+// ICAO or the IATA ident of a flight.
+func TestKeyFilterBuilder_MatchFlight(t *testing.T) {
+	qantas := nzflights.FlightValue{Flight: nzflights.Flight{Ident: "QFA44", IdentICAO: "QFA44", IdentIATA: "QF44"}}
+	tests := map[string]bool{
+		"qf4":  true,
+		"QFA4": true,
+		"QF44": true,
+		"NZ":   false,
+		"":     true,
+	}
+	for term, want := range tests {
+		if got := ParseTerm(term).MatchFlight(qantas); got != want {
+			t.Errorf("ParseTerm(%q).MatchFlight: got %v, want %v", term, got, want)
+		}
+	}
+}
+
+// TestKeyFilterBuilder_MatchKeyIdent verifies that a key is only ruled out once its
+// airline's IATA designator is known and neither ident can match.
+func TestKeyFilterBuilder_MatchKeyIdent(t *testing.T) {
+	const key = "flights.master.QFA44.2025-09-15.0855.YSSY.NZAA"
+	var airlines Airlines
+
+	// Until a Qantas flight has been seen, an IATA term may match any key.
+	if !ParseTerm("qf4").MatchKeyIdent(key, &airlines) || !ParseTerm("JQ").MatchKeyIdent(key, &airlines) {
+		t.Error("expected keys of an unknown airline to be fetched")
+	}
+
+	airlines.Learn(key, nzflights.FlightValue{Flight: nzflights.Flight{Ident: "QFA44", IdentICAO: "QFA44", IdentIATA: "QF44"}})
+	tests := map[string]bool{
+		"qf4":  true,
+		"QFA4": true,
+		"44":   true,
+		"JQ":   false,
+		"NZ":   false,
+		"":     true,
+	}
+	for term, want := range tests {
+		if got := ParseTerm(term).MatchKeyIdent(key, &airlines); got != want {
+			t.Errorf("ParseTerm(%q).MatchKeyIdent: got %v, want %v", term, got, want)
+		}
+	}
+}
+
+// TestFilters_StreamKeys verifies the filter functions against a real bucket.
+func TestFilters_StreamKeys(t *testing.T) {
+	kv := kvtest.NewKV(t, jetstream.KeyValueConfig{})
+	ctx := context.Background()
+
+	for _, key := range []string{
+		"flights.master.ANZ5272.2025-09-11.0830.NZAA.NZCH",
+		"flights.master.ANZ5272.2025-09-12.0830.NZAA.NZCH",
+		"flights.master.ANZ123.2025-09-11.1415.NZAA.NZWN",
+		"flights.master.QFA44.2025-09-11.0855.YSSY.NZAA",
+		"users.u1.flights.owned.NZ1",
+	} {
+		if _, err := kv.Put(ctx, key, []byte("{}")); err != nil {
+			t.Fatalf("Put failed: %v", err)
+		}
+	}
+
+	collect := func(seq func(func(string, error) bool)) []string {
+		t.Helper()
+		var got []string
+		for key, err := range seq {
+			if err != nil {
+				t.Fatalf("listing keys failed: %v", err)
+			}
+			got = append(got, key)
+		}
+		slices.Sort(got)
+		return got
+	}
+
+	if got := collect(FilterByDate(ctx, kv, 2025, time.September, 11)); len(got) != 3 {
+		t.Errorf("FilterByDate: expected 3 keys, got %v", got)
+	}
+	if got := collect(FilterByHour(ctx, kv, 2025, time.September, 11, 8)); len(got) != 2 {
+		t.Errorf("FilterByHour: expected 2 keys, got %v", got)
+	}
+	if got := collect(FilterByRoute(ctx, kv, "NZAA", "NZCH")); len(got) != 2 {
+		t.Errorf("FilterByRoute: expected 2 keys, got %v", got)
+	}
+	if got := collect(FilterByAirlineAndDate(ctx, kv, "ANZ5272", 2025, time.September, 12)); len(got) != 1 {
+		t.Errorf("FilterByAirlineAndDate: expected 1 key, got %v", got)
+	}
+	// The ident is matched on the decoded flight, so only the date narrows the keys.
+	if got := collect(ParseTerm("nz 2025-09-11").Keys(ctx, kv)); len(got) != 3 {
+		t.Errorf("ParseTerm: expected 3 keys, got %v", got)
+	}
+
+	// Breaking out early must not hang or leak the lister.
+	for range FilterByDestination(ctx, kv, "NZCH") {
+		break
+	}
+}
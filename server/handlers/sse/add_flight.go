@@ -0,0 +1,118 @@
+package sse
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/arcade55/htma"
+	"github.com/arcade55/nzflights_webui/natsclient"
+	"github.com/starfederation/datastar-go/datastar"
+)
+
+// defaultAddWait is how long adding a flight waits for an accepted fetch to store it.
+const defaultAddWait = 30 * time.Second
+
+// AddFlightHandler fetches a flight and tracks it for the user. Fetches for the same
+// flight are shared between users, so the flight is tracked here from its master entry
+// rather than left to the fetcher service, which only hears of the first requester.
+// The open flight list shows the flight once it is tracked, so that sends nothing;
+// otherwise a notice is added to the top of the list.
+type AddFlightHandler struct {
+	Fetcher natsclient.FlightFetcher
+	Flights natsclient.FlightStore
+	// Wait is how long an accepted fetch has to store the flight. Defaults to defaultAddWait.
+	Wait time.Duration
+}
+
+func (h *AddFlightHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	visitorID, ok := userID(r)
+	if !ok {
+		http.Error(w, "User could not be identified ", http.StatusInternalServerError)
+		return
+	}
+	flightID := r.URL.Query().Get("flight")
+	if flightID == "" {
+		http.Error(w, "A flight is required", http.StatusBadRequest)
+		return
+	}
+
+	sse := datastar.NewSSE(w, r)
+	reply, err := h.Fetcher.Fetch(r.Context(), flightID, visitorID)
+	tracked := false
+	if err == nil && reply.Key != "" {
+		tracked, err = h.track(r.Context(), visitorID, reply.Key)
+	}
+	if err != nil {
+		log.Error(err)
+	}
+
+	var text string
+	switch {
+	case tracked:
+		return
+	case err == nil && reply.Key == "" && reply.Status == natsclient.FetchComplete:
+		// The service did not say where the flight is, so it is left to add it.
+		return
+	case err == nil:
+		text = fmt.Sprintf("Looking up %s. It will appear in your flights shortly.", flightID)
+	case errors.Is(err, natsclient.ErrFetchFailed):
+		text = fmt.Sprintf("Couldn't find %s. Check the flight number and try again.", flightID)
+	case errors.Is(err, natsclient.ErrFetchTimeout):
+		text = fmt.Sprintf("Couldn't look up %s right now. Please try again.", flightID)
+	default:
+		text = fmt.Sprintf("Couldn't add %s. Please try again.", flightID)
+	}
+	if err := sse.PatchElements(htma.Div().ClassAttr("flights-notice").Text(text).Render(),
+		datastar.WithSelector("#flights"),
+		datastar.WithModePrepend(),
+	); err != nil {
+		log.Error(err)
+	}
+}
+
+// track waits for the flight at the master key to be stored and tracks it for the user.
+// It reports false if the flight was not stored in time. A flight the user already
+// tracks counts as tracked.
+func (h *AddFlightHandler) track(ctx context.Context, visitorID, masterKey string) (bool, error) {
+	wait := h.Wait
+	if wait <= 0 {
+		wait = defaultAddWait
+	}
+	ctx, cancel := context.WithTimeout(ctx, wait)
+	defer cancel()
+
+	watcher, err := h.Flights.WatchFlights(ctx, []string{masterKey})
+	if err != nil {
+		return false, err
+	}
+	defer watcher.Stop()
+
+	errs := watcher.Errors()
+	for {
+		select {
+		case <-ctx.Done():
+			return false, nil
+		case decodeErr, ok := <-errs:
+			if !ok {
+				errs = nil
+				continue
+			}
+			return false, decodeErr
+		case flight, ok := <-watcher.Updates():
+			if !ok {
+				return false, nil
+			}
+			if flight.Removed {
+				continue
+			}
+			_, err := h.Flights.Track(ctx, visitorID, flight.Value.ElementId, flight.Value)
+			if err != nil && !errors.Is(err, natsclient.ErrFlightAlreadyTracked) {
+				return false, err
+			}
+			return true, nil
+		}
+	}
+}
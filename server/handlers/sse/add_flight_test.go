@@ -0,0 +1,100 @@
+package sse
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/arcade55/nzflights-models"
+	"github.com/arcade55/nzflights_webui/natsclient"
+	"github.com/arcade55/nzflights_webui/natsclient/fake"
+	"github.com/arcade55/nzflights_webui/server/handlers/middleware"
+)
+
+// fetchFunc answers fetches in tests.
+type fetchFunc func(ctx context.Context, flightID, requester string) (natsclient.FetchReply, error)
+
+func (f fetchFunc) Fetch(ctx context.Context, flightID, requester string) (natsclient.FetchReply, error) {
+	return f(ctx, flightID, requester)
+}
+
+// TestAddFlight verifies that adding a flight fetches it and tracks it for each user
+// adding it, even when they share one fetch, and explains when that could not be done.
+func TestAddFlight(t *testing.T) {
+	store := fake.NewStore()
+	const nz1, nz2, nz5 = "flights.master.ANZ1.2025-09-15.0900.NZAA.NZWN",
+		"flights.master.ANZ2.2025-09-15.0900.NZAA.NZWN", "flights.master.ANZ5.2025-09-15.0900.NZAA.NZWN"
+	store.PutFlight(nz1, nzflights.FlightValue{ElementId: "NZ1", NatsKey: nz1, Flight: nzflights.Flight{Ident: "NZ1"}})
+
+	var requesters []string
+	fetcher := fetchFunc(func(ctx context.Context, flightID, requester string) (natsclient.FetchReply, error) {
+		requesters = append(requesters, requester)
+		switch flightID {
+		case "NZ1":
+			return natsclient.FetchReply{FlightID: flightID, Status: natsclient.FetchComplete, Key: nz1}, nil
+		case "NZ2":
+			return natsclient.FetchReply{FlightID: flightID, Status: natsclient.FetchAccepted, Key: nz2}, nil
+		case "NZ5":
+			// The flight is stored a little after the fetch is accepted.
+			time.AfterFunc(50*time.Millisecond, func() {
+				store.PutFlight(nz5, nzflights.FlightValue{ElementId: "NZ5", NatsKey: nz5, Flight: nzflights.Flight{Ident: "NZ5"}})
+			})
+			return natsclient.FetchReply{FlightID: flightID, Status: natsclient.FetchAccepted, Key: nz5}, nil
+		case "NZ3":
+			return natsclient.FetchReply{FlightID: flightID, Status: natsclient.FetchFailed},
+				fmt.Errorf("%w: %s: unknown", natsclient.ErrFetchFailed, flightID)
+		default:
+			return natsclient.FetchReply{}, fmt.Errorf("%w: %s", natsclient.ErrFetchTimeout, flightID)
+		}
+	})
+	add := func(query, visitor string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/flights/add?"+query, nil)
+		req.AddCookie(&http.Cookie{Name: middleware.VisitorCookieName, Value: visitor})
+		w := httptest.NewRecorder()
+		(&AddFlightHandler{Fetcher: fetcher, Flights: store, Wait: time.Second}).ServeHTTP(w, req)
+		return w
+	}
+
+	// Both users get the flight from the same fetch, and adding it twice is harmless.
+	for _, visitor := range []string{"u1", "u2", "u1"} {
+		if w := add("flight=NZ1", visitor); strings.Contains(w.Body.String(), "NZ1") {
+			t.Errorf("%s: expected a tracked flight to send nothing, got %q", visitor, w.Body.String())
+		}
+		if store.Revision("users."+visitor+".flights.owned.NZ1") == 0 {
+			t.Errorf("expected NZ1 to be tracked for %s", visitor)
+		}
+	}
+	if len(requesters) != 3 || requesters[0] != "u1" || requesters[1] != "u2" {
+		t.Errorf("expected the fetches to be made for their users, got %v", requesters)
+	}
+
+	if w := add("flight=NZ5", "u1"); strings.Contains(w.Body.String(), "NZ5") || store.Revision("users.u1.flights.owned.NZ5") == 0 {
+		t.Errorf("expected NZ5 to be tracked once stored, got %q", w.Body.String())
+	}
+
+	handler := &AddFlightHandler{Fetcher: fetcher, Flights: store, Wait: 100 * time.Millisecond}
+	tests := map[string]string{
+		"flight=NZ2": "Looking up NZ2",
+		"flight=NZ3": "Couldn't find NZ3",
+		"flight=NZ4": "Couldn't look up NZ4",
+	}
+	for query, want := range tests {
+		req := httptest.NewRequest(http.MethodPost, "/flights/add?"+query, nil)
+		req.AddCookie(&http.Cookie{Name: middleware.VisitorCookieName, Value: "u1"})
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		if !strings.Contains(w.Body.String(), want) || !strings.Contains(w.Body.String(), "selector #flights") {
+			t.Errorf("%s: expected a notice containing %q, got %q", query, want, w.Body.String())
+		}
+	}
+	if store.Revision("users.u1.flights.owned.NZ2") != 0 {
+		t.Error("expected NZ2 not to be tracked before it is stored")
+	}
+	if w := add("", "u1"); w.Code != http.StatusBadRequest {
+		t.Errorf("expected status %d without a flight, got %d", http.StatusBadRequest, w.Code)
+	}
+}
@@ -2,14 +2,20 @@ package sse
 
 import (
 	"context"
-	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"net/http"
+	"net/url"
 	"sort"
+	"strconv"
+	"time"
 
 	"github.com/arcade55/htma"
 	"github.com/arcade55/logging"
 	"github.com/arcade55/nzflights-models"
+	"github.com/arcade55/nzflights_webui/keys"
+	"github.com/arcade55/nzflights_webui/natsclient"
 	"github.com/arcade55/nzflights_webui/server/handlers/middleware"
 	"github.com/arcade55/nzflights_webui/webui/components"
 	"github.com/nats-io/nats.go/jetstream"
@@ -18,8 +24,28 @@ import (
 
 type FlightSSEHandler struct {
 	KV jetstream.KeyValue
+	// Flights is optional. When set, flight values are fetched through it so
+	// that reads can fall back from the in-memory mirror to the cloud store.
+	Flights natsclient.FlightStore
+	// Hub is optional. When set, watches on KV are shared between all open streams.
+	Hub *natsclient.Hub
+	// State is optional. When set, a banner tells the user while only cached flights can be shown.
+	State *natsclient.StateTracker
+	// UndoWindow is how long an untracked flight's card offers to undo before it is
+	// removed. Defaults to defaultUndoWindow.
+	UndoWindow time.Duration
+	// HeartbeatInterval is how often a comment is sent on an otherwise idle stream, so
+	// proxies keep it open and dead connections are noticed. Defaults to defaultHeartbeatInterval.
+	HeartbeatInterval time.Duration
 }
 
+const (
+	// defaultUndoWindow is how long an untracked flight can be restored from its card.
+	defaultUndoWindow = 10 * time.Second
+	// defaultHeartbeatInterval is how often an idle stream sends a heartbeat.
+	defaultHeartbeatInterval = 15 * time.Second
+)
+
 // Initialize the logger
 var logger, _, _ = logging.Init(context.Background(), logging.Config{
 	Format:    logging.FormatPretty,
@@ -32,88 +58,495 @@ func (h *FlightSSEHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 	log.Info("Starting interactive UI test server...")
 
-	visitorCookie, err := r.Cookie(middleware.VisitorCookieName)
-	if err != nil {
+	visitorID, ok := userID(r)
+	if !ok {
 		// This should technically never happen because the middleware adds it.
 		http.Error(w, "User could not be identified ", http.StatusInternalServerError)
 		return
 	}
 
-	visitorID := visitorCookie.Value
+	// The ID comes from a cookie, so it must not be able to widen the filter to other users.
+	// One watch covers both the flights the user owns and those shared with them.
+	flightsPattern, err := keys.UserFlights(visitorID)
+	if err != nil {
+		http.Error(w, "Invalid visitor ID", http.StatusBadRequest)
+		return
+	}
 
 	sse := datastar.NewSSE(w, r)
 	ctx := r.Context()
 
-	if visitorID == "" {
-		// This should not happen if the middleware is applied, but it's a good safeguard.
-		log.Error(err)
-		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
-		return
-	}
-	// --- END MODIFICATION ---
-
-	ownedFlightsPattern := fmt.Sprintf("users.%s.flights.owned.>", visitorID)
+	// cards holds the card shown for each key, so updates patch just that card.
+	cards := make(map[string]shownCard)
 
+	// renderFlights replaces both lists. It only runs once, when the stream opens.
 	renderFlights := func() {
-		var flights []nzflights.FlightValue
 		// IMPORTANT: Use the request context for NATS operations
-		keyLister, err := h.KV.ListKeysFiltered(ctx, ownedFlightsPattern)
+		keyLister, err := h.KV.ListKeysFiltered(ctx, flightsPattern)
 		if err != nil {
 			// This will now correctly log an error if the client disconnects mid-operation
 			log.Error(err)
 			return
 		}
 
+		var keys []string
 		for key := range keyLister.Keys() {
-			kvEntry, err := h.KV.Get(ctx, key)
-			if err != nil {
-				log.Error(err)
-				continue
-			}
-			var fv nzflights.FlightValue
-			if err := json.Unmarshal(kvEntry.Value(), &fv); err != nil {
-				log.Error(err)
-				continue
-			}
-			flights = append(flights, fv)
+			keys = append(keys, key)
 		}
 
-		sort.Slice(flights, func(i, j int) bool {
-			return flights[i].Flight.Ident < flights[j].Flight.Ident
-		})
+		found, failed := h.getFlights(ctx, keys)
+		// The lists are tagged with the latest revision in them, for the browser to resume from.
+		var owned, shared []natsclient.FlightEntry
+		var latest uint64
+		for _, flight := range found {
+			latest = max(latest, flight.Revision)
+			switch {
+			case flight.Share == nil:
+				owned = append(owned, flight)
+				cards[flight.Key] = shownCard{id: components.FlightCardID(flight.Value), revision: flight.Revision, value: flight.Value}
+			case flight.Share.Hidden:
+				cards[flight.Key] = shownCard{id: components.SharedFlightCardID(flight.Value), revision: flight.Revision, value: flight.Value, hidden: true}
+			default:
+				shared = append(shared, flight)
+				cards[flight.Key] = shownCard{id: components.SharedFlightCardID(flight.Value), revision: flight.Revision, value: flight.Value}
+			}
+		}
+		sortByIdent(owned)
+		sortByIdent(shared)
 
-		var flightCards []htma.Renderable
-		for _, fv := range flights {
-			flightCards = append(flightCards, components.FlightCardComponent(fv))
+		var ownedCards []htma.Renderable
+		for _, flight := range owned {
+			ownedCards = append(ownedCards, ownedFlightCard(flight))
 		}
-		content := htma.Div().ClassAttr("flight-card-container").IDAttr("flights").AddChild(flightCards...)
-		log.Info(content.Render())
-		if err := sse.PatchElements(content.Render(),
-			datastar.WithSelector("#flights"),
+		var sharedCards []htma.Renderable
+		for _, flight := range shared {
+			sharedCards = append(sharedCards, sharedFlightCard(flight))
+		}
+		// Flights that couldn't be read keep a card saying so, rather than quietly
+		// dropping out of the list. The next update to them replaces it.
+		for _, key := range failed {
+			card, inShared := staleCard(key)
+			cards[key] = card
+			if inShared {
+				sharedCards = append(sharedCards, components.StaleFlightCard(card.id, card.value))
+			} else {
+				ownedCards = append(ownedCards, components.StaleFlightCard(card.id, card.value))
+			}
+		}
+		// Without a selector, each list replaces the element with its ID.
+		content := htma.Div().ClassAttr("flight-card-container").IDAttr("flights").AddChild(ownedCards...).Render() +
+			htma.Div().ClassAttr("flight-card-container").IDAttr("shared-flights").AddChild(sharedCards...).Render()
+		log.Info(content)
+		opts := []datastar.PatchElementOption{
 			datastar.WithMode("replace"),
-		); err != nil {
+		}
+		if latest > 0 {
+			opts = append(opts, datastar.WithPatchElementsEventID(strconv.FormatUint(latest, 10)))
+		}
+		if err := sse.PatchElements(content, opts...); err != nil {
 			log.Error(err)
 		}
 	}
 
-	watcher, err := h.KV.Watch(ctx, ownedFlightsPattern)
+	// Share one upstream watch per user between all of their open tabs.
+	// Without a shared hub, fall back to a private one for this request.
+	// Subscribing before the list is rendered means no update can fall in between.
+	hub := h.Hub
+	if hub == nil {
+		hub = natsclient.NewHub(h.KV, natsclient.PolicyCoalesce, 0)
+	}
+	// A browser reconnecting after a dropped stream sends the revision of the last
+	// patch it applied. It still shows the list, so only the changes since are sent.
+	resumeFrom, resumed := lastEventID(r)
+	var watcher *natsclient.Subscription
+	if resumed {
+		log.Info(fmt.Sprintf("Resuming stream for user %s after revision %d", visitorID, resumeFrom))
+		watcher, err = hub.SubscribeFrom(flightsPattern, resumeFrom+1)
+	} else {
+		watcher, err = hub.Subscribe(flightsPattern)
+	}
 	if err != nil {
 		log.Error(err)
 		return
 	}
 	defer watcher.Stop()
+	if !resumed {
+		renderFlights()
+	}
+
+	undoWindow := h.UndoWindow
+	if undoWindow <= 0 {
+		undoWindow = defaultUndoWindow
+	}
+	// expired receives untracked cards whose undo window has run out.
+	expired := make(chan expiredCard)
+
+	heartbeatInterval := h.HeartbeatInterval
+	if heartbeatInterval <= 0 {
+		heartbeatInterval = defaultHeartbeatInterval
+	}
+	heartbeat := time.NewTicker(heartbeatInterval)
+	defer heartbeat.Stop()
+
+	var stateChanges <-chan natsclient.StateEvent
+	if h.State != nil {
+		var unsubscribe func()
+		stateChanges, unsubscribe = h.State.Subscribe()
+		defer unsubscribe()
+		renderBanner(sse, h.State.State())
+	}
 
 	for {
 		select {
 		case <-ctx.Done():
 			log.Info(fmt.Sprintf("Client for user %s disconnected.", visitorID))
 			return
-		case entry := <-watcher.Updates():
-			if entry == nil {
-				continue
+		case decodeErr := <-watcher.Errors():
+			log.Error(decodeErr)
+			if err := markStale(sse, cards, decodeErr.Key); err != nil {
+				log.Error(err)
+			}
+		case event := <-stateChanges:
+			log.Info(fmt.Sprintf("Connection state changed from %s to %s", event.From, event.To))
+			renderBanner(sse, event.To)
+		case flight, ok := <-watcher.Updates():
+			if !ok {
+				// The hub disconnected this stream for falling behind. Ending it lets the
+				// browser reconnect and resume from the last revision it applied.
+				log.Error(fmt.Errorf("flight stream for user %s ended: %w", visitorID, watcher.Err()))
+				return
+			}
+			log.Info(fmt.Sprintf("Update for %s at revision %d", flight.Key, flight.Revision))
+			if err := patchCard(sse, cards, flight, resumed); err != nil {
+				log.Error(err)
+			}
+			if card := cards[flight.Key]; flight.Removed && card.untracked {
+				time.AfterFunc(undoWindow, func() {
+					select {
+					case expired <- expiredCard{key: flight.Key, revision: flight.Revision}:
+					case <-ctx.Done():
+					}
+				})
+			}
+		case card := <-expired:
+			// The flight may have been restored or removed again since.
+			if shown, ok := cards[card.key]; ok && shown.untracked && shown.revision == card.revision {
+				delete(cards, card.key)
+				if err := sse.RemoveElementByID(shown.id); err != nil {
+					log.Error(err)
+				}
+			}
+		case <-heartbeat.C:
+			if err := sendHeartbeat(w); err != nil {
+				log.Error(err)
 			}
-			log.Info(string(entry.Value()))
-			renderFlights()
 		}
 	}
 }
+
+// lastEventID returns the revision in the Last-Event-ID header of a reconnecting
+// browser, and false if there is none.
+func lastEventID(r *http.Request) (uint64, bool) {
+	revision, err := strconv.ParseUint(r.Header.Get("Last-Event-ID"), 10, 64)
+	if err != nil || revision == 0 {
+		return 0, false
+	}
+	return revision, true
+}
+
+// sendHeartbeat writes an SSE comment, which browsers ignore. Every other write to the
+// stream happens on the handler's goroutine too, so it cannot interleave with an event.
+func sendHeartbeat(w http.ResponseWriter) error {
+	if _, err := io.WriteString(w, ": heartbeat\n\n"); err != nil {
+		return err
+	}
+	return http.NewResponseController(w).Flush()
+}
+
+// shownCard is the card on the page for one key.
+type shownCard struct {
+	id       string
+	revision uint64
+	// value is the flight the card was last rendered from.
+	value nzflights.FlightValue
+	// stale is set while the card says the flight couldn't be refreshed.
+	stale bool
+	// untracked is set while the card offers to undo the flight's removal.
+	// restore is then the revision the flight had before it was removed.
+	untracked bool
+	restore   uint64
+	// hidden is set for a shared flight the user hid, which has no card on the page.
+	hidden bool
+}
+
+// expiredCard identifies an untracked card whose undo window has run out.
+type expiredCard struct {
+	key      string
+	revision uint64
+}
+
+// patchCard brings the card for flight up to date: a new flight appends a card, an
+// update morphs its card in place so client-side state survives, and a removal turns
+// the card into an untracked one that offers to restore the previous revision. The
+// caller removes untracked cards once the undo window is over. Updates no newer than
+// the card shown, such as the watcher's replay of values the initial render already
+// showed, are skipped. Flights shared with the user are patched in the shared list by
+// patchSharedCard instead.
+//
+// Each patch is tagged with the flight's revision as its event ID. When resumed is set
+// the page already shows the cards from before a reconnect, which cards does not
+// know about, so a new flight replaces any card it already has and a removal of an
+// unknown flight removes its card outright.
+func patchCard(sse *datastar.ServerSentEventGenerator, cards map[string]shownCard, flight natsclient.FlightEntry, resumed bool) error {
+	shown, ok := cards[flight.Key]
+	if ok && flight.Revision <= shown.revision {
+		return nil
+	}
+	eventID := datastar.WithPatchElementsEventID(strconv.FormatUint(flight.Revision, 10))
+	if flight.Share != nil {
+		return patchSharedCard(sse, cards, flight, resumed, eventID)
+	}
+
+	if flight.Removed {
+		if !ok {
+			if !resumed {
+				return nil
+			}
+			return sse.RemoveElement("#"+components.FlightCardID(removedValue(flight)), eventID)
+		}
+		if shown.untracked {
+			// Purged after being deleted: keep offering the revision shown before.
+			shown.revision = flight.Revision
+			cards[flight.Key] = shown
+			return nil
+		}
+		cards[flight.Key] = shownCard{id: shown.id, revision: flight.Revision, value: flight.Value, untracked: true, restore: shown.revision}
+		card := components.UntrackedFlightCard(shown.id, flight.Value, undoAction(flight.Key, shown.revision))
+		return sse.PatchElements(card.Render(), datastar.WithSelectorID(shown.id), eventID)
+	}
+
+	card := ownedFlightCard(flight)
+	id := components.FlightCardID(flight.Value)
+	cards[flight.Key] = shownCard{id: id, revision: flight.Revision, value: flight.Value}
+	if !ok {
+		if resumed {
+			if err := sse.RemoveElementByID(id); err != nil {
+				return err
+			}
+		}
+		return sse.PatchElements(card.Render(),
+			datastar.WithSelector("#flights"),
+			datastar.WithModeAppend(),
+			eventID,
+		)
+	}
+	// The default outer mode morphs the card rather than replacing it.
+	return sse.PatchElements(card.Render(), datastar.WithSelectorID(shown.id), eventID)
+}
+
+// patchSharedCard is patchCard for a flight shared with the user, whose card is in the
+// shared list. Hiding or removing the flight takes its card away outright, as there is
+// nothing to undo.
+func patchSharedCard(sse *datastar.ServerSentEventGenerator, cards map[string]shownCard, flight natsclient.FlightEntry,
+	resumed bool, eventID datastar.PatchElementOption) error {
+	shown, ok := cards[flight.Key]
+	visible := ok && !shown.hidden
+
+	if flight.Removed || flight.Share.Hidden {
+		id := shown.id
+		if !ok {
+			id = components.SharedFlightCardID(removedValue(flight))
+		}
+		if flight.Removed {
+			delete(cards, flight.Key)
+		} else {
+			cards[flight.Key] = shownCard{id: id, revision: flight.Revision, value: flight.Value, hidden: true}
+		}
+		if !visible && (ok || !resumed) {
+			return nil
+		}
+		return sse.RemoveElement("#"+id, eventID)
+	}
+
+	card := sharedFlightCard(flight)
+	id := components.SharedFlightCardID(flight.Value)
+	cards[flight.Key] = shownCard{id: id, revision: flight.Revision, value: flight.Value}
+	if visible {
+		return sse.PatchElements(card.Render(), datastar.WithSelectorID(shown.id), eventID)
+	}
+	if resumed && !ok {
+		if err := sse.RemoveElementByID(id); err != nil {
+			return err
+		}
+	}
+	return sse.PatchElements(card.Render(),
+		datastar.WithSelector("#shared-flights"),
+		datastar.WithModeAppend(),
+		eventID,
+	)
+}
+
+// ownedFlightCard renders the card of a flight the user owns. Its share button shares the flight.
+func ownedFlightCard(flight natsclient.FlightEntry) htma.Element {
+	return components.FlightCardComponent(flight.Value).Attr("data-on-share", shareAction(flight.Key))
+}
+
+// sharedFlightCard renders the card of a flight shared with the user. Its actions only
+// apply to the revision shown.
+func sharedFlightCard(flight natsclient.FlightEntry) htma.Element {
+	actions := components.SharedFlightActions{
+		Convert: flightAction("/flights/shared/convert", flight.Key, flight.Revision),
+		Hide:    flightAction("/flights/shared/hide", flight.Key, flight.Revision),
+	}
+	if !flight.Share.Accepted {
+		actions.Accept = flightAction("/flights/shared/accept", flight.Key, flight.Revision)
+	}
+	return components.SharedFlightCard(flight.Value, flight.Share.SharedBy, actions)
+}
+
+// removedValue is the value the card of a removed flight that was never patched on this
+// stream was rendered from. The watch may not have seen it, in which case it is derived
+// from the flight ID in the key, as flights are tracked under their ident.
+func removedValue(flight natsclient.FlightEntry) nzflights.FlightValue {
+	if flight.Value.ElementId != "" || flight.Value.Flight.Ident != "" {
+		return flight.Value
+	}
+	parsed, err := keys.Parse(flight.Key)
+	if err != nil {
+		return flight.Value
+	}
+	return nzflights.FlightValue{ElementId: parsed.FlightID}
+}
+
+// staleCard is the card kept for the flight at key when it could not be read, with only
+// the ID in its key to show, and whether it belongs in the shared list.
+func staleCard(key string) (card shownCard, shared bool) {
+	value := removedValue(natsclient.FlightEntry{Key: key})
+	parsed, err := keys.Parse(key)
+	if err == nil && parsed.Kind == keys.KindSharedFlight {
+		return shownCard{id: components.SharedFlightCardID(value), value: value, stale: true}, true
+	}
+	return shownCard{id: components.FlightCardID(value), value: value, stale: true}, false
+}
+
+// markStale marks the card shown for key as not refreshed, keeping the last value it
+// showed, after an update to its flight could not be decoded.
+func markStale(sse *datastar.ServerSentEventGenerator, cards map[string]shownCard, key string) error {
+	shown, ok := cards[key]
+	if !ok || shown.stale || shown.untracked || shown.hidden {
+		return nil
+	}
+	shown.stale = true
+	cards[key] = shown
+	return sse.PatchElements(components.StaleFlightCard(shown.id, shown.value).Render(), datastar.WithSelectorID(shown.id))
+}
+
+// sortByIdent orders flights by their ident.
+func sortByIdent(flights []natsclient.FlightEntry) {
+	sort.Slice(flights, func(i, j int) bool {
+		return flights[i].Value.Flight.Ident < flights[j].Value.Flight.Ident
+	})
+}
+
+// undoAction is the Datastar action that restores the flight at key to revision.
+func undoAction(key string, revision uint64) string {
+	return flightAction("/flights/undo", key, revision)
+}
+
+// shareAction is the Datastar action that shares the flight at key. Any revision is
+// shared, as the share holds a copy of the latest.
+func shareAction(key string) string {
+	parsed, err := keys.Parse(key)
+	if err != nil {
+		return ""
+	}
+	return fmt.Sprintf("@post('/flights/share?flight=%s')", url.QueryEscape(parsed.FlightID))
+}
+
+// flightAction is the Datastar action that posts the flight at key and revision to path.
+func flightAction(path, key string, revision uint64) string {
+	parsed, err := keys.Parse(key)
+	if err != nil {
+		return ""
+	}
+	return fmt.Sprintf("@post('%s?flight=%s&revision=%d')", path, url.QueryEscape(parsed.FlightID), revision)
+}
+
+// getFlights fetches and decodes the latest flight for each key, using the FlightStore when one is configured.
+// Flights that cannot be fetched or decoded are logged and their keys returned in failed, in order.
+// Keys that no longer exist are left out silently.
+func (h *FlightSSEHandler) getFlights(ctx context.Context, keys []string) (flights []natsclient.FlightEntry, failed []string) {
+	if h.Flights != nil {
+		result, err := h.Flights.GetFlights(ctx, keys)
+		if err != nil {
+			log.Error(err)
+		}
+		for _, flight := range result.Found {
+			flights = append(flights, flight)
+		}
+		for key := range result.Failed {
+			failed = append(failed, key)
+		}
+		sort.Strings(failed)
+		return flights, failed
+	}
+
+	for _, key := range keys {
+		entry, err := h.KV.Get(ctx, key)
+		if errors.Is(err, jetstream.ErrKeyNotFound) {
+			continue
+		}
+		if err != nil {
+			log.Error(err)
+			failed = append(failed, key)
+			continue
+		}
+		flight, err := natsclient.DecodeEntry(natsclient.Entry{KeyValueEntry: entry})
+		if err != nil {
+			log.Error(err)
+			failed = append(failed, key)
+			continue
+		}
+		flights = append(flights, flight)
+	}
+	return flights, failed
+}
+
+// connectionBanner tells the user when the flights shown may be out of date.
+// It is empty while the connection is healthy.
+func connectionBanner(state natsclient.ConnState) htma.Element {
+	banner := htma.Div().IDAttr("connection-banner")
+	switch state {
+	case natsclient.StateDegraded:
+		return banner.ClassAttr("connection-banner").Text("Showing cached data. Changes can't be saved until we reconnect.")
+	case natsclient.StateOffline:
+		return banner.ClassAttr("connection-banner").Text("Showing cached data. Flights may be out of date until we reconnect.")
+	case natsclient.StateCloudOnly:
+		return banner.ClassAttr("connection-banner").Text("Some flights may be out of date until we reconnect.")
+	default:
+		return banner
+	}
+}
+
+// renderBanner patches the connection banner for state.
+func renderBanner(sse *datastar.ServerSentEventGenerator, state natsclient.ConnState) {
+	if err := sse.PatchElements(connectionBanner(state).Render(),
+		datastar.WithSelector("#connection-banner"),
+		datastar.WithMode("replace"),
+	); err != nil {
+		log.Error(err)
+	}
+}
+
+// userID identifies the user for a request. An authenticated user ID set by
+// middleware.Auth takes precedence over the anonymous visitor cookie.
+func userID(r *http.Request) (string, bool) {
+	if id, ok := r.Context().Value(middleware.UserIDKey).(string); ok && id != "" {
+		return id, true
+	}
+	cookie, err := r.Cookie(middleware.VisitorCookieName)
+	if err != nil || cookie.Value == "" {
+		return "", false
+	}
+	return cookie.Value, true
+}
@@ -5,6 +5,7 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"io"
 	"net/http"
 	"net/http/httptest"
 	"strings"
@@ -12,6 +13,9 @@ import (
 	"time"
 
 	"github.com/arcade55/nzflights-models"
+	"github.com/arcade55/nzflights_webui/keys"
+	"github.com/arcade55/nzflights_webui/natsclient"
+	"github.com/arcade55/nzflights_webui/natsclient/fake"
 	"github.com/arcade55/nzflights_webui/server/handlers/middleware"
 	"github.com/nats-io/nats-server/v2/server"
 	"github.com/nats-io/nats-server/v2/test"
@@ -74,7 +78,7 @@ func readEvents(t *testing.T, scanner *bufio.Scanner, count int, timeout time.Du
 	return events
 }
 
-// TestFlightSSE_InitialState verifies that N events are sent for N initial flights.
+// TestFlightSSE_InitialState verifies that the initial flights arrive in a single patch of the whole list.
 func TestFlightSSE_InitialState(t *testing.T) {
 	kv, cleanup := setupTestEnvironment(t)
 	defer cleanup()
@@ -87,7 +91,7 @@ func TestFlightSSE_InitialState(t *testing.T) {
 		{ElementId: "QF144", Flight: nzflights.Flight{Ident: "QF144"}},
 	}
 	for _, flight := range initialFlights {
-		key := fmt.Sprintf("users.%s.flights.owned.%s", expectedUserID, flight.Flight.Ident)
+		key, _ := keys.OwnedFlight(expectedUserID, flight.Flight.Ident)
 		data, _ := json.Marshal(flight)
 		kv.Put(context.Background(), key, data)
 	}
@@ -107,12 +111,348 @@ func TestFlightSSE_InitialState(t *testing.T) {
 	defer res.Body.Close()
 
 	scanner := bufio.NewScanner(res.Body)
-	events := readEvents(t, scanner, len(initialFlights), 1*time.Second)
+	events := readEvents(t, scanner, 1, 1*time.Second)
 
-	if len(events) != len(initialFlights) {
-		t.Fatalf("Expected %d initial events, but got %d", len(initialFlights), len(events))
+	if len(events) != 1 {
+		t.Fatalf("Expected 1 initial event, but got %d", len(events))
+	}
+	for _, flight := range initialFlights {
+		if !strings.Contains(events[0], "flight-"+flight.ElementId) {
+			t.Errorf("Expected the initial list to contain %s, got %s", flight.ElementId, events[0])
+		}
+	}
+	t.Logf("Successfully received the initial list of %d flights.", len(initialFlights))
+}
+
+// sseEvents delivers each SSE event read from body as its id, comment and data lines
+// joined by newlines. Data lines lose their "data: " prefix.
+func sseEvents(body io.Reader) <-chan string {
+	events := make(chan string)
+	go func() {
+		defer close(events)
+		scanner := bufio.NewScanner(body)
+		var lines []string
+		for scanner.Scan() {
+			line := scanner.Text()
+			if line == "" && len(lines) > 0 {
+				events <- strings.Join(lines, "\n")
+				lines = nil
+				continue
+			}
+			if data, ok := strings.CutPrefix(line, "data: "); ok {
+				lines = append(lines, data)
+			} else if strings.HasPrefix(line, "id: ") || strings.HasPrefix(line, ":") {
+				lines = append(lines, line)
+			}
+		}
+	}()
+	return events
+}
+
+// nextEvent waits for the next SSE event.
+func nextEvent(t *testing.T, events <-chan string) string {
+	t.Helper()
+	select {
+	case event := <-events:
+		return event
+	case <-time.After(2 * time.Second):
+		t.Fatal("timed out waiting for an SSE event")
+		return ""
+	}
+}
+
+// TestFlightSSE_PatchesSingleCards verifies that a new flight appends a card, an update
+// morphs only its card, and a delete turns it into an untracked card that is removed
+// once the undo window is over unless the flight comes back first.
+func TestFlightSSE_PatchesSingleCards(t *testing.T) {
+	kv, cleanup := setupTestEnvironment(t)
+	defer cleanup()
+	ctx := context.Background()
+
+	put := func(ident, status string) {
+		t.Helper()
+		key, _ := keys.OwnedFlight("u1", ident)
+		data, _ := json.Marshal(nzflights.FlightValue{ElementId: ident, Flight: nzflights.Flight{Ident: ident, Status: status}})
+		if _, err := kv.Put(ctx, key, data); err != nil {
+			t.Fatalf("Put failed: %v", err)
+		}
+	}
+	put("NZ1", "Scheduled")
+
+	server := httptest.NewServer(&FlightSSEHandler{KV: kv, UndoWindow: 300 * time.Millisecond})
+	defer server.Close()
+	req, _ := http.NewRequest("GET", server.URL, nil)
+	req.AddCookie(&http.Cookie{Name: middleware.VisitorCookieName, Value: "u1"})
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	defer res.Body.Close()
+	events := sseEvents(res.Body)
+
+	if event := nextEvent(t, events); !strings.Contains(event, "mode replace") || !strings.Contains(event, "flight-NZ1") {
+		t.Fatalf("expected the initial list, got %q", event)
+	}
+
+	put("NZ2", "Scheduled")
+	if event := nextEvent(t, events); !strings.Contains(event, "mode append") || !strings.Contains(event, "flight-NZ2") ||
+		strings.Contains(event, "flight-NZ1") {
+		t.Errorf("expected NZ2 to be appended on its own, got %q", event)
+	}
+
+	put("NZ1", "Boarding")
+	if event := nextEvent(t, events); !strings.Contains(event, "selector #flight-NZ1") || strings.Contains(event, "mode ") ||
+		strings.Contains(event, "flight-NZ2") {
+		t.Errorf("expected only the NZ1 card to be morphed, got %q", event)
+	}
+
+	remove := func(ident string) {
+		t.Helper()
+		key, _ := keys.OwnedFlight("u1", ident)
+		if err := kv.Delete(ctx, key); err != nil {
+			t.Fatalf("Delete failed: %v", err)
+		}
+	}
+
+	// Restoring the flight within the undo window brings its card back.
+	remove("NZ2")
+	if event := nextEvent(t, events); !strings.Contains(event, "selector #flight-NZ2") || !strings.Contains(event, "NZ2 untracked") {
+		t.Errorf("expected the NZ2 card to be untracked, got %q", event)
+	}
+	if action := undoAction("users.u1.flights.owned.NZ2", 3); action != "@post('/flights/undo?flight=NZ2&revision=3')" {
+		t.Errorf("unexpected undo action %q", action)
+	}
+	put("NZ2", "Scheduled")
+	if event := nextEvent(t, events); !strings.Contains(event, "selector #flight-NZ2") || !strings.Contains(event, "<flightcard>") {
+		t.Errorf("expected the NZ2 card to be restored, got %q", event)
+	}
+
+	// Otherwise the card is removed once the window is over.
+	remove("NZ1")
+	if event := nextEvent(t, events); !strings.Contains(event, "NZ1 untracked") {
+		t.Errorf("expected the NZ1 card to be untracked, got %q", event)
+	}
+	if event := nextEvent(t, events); !strings.Contains(event, "mode remove") || !strings.Contains(event, "selector #flight-NZ1") {
+		t.Errorf("expected the NZ1 card to be removed, got %q", event)
+	}
+	select {
+	case event := <-events:
+		t.Errorf("expected the restored NZ2 card to stay, got %q", event)
+	case <-time.After(500 * time.Millisecond):
+	}
+}
+
+// TestFlightSSE_ResumesFromLastEventID verifies that patches carry their revision as
+// the event ID, and that a browser reconnecting with the last one it saw is sent only
+// the changes since, followed by heartbeats once the stream is idle.
+func TestFlightSSE_ResumesFromLastEventID(t *testing.T) {
+	kv, cleanup := setupTestEnvironment(t)
+	defer cleanup()
+	ctx := context.Background()
+
+	put := func(ident, status string) {
+		t.Helper()
+		key, _ := keys.OwnedFlight("u1", ident)
+		data, _ := json.Marshal(nzflights.FlightValue{ElementId: ident, Flight: nzflights.Flight{Ident: ident, Status: status}})
+		if _, err := kv.Put(ctx, key, data); err != nil {
+			t.Fatalf("Put failed: %v", err)
+		}
+	}
+	put("NZ1", "Scheduled")
+	put("NZ2", "Scheduled")
+
+	server := httptest.NewServer(&FlightSSEHandler{KV: kv, HeartbeatInterval: 200 * time.Millisecond})
+	defer server.Close()
+	connect := func(lastEventID string) (<-chan string, func()) {
+		t.Helper()
+		req, _ := http.NewRequest("GET", server.URL, nil)
+		req.AddCookie(&http.Cookie{Name: middleware.VisitorCookieName, Value: "u1"})
+		if lastEventID != "" {
+			req.Header.Set("Last-Event-ID", lastEventID)
+		}
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Request failed: %v", err)
+		}
+		return sseEvents(res.Body), func() { res.Body.Close() }
+	}
+
+	events, disconnect := connect("")
+	if event := nextEvent(t, events); !strings.Contains(event, "id: 2") || !strings.Contains(event, "mode replace") {
+		t.Fatalf("expected the initial list tagged with revision 2, got %q", event)
+	}
+	disconnect()
+
+	// Changes made while the browser is disconnected.
+	put("NZ3", "Scheduled")
+	put("NZ1", "Boarding")
+	key, _ := keys.OwnedFlight("u1", "NZ2")
+	if err := kv.Delete(ctx, key); err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+
+	events, disconnect = connect("2")
+	defer disconnect()
+	// The page still shows its cards, so a flight this stream has not patched yet
+	// replaces any card it has rather than adding a second one.
+	for _, ident := range []string{"NZ3", "NZ1"} {
+		if event := nextEvent(t, events); !strings.Contains(event, "mode remove") || !strings.Contains(event, "selector #flight-"+ident) {
+			t.Errorf("expected any %s card to be removed first, got %q", ident, event)
+		}
+		if event := nextEvent(t, events); !strings.Contains(event, "mode append") || !strings.Contains(event, "flight-"+ident) {
+			t.Errorf("expected %s to be appended, got %q", ident, event)
+		}
+	}
+	if event := nextEvent(t, events); !strings.Contains(event, "id: 5") || !strings.Contains(event, "mode remove") ||
+		!strings.Contains(event, "selector #flight-NZ2") {
+		t.Errorf("expected the NZ2 card to be removed at revision 5, got %q", event)
+	}
+	if event := nextEvent(t, events); event != ": heartbeat" {
+		t.Errorf("expected a heartbeat on the idle stream, got %q", event)
+	}
+}
+
+// TestFlightSSE_SharedSection verifies that flights shared with the user are listed in
+// their own section from the same watch, with a badge and actions, and that hiding or
+// removing one takes its card away.
+func TestFlightSSE_SharedSection(t *testing.T) {
+	kv, cleanup := setupTestEnvironment(t)
+	defer cleanup()
+	ctx := context.Background()
+
+	share := func(ident string, share natsclient.Share) {
+		t.Helper()
+		key, _ := keys.SharedFlight("u1", ident)
+		data, _ := json.Marshal(natsclient.SharedFlightValue{
+			FlightValue: nzflights.FlightValue{ElementId: ident, Flight: nzflights.Flight{Ident: ident}},
+			Share:       share,
+		})
+		if _, err := kv.Put(ctx, key, data); err != nil {
+			t.Fatalf("Put failed: %v", err)
+		}
+	}
+	owned, _ := keys.OwnedFlight("u1", "NZ1")
+	data, _ := json.Marshal(nzflights.FlightValue{ElementId: "NZ1", Flight: nzflights.Flight{Ident: "NZ1"}})
+	kv.Put(ctx, owned, data)
+	// The same flight can be both owned and shared.
+	share("NZ1", natsclient.Share{SharedBy: "alice"})
+	share("NZ2", natsclient.Share{SharedBy: "alice", Hidden: true})
+
+	server := httptest.NewServer(&FlightSSEHandler{KV: kv})
+	defer server.Close()
+	req, _ := http.NewRequest("GET", server.URL, nil)
+	req.AddCookie(&http.Cookie{Name: middleware.VisitorCookieName, Value: "u1"})
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	defer res.Body.Close()
+	events := sseEvents(res.Body)
+
+	event := nextEvent(t, events)
+	for _, want := range []string{"flights", "flight-NZ1", "shared-flights", "shared-flight-NZ1", "Shared by alice", "shared-flight-NZ1-accept"} {
+		if !strings.Contains(event, want) {
+			t.Errorf("expected the initial lists to contain %q, got %q", want, event)
+		}
+	}
+	if strings.Contains(event, "shared-flight-NZ2") {
+		t.Errorf("expected the hidden flight to be left out, got %q", event)
+	}
+
+	share("NZ1", natsclient.Share{SharedBy: "alice", Accepted: true})
+	if event := nextEvent(t, events); !strings.Contains(event, "selector #shared-flight-NZ1") ||
+		strings.Contains(event, "shared-flight-NZ1-accept") || !strings.Contains(event, "shared-flight-NZ1-convert") {
+		t.Errorf("expected the accepted card to be morphed without its accept button, got %q", event)
+	}
+
+	share("NZ3", natsclient.Share{SharedBy: "bob"})
+	if event := nextEvent(t, events); !strings.Contains(event, "selector #shared-flights") || !strings.Contains(event, "mode append") ||
+		!strings.Contains(event, "Shared by bob") {
+		t.Errorf("expected NZ3 to be appended to the shared list, got %q", event)
+	}
+
+	share("NZ3", natsclient.Share{SharedBy: "bob", Hidden: true})
+	if event := nextEvent(t, events); !strings.Contains(event, "mode remove") || !strings.Contains(event, "selector #shared-flight-NZ3") {
+		t.Errorf("expected the hidden card to be removed, got %q", event)
+	}
+
+	shared, _ := keys.SharedFlight("u1", "NZ1")
+	if err := kv.Delete(ctx, shared); err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+	if event := nextEvent(t, events); !strings.Contains(event, "mode remove") || !strings.Contains(event, "selector #shared-flight-NZ1") {
+		t.Errorf("expected the removed shared card to go without an undo, got %q", event)
+	}
+}
+
+// TestSharedFlightActions verifies that each action applies to the shared flight and
+// that failures explain themselves in the shared list.
+func TestSharedFlightActions(t *testing.T) {
+	store := fake.NewStore()
+	key, _ := keys.SharedFlight("u1", "NZ1")
+	data, _ := json.Marshal(natsclient.SharedFlightValue{
+		FlightValue: nzflights.FlightValue{ElementId: "NZ1", Flight: nzflights.Flight{Ident: "NZ1"}},
+		Share:       natsclient.Share{SharedBy: "alice"},
+	})
+	rev := store.Put(key, data)
+
+	act := func(action, query string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/flights/shared/"+action+"?"+query, nil)
+		req.SetPathValue("action", action)
+		req.AddCookie(&http.Cookie{Name: middleware.VisitorCookieName, Value: "u1"})
+		w := httptest.NewRecorder()
+		(&SharedFlightHandler{Flights: store}).ServeHTTP(w, req)
+		return w
+	}
+
+	if w := act("accept", fmt.Sprintf("flight=NZ1&revision=%d", rev)); strings.Contains(w.Body.String(), "flights-notice") {
+		t.Errorf("expected a silent accept, got %q", w.Body.String())
+	}
+	if w := act("hide", fmt.Sprintf("flight=NZ1&revision=%d", rev)); !strings.Contains(w.Body.String(), "changed while you were looking") {
+		t.Errorf("expected a stale hide to be refused, got %q", w.Body.String())
+	}
+	if w := act("convert", fmt.Sprintf("flight=NZ1&revision=%d", store.Revision(key))); strings.Contains(w.Body.String(), "flights-notice") {
+		t.Errorf("expected a silent convert, got %q", w.Body.String())
+	}
+	if store.Revision("users.u1.flights.owned.NZ1") == 0 || store.Revision(key) != 0 {
+		t.Error("expected the flight to move to the owned list")
+	}
+	if w := act("accept", "flight=NZ1&revision=0"); !strings.Contains(w.Body.String(), "no longer shared with you") {
+		t.Errorf("expected an accept after converting to be refused, got %q", w.Body.String())
+	}
+	if w := act("share", "flight=NZ1&revision=1"); w.Code != http.StatusNotFound {
+		t.Errorf("expected an unknown action to be not found, got %d", w.Code)
+	}
+}
+
+// TestUndoUntrack verifies that undo restores the previous revision and explains when it cannot.
+func TestUndoUntrack(t *testing.T) {
+	store := fake.NewStore()
+	ctx := context.Background()
+	fv := nzflights.FlightValue{ElementId: "NZ1", Flight: nzflights.Flight{Ident: "NZ1"}}
+	rev, _ := store.Track(ctx, "u1", "NZ1", fv)
+	store.Untrack(ctx, "u1", "NZ1", rev)
+
+	undo := func(query string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/flights/undo?"+query, nil)
+		req.AddCookie(&http.Cookie{Name: middleware.VisitorCookieName, Value: "u1"})
+		w := httptest.NewRecorder()
+		(&UndoUntrackHandler{Flights: store}).ServeHTTP(w, req)
+		return w
+	}
+
+	if w := undo(fmt.Sprintf("flight=NZ1&revision=%d", rev)); strings.Contains(w.Body.String(), "flights-notice") {
+		t.Errorf("expected a silent undo, got %q", w.Body.String())
+	}
+	if store.Revision("users.u1.flights.owned.NZ1") == 0 {
+		t.Fatal("expected the flight to be tracked again")
+	}
+	if w := undo(fmt.Sprintf("flight=NZ1&revision=%d", rev)); !strings.Contains(w.Body.String(), "already back in your list") {
+		t.Errorf("expected a second undo to be refused, got %q", w.Body.String())
+	}
+	if w := undo("flight=NZ1"); w.Code != http.StatusBadRequest {
+		t.Errorf("expected status %d without a revision, got %d", http.StatusBadRequest, w.Code)
 	}
-	t.Logf("Successfully received %d initial SSE events.", len(events))
 }
 
 // TestFlightSSE_Unauthorized verifies the middleware blocks unauthorized requests.
@@ -151,3 +491,78 @@ func TestFlightSSE_Unauthorized(t *testing.T) {
 	}
 	t.Log("Successfully blocked request with invalid cookie.")
 }
+
+// TestFlightSSE_RejectsWildcardVisitor verifies that a crafted visitor cookie cannot widen the watch to other users.
+func TestFlightSSE_RejectsWildcardVisitor(t *testing.T) {
+	kv, cleanup := setupTestEnvironment(t)
+	defer cleanup()
+
+	for _, visitor := range []string{"*", ">", "u1.>"} {
+		req := httptest.NewRequest(http.MethodGet, "/sse/flights", nil)
+		req.AddCookie(&http.Cookie{Name: middleware.VisitorCookieName, Value: visitor})
+		w := httptest.NewRecorder()
+		(&FlightSSEHandler{KV: kv}).ServeHTTP(w, req)
+
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("visitor %q: expected status %d, got %d", visitor, http.StatusBadRequest, w.Code)
+		}
+	}
+}
+
+// TestFlightSSE_GetFlightsReportsFailures verifies that flights which could not be refreshed are counted, not silently dropped.
+func TestFlightSSE_GetFlightsReportsFailures(t *testing.T) {
+	store := fake.NewStore()
+	ok := "users.u1.flights.owned.NZ1"
+	failing := "users.u1.flights.owned.NZ2"
+	store.PutFlight(ok, nzflights.FlightValue{Flight: nzflights.Flight{Ident: "NZ1"}})
+	store.PutFlight(failing, nzflights.FlightValue{Flight: nzflights.Flight{Ident: "NZ2"}})
+	store.FailGet(failing, natsclient.ErrCloudUnavailable)
+
+	h := &FlightSSEHandler{Flights: store}
+	flights, failed := h.getFlights(context.Background(), []string{ok, failing, "users.u1.flights.owned.NZ3"})
+	if len(flights) != 1 || flights[0].Key != ok {
+		t.Errorf("expected only %s, got %+v", ok, flights)
+	}
+	if len(failed) != 1 || failed[0] != failing {
+		t.Errorf("expected %s to fail, got %v", failing, failed)
+	}
+}
+
+// TestFlightSSE_MarksStaleCards verifies that a flight that can't be read keeps a card
+// saying so, both when the list is rendered and when a later update can't be decoded,
+// until a good update replaces it.
+func TestFlightSSE_MarksStaleCards(t *testing.T) {
+	kv, cleanup := setupTestEnvironment(t)
+	defer cleanup()
+	ctx := context.Background()
+
+	data, _ := json.Marshal(nzflights.FlightValue{ElementId: "NZ1", Flight: nzflights.Flight{Ident: "NZ1"}})
+	kv.Put(ctx, "users.u1.flights.owned.NZ1", data)
+	kv.Put(ctx, "users.u1.flights.owned.NZ2", []byte("not json"))
+
+	server := httptest.NewServer(&FlightSSEHandler{KV: kv})
+	defer server.Close()
+	req, _ := http.NewRequest("GET", server.URL, nil)
+	req.AddCookie(&http.Cookie{Name: middleware.VisitorCookieName, Value: "u1"})
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	defer res.Body.Close()
+	events := sseEvents(res.Body)
+
+	if event := nextEvent(t, events); !strings.Contains(event, "flight-NZ1") ||
+		!strings.Contains(event, "flight-NZ2") || !strings.Contains(event, "Couldn't refresh NZ2") {
+		t.Errorf("expected NZ2 to keep a card marked as not refreshed, got %q", event)
+	}
+
+	kv.Put(ctx, "users.u1.flights.owned.NZ1", []byte("not json"))
+	if event := nextEvent(t, events); !strings.Contains(event, "selector #flight-NZ1") || !strings.Contains(event, "Couldn't refresh NZ1") {
+		t.Errorf("expected the NZ1 card to be marked stale, got %q", event)
+	}
+
+	kv.Put(ctx, "users.u1.flights.owned.NZ1", data)
+	if event := nextEvent(t, events); !strings.Contains(event, "selector #flight-NZ1") || strings.Contains(event, "Couldn't refresh") {
+		t.Errorf("expected a good update to replace the stale card, got %q", event)
+	}
+}
@@ -1,19 +1,89 @@
 package sse
 
 import (
+	"context"
 	"fmt"
+	"log/slog"
 	"net/http"
+	"net/url"
 	"strings"
 
-	"log/slog"
-
 	"github.com/arcade55/htma"
 	"github.com/arcade55/nzflights-models"
+	"github.com/arcade55/nzflights_webui/natsclient"
+	"github.com/arcade55/nzflights_webui/search"
+	"github.com/nats-io/nats.go/jetstream"
 	"github.com/starfederation/datastar-go/datastar"
 )
 
+// maxSearchResults caps how many flights a search returns.
+const maxSearchResults = 5
+
 type SearchSSEHandler struct {
+	// KV holds the flights.master keys that searches query.
+	KV jetstream.KeyValue
+	// Flights is a fixed set of flights to search when KV is not set, e.g. in tests.
 	Flights map[string]nzflights.FlightValue
+
+	// airlines lets query skip keys whose ident cannot match without fetching them.
+	airlines search.Airlines
+}
+
+// query finds flights matching term among the flights.master keys in KV.
+// Only the keys matching the date and route in term are listed, and only those whose
+// ident may match are fetched, to be matched on the flight's idents. The listing stops
+// once enough are found.
+func (h *SearchSSEHandler) query(ctx context.Context, term string) []nzflights.FlightValue {
+	var matches []nzflights.FlightValue
+	filter := search.ParseTerm(term)
+	for key, err := range filter.Keys(ctx, h.KV) {
+		if err != nil {
+			log.Error(err, slog.String("searchTerm", term))
+			break
+		}
+		if !filter.MatchKeyIdent(key, &h.airlines) {
+			continue
+		}
+		entry, err := h.KV.Get(ctx, key)
+		if err != nil {
+			log.Error(err, slog.String("key", key))
+			continue
+		}
+		flight, err := natsclient.DecodeEntry(natsclient.Entry{KeyValueEntry: entry})
+		if err != nil {
+			log.Error(err)
+			continue
+		}
+		h.airlines.Learn(key, flight.Value)
+		if !filter.MatchFlight(flight.Value) {
+			continue
+		}
+		matches = append(matches, flight.Value)
+		if len(matches) >= maxSearchResults {
+			break
+		}
+	}
+	return matches
+}
+
+// scan finds flights in Flights whose identifier contains term.
+func (h *SearchSSEHandler) scan(term string) []nzflights.FlightValue {
+	var matches []nzflights.FlightValue
+	// The same flight can be stored under several keys (e.g. one per user), so only show it once.
+	seen := make(map[string]bool)
+	for _, flight := range h.Flights {
+		if seen[flight.Flight.Ident] {
+			continue
+		}
+		if strings.Contains(strings.ToLower(flight.Flight.Ident), strings.ToLower(term)) {
+			seen[flight.Flight.Ident] = true
+			matches = append(matches, flight)
+			if len(matches) >= maxSearchResults {
+				break
+			}
+		}
+	}
+	return matches
 }
 
 func (h *SearchSSEHandler) Search(w http.ResponseWriter, r *http.Request) {
@@ -42,15 +112,10 @@ func (h *SearchSSEHandler) Search(w http.ResponseWriter, r *http.Request) {
 	}
 
 	var matches []nzflights.FlightValue
-	for _, flight := range h.Flights {
-
-		log.Info(flight.Flight.Ident)
-		if strings.Contains(strings.ToLower(flight.Flight.Ident), strings.ToLower(signals.SearchTerm)) {
-			matches = append(matches, flight)
-			if len(matches) >= 5 {
-				break
-			}
-		}
+	if h.KV != nil {
+		matches = h.query(r.Context(), signals.SearchTerm)
+	} else {
+		matches = h.scan(signals.SearchTerm)
 	}
 	log.Info("   - Found matches.", slog.Int("count", len(matches)))
 
@@ -75,7 +140,8 @@ func miniCardComponent(flight nzflights.FlightValue) htma.Element {
             $myFlights.push({ id: '%s', origin: '%s', destination: '%s' })
         };
         $searchTerm = '';
-    `, flight.Flight.Ident, flight.Flight.Ident, flight.Flight.OriginCity, flight.Flight.DestinationCity)
+        @post('/flights/add?flight=%s');
+    `, flight.Flight.Ident, flight.Flight.Ident, flight.Flight.OriginCity, flight.Flight.DestinationCity, url.QueryEscape(flight.Flight.Ident))
 
 	return htma.Div().ClassAttr("mini-card").
 		DataOnClickAttr(onClickScript).
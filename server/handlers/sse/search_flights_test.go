@@ -0,0 +1,76 @@
+package sse
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/arcade55/nzflights-models"
+)
+
+// TestSearchSSE_QueriesKV verifies that searches follow puts and deletes of master flights in the KV store.
+func TestSearchSSE_QueriesKV(t *testing.T) {
+	kv, cleanup := setupTestEnvironment(t)
+	defer cleanup()
+
+	ctx := context.Background()
+	const key = "flights.master.ANZ527.2025-09-15.0830.NZAA.NZWN"
+
+	flight := nzflights.FlightValue{ElementId: "NZ527", Flight: nzflights.Flight{Ident: "NZ527"}}
+	data, _ := json.Marshal(flight)
+	if _, err := kv.Put(ctx, key, data); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	// A user's copy of a flight is not a master flight and must not show up in search.
+	if _, err := kv.Put(ctx, "users.u1.flights.owned.NZ5", data); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+
+	// Users type the IATA ident, while the key holds the ICAO one.
+	const qantasKey = "flights.master.QFA44.2025-09-15.0855.YSSY.NZAA"
+	qantas, _ := json.Marshal(nzflights.FlightValue{ElementId: "QFA44",
+		Flight: nzflights.Flight{Ident: "QFA44", IdentICAO: "QFA44", IdentIATA: "QF44"}})
+	if _, err := kv.Put(ctx, qantasKey, qantas); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+
+	h := &SearchSSEHandler{KV: kv}
+	search := func(term string) string {
+		req := httptest.NewRequest(http.MethodPost, "/search-flights", strings.NewReader(`{"searchTerm": "`+term+`"}`))
+		w := httptest.NewRecorder()
+		h.Search(w, req)
+		body, _ := io.ReadAll(w.Result().Body)
+		return string(body)
+	}
+
+	for _, term := range []string{"nz5", "NZ527 2025-09-15", "nzaa-nzwn"} {
+		if body := search(term); !strings.Contains(body, "NZ527") {
+			t.Errorf("search %q: expected NZ527, got %s", term, body)
+		}
+	}
+	for _, term := range []string{"QF", "nz5 2025-09-16", "NZWN-NZAA"} {
+		if body := search(term); strings.Contains(body, "NZ527") {
+			t.Errorf("search %q: expected no results, got %s", term, body)
+		}
+	}
+
+	for _, term := range []string{"QF4", "qf44 2025-09-15"} {
+		if body := search(term); !strings.Contains(body, "QFA44") || strings.Contains(body, "NZ527") {
+			t.Errorf("search %q: expected only QFA44 by its IATA ident, got %s", term, body)
+		}
+	}
+	if body := search("JQ"); strings.Contains(body, "QFA44") || strings.Contains(body, "NZ527") {
+		t.Errorf("search %q: expected no results, got %s", "JQ", body)
+	}
+
+	if err := kv.Delete(ctx, key); err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+	if body := search("nz5"); strings.Contains(body, "NZ527") {
+		t.Errorf("expected deleted flight to be gone, got %s", body)
+	}
+}
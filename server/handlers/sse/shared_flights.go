@@ -0,0 +1,70 @@
+package sse
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/arcade55/htma"
+	"github.com/arcade55/nzflights_webui/natsclient"
+	"github.com/starfederation/datastar-go/datastar"
+)
+
+// SharedFlightHandler applies the action named in its path to a flight shared with the
+// user: accept, hide, or convert to move it to their own flights. As with undo, the open
+// flight list patches the card once the change reaches it, so a successful action sends
+// nothing; a failed one adds a notice to the shared list.
+type SharedFlightHandler struct {
+	Flights natsclient.FlightStore
+}
+
+func (h *SharedFlightHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var apply func(ctx context.Context, userID, flightID string, lastRevision uint64) (uint64, error)
+	switch r.PathValue("action") {
+	case "accept":
+		apply = h.Flights.AcceptSharedFlight
+	case "hide":
+		apply = h.Flights.HideSharedFlight
+	case "convert":
+		apply = h.Flights.ConvertSharedFlight
+	default:
+		http.NotFound(w, r)
+		return
+	}
+
+	visitorID, ok := userID(r)
+	if !ok {
+		http.Error(w, "User could not be identified ", http.StatusInternalServerError)
+		return
+	}
+	flightID := r.URL.Query().Get("flight")
+	revision, err := strconv.ParseUint(r.URL.Query().Get("revision"), 10, 64)
+	if flightID == "" || err != nil {
+		http.Error(w, "A flight and revision are required", http.StatusBadRequest)
+		return
+	}
+
+	sse := datastar.NewSSE(w, r)
+	_, err = apply(r.Context(), visitorID, flightID, revision)
+	if err == nil {
+		return
+	}
+	log.Error(err)
+
+	text := "Couldn't update this flight. Please try again."
+	switch {
+	case errors.Is(err, natsclient.ErrRevisionConflict):
+		text = "This flight changed while you were looking at it. Please try again."
+	case errors.Is(err, natsclient.ErrFlightNotTracked):
+		text = "This flight is no longer shared with you."
+	case errors.Is(err, natsclient.ErrFlightAlreadyTracked):
+		text = "This flight is already in your flights."
+	}
+	if err := sse.PatchElements(htma.Div().ClassAttr("flights-notice").Text(text).Render(),
+		datastar.WithSelector("#shared-flights"),
+		datastar.WithModePrepend(),
+	); err != nil {
+		log.Error(err)
+	}
+}
@@ -0,0 +1,320 @@
+package sse
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/arcade55/htma"
+	"github.com/arcade55/nzflights_webui/keys"
+	"github.com/arcade55/nzflights_webui/natsclient"
+	"github.com/arcade55/nzflights_webui/webui/components"
+	"github.com/nats-io/nats.go/jetstream"
+	"github.com/starfederation/datastar-go/datastar"
+)
+
+// defaultShareTTL is how long a share link can be claimed for.
+const defaultShareTTL = 24 * time.Hour
+
+// ShareFlightHandler shares a flight the user owns, adding a notice with the link to
+// pass on to the top of their flight list.
+type ShareFlightHandler struct {
+	Flights natsclient.FlightStore
+	// TTL is how long the link can be claimed for. Defaults to defaultShareTTL.
+	TTL time.Duration
+}
+
+func (h *ShareFlightHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	visitorID, ok := userID(r)
+	if !ok {
+		http.Error(w, "User could not be identified ", http.StatusInternalServerError)
+		return
+	}
+	flightID := r.URL.Query().Get("flight")
+	if flightID == "" {
+		http.Error(w, "A flight is required", http.StatusBadRequest)
+		return
+	}
+	ttl := h.TTL
+	if ttl <= 0 {
+		ttl = defaultShareTTL
+	}
+
+	sse := datastar.NewSSE(w, r)
+	notice := htma.Div().ClassAttr("flights-notice share-link")
+	shareID, err := h.Flights.ShareFlight(r.Context(), visitorID, flightID, ttl)
+	switch {
+	case err == nil:
+		link := shareLink(r, shareID)
+		notice = notice.AddChild(
+			htma.Span().Text(fmt.Sprintf("Anyone with this link can add %s to their flights, once: ", flightID)),
+			htma.A().HrefAttr(link).Text(link),
+		)
+	case errors.Is(err, natsclient.ErrFlightNotTracked):
+		log.Error(err)
+		notice = notice.Text("This flight is no longer in your flights.")
+	default:
+		log.Error(err)
+		notice = notice.Text("Couldn't share this flight. Please try again.")
+	}
+	if err := sse.PatchElements(notice.Render(),
+		datastar.WithSelector("#flights"),
+		datastar.WithModePrepend(),
+	); err != nil {
+		log.Error(err)
+	}
+}
+
+// shareLink is the address of the shared page that offers to claim shareID, on the
+// host the request came in on.
+func shareLink(r *http.Request, shareID string) string {
+	scheme := "http"
+	if r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https" {
+		scheme = "https"
+	}
+	return fmt.Sprintf("%s://%s/shared?claim=%s", scheme, r.Host, url.QueryEscape(shareID))
+}
+
+// ClaimShareHandler claims the share in its query for the user, replacing the claim
+// card on the shared page with the outcome. The flight then reaches the page's received
+// list, and the sharer's, over their watches.
+type ClaimShareHandler struct {
+	Flights natsclient.FlightStore
+}
+
+func (h *ClaimShareHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	visitorID, ok := userID(r)
+	if !ok {
+		http.Error(w, "User could not be identified ", http.StatusInternalServerError)
+		return
+	}
+	shareID := r.URL.Query().Get("share")
+	if shareID == "" {
+		http.Error(w, "A share is required", http.StatusBadRequest)
+		return
+	}
+
+	sse := datastar.NewSSE(w, r)
+	card := htma.Div().IDAttr("claim").ClassAttr("claim-card")
+	flightID, err := h.Flights.ClaimShare(r.Context(), visitorID, shareID)
+	if err != nil {
+		log.Error(err)
+	}
+	// A flight ID comes back with an error when only the sharer's record failed to update.
+	switch {
+	case flightID != "":
+		card = card.AddChild(
+			htma.Span().Text(fmt.Sprintf("%s has been added to the flights shared with you. ", flightID)),
+			htma.A().HrefAttr("/home").Text("See your flights"),
+		)
+	case errors.Is(err, natsclient.ErrShareNotFound):
+		// The bucket removes a pending share once it expires, so this covers expired links too.
+		card = card.Text("This link has already been claimed, was withdrawn, or has expired.")
+	case errors.Is(err, natsclient.ErrShareExpired):
+		card = card.Text("This link has expired. Ask for a new link.")
+	case errors.Is(err, natsclient.ErrOwnShare):
+		card = card.Text("This is your own share link. Send it to someone else.")
+	case errors.Is(err, natsclient.ErrAlreadyShared):
+		card = card.Text("This flight has already been shared with you.")
+	default:
+		card = card.Text("Couldn't claim this flight. Please try again.")
+	}
+	if err := sse.PatchElements(card.Render(), datastar.WithSelectorID("claim")); err != nil {
+		log.Error(err)
+	}
+}
+
+// SharesSSEHandler streams the lists on the shared page: the shares the user has sent
+// and the flights shared with them. Both are kept live from one watch.
+type SharesSSEHandler struct {
+	KV jetstream.KeyValue
+}
+
+// expiringShare is a pending sent share whose expiry has come, at the revision shown.
+type expiringShare struct {
+	key      string
+	revision uint64
+}
+
+func (h *SharesSSEHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	visitorID, ok := userID(r)
+	if !ok {
+		http.Error(w, "User could not be identified ", http.StatusInternalServerError)
+		return
+	}
+	sentPattern, err := keys.SentShares(visitorID)
+	if err != nil {
+		http.Error(w, "Invalid visitor ID", http.StatusBadRequest)
+		return
+	}
+	receivedPattern, err := keys.SharedFlights(visitorID)
+	if err != nil {
+		http.Error(w, "Invalid visitor ID", http.StatusBadRequest)
+		return
+	}
+
+	sse := datastar.NewSSE(w, r)
+	ctx := r.Context()
+
+	watcher, err := h.KV.WatchFiltered(ctx, []string{sentPattern, receivedPattern})
+	if err != nil {
+		log.Error(err)
+		return
+	}
+	defer watcher.Stop()
+
+	// The watch replays every share, so start from empty lists. A reconnecting stream
+	// would otherwise add its items a second time.
+	lists := htma.Ul().ClassAttr("share-list").IDAttr("received-shares").Render() +
+		htma.Ul().ClassAttr("share-list").IDAttr("sent-shares").Render()
+	if err := sse.PatchElements(lists, datastar.WithMode("replace")); err != nil {
+		log.Error(err)
+		return
+	}
+
+	// shown holds the revision of the item shown for each key.
+	shown := make(map[string]uint64)
+	// expiring receives pending sent shares once they expire, as nothing is written then.
+	expiring := make(chan expiringShare)
+	// Shares can be pending for a day, so stop their timers once the user leaves.
+	var timers []*time.Timer
+	defer func() {
+		for _, timer := range timers {
+			timer.Stop()
+		}
+	}()
+
+	for {
+		select {
+		case <-ctx.Done():
+			log.Info(fmt.Sprintf("Shares client for user %s disconnected.", visitorID))
+			return
+		case entry, ok := <-watcher.Updates():
+			if !ok {
+				return
+			}
+			if entry == nil {
+				// The end of the replay.
+				continue
+			}
+			expiresAt, err := h.patchShare(sse, r, shown, entry, time.Now())
+			if err != nil {
+				log.Error(err)
+			}
+			if !expiresAt.IsZero() {
+				key, revision := entry.Key(), entry.Revision()
+				timers = append(timers, time.AfterFunc(time.Until(expiresAt), func() {
+					select {
+					case expiring <- expiringShare{key: key, revision: revision}:
+					case <-ctx.Done():
+					}
+				}))
+			}
+		case share := <-expiring:
+			// The share may have been claimed since.
+			if shown[share.key] != share.revision {
+				continue
+			}
+			entry, err := h.KV.Get(ctx, share.key)
+			if err != nil {
+				log.Error(err)
+				continue
+			}
+			if _, err := h.patchShare(sse, r, shown, entry, time.Now()); err != nil {
+				log.Error(err)
+			}
+		}
+	}
+}
+
+// patchShare adds, updates or removes the item for entry as of now. For a sent share
+// that is still pending it returns when the share expires, for its item to be updated then.
+func (h *SharesSSEHandler) patchShare(sse *datastar.ServerSentEventGenerator, r *http.Request, shown map[string]uint64,
+	entry jetstream.KeyValueEntry, now time.Time) (expiresAt time.Time, err error) {
+	parsed, err := keys.Parse(entry.Key())
+	if err != nil {
+		return time.Time{}, err
+	}
+	var list, id string
+	switch parsed.Kind {
+	case keys.KindSentShare:
+		list, id = "sent-shares", components.ShareItemID("sent", parsed.ShareID)
+	case keys.KindSharedFlight:
+		list, id = "received-shares", components.ShareItemID("received", parsed.FlightID)
+	default:
+		return time.Time{}, fmt.Errorf("unexpected key on the shares watch: %s", entry.Key())
+	}
+
+	_, known := shown[entry.Key()]
+	if entry.Operation() != jetstream.KeyValuePut {
+		if !known {
+			return time.Time{}, nil
+		}
+		delete(shown, entry.Key())
+		return time.Time{}, sse.RemoveElementByID(id)
+	}
+
+	var item htma.Element
+	if parsed.Kind == keys.KindSentShare {
+		var sent natsclient.SentShare
+		if err := json.Unmarshal(entry.Value(), &sent); err != nil {
+			return time.Time{}, &natsclient.DecodeError{Key: entry.Key(), Revision: entry.Revision(), Err: err}
+		}
+		item = sentShareItem(r, id, parsed.ShareID, sent, now)
+		if sent.StatusAt(now) == natsclient.SharePending {
+			expiresAt = sent.ExpiresAt
+		}
+	} else {
+		var shared natsclient.SharedFlightValue
+		if err := json.Unmarshal(entry.Value(), &shared); err != nil {
+			return time.Time{}, &natsclient.DecodeError{Key: entry.Key(), Revision: entry.Revision(), Err: err}
+		}
+		item = receivedShareItem(id, shared)
+	}
+
+	shown[entry.Key()] = entry.Revision()
+	if known {
+		return expiresAt, sse.PatchElements(item.Render(), datastar.WithSelectorID(id))
+	}
+	return expiresAt, sse.PatchElements(item.Render(),
+		datastar.WithSelector("#"+list),
+		datastar.WithModeAppend(),
+	)
+}
+
+// sentShareItem renders a share the user sent. While it can still be claimed it carries
+// the link, so the user can pass it on again.
+func sentShareItem(r *http.Request, id, shareID string, sent natsclient.SentShare, now time.Time) htma.Element {
+	status := sent.StatusAt(now)
+	var detail, link string
+	switch status {
+	case natsclient.SharePending:
+		detail = "Waiting to be claimed, until " + sent.ExpiresAt.Local().Format("Mon 2 Jan 15:04")
+		link = shareLink(r, shareID)
+	case natsclient.ShareClaimed:
+		detail = "Claimed"
+	default:
+		detail = "Expired"
+	}
+	return components.ShareItem(id, sent.Snapshot, status.String(), detail, link)
+}
+
+// receivedShareItem renders a flight shared with the user.
+func receivedShareItem(id string, shared natsclient.SharedFlightValue) htma.Element {
+	status := "new"
+	switch {
+	case shared.Hidden:
+		status = "hidden"
+	case shared.Accepted:
+		status = "accepted"
+	}
+	detail := "Shared by " + shared.SharedBy
+	if status != "new" {
+		detail += ", " + strings.ToLower(status)
+	}
+	return components.ShareItem(id, shared.FlightValue, status, detail, "")
+}
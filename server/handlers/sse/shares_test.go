@@ -0,0 +1,147 @@
+package sse
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/arcade55/nzflights-models"
+	"github.com/arcade55/nzflights_webui/keys"
+	"github.com/arcade55/nzflights_webui/natsclient"
+	"github.com/arcade55/nzflights_webui/natsclient/fake"
+	"github.com/arcade55/nzflights_webui/server/handlers/middleware"
+)
+
+// shareIDPattern finds the share ID in a share link.
+var shareIDPattern = regexp.MustCompile(`/shared\?claim=([0-9a-f-]+)`)
+
+// TestShareAndClaim verifies that sharing a flight returns a link that can be claimed
+// once, by someone other than the sharer.
+func TestShareAndClaim(t *testing.T) {
+	store := fake.NewStore()
+	store.Track(context.Background(), "u1", "NZ1", nzflights.FlightValue{ElementId: "NZ1", Flight: nzflights.Flight{Ident: "NZ1"}})
+
+	post := func(h http.Handler, target, visitor string) string {
+		req := httptest.NewRequest(http.MethodPost, target, nil)
+		req.AddCookie(&http.Cookie{Name: middleware.VisitorCookieName, Value: visitor})
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w.Body.String()
+	}
+	share := func(flightID string) string {
+		return post(&ShareFlightHandler{Flights: store}, "/flights/share?flight="+flightID, "u1")
+	}
+	claim := func(shareID, visitor string) string {
+		return post(&ClaimShareHandler{Flights: store}, "/shared/claim?share="+shareID, visitor)
+	}
+
+	body := share("NZ1")
+	match := shareIDPattern.FindStringSubmatch(body)
+	if match == nil || !strings.Contains(body, "selector #flights") {
+		t.Fatalf("expected a share link at the top of the flight list, got %q", body)
+	}
+	shareID := match[1]
+
+	if body := claim(shareID, "u1"); !strings.Contains(body, "your own share link") {
+		t.Errorf("expected the sharer's claim to be refused, got %q", body)
+	}
+	if body := claim(shareID, "u2"); !strings.Contains(body, "NZ1 has been added") {
+		t.Errorf("expected the claim to succeed, got %q", body)
+	}
+	if store.Revision("users.u2.flights.shared.NZ1") == 0 {
+		t.Error("expected the flight to be shared with the recipient")
+	}
+	if body := claim(shareID, "u3"); !strings.Contains(body, "already been claimed") {
+		t.Errorf("expected a second claim to be refused, got %q", body)
+	}
+
+	// A second link to the same flight cannot replace the copy u2 already has.
+	again := shareIDPattern.FindStringSubmatch(share("NZ1"))
+	if body := claim(again[1], "u2"); !strings.Contains(body, "already been shared with you") {
+		t.Errorf("expected a claim of a flight already shared to be refused, got %q", body)
+	}
+	if body := claim(again[1], "u3"); !strings.Contains(body, "NZ1 has been added") {
+		t.Errorf("expected the refused link to stay claimable, got %q", body)
+	}
+
+	if body := share("NZ2"); !strings.Contains(body, "no longer in your flights") || shareIDPattern.MatchString(body) {
+		t.Errorf("expected sharing an untracked flight to be refused, got %q", body)
+	}
+}
+
+// TestSharesSSE verifies that the shared page lists sent and received shares, and
+// updates them as they are claimed, expire or go away.
+func TestSharesSSE(t *testing.T) {
+	kv, cleanup := setupTestEnvironment(t)
+	defer cleanup()
+	ctx := context.Background()
+
+	put := func(key string, value any) {
+		t.Helper()
+		data, _ := json.Marshal(value)
+		if _, err := kv.Put(ctx, key, data); err != nil {
+			t.Fatalf("Put failed: %v", err)
+		}
+	}
+	nz1 := nzflights.FlightValue{ElementId: "NZ1", Flight: nzflights.Flight{Ident: "NZ1"}}
+	nz2 := nzflights.FlightValue{ElementId: "NZ2", Flight: nzflights.Flight{Ident: "NZ2"}}
+	sent, _ := keys.SentShare("u1", "s1")
+	put(sent, natsclient.SentShare{FlightID: "NZ1", Status: natsclient.SharePending, Snapshot: nz1, ExpiresAt: time.Now().Add(time.Hour)})
+	expiring, _ := keys.SentShare("u1", "s2")
+	put(expiring, natsclient.SentShare{FlightID: "NZ1", Status: natsclient.SharePending, Snapshot: nz1, ExpiresAt: time.Now().Add(time.Second)})
+	received, _ := keys.SharedFlight("u1", "NZ2")
+	put(received, natsclient.SharedFlightValue{FlightValue: nz2, Share: natsclient.Share{SharedBy: "alice"}})
+	// Other users' shares are not listed.
+	other, _ := keys.SentShare("u2", "s3")
+	put(other, natsclient.SentShare{FlightID: "NZ1", Status: natsclient.SharePending, Snapshot: nz1, ExpiresAt: time.Now().Add(time.Hour)})
+
+	server := httptest.NewServer(&SharesSSEHandler{KV: kv})
+	defer server.Close()
+	req, _ := http.NewRequest("GET", server.URL, nil)
+	req.AddCookie(&http.Cookie{Name: middleware.VisitorCookieName, Value: "u1"})
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	defer res.Body.Close()
+	events := sseEvents(res.Body)
+
+	if event := nextEvent(t, events); !strings.Contains(event, "mode replace") ||
+		!strings.Contains(event, "sent-shares") || !strings.Contains(event, "received-shares") {
+		t.Errorf("expected the lists to be reset first, got %q", event)
+	}
+	if event := nextEvent(t, events); !strings.Contains(event, "selector #sent-shares") || !strings.Contains(event, "sent-share-s1") ||
+		!strings.Contains(event, "Waiting to be claimed") || !strings.Contains(event, "/shared?claim=s1") {
+		t.Errorf("expected the pending share with its link, got %q", event)
+	}
+	if event := nextEvent(t, events); !strings.Contains(event, "sent-share-s2") {
+		t.Errorf("expected the second pending share, got %q", event)
+	}
+	if event := nextEvent(t, events); !strings.Contains(event, "selector #received-shares") ||
+		!strings.Contains(event, "received-share-NZ2") || !strings.Contains(event, "Shared by alice") {
+		t.Errorf("expected the received flight, got %q", event)
+	}
+
+	if event := nextEvent(t, events); !strings.Contains(event, "selector #sent-share-s2") || !strings.Contains(event, "Expired") {
+		t.Errorf("expected the share to show as expired once its time ran out, got %q", event)
+	}
+
+	put(sent, natsclient.SentShare{FlightID: "NZ1", Status: natsclient.ShareClaimed, Snapshot: nz1,
+		ExpiresAt: time.Now().Add(time.Hour), ClaimedAt: time.Now()})
+	if event := nextEvent(t, events); !strings.Contains(event, "selector #sent-share-s1") || !strings.Contains(event, "Claimed") ||
+		strings.Contains(event, "/shared?claim=s1") {
+		t.Errorf("expected the claimed share to be morphed without its link, got %q", event)
+	}
+
+	if err := kv.Delete(ctx, received); err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+	if event := nextEvent(t, events); !strings.Contains(event, "mode remove") || !strings.Contains(event, "received-share-NZ2") {
+		t.Errorf("expected the received flight to be removed, got %q", event)
+	}
+}
@@ -12,8 +12,13 @@ package sse
 	4. To test search: Assuming the home page has a search input (bound to POST to /sse/search-flights via DataStar or similar),
 	   type a partial flight identifier (e.g., "NZ", "QF", "JET", or "XXX") and observe the results rendering in #search-results.
 	   The search queries the static flights loaded from testdata/scheduled_departures.json.
-	5. Verify SSE updates: Watch the flight list update every ~10s as the simulator adds flights.
+	5. Verify SSE updates: Watch the flights board, get delayed, divert and land as the simulator
+	   plays simulator/testdata/demo_day.json at one simulated minute per second.
 	6. Stop the server with Ctrl+C.
+
+	To reproduce a recorded session instead of the demo scenario, add -replay with a file
+	written by 'kvreplay record' (and optionally -replay-speed). Every user's keys in the
+	recording are replayed as the test user's.
 */
 
 import (
@@ -29,6 +34,8 @@ import (
 
 	"github.com/arcade55/logging"
 	"github.com/arcade55/nzflights-models"
+	"github.com/arcade55/nzflights_webui/replay"
+	"github.com/arcade55/nzflights_webui/simulator"
 	"github.com/arcade55/nzflights_webui/webui/pages"
 	"github.com/google/uuid"
 )
@@ -36,6 +43,11 @@ import (
 // Define a flag to ensure this test only runs when you explicitly ask for it.
 var manualTest = flag.Bool("manual", false, "run manual, long-running tests")
 
+var (
+	replayFile  = flag.String("replay", "", "recording to replay into the test user's flights instead of the demo scenario")
+	replaySpeed = flag.Float64("replay-speed", 1, "how many times faster than recorded the recording is replayed")
+)
+
 // generateSampleFlights creates a map with two representative FlightValue entries.
 func generateSampleFlights() map[string]nzflights.FlightValue {
 	flights := make(map[string]nzflights.FlightValue)
@@ -150,39 +162,44 @@ func TestInteractiveUI(t *testing.T) {
 	testUserID := uuid.NewString()
 	log.Info("Test user ID generated", slog.String("userID", testUserID))
 
-	// Backend Simulator Goroutine
-	go func() {
-		flightsToSimulate := []nzflights.FlightValue{
-			{ElementId: "NZ527", Flight: nzflights.Flight{Operator: "ANZ", Ident: "NZ527", OriginCity: "Auckland", DestinationCity: "Wellington", Status: "Scheduled"}},
-			{ElementId: "QF144", Flight: nzflights.Flight{Operator: "JST", Ident: "QF144", Origin: "Sydney", Destination: "Auckland", Status: "En Route"}},
-			{ElementId: "JET345", Flight: nzflights.Flight{Ident: "JET345", Origin: "Christchurch", Destination: "Queenstown", Status: "Landed"}},
-			{ElementId: "XXX", Flight: nzflights.Flight{Ident: "XXX", Origin: "Christchurch", Destination: "Queenstown", Status: "Landed"}},
-			{ElementId: "NZ999", Flight: nzflights.Flight{Operator: "ANZ", Ident: "NZ999", OriginCity: "Wellington", DestinationCity: "Dunedin", Status: "Delayed"}},
-			{ElementId: "QF200", Flight: nzflights.Flight{Operator: "QFA", Ident: "QF200", Origin: "Melbourne", Destination: "Christchurch", Status: "Boarding"}},
+	if *replayFile != "" {
+		// Replay a recorded session into the test user's flight list.
+		f, err := os.Open(*replayFile)
+		if err != nil {
+			t.Fatalf("failed to open recording: %v", err)
 		}
-		var flightIndex int
-
-		time.Sleep(1 * time.Second)
-		for {
-			if flightIndex >= len(flightsToSimulate) {
-				log.Info("SIMULATOR: All flights have been added.")
+		entries, err := replay.ReadAll(f)
+		f.Close()
+		if err != nil {
+			t.Fatalf("failed to read recording: %v", err)
+		}
+		rename, err := replay.AsUser(testUserID)
+		if err != nil {
+			t.Fatalf("invalid test user: %v", err)
+		}
+		go func() {
+			opts := replay.Options{Speed: *replaySpeed, Rename: rename}
+			if err := replay.Replay(context.Background(), kv, entries, opts); err != nil {
+				log.Error(fmt.Errorf("REPLAY: %w", err))
 				return
 			}
-
-			flight := flightsToSimulate[flightIndex]
-			key := fmt.Sprintf("users.%s.flights.owned.%s", testUserID, flight.Flight.Ident)
-			data, _ := json.Marshal(flight)
-
-			if _, err := kv.Put(context.Background(), key, data); err != nil {
-				log.Error(fmt.Errorf("SIMULATOR: failed to put flight: %w", err))
-			} else {
-				log.Info("SIMULATOR: Wrote update for flight", slog.String("flightID", flight.Flight.Ident), slog.String("status", flight.Flight.Status))
-			}
-			flightIndex++
-
-			time.Sleep(1 * time.Second) // Stagger additions for easier observation.
+			log.Info("REPLAY: Recording finished.", slog.Int("entries", len(entries)))
+		}()
+	} else {
+		// Play the demo scenario into the test user's flight list, one simulated minute per second.
+		scenario, err := simulator.LoadScenario("../../../simulator/testdata/demo_day.json")
+		if err != nil {
+			t.Fatalf("failed to load scenario: %v", err)
 		}
-	}()
+		go func() {
+			sim := simulator.New(kv, scenario, simulator.Options{Speed: 60, Users: []string{testUserID}})
+			if err := sim.Run(context.Background()); err != nil {
+				log.Error(fmt.Errorf("SIMULATOR: %w", err))
+				return
+			}
+			log.Info("SIMULATOR: Scenario finished.")
+		}()
+	}
 
 	// Set up the HTTP server mux.
 	mux := http.NewServeMux()
@@ -0,0 +1,53 @@
+package sse
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/arcade55/htma"
+	"github.com/arcade55/nzflights_webui/natsclient"
+	"github.com/starfederation/datastar-go/datastar"
+)
+
+// UndoUntrackHandler restores a flight the user untracked, from the revision it had
+// before. The open flight list morphs the untracked card back once the restored flight
+// reaches it, so a successful undo sends nothing; a failed one adds a notice.
+type UndoUntrackHandler struct {
+	Flights natsclient.FlightStore
+}
+
+func (h *UndoUntrackHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	visitorID, ok := userID(r)
+	if !ok {
+		http.Error(w, "User could not be identified ", http.StatusInternalServerError)
+		return
+	}
+	flightID := r.URL.Query().Get("flight")
+	revision, err := strconv.ParseUint(r.URL.Query().Get("revision"), 10, 64)
+	if flightID == "" || err != nil {
+		http.Error(w, "A flight and revision are required", http.StatusBadRequest)
+		return
+	}
+
+	sse := datastar.NewSSE(w, r)
+	_, err = h.Flights.RestoreUserFlight(r.Context(), visitorID, flightID, revision)
+	if err == nil {
+		return
+	}
+	log.Error(err)
+
+	text := "Couldn't undo. Please try again."
+	switch {
+	case errors.Is(err, natsclient.ErrFlightAlreadyTracked):
+		text = "This flight is already back in your list."
+	case errors.Is(err, natsclient.ErrRevisionUnavailable):
+		text = "This flight can no longer be restored. Add it again instead."
+	}
+	if err := sse.PatchElements(htma.Div().ClassAttr("flights-notice").Text(text).Render(),
+		datastar.WithSelector("#flights"),
+		datastar.WithModePrepend(),
+	); err != nil {
+		log.Error(err)
+	}
+}
@@ -1,8 +1,12 @@
 package standard
 
 import (
+	"encoding/json"
+	"fmt"
 	"net/http"
+	"net/url"
 
+	"github.com/arcade55/nzflights_webui/natsclient"
 	"github.com/arcade55/nzflights_webui/webui/pages"
 )
 
@@ -14,3 +18,50 @@ func HomeHandler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "text/html; charset=utf-8")
 	page.RenderStream(w)
 }
+
+// HealthHandler reports the connection state and mirror health as JSON.
+type HealthHandler struct {
+	// State is optional. Without it the connection is reported as connected.
+	State *natsclient.StateTracker
+	// Mirror is optional. It is nil when there is no mirror, e.g. in offline mode.
+	Mirror *natsclient.MirrorMonitor
+}
+
+// health is the body written by HealthHandler.
+type health struct {
+	Connection string                   `json:"connection"`
+	Mirror     *natsclient.MirrorHealth `json:"mirror,omitempty"`
+	MirrorErr  string                   `json:"mirrorError,omitempty"`
+}
+
+func (h *HealthHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body := health{Connection: natsclient.StateConnected.String()}
+	if h.State != nil {
+		body.Connection = h.State.State().String()
+	}
+	if h.Mirror != nil {
+		mirror := h.Mirror.Health()
+		body.Mirror = &mirror
+		if mirror.Err != nil {
+			body.MirrorErr = mirror.Err.Error()
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(body); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// SharedHandler serves the shared page. A link from a share carries it in ?claim=,
+// for the page to offer to claim.
+func SharedHandler(w http.ResponseWriter, r *http.Request) {
+	var claimAction string
+	if shareID := r.URL.Query().Get("claim"); shareID != "" {
+		claimAction = fmt.Sprintf("@post('/shared/claim?share=%s')", url.QueryEscape(shareID))
+	}
+
+	page := pages.SharedPage(claimAction)
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	page.RenderStream(w)
+}
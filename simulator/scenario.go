@@ -0,0 +1,185 @@
+package simulator
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/arcade55/nzflights-models"
+)
+
+// Flight statuses written by the simulator.
+const (
+	StatusScheduled = "Scheduled"
+	StatusBoarding  = "Boarding"
+	StatusDeparted  = "Departed"
+	StatusEnRoute   = "En Route"
+	StatusLanded    = "Landed"
+	StatusDelayed   = "Delayed"
+	StatusDiverted  = "Diverted"
+	StatusCancelled = "Cancelled"
+)
+
+// Alert event codes raised by the simulator.
+const (
+	AlertDelay     = "DELAY"
+	AlertGate      = "GATE"
+	AlertDiversion = "DIVERSION"
+	AlertCancelled = "CANCELLED"
+)
+
+// Duration is a time.Duration written as a string such as "90s" or "1h30m" in scenario files.
+type Duration time.Duration
+
+// MarshalText writes d in the form accepted by time.ParseDuration.
+func (d Duration) MarshalText() ([]byte, error) {
+	return []byte(time.Duration(d).String()), nil
+}
+
+// UnmarshalText parses a duration such as "15m".
+func (d *Duration) UnmarshalText(text []byte) error {
+	parsed, err := time.ParseDuration(string(text))
+	if err != nil {
+		return err
+	}
+	*d = Duration(parsed)
+	return nil
+}
+
+// Airport is where a diverted flight lands instead.
+type Airport struct {
+	ICAO string `json:"icao"`
+	IATA string `json:"iata"`
+	City string `json:"city"`
+}
+
+// Event is a change to a flight at a point in simulated time. Every field other than
+// At is optional, and an event may combine several changes, e.g. a delay with a gate change.
+type Event struct {
+	// At is how far into the simulation the event happens.
+	At Duration `json:"at"`
+	// Status becomes the flight's status.
+	Status string `json:"status,omitempty"`
+	// Gate becomes the departure gate, raising a gate change alert if it was already set.
+	Gate string `json:"gate,omitempty"`
+	// Delay raises a delay alert and marks the flight as delayed unless Status is also set.
+	Delay Duration `json:"delay,omitempty"`
+	// DivertTo sends the flight to another airport.
+	DivertTo *Airport `json:"divertTo,omitempty"`
+	// Cancel cancels the flight.
+	Cancel bool `json:"cancel,omitempty"`
+	// Alert is raised as given, in addition to any raised by the other changes.
+	Alert *nzflights.Alert `json:"alert,omitempty"`
+}
+
+// ScenarioFlight is a flight and the events that happen to it.
+type ScenarioFlight struct {
+	Flight nzflights.Flight `json:"flight"`
+	// Events default to Lifecycle when empty.
+	Events []Event `json:"events"`
+}
+
+// Scenario is a set of flights to simulate, as read from a scenario file.
+type Scenario struct {
+	Flights []ScenarioFlight `json:"flights"`
+}
+
+// LoadScenario reads a scenario from a JSON file.
+func LoadScenario(path string) (Scenario, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return Scenario{}, err
+	}
+	var scenario Scenario
+	if err := json.Unmarshal(data, &scenario); err != nil {
+		return Scenario{}, fmt.Errorf("failed to unmarshal %s: %w", path, err)
+	}
+	for i, flight := range scenario.Flights {
+		if flight.Flight.Ident == "" {
+			return Scenario{}, fmt.Errorf("%s: flight %d has no ident", path, i)
+		}
+	}
+	return scenario, nil
+}
+
+// Lifecycle is an uneventful flight: Scheduled → Boarding → Departed → En Route → Landed.
+func Lifecycle() []Event {
+	return []Event{
+		{At: 0, Status: StatusScheduled},
+		{At: Duration(10 * time.Minute), Status: StatusBoarding},
+		{At: Duration(40 * time.Minute), Status: StatusDeparted},
+		{At: Duration(45 * time.Minute), Status: StatusEnRoute},
+		{At: Duration(105 * time.Minute), Status: StatusLanded},
+	}
+}
+
+// apply makes the changes in e to flight at the simulated time now.
+// Alerts are numbered from nextAlertID, which is advanced past the ones raised.
+func (e Event) apply(flight *nzflights.Flight, now time.Time, nextAlertID *int) {
+	alert := func(code, short, summary string) {
+		*nextAlertID++
+		flight.Alerts = append(flight.Alerts, nzflights.Alert{
+			AlertID:          *nextAlertID,
+			EventCode:        code,
+			ShortDescription: short,
+			Summary:          summary,
+			LongDescription:  summary,
+		})
+	}
+
+	if e.Delay > 0 {
+		flight.Status = StatusDelayed
+		alert(AlertDelay, "Delayed departure",
+			fmt.Sprintf("Flight %s delayed by %s.", flight.Ident, minutes(time.Duration(e.Delay))))
+	}
+	if e.Gate != "" && e.Gate != flight.GateOrigin {
+		if flight.GateOrigin != "" {
+			alert(AlertGate, "Gate change",
+				fmt.Sprintf("Flight %s now departs from gate %s instead of %s.", flight.Ident, e.Gate, flight.GateOrigin))
+		}
+		flight.GateOrigin = e.Gate
+	}
+	if e.DivertTo != nil {
+		flight.Status = StatusDiverted
+		flight.Destination = e.DivertTo.ICAO
+		flight.DestinationIATA = e.DivertTo.IATA
+		flight.DestinationCity = e.DivertTo.City
+		flight.GateDestination = ""
+		alert(AlertDiversion, "Diverted",
+			fmt.Sprintf("Flight %s has been diverted to %s.", flight.Ident, e.DivertTo.City))
+	}
+	if e.Cancel {
+		flight.Status = StatusCancelled
+		alert(AlertCancelled, "Cancelled", fmt.Sprintf("Flight %s has been cancelled.", flight.Ident))
+	}
+	if e.Alert != nil {
+		*nextAlertID++
+		a := *e.Alert
+		a.AlertID = *nextAlertID
+		flight.Alerts = append(flight.Alerts, a)
+	}
+
+	if e.Status != "" {
+		flight.Status = e.Status
+	}
+	switch flight.Status {
+	case StatusDeparted, StatusEnRoute:
+		if flight.ActualOff == "" {
+			flight.ActualOff = now.UTC().Format(time.RFC3339)
+		}
+	case StatusLanded:
+		if flight.ActualOn == "" {
+			flight.ActualOn = now.UTC().Format(time.RFC3339)
+		}
+	}
+}
+
+// minutes formats d for an alert, e.g. "1 minute" or "25 minutes".
+func minutes(d time.Duration) string {
+	n := int(d.Round(time.Minute) / time.Minute)
+	if n == 1 {
+		return "1 minute"
+	}
+	return fmt.Sprintf("%d minutes", n)
+}
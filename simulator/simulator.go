@@ -0,0 +1,174 @@
+// Package simulator drives flights through realistic state changes in the flights KV
+// so the UI can be developed and tested without live data.
+//
+// A Scenario lists flights and timed events: status transitions, delays, gate changes,
+// diversions, cancellations and alerts. The Simulator plays them back, optionally faster
+// than real time, writing each flight's master entry and every user's owned copy of it.
+package simulator
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/arcade55/nzflights-models"
+	"github.com/arcade55/nzflights_webui/keys"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+// Options controls how a scenario is played back.
+type Options struct {
+	// Scenario is the path of the scenario file to play.
+	Scenario string `json:"scenario"`
+	// Speed is how many times faster than real time the scenario runs. Defaults to 1.
+	Speed float64 `json:"speed"`
+	// Users always get an owned copy of every simulated flight, in addition to any
+	// user already tracking it.
+	Users []string `json:"users"`
+	// Start is the simulated time the scenario begins at. Defaults to the time Run is called.
+	Start time.Time `json:"-"`
+}
+
+// Simulator plays a Scenario into a flights KV.
+type Simulator struct {
+	kv       jetstream.KeyValue
+	scenario Scenario
+	opts     Options
+}
+
+// step is one event for one flight on the simulation's timeline.
+type step struct {
+	flight int
+	event  Event
+}
+
+// New returns a Simulator that writes scenario to kv.
+func New(kv jetstream.KeyValue, scenario Scenario, opts Options) *Simulator {
+	if opts.Speed <= 0 {
+		opts.Speed = 1
+	}
+	return &Simulator{kv: kv, scenario: scenario, opts: opts}
+}
+
+// Run plays the scenario and returns once every event has been written or ctx is done.
+// Every flight is written in its initial state first, then events follow in time order.
+func (s *Simulator) Run(ctx context.Context) error {
+	start := s.opts.Start
+	if start.IsZero() {
+		start = time.Now()
+	}
+	began := time.Now()
+
+	// Each flight keeps the master key of its initial state, so a diversion
+	// updates the same entry rather than starting a new one.
+	flights := make([]nzflights.Flight, len(s.scenario.Flights))
+	masters := make([]string, len(s.scenario.Flights))
+	var timeline []step
+	for i, sf := range s.scenario.Flights {
+		flights[i] = sf.Flight
+		master, err := masterKey(sf.Flight)
+		if err != nil {
+			return err
+		}
+		masters[i] = master
+		events := sf.Events
+		if len(events) == 0 {
+			events = Lifecycle()
+		}
+		for _, e := range events {
+			timeline = append(timeline, step{flight: i, event: e})
+		}
+	}
+	slices.SortStableFunc(timeline, func(a, b step) int {
+		return cmp.Compare(a.event.At, b.event.At)
+	})
+
+	for i, flight := range flights {
+		if err := s.write(ctx, masters[i], flight, start); err != nil {
+			return err
+		}
+	}
+
+	alertIDs := 0
+	for _, st := range timeline {
+		wait := time.Duration(float64(st.event.At)/s.opts.Speed) - time.Since(began)
+		if wait > 0 {
+			select {
+			case <-time.After(wait):
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+
+		now := start.Add(time.Duration(st.event.At))
+		st.event.apply(&flights[st.flight], now, &alertIDs)
+		if err := s.write(ctx, masters[st.flight], flights[st.flight], now); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// masterKey returns the flights.master key for flight.
+func masterKey(flight nzflights.Flight) (string, error) {
+	masterFlight, err := keys.MasterFlightFor(flight)
+	if err != nil {
+		return "", err
+	}
+	return masterFlight.Key()
+}
+
+// write stores flight under master and in every owned copy of it.
+func (s *Simulator) write(ctx context.Context, master string, flight nzflights.Flight, now time.Time) error {
+	owned, err := s.owners(ctx, flight.Ident)
+	if err != nil {
+		return err
+	}
+
+	for _, key := range append([]string{master}, owned...) {
+		data, err := json.Marshal(nzflights.FlightValue{
+			ElementId:   flight.Ident,
+			NatsKey:     key,
+			LastUpdated: now,
+			Flight:      flight,
+		})
+		if err != nil {
+			return err
+		}
+		if _, err := s.kv.Put(ctx, key, data); err != nil {
+			return fmt.Errorf("failed to put %s: %w", key, err)
+		}
+	}
+	return nil
+}
+
+// owners returns the owned flight keys to update for ident: one for each user in
+// Options.Users and one for each user already tracking it.
+func (s *Simulator) owners(ctx context.Context, ident string) ([]string, error) {
+	var owned []string
+	for _, user := range s.opts.Users {
+		key, err := keys.OwnedFlight(user, ident)
+		if err != nil {
+			return nil, err
+		}
+		owned = append(owned, key)
+	}
+
+	filter, err := keys.FlightOwners(ident)
+	if err != nil {
+		return nil, err
+	}
+	lister, err := s.kv.ListKeysFiltered(ctx, filter)
+	if err != nil {
+		return nil, err
+	}
+	for key := range lister.Keys() {
+		if !slices.Contains(owned, key) {
+			owned = append(owned, key)
+		}
+	}
+	return owned, ctx.Err()
+}
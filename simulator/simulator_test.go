@@ -0,0 +1,177 @@
+package simulator
+
+import (
+	"context"
+	"encoding/json"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/arcade55/nzflights-models"
+	"github.com/arcade55/nzflights_webui/keys"
+	"github.com/arcade55/nzflights_webui/natsclient/kvtest"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+// get decodes the flight stored under key.
+func get(t *testing.T, kv jetstream.KeyValue, key string) nzflights.FlightValue {
+	t.Helper()
+	entry, err := kv.Get(context.Background(), key)
+	if err != nil {
+		t.Fatalf("Get(%s) failed: %v", key, err)
+	}
+	var fv nzflights.FlightValue
+	if err := json.Unmarshal(entry.Value(), &fv); err != nil {
+		t.Fatalf("bad value for %s: %v", key, err)
+	}
+	return fv
+}
+
+// alertCodes lists the event codes of a flight's alerts in order.
+func alertCodes(f nzflights.Flight) []string {
+	var codes []string
+	for _, a := range f.Alerts {
+		codes = append(codes, a.EventCode)
+	}
+	return codes
+}
+
+// TestSimulator_DemoDay plays the demo scenario and checks where each flight ends up.
+func TestSimulator_DemoDay(t *testing.T) {
+	kv := kvtest.NewHistoryKV(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	scenario, err := LoadScenario("testdata/demo_day.json")
+	if err != nil {
+		t.Fatalf("LoadScenario failed: %v", err)
+	}
+
+	// u2 already tracks NZ421, so it gets updates without being listed in Users.
+	tracked, _ := keys.OwnedFlight("u2", "NZ421")
+	if _, err := kv.Put(ctx, tracked, []byte("{}")); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+
+	start := time.Date(2025, 9, 15, 8, 50, 0, 0, time.UTC)
+	sim := New(kv, scenario, Options{Speed: 1e6, Users: []string{"u1"}, Start: start})
+	if err := sim.Run(ctx); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+
+	owned := func(user, ident string) nzflights.Flight {
+		key, _ := keys.OwnedFlight(user, ident)
+		return get(t, kv, key).Flight
+	}
+
+	tests := map[string]struct {
+		flight nzflights.Flight
+		status string
+		alerts []string
+	}{
+		"lifecycle":        {owned("u1", "NZ527"), StatusLanded, nil},
+		"delay and gate":   {owned("u1", "NZ421"), StatusLanded, []string{AlertGate, AlertDelay}},
+		"already tracking": {owned("u2", "NZ421"), StatusLanded, []string{AlertGate, AlertDelay}},
+		"diversion":        {owned("u1", "NZ677"), StatusLanded, []string{AlertDiversion, "WEATHER"}},
+		"cancellation":     {owned("u1", "JQ255"), StatusCancelled, []string{AlertDelay, AlertCancelled}},
+		"master entry":     {get(t, kv, "flights.master.QFA140.2025-09-15.0910.NZAA.YSSY").Flight, StatusLanded, []string{AlertGate}},
+	}
+	for name, tt := range tests {
+		if tt.flight.Status != tt.status {
+			t.Errorf("%s: expected %s to end %s, got %s", name, tt.flight.Ident, tt.status, tt.flight.Status)
+		}
+		if codes := alertCodes(tt.flight); !slices.Equal(codes, tt.alerts) {
+			t.Errorf("%s: expected alerts %v for %s, got %v", name, tt.alerts, tt.flight.Ident, codes)
+		}
+	}
+
+	diverted := owned("u1", "NZ677")
+	if diverted.Destination != "NZDN" || diverted.DestinationCity != "Dunedin" {
+		t.Errorf("expected NZ677 to land in Dunedin, got %s (%s)", diverted.DestinationCity, diverted.Destination)
+	}
+	landed := owned("u1", "NZ527")
+	if want := start.Add(40 * time.Minute).Format(time.RFC3339); landed.ActualOff != want {
+		t.Errorf("expected NZ527 to take off at %s, got %s", want, landed.ActualOff)
+	}
+	if landed.ActualOn == "" {
+		t.Error("expected NZ527 to have landed")
+	}
+}
+
+// TestSimulator_Timeline verifies that every transition is written, in order, at the accelerated pace.
+func TestSimulator_Timeline(t *testing.T) {
+	kv := kvtest.NewHistoryKV(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	flight := nzflights.Flight{Ident: "NZ1", Origin: "NZAA", Destination: "NZWN", ScheduledOut: "2025-09-15T09:00:00Z"}
+	scenario := Scenario{Flights: []ScenarioFlight{{Flight: flight}}}
+	key, _ := keys.OwnedFlight("u1", "NZ1")
+
+	watcher, err := kv.Watch(ctx, key, jetstream.UpdatesOnly())
+	if err != nil {
+		t.Fatalf("Watch failed: %v", err)
+	}
+	defer watcher.Stop()
+
+	// The lifecycle spans 105 simulated minutes, so at 21000x it takes 300ms.
+	began := time.Now()
+	if err := New(kv, scenario, Options{Speed: 21000, Users: []string{"u1"}}).Run(ctx); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	if elapsed := time.Since(began); elapsed < 250*time.Millisecond {
+		t.Errorf("expected the scenario to take about 300ms, took %v", elapsed)
+	}
+
+	var statuses []string
+	for len(statuses) < 6 {
+		select {
+		case entry := <-watcher.Updates():
+			var fv nzflights.FlightValue
+			if err := json.Unmarshal(entry.Value(), &fv); err != nil {
+				t.Fatalf("bad value: %v", err)
+			}
+			statuses = append(statuses, fv.Flight.Status)
+		case <-ctx.Done():
+			t.Fatalf("timed out after %v", statuses)
+		}
+	}
+	want := []string{"", StatusScheduled, StatusBoarding, StatusDeparted, StatusEnRoute, StatusLanded}
+	if !slices.Equal(statuses, want) {
+		t.Errorf("expected %v, got %v", want, statuses)
+	}
+}
+
+// TestSimulator_DiversionKeepsMasterKey verifies that a diverted flight keeps updating
+// the master entry of its original route.
+func TestSimulator_DiversionKeepsMasterKey(t *testing.T) {
+	kv := kvtest.NewHistoryKV(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	flight := nzflights.Flight{Ident: "NZ1", Origin: "NZAA", Destination: "NZWN", ScheduledOut: "2025-09-15T09:00:00Z"}
+	scenario := Scenario{Flights: []ScenarioFlight{{
+		Flight: flight,
+		Events: []Event{{At: Duration(time.Minute), DivertTo: &Airport{ICAO: "NZCH", IATA: "CHC", City: "Christchurch"}}},
+	}}}
+	if err := New(kv, scenario, Options{Speed: 6000}).Run(ctx); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+
+	lister, err := kv.ListKeys(ctx)
+	if err != nil {
+		t.Fatalf("ListKeys failed: %v", err)
+	}
+	var masters []string
+	for key := range lister.Keys() {
+		masters = append(masters, key)
+	}
+	masterFlight, _ := keys.MasterFlightFor(flight)
+	want, _ := masterFlight.Key()
+	if !slices.Equal(masters, []string{want}) {
+		t.Fatalf("expected only %s, got %v", want, masters)
+	}
+	if fv := get(t, kv, want); fv.Flight.Status != StatusDiverted || fv.Flight.Destination != "NZCH" {
+		t.Errorf("expected the master entry to show the diversion, got %+v", fv.Flight)
+	}
+}
@@ -1,11 +1,19 @@
 package components
 
 import (
+	"fmt"
+	"strings"
+
 	"github.com/arcade55/htma"
 	"github.com/arcade55/nzflights-models"
 )
 
 func FlightCardComponent(flightValue nzflights.FlightValue) htma.Element {
+	return flightCard(flightValue).IDAttr(FlightCardID(flightValue))
+}
+
+// flightCard renders a flight without an element ID, for cards that wrap it.
+func flightCard(flightValue nzflights.FlightValue) htma.Element {
 	f := flightValue.Flight
 
 	return htma.FlightCard().
@@ -22,6 +30,107 @@ func FlightCardComponent(flightValue nzflights.FlightValue) htma.Element {
 
 }
 
+// UntrackedFlightCard takes the place of the card with the given id after its flight
+// is untracked, offering undoAction until the card is removed.
+func UntrackedFlightCard(id string, flightValue nzflights.FlightValue, undoAction string) htma.Element {
+	text := "Flight untracked"
+	if ident := flightValue.Flight.Ident; ident != "" {
+		text = ident + " untracked"
+	}
+	return htma.Div().IDAttr(id).ClassAttr("flight-card untracked").AddChild(
+		htma.Span().Text(text),
+		htma.Button().IDAttr(id+"-undo").ClassAttr("undo").DataOnClickAttr(undoAction).Text("Undo"),
+	)
+}
+
+// StaleFlightCard takes the place of the card with the given id when its flight couldn't
+// be refreshed. It keeps showing the last value known, if there is more to it than an ID.
+func StaleFlightCard(id string, flightValue nzflights.FlightValue) htma.Element {
+	text := "Couldn't refresh this flight"
+	if ident := flightValue.Flight.Ident; ident != "" {
+		text = "Couldn't refresh " + ident
+	} else if flightValue.ElementId != "" {
+		text = "Couldn't refresh " + flightValue.ElementId
+	}
+	card := htma.Div().IDAttr(id).ClassAttr("flight-card stale").AddChild(
+		htma.Span().ClassAttr("stale-notice").Text(text),
+	)
+	if flightValue.Flight.Ident != "" {
+		card = card.AddChild(flightCard(flightValue))
+	}
+	return card
+}
+
+// SharedFlightActions are the Datastar actions offered on the card of a flight shared
+// with the user. A button is left out if its action is empty.
+type SharedFlightActions struct {
+	Accept  string
+	Convert string
+	Hide    string
+}
+
+// SharedFlightCard shows a flight someone shared with the user, with a badge naming
+// them and the actions the user can take.
+func SharedFlightCard(flightValue nzflights.FlightValue, sharedBy string, actions SharedFlightActions) htma.Element {
+	id := SharedFlightCardID(flightValue)
+	badge := "Shared with you"
+	if sharedBy != "" {
+		badge = "Shared by " + sharedBy
+	}
+
+	var buttons []htma.Renderable
+	for _, button := range []struct{ name, label, action string }{
+		{"accept", "Accept", actions.Accept},
+		{"convert", "Add to my flights", actions.Convert},
+		{"hide", "Hide", actions.Hide},
+	} {
+		if button.action == "" {
+			continue
+		}
+		buttons = append(buttons,
+			htma.Button().IDAttr(id+"-"+button.name).ClassAttr(button.name).DataOnClickAttr(button.action).Text(button.label))
+	}
+
+	return htma.Div().IDAttr(id).ClassAttr("shared-flight-card").AddChild(
+		htma.Span().ClassAttr("shared-badge").Text(badge),
+		flightCard(flightValue),
+		htma.Div().ClassAttr("shared-actions").AddChild(buttons...),
+	)
+}
+
+// SharedFlightCardID returns the element ID of the card for a flight shared with the
+// user. It differs from FlightCardID, as the user may own the same flight.
+func SharedFlightCardID(flightValue nzflights.FlightValue) string {
+	return "shared-" + FlightCardID(flightValue)
+}
+
+// FlightCardID returns the element ID of the card for flightValue, so that SSE patches
+// can target a single card. It is derived from ElementId, or the ident if that is empty,
+// with any character that is not safe in a CSS selector escaped.
+func FlightCardID(flightValue nzflights.FlightValue) string {
+	id := flightValue.ElementId
+	if id == "" {
+		id = flightValue.Flight.Ident
+	}
+	return elementID("flight-", id)
+}
+
+// elementID returns prefix followed by id, with any character of id that is not safe
+// in a CSS selector escaped.
+func elementID(prefix, id string) string {
+	var b strings.Builder
+	b.WriteString(prefix)
+	for i := 0; i < len(id); i++ {
+		c := id[i]
+		if c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' {
+			b.WriteByte(c)
+			continue
+		}
+		fmt.Fprintf(&b, "_%02X", c)
+	}
+	return b.String()
+}
+
 /*
 	func formatTime(isoString string) string {
 		t, err := time.Parse(time.RFC3339, isoString)
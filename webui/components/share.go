@@ -0,0 +1,30 @@
+package components
+
+import (
+	"github.com/arcade55/htma"
+	"github.com/arcade55/nzflights-models"
+)
+
+// ShareItem is one entry in a list on the shared page: a flight and what has become of
+// its share, e.g. "claimed". link, if set, is the share link for the sharer to pass on.
+func ShareItem(id string, flightValue nzflights.FlightValue, status, detail, link string) htma.Element {
+	ident := flightValue.Flight.Ident
+	if ident == "" {
+		ident = "Flight"
+	}
+
+	item := htma.Li().IDAttr(id).ClassAttr("share-item "+status).AddChild(
+		htma.Span().ClassAttr("share-flight").Text(ident),
+		htma.Span().ClassAttr("share-detail").Text(detail),
+	)
+	if link != "" {
+		item = item.AddChild(htma.A().ClassAttr("share-link").HrefAttr(link).Text(link))
+	}
+	return item
+}
+
+// ShareItemID returns the element ID of the item for id on the shared page. The kind,
+// such as "sent", keeps the lists' IDs apart.
+func ShareItemID(kind, id string) string {
+	return elementID(kind+"-share-", id)
+}
@@ -10,6 +10,7 @@ func HomePage() htma.Element {
 
 	mainContent := htma.A().AddChild(
 		htma.SearchCard().IDAttr("search-results"),
+		htma.Div().IDAttr("connection-banner"),
 		htma.Div().ClassAttr("flight-card-container").IDAttr("flights"),
 	)
 
@@ -14,20 +14,7 @@ import (
 
 func LayoutComponent(title string, content htma.Renderable) htma.Element {
 	return htma.HTML().LangAttr("en").AddChild(
-		htma.Head().AddChild(
-			// ... head content is unchanged ...
-			htma.Meta().CharsetAttr("UTF-8"),
-			htma.Meta().NameAttr("viewport").Attr("content", "width=device-width, initial-scale=1.0"),
-			htma.Title(title),
-			htma.Link().RelAttr("preconnect").HrefAttr("https://fonts.googleapis.com"),
-			htma.Link().RelAttr("preconnect").HrefAttr("https://fonts.gstatic.com").CrossOriginAttr(""),
-			htma.Link().HrefAttr("https://fonts.googleapis.com/css2?family=Roboto:wght@400;500;700&display=swap").RelAttr("stylesheet"),
-			htma.Link().HrefAttr("https://fonts.googleapis.com/css2?family=Material+Symbols+Outlined:opsz,wght,FILL,GRAD@24,400,0,0").RelAttr("stylesheet"),
-			htma.Link().RelAttr("stylesheet").HrefAttr("/static/style.css"),
-			htma.Script().TypeAttr("module").SrcAttr("/static/datastar.js"),
-			htma.Script().TypeAttr("module").SrcAttr("/static/flightcard.js"),
-			htma.Script().TypeAttr("module").SrcAttr("/static/searchcard.js"),
-		),
+		documentHead(title),
 		// ADD data-signals and data-effect attributes HERE 👇
 		htma.Body().
 			DataSignalsAttr(`{ "page": "home" }`).
@@ -57,8 +44,28 @@ func LayoutComponent(title string, content htma.Renderable) htma.Element {
 							),
 						),
 
-						htma.Div().ClassAttr("flight-card-container").IDAttr("flights")).DataOnLoadAttr("@get('/sse/flights')"),
+						htma.Div().IDAttr("connection-banner"),
+						htma.Div().ClassAttr("flight-card-container").IDAttr("flights"),
+						htma.H2().ClassAttr("flights-section-title").Text("Shared with you"),
+						htma.Div().ClassAttr("flight-card-container").IDAttr("shared-flights")).DataOnLoadAttr("@get('/sse/flights')"),
 				components.FooterComponent(),
 			),
 	)
 }
+
+// documentHead is the head shared by every page: fonts, styles and scripts.
+func documentHead(title string) htma.Element {
+	return htma.Head().AddChild(
+		htma.Meta().CharsetAttr("UTF-8"),
+		htma.Meta().NameAttr("viewport").Attr("content", "width=device-width, initial-scale=1.0"),
+		htma.Title(title),
+		htma.Link().RelAttr("preconnect").HrefAttr("https://fonts.googleapis.com"),
+		htma.Link().RelAttr("preconnect").HrefAttr("https://fonts.gstatic.com").CrossOriginAttr(""),
+		htma.Link().HrefAttr("https://fonts.googleapis.com/css2?family=Roboto:wght@400;500;700&display=swap").RelAttr("stylesheet"),
+		htma.Link().HrefAttr("https://fonts.googleapis.com/css2?family=Material+Symbols+Outlined:opsz,wght,FILL,GRAD@24,400,0,0").RelAttr("stylesheet"),
+		htma.Link().RelAttr("stylesheet").HrefAttr("/static/style.css"),
+		htma.Script().TypeAttr("module").SrcAttr("/static/datastar.js"),
+		htma.Script().TypeAttr("module").SrcAttr("/static/flightcard.js"),
+		htma.Script().TypeAttr("module").SrcAttr("/static/searchcard.js"),
+	)
+}
@@ -0,0 +1,38 @@
+package pages
+
+import (
+	"github.com/arcade55/htma"
+	"github.com/arcade55/nzflights_webui/webui/components"
+)
+
+// SharedPage lists the flights the user has shared and the flights shared with them,
+// kept live by /sse/shared. claimAction, if set, claims the share the user followed a
+// link to. It waits for the user to press a button, so a link preview cannot claim it.
+func SharedPage(claimAction string) htma.Element {
+	var content []htma.Renderable
+	if claimAction != "" {
+		content = append(content, htma.Div().IDAttr("claim").ClassAttr("claim-card").AddChild(
+			htma.Span().Text("A flight has been shared with you."),
+			htma.Button().IDAttr("claim-button").DataOnClickAttr(claimAction).Text("Add to my flights"),
+		))
+	}
+	content = append(content,
+		htma.H2().ClassAttr("flights-section-title").Text("Shared with you"),
+		htma.Ul().ClassAttr("share-list").IDAttr("received-shares"),
+		htma.H2().ClassAttr("flights-section-title").Text("Shared by you"),
+		htma.Ul().ClassAttr("share-list").IDAttr("sent-shares"),
+	)
+
+	return htma.HTML().LangAttr("en").AddChild(
+		documentHead("Shared Flights"),
+		// The footer's home and add flight buttons set $page, which leaves this page.
+		htma.Body().
+			DataSignalsAttr(`{ "page": "shared" }`).
+			DataEffectAttr(`if ($page !== 'shared') window.location.assign('/' + $page)`).
+			AddChild(
+				components.HeaderComponent(),
+				htma.Main().AddChild(content...).DataOnLoadAttr("@get('/sse/shared')"),
+				components.FooterComponent(),
+			),
+	)
+}
@@ -235,6 +235,12 @@ class FlightCard extends HTMLElement {
     // Attach a shadow root to the element.
     this.attachShadow({ mode: 'open' });
     this.shadowRoot.appendChild(template.content.cloneNode(true));
+
+    // The share button is in the shadow DOM, so dispatch an event on the card itself
+    // for Datastar to catch (data-on-share).
+    this.shadowRoot.querySelector('.card-share-button').addEventListener('click', () => {
+      this.dispatchEvent(new CustomEvent('share', { bubbles: true, composed: true }));
+    });
   }
 
   // This method is called when the element is added to the DOM.